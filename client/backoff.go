@@ -0,0 +1,45 @@
+package client
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// backoff computes exponentially growing
+// reconnection delays with jitter so that
+// clients don't all redial at the same time.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{
+		min: min,
+		max: max,
+	}
+}
+
+// next returns the delay to wait before the next
+// attempt, a random duration in [d/2, d) where d
+// doubles on every call until it reaches max.
+func (b *backoff) next() time.Duration {
+	d := b.min << b.attempt
+	if d <= 0 || d >= b.max {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	half := d / 2
+	return half + rand.N(d-half)
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
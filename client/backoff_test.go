@@ -0,0 +1,27 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	var (
+		lo = 100 * time.Millisecond
+		hi = time.Second
+		b  = newBackoff(lo, hi)
+	)
+	want := lo
+	for range 10 {
+		got := b.next()
+		require.GreaterOrEqual(t, got, want/2)
+		require.Less(t, got, want)
+		want = min(want*2, hi)
+	}
+	b.reset()
+	got := b.next()
+	require.GreaterOrEqual(t, got, lo/2)
+	require.Less(t, got, lo)
+}
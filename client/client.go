@@ -1,11 +1,18 @@
-package main
+package client
 
 import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
 
 	"github.com/coder/websocket"
 	"github.com/fsnotify/fsnotify"
@@ -13,44 +20,180 @@ import (
 	"github.com/thesicktwist1/harmony/shared/database"
 )
 
+var errNoRoot = errors.New("path out of the sync roots")
+
 const (
-	localhost = "ws://localhost:8080/ws"
+	// files up to shared.ChunkThreshold
+	// are embedded in a single message
+	readLimit = -1
 )
 
 type client struct {
 	registry *registry
+	// websocket URL of the server
+	url string
+	// token of the device, issued
+	// by the server on enrollment
+	token string
+	// carries the TLS settings, if any
+	httpClient *http.Client
+	// downloads in progress
+	transfers *shared.Transfers
+	// uploads waiting for the server to
+	// tell which chunks it is missing
+	wants map[string]chan []int64
+	// transfer ID of those uploads, by outbox event ID
+	uploads map[int64]string
+	// tree exchange in progress, only
+	// the connection loop touches it
+	pull *pull
+	sync.Mutex
 	shared.Hub
 }
 
-func NewClient(watcher *fsnotify.Watcher, db *sql.DB) *client {
-	return &client{
-		registry: newRegistry(watcher, database.New(db)),
-		Hub:      shared.NewClientHub(),
+func NewClient(watcher *fsnotify.Watcher, db *sql.DB, name string) *client {
+	registry := newRegistry(watcher, database.New(db))
+	registry.name = name
+	c := &client{
+		url:      defaultServerURL,
+		registry: registry,
+		wants:    make(map[string]chan []int64),
+		uploads:  make(map[int64]string),
 	}
+	c.setRoots(defaultRoots)
+	return c
+}
+
+// setRoots makes the client sync the directories of rs,
+// partial downloads are kept in the first one.
+func (c *client) setRoots(rs roots) {
+	c.registry.roots = rs
+	c.transfers = shared.NewTransfers(rs[0].tmpDir(), nil)
+	c.Hub = shared.NewClientHubIn(rs.check)
 }
 
 func (c *client) Run(ctx context.Context) error {
 	log.Println("client starting...")
-	if err := shared.MakeStorage(); err != nil {
-		return err
+	for _, root := range c.registry.roots {
+		if err := os.MkdirAll(root.local, 0777); err != nil {
+			return err
+		}
 	}
 	if err := shared.MakeBackUp(); err != nil {
 		return err
 	}
-	if err := c.registry.appendDir(storage); err != nil {
+	if err := c.registry.dropUnselected(ctx); err != nil {
 		return err
 	}
-	conn, _, err := websocket.Dial(ctx, localhost, nil)
-	if err != nil {
-		return err
+	for _, root := range c.registry.roots {
+		if err := c.registry.appendDir(root.local); err != nil {
+			return err
+		}
+	}
+	if c.registry.watcher != nil {
+		go c.registry.ListenForEvents(ctx)
 	}
+	go c.maintainConn(ctx)
+	return nil
+}
 
+// maintainConn keeps the client connected to the server,
+// redialing with backoff whenever the connection drops
+// until ctx is cancelled.
+func (c *client) maintainConn(ctx context.Context) {
+	b := newBackoff(minBackoff, maxBackoff)
+	for {
+		conn, resp, err := websocket.Dial(ctx, c.url, &websocket.DialOptions{
+			HTTPClient: c.httpClient,
+			HTTPHeader: http.Header{"Authorization": {"Bearer " + c.token}},
+		})
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			// redialing would not help
+			slog.Error("device token rejected by the server", "err", err)
+			return
+		}
+		if err != nil {
+			wait := b.next()
+			slog.Error("dial error", "err", err, "retry", wait)
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		b.reset()
+		log.Println("connected to server")
+		c.serveConn(ctx, conn)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("connection lost, reconnecting...")
+	}
+}
+
+// serveConn runs the read and write loops of a single
+// connection and returns once either of them stops.
+func (c *client) serveConn(ctx context.Context, conn *websocket.Conn) {
+	defer conn.CloseNow()
+	defer c.transfers.Close()
+	conn.SetReadLimit(readLimit)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := c.subscribe(ctx, conn); err != nil {
+		slog.Error("subscription error", "err", err)
+		return
+	}
+	// the tree is pulled on every connection so
+	// that changes made while offline get reconciled
+	if err := c.pullTree(ctx, conn); err != nil {
+		slog.Error("tree request error", "err", err)
+		return
+	}
+
+	done := make(chan struct{})
 	go func() {
-		defer conn.CloseNow()
-		go c.writeMessages(ctx, conn)
-		c.readMessages(ctx, conn)
+		defer close(done)
+		defer cancel()
+		c.writeMessages(ctx, conn)
 	}()
-	return nil
+	c.readMessages(ctx, conn)
+	cancel()
+	<-done
+}
+
+// subscribe tells the server which subtrees the
+// device mirrors, the tree it sends is pruned to them.
+func (c *client) subscribe(ctx context.Context, conn *websocket.Conn) error {
+	var sub shared.Subscription
+	for _, p := range c.registry.selection {
+		if v := c.registry.vault; v != nil {
+			p = v.sealPath(p)
+		}
+		sub.Paths = append(sub.Paths, p)
+	}
+	payload, err := shared.MarshalEnvl(sub, shared.Subscribe)
+	if err != nil {
+		return err
+	}
+	return conn.Write(ctx, websocket.MessageBinary, payload)
+}
+
+// syncTree reconciles each root with its folder of the tree of
+// the server, the folders the server doesn't have are sent.
+func (c *client) syncTree(ctx context.Context, tree *shared.FSNode) {
+	r := c.registry
+	for _, root := range r.roots {
+		node := r.roots.subtree(tree, root)
+		if node == nil {
+			if err := r.handleDir(ctx, fsnotify.Event{Name: root.local, Op: fsnotify.Create}); err != nil {
+				slog.Error("error sending root", "root", root.local, "err", err)
+			}
+			continue
+		}
+		r.SyncTree(ctx, node)
+	}
 }
 
 func (c *client) readMessages(ctx context.Context, conn *websocket.Conn) {
@@ -63,8 +206,8 @@ func (c *client) readMessages(ctx context.Context, conn *websocket.Conn) {
 			if err != nil {
 				if websocket.CloseStatus(err) != websocket.StatusNormalClosure {
 					slog.Error("error abnormal closure", "err", err)
-					return
 				}
+				return
 			}
 			if mType == websocket.MessageBinary {
 				var env shared.Envelope
@@ -79,17 +222,47 @@ func (c *client) readMessages(ctx context.Context, conn *websocket.Conn) {
 						slog.Error("unmarshal file event error: %v", "err", err)
 						return
 					}
-					if err := c.Process(ctx, &event); err != nil {
-						slog.Error("error processing event: %v", "err", err)
+					if err := c.open(&event); err != nil {
+						slog.Error("error opening event", "err", err)
+					} else if err := c.apply(ctx, &event); err != nil {
+						slog.Error("error applying event: %v", "err", err)
 					}
-				case shared.FSTree:
-					var tree shared.FSNode
-					if err := json.Unmarshal(env.Message, &tree); err != nil {
-						slog.Error("unmarshal fsnode error: %v", "err", err)
+				case shared.Folders:
+					var reply shared.TreeReply
+					if err := json.Unmarshal(env.Message, &reply); err != nil {
+						slog.Error("unmarshal tree reply error: %v", "err", err)
 						return
 					}
-					c.registry.SyncTree(&tree)
-					once.Do(func() { go c.registry.ListenForEvents(ctx) })
+					if err := c.pulled(ctx, conn, reply); err != nil {
+						slog.Error("error pulling tree", "err", err)
+					}
+				case shared.Begin, shared.Chunk, shared.Commit, shared.Want:
+					if err := c.receiveTransfer(ctx, env); err != nil {
+						slog.Error("error receiving file", "err", err)
+					}
+				case shared.Ack, shared.Nack:
+					var res shared.Result
+					if err := json.Unmarshal(env.Message, &res); err != nil {
+						slog.Error("unmarshal result error: %v", "err", err)
+						return
+					}
+					if v := c.registry.vault; v != nil {
+						if p, err := v.openPath(res.Path); err == nil {
+							res.Path = p
+						}
+					}
+					if p, ok := c.registry.roots.local(res.Path); ok {
+						res.Path = p
+					}
+					if env.Type == shared.Ack {
+						err = c.registry.acked(ctx, res)
+					} else {
+						c.abortUpload(res.ID)
+						err = c.registry.nack(ctx, res)
+					}
+					if err != nil {
+						slog.Error("error handling result", "err", err)
+					}
 				}
 			}
 		}
@@ -97,6 +270,13 @@ func (c *client) readMessages(ctx context.Context, conn *websocket.Conn) {
 }
 
 func (c *client) writeMessages(ctx context.Context, conn *websocket.Conn) {
+	// events that were handed to a previous
+	// connection are replayed from the outbox
+	c.registry.resetOutbox()
+	if err := c.flushOutbox(ctx, conn); err != nil {
+		slog.Error("outbox replay error", "err", err)
+		return
+	}
 	for {
 		select {
 		case msg, ok := <-c.registry.msgBuffer:
@@ -104,12 +284,210 @@ func (c *client) writeMessages(ctx context.Context, conn *websocket.Conn) {
 				slog.Error("client message buffer closed")
 				return
 			}
-			if err := conn.Write(ctx, websocket.MessageBinary, msg); err != nil {
+			if err := c.write(ctx, conn, msg); err != nil {
 				slog.Error("connection closed error", "err", err)
 				return
 			}
+			if c.registry.overflowed() {
+				if err := c.flushOutbox(ctx, conn); err != nil {
+					slog.Error("outbox replay error", "err", err)
+					return
+				}
+			}
 		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+// flushOutbox sends the persisted events that
+// didn't make it through msgBuffer.
+func (c *client) flushOutbox(ctx context.Context, conn *websocket.Conn) error {
+	payloads, err := c.registry.pending(ctx)
+	if err != nil {
+		return err
+	}
+	for _, msg := range payloads {
+		if err := c.write(ctx, conn, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *client) write(ctx context.Context, conn *websocket.Conn, msg []byte) error {
+	event := peekEvent(msg)
+	if event == nil {
+		return conn.Write(ctx, websocket.MessageBinary, msg)
+	}
+	if !c.registry.take(event.ID) {
+		return nil
+	}
+	if event.Chunked {
+		return c.upload(ctx, conn, event)
+	}
+	// the outbox holds local paths and plaintext,
+	// events are translated on their way out
+	c.registry.roots.send(event)
+	if v := c.registry.vault; v != nil {
+		v.sealEvent(event)
+	}
+	payload, err := shared.MarshalEnvl(event, shared.Event)
+	if err != nil {
+		return err
+	}
+	// the event stays in the outbox until
+	// the server acknowledges it
+	return conn.Write(ctx, websocket.MessageBinary, payload)
+}
+
+// upload streams the content of a large file to the server,
+// only the chunks the server doesn't already have are sent.
+func (c *client) upload(ctx context.Context, conn *websocket.Conn, event *shared.FileEvent) error {
+	id := shared.NewTransferID()
+	wanted := make(chan []int64, 1)
+	c.Lock()
+	c.wants[id] = wanted
+	if event.ID != 0 {
+		c.uploads[event.ID] = id
+	}
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		delete(c.wants, id)
+		delete(c.uploads, event.ID)
+		c.Unlock()
+	}()
+	var (
+		src     = event.Path
+		wire    = *event
+		root, _ = c.registry.roots.of(event.Path)
+		err     error
+	)
+	c.registry.roots.send(&wire)
+	if v := c.registry.vault; v != nil {
+		// the sealed content is streamed from a temporary copy
+		if src, err = v.sealFile(root.tmpDir(), event.Path); err == nil {
+			defer os.Remove(src)
+			v.sealEvent(&wire)
+		}
+	}
+	if err == nil {
+		err = shared.StreamDelta(ctx, id, src, wire, func(payload []byte) error {
+			return conn.Write(ctx, websocket.MessageBinary, payload)
+		}, wanted)
+	}
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, shared.ErrMalformedEvent) {
+		// the file is gone or was replaced by a directory,
+		// the events that followed take care of it
+		slog.Error("upload dropped", "path", event.Path, "err", err)
+		return c.registry.ack(ctx, event.ID)
+	}
+	if errors.Is(err, shared.ErrTransferAborted) {
+		// the server rejected the event, the nack takes care of it
+		return nil
+	}
+	return err
+}
+
+// deliverWant hands the chunks requested by
+// the server to the matching upload.
+func (c *client) deliverWant(want shared.TransferWant) {
+	c.Lock()
+	defer c.Unlock()
+	wanted, exists := c.wants[want.ID]
+	if !exists {
+		return
+	}
+	select {
+	case wanted <- want.Indices:
+	default:
+	}
+}
+
+// abortUpload stops the upload of the outbox event id
+// if it waits for the server, which rejected its Begin.
+func (c *client) abortUpload(id int64) {
+	c.Lock()
+	defer c.Unlock()
+	transfer, exists := c.uploads[id]
+	if !exists {
+		return
+	}
+	close(c.wants[transfer])
+	delete(c.wants, transfer)
+	delete(c.uploads, id)
+}
+
+// receiveTransfer handles the envelopes of
+// files streamed by the server.
+func (c *client) receiveTransfer(ctx context.Context, env shared.Envelope) error {
+	switch env.Type {
+	case shared.Begin:
+		var begin shared.TransferBegin
+		if err := json.Unmarshal(env.Message, &begin); err != nil {
+			return err
+		}
+		_, err := c.transfers.Begin(ctx, begin)
+		return err
+	case shared.Chunk:
+		var chunk shared.TransferChunk
+		if err := json.Unmarshal(env.Message, &chunk); err != nil {
+			return err
+		}
+		return c.transfers.Write(chunk)
+	case shared.Want:
+		var want shared.TransferWant
+		if err := json.Unmarshal(env.Message, &want); err != nil {
+			return err
+		}
+		c.deliverWant(want)
+	case shared.Commit:
+		var commit shared.TransferCommit
+		if err := json.Unmarshal(env.Message, &commit); err != nil {
+			return err
+		}
+		event, err := c.transfers.Commit(commit)
+		if err != nil {
+			return err
+		}
+		if err := c.open(event); err != nil {
+			os.Remove(event.Source)
+			return err
+		}
+		defer os.Remove(event.Source)
+		return c.apply(ctx, event)
+	}
+	return nil
+}
+
+// open turns an event received from the server into a local
+// one: decrypted in end-to-end mode, the content of a committed
+// transfer replaced by its plaintext, its paths the ones of the
+// roots.
+func (c *client) open(event *shared.FileEvent) error {
+	v := c.registry.vault
+	if v != nil {
+		if err := v.openEvent(event); err != nil {
+			return err
+		}
+	}
+	if !c.registry.roots.receive(event) {
+		return fmt.Errorf("%w: %s", errNoRoot, event.Path)
+	}
+	// the files left on the server are
+	// written to without a hub
+	if err := c.registry.roots.check(event.Path); err != nil {
+		return fmt.Errorf("%w: %s", err, event.Path)
+	}
+	if v == nil || event.Source == "" {
+		return nil
+	}
+	src, err := v.openFile(path.Dir(event.Source), event.Source)
+	if err != nil {
+		return err
+	}
+	os.Remove(event.Source)
+	event.Source = src
+	return nil
+}
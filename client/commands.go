@@ -0,0 +1,600 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/thesicktwist1/harmony/shared"
+	_ "github.com/tursodatabase/libsql-client-go/libsql"
+)
+
+var (
+	errUsage      = errors.New("usage")
+	errNoDatabase = errors.New("DATABASE_URL environment variable is not set")
+	errNoToken    = errors.New("DEVICE_TOKEN environment variable is not set")
+	errNoAdmin    = errors.New("ADMIN_TOKEN environment variable is not set")
+	errMountRoots = errors.New("mount serves a single sync root")
+)
+
+// usage is the error of a command called with the wrong arguments.
+func usage(command, args string) error {
+	return fmt.Errorf("%w: harmony %s [flags] %s", errUsage, command, args)
+}
+
+// serverPath returns the path of the server named by the
+// arguments of a command, relative to the top of its tree.
+func serverPath(args ...string) (string, error) {
+	return shared.CanonicalPath(path.Join(append([]string{shared.Root}, args...)...))
+}
+
+// newVaultFromEnv returns the vault of the passphrase set in the
+// environment, nil when end-to-end encryption is off. Every device
+// of the user has to use the same passphrase, the salt is the one
+// the server keeps for the user.
+func newVaultFromEnv(ctx context.Context, r remote) (*vault, error) {
+	passphrase := os.Getenv("E2E_PASSPHRASE")
+	if passphrase == "" {
+		return nil, nil
+	}
+	var info struct {
+		Salt string `json:"salt"`
+	}
+	if err := r.do(ctx, http.MethodGet, "vault", nil, nil, &info); err != nil {
+		return nil, err
+	}
+	salt, err := hex.DecodeString(info.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return newVault(passphrase, salt)
+}
+
+// newClientFromEnv builds the client syncing the roots of cfg,
+// the database it returns has to be closed by the caller.
+func newClientFromEnv(ctx context.Context, cfg config, watcher *fsnotify.Watcher) (*client, *sql.DB, error) {
+	r, err := newRemote(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	rs, err := cfg.roots()
+	if err != nil {
+		return nil, nil, err
+	}
+	selection, err := cfg.selection()
+	if err != nil {
+		return nil, nil, err
+	}
+	// the name of the client shows in its conflict copies
+	name := os.Getenv("CLIENT_NAME")
+	if name == "" {
+		if name, err = os.Hostname(); err != nil {
+			return nil, nil, err
+		}
+	}
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		return nil, nil, errNoDatabase
+	}
+	db, err := shared.OpenWithGoose(dbURL, "libsql")
+	if err != nil {
+		return nil, nil, err
+	}
+	c := NewClient(watcher, db, name)
+	c.setRoots(rs)
+	c.token = r.token
+	c.url = r.url
+	c.httpClient = r.httpClient
+	c.registry.vault = r.vault
+	c.registry.selection = selection
+	c.registry.onlineOnly = cfg.onlineOnly
+	c.registry.keepLinks = cfg.keepLinks
+	return c, db, nil
+}
+
+// Run syncs the roots with the server until
+// ctx is done, args are the flags of the client.
+func Run(ctx context.Context, args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if len(cfg.args) != 0 {
+		return usage("client", "")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	c, db, err := newClientFromEnv(ctx, cfg, watcher)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := c.Run(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	log.Print("Client successfully closed")
+	return nil
+}
+
+// Mount syncs a single root like Run but serves it at the
+// directory given as argument, the mount reports its own
+// changes in place of the watcher.
+func Mount(ctx context.Context, args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if len(cfg.args) != 1 {
+		return usage("mount", "<dir>")
+	}
+	c, db, err := newClientFromEnv(ctx, cfg, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if len(c.registry.roots) != 1 {
+		return errMountRoots
+	}
+	if err := c.Run(ctx); err != nil {
+		return err
+	}
+	server, err := c.mount(ctx, cfg.args[0])
+	if err != nil {
+		return err
+	}
+	defer server.Unmount()
+	log.Printf("tree mounted at %v\n", cfg.args[0])
+	<-ctx.Done()
+	log.Print("Client successfully closed")
+	return nil
+}
+
+// Fetch downloads the content of placeholders, whether
+// or not the client is running. Their paths are the ones
+// of the server, relative to the top of the tree.
+func Fetch(ctx context.Context, args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if len(cfg.args) == 0 {
+		return usage("fetch", "<path>...")
+	}
+	c, db, err := newClientFromEnv(ctx, cfg, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, p := range cfg.args {
+		wire, err := serverPath(p)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, p)
+		}
+		local, ok := c.registry.roots.local(wire)
+		if !ok {
+			return fmt.Errorf("%w: %s", errNoRoot, p)
+		}
+		if err := c.fetch(ctx, local); err != nil {
+			return err
+		}
+		log.Printf("%v fetched\n", p)
+	}
+	return nil
+}
+
+// Status prints the events waiting to be sent to the server,
+// when the last change was synced and the devices connected.
+func Status(ctx context.Context, args []string, out io.Writer) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if len(cfg.args) != 0 {
+		return usage("status", "")
+	}
+	c, db, err := newClientFromEnv(ctx, cfg, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	pending, err := c.registry.DB.ListOutbox(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "pending:   %d\n", len(pending))
+	for _, event := range pending {
+		fmt.Fprintf(out, "  %s %s\n", event.Op, event.Path)
+	}
+	files, err := c.registry.DB.ListFiles(ctx)
+	if err != nil {
+		return err
+	}
+	var last time.Time
+	for _, f := range files {
+		if t, err := time.Parse(shared.TimeLayout, f.Updatedat); err == nil && t.After(last) {
+			last = t
+		}
+	}
+	if last.IsZero() {
+		fmt.Fprintln(out, "last sync: never")
+	} else {
+		fmt.Fprintf(out, "last sync: %s\n", last.Format(time.DateTime))
+	}
+	var peers []shared.Peer
+	if err := c.remote().do(ctx, http.MethodGet, "peers", nil, nil, &peers); err != nil {
+		// the local state is worth showing offline
+		fmt.Fprintf(out, "peers:     unreachable (%v)\n", err)
+		return nil
+	}
+	names := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		names = append(names, peer.Name)
+	}
+	fmt.Fprintf(out, "peers:     %d %s\n", len(peers), strings.Join(names, ", "))
+	return nil
+}
+
+// List prints the content of a folder of the server,
+// the root of the tree by default.
+func List(ctx context.Context, args []string, out io.Writer) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if len(cfg.args) > 1 {
+		return usage("ls", "[path]")
+	}
+	r, err := newRemote(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	p, err := serverPath(cfg.args...)
+	if err != nil {
+		return err
+	}
+	node, err := r.lookup(ctx, p)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if !node.IsDir {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", path.Base(node.Path), node.Revision, node.ModTime)
+		return w.Flush()
+	}
+	for _, name := range slices.Sorted(maps.Keys(node.Childs)) {
+		child := node.Childs[name]
+		if child.IsDir {
+			fmt.Fprintf(w, "%s/\t\t%s\n", name, child.ModTime)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", name, child.Revision, child.ModTime)
+	}
+	return w.Flush()
+}
+
+// Tree prints the tree of the server below a
+// folder, the whole tree by default.
+func Tree(ctx context.Context, args []string, out io.Writer) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if len(cfg.args) > 1 {
+		return usage("tree", "[path]")
+	}
+	r, err := newRemote(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	p, err := serverPath(cfg.args...)
+	if err != nil {
+		return err
+	}
+	node, err := r.lookup(ctx, p)
+	if err != nil {
+		return err
+	}
+	printTree(out, node, path.Base(node.Path), "")
+	return nil
+}
+
+func printTree(w io.Writer, node *shared.FSNode, name, indent string) {
+	if !node.IsDir {
+		fmt.Fprintf(w, "%s%s\n", indent, name)
+		return
+	}
+	fmt.Fprintf(w, "%s%s/\n", indent, name)
+	for _, name := range slices.Sorted(maps.Keys(node.Childs)) {
+		printTree(w, node.Childs[name], name, indent+"  ")
+	}
+}
+
+// Get downloads a file of the server to dest, its base name
+// in the working directory by default and the standard output
+// for "-". Unlike fetch it leaves the roots alone.
+func Get(ctx context.Context, args []string, out io.Writer) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if len(cfg.args) != 1 && len(cfg.args) != 2 {
+		return usage("get", "<path> [dest]")
+	}
+	r, err := newRemote(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	p, err := serverPath(cfg.args[0])
+	if err != nil {
+		return err
+	}
+	dest := path.Base(p)
+	if len(cfg.args) == 2 {
+		dest = cfg.args[1]
+	}
+	if stat, err := os.Stat(dest); err == nil && stat.IsDir() {
+		dest = path.Join(dest, path.Base(p))
+	}
+	resp, err := r.send(ctx, http.MethodGet, "content", url.Values{"path": {r.seal(p)}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if dest == "-" {
+		return r.copy(out, resp.Body)
+	}
+	// written aside so that dest is
+	// never left half downloaded
+	tmp, err := os.CreateTemp(path.Dir(dest), "."+path.Base(dest)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := r.copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// Put uploads a local file to the path of the server, the
+// file is created or overwritten whatever its revision.
+func Put(ctx context.Context, args []string, out io.Writer) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if len(cfg.args) != 2 {
+		return usage("put", "<file> <path>")
+	}
+	r, err := newRemote(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	src := cfg.args[0]
+	if stat, err := os.Stat(src); err != nil {
+		return err
+	} else if stat.IsDir() {
+		return fmt.Errorf("%s is a directory", src)
+	}
+	if r.vault != nil {
+		if src, err = r.vault.sealFile(os.TempDir(), src); err != nil {
+			return err
+		}
+		defer os.Remove(src)
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	p, err := serverPath(cfg.args[1])
+	if err != nil {
+		return err
+	}
+	var res shared.Result
+	if err := r.do(ctx, http.MethodPut, "content", url.Values{"path": {r.seal(p)}}, file, &res); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s at revision %d\n", cfg.args[1], res.Revision)
+	return nil
+}
+
+// History prints the versions the server
+// keeps of a file, the newest first.
+func History(ctx context.Context, args []string, out io.Writer) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if len(cfg.args) != 1 {
+		return usage("history", "<path>")
+	}
+	r, err := newRemote(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	var versions []shared.Version
+	p, err := serverPath(cfg.args[0])
+	if err != nil {
+		return err
+	}
+	if err := r.do(ctx, http.MethodGet, "versions", url.Values{"path": {r.seal(p)}}, nil, &versions); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tAUTHOR\tSIZE\tHASH")
+	for _, v := range versions {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%.12s\n", v.ID, v.CreatedAt, v.Author, v.Size, v.Hash)
+	}
+	return w.Flush()
+}
+
+// Restore makes a version listed by history
+// the current content of its file.
+func Restore(ctx context.Context, args []string, out io.Writer) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if len(cfg.args) != 1 {
+		return usage("restore", "<version>")
+	}
+	id, err := strconv.ParseInt(cfg.args[0], 10, 64)
+	if err != nil {
+		return usage("restore", "<version>")
+	}
+	r, err := newRemote(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if err := r.do(ctx, http.MethodPost, fmt.Sprintf("versions/%d/restore", id), nil, nil, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "version %d restored\n", id)
+	return nil
+}
+
+// Trash lists the trash of the server, "restore <id>"
+// and "purge <id>" restore or delete one of its entries.
+func Trash(ctx context.Context, args []string, out io.Writer) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	var id int64
+	switch len(cfg.args) {
+	case 0:
+	case 2:
+		id, err = strconv.ParseInt(cfg.args[1], 10, 64)
+		if err == nil && (cfg.args[0] == "restore" || cfg.args[0] == "purge") {
+			break
+		}
+		fallthrough
+	default:
+		return usage("trash", "[restore|purge <id>]")
+	}
+	r, err := newRemote(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.args) == 2 {
+		method, name := http.MethodPost, fmt.Sprintf("trash/%d/restore", id)
+		if cfg.args[0] == "purge" {
+			method, name = http.MethodDelete, fmt.Sprintf("trash/%d", id)
+		}
+		if err := r.do(ctx, method, name, nil, nil, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "entry %d %sd\n", id, cfg.args[0])
+		return nil
+	}
+	var entries []shared.TrashEntry
+	if err := r.do(ctx, http.MethodGet, "trash", nil, nil, &entries); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPATH\tDELETED BY\tDELETED AT")
+	for _, e := range entries {
+		p := r.open(e.Path)
+		if e.IsDir {
+			p += "/"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", e.ID, p, e.DeletedBy, e.DeletedAt)
+	}
+	return w.Flush()
+}
+
+// Devices lists the devices enrolled on the server, "enroll
+// <name> [user]" and "revoke <id>" manage them. They are
+// reserved to the admin token of the server.
+func Devices(ctx context.Context, args []string, out io.Writer) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	var (
+		n       = len(cfg.args)
+		command string
+	)
+	if n > 0 {
+		command = cfg.args[0]
+	}
+	if !(n == 0 || command == "enroll" && (n == 2 || n == 3) || command == "revoke" && n == 2) {
+		return usage("devices", "[enroll <name> [user]|revoke <id>]")
+	}
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return errNoAdmin
+	}
+	httpClient, err := cfg.httpClient()
+	if err != nil {
+		return err
+	}
+	r := remote{url: cfg.serverURL, token: token, httpClient: httpClient}
+
+	switch command {
+	case "enroll":
+		body := map[string]string{"name": cfg.args[1]}
+		if n == 3 {
+			body["user"] = cfg.args[2]
+		}
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		var enrolled struct {
+			Device shared.Device `json:"device"`
+			Token  string        `json:"token"`
+		}
+		if err := r.do(ctx, http.MethodPost, "devices", nil, bytes.NewReader(payload), &enrolled); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "device %d enrolled, its token is only shown once:\nDEVICE_TOKEN=%s\n", enrolled.Device.ID, enrolled.Token)
+		return nil
+	case "revoke":
+		id, err := strconv.ParseInt(cfg.args[1], 10, 64)
+		if err != nil {
+			return usage("devices", "revoke <id>")
+		}
+		if err := r.do(ctx, http.MethodDelete, fmt.Sprintf("devices/%d", id), nil, nil, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "device %d revoked\n", id)
+		return nil
+	}
+	var devices []shared.Device
+	if err := r.do(ctx, http.MethodGet, "devices", nil, nil, &devices); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tUSER\tLAST SEEN\tREVOKED")
+	for _, d := range devices {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", d.ID, d.Name, d.User, d.LastSeenAt, d.RevokedAt)
+	}
+	return w.Flush()
+}
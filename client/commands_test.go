@@ -0,0 +1,177 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+func TestCommandUsage(t *testing.T) {
+	ctx := context.Background()
+	tests := map[string]func() error{
+		"client":           func() error { return Run(ctx, []string{"sync"}) },
+		"mount":            func() error { return Mount(ctx, nil) },
+		"fetch":            func() error { return Fetch(ctx, []string{"-online-only"}) },
+		"status":           func() error { return Status(ctx, []string{"now"}, io.Discard) },
+		"ls":               func() error { return List(ctx, []string{"a", "b"}, io.Discard) },
+		"tree":             func() error { return Tree(ctx, []string{"a", "b"}, io.Discard) },
+		"get":              func() error { return Get(ctx, nil, io.Discard) },
+		"put":              func() error { return Put(ctx, []string{"a.txt"}, io.Discard) },
+		"history":          func() error { return History(ctx, nil, io.Discard) },
+		"restore":          func() error { return Restore(ctx, []string{"latest"}, io.Discard) },
+		"trash":            func() error { return Trash(ctx, []string{"empty"}, io.Discard) },
+		"trash restore":    func() error { return Trash(ctx, []string{"restore", "a"}, io.Discard) },
+		"devices":          func() error { return Devices(ctx, []string{"list"}, io.Discard) },
+		"devices enroll":   func() error { return Devices(ctx, []string{"enroll"}, io.Discard) },
+		"devices revoke":   func() error { return Devices(ctx, []string{"revoke", "1", "2"}, io.Discard) },
+		"flags come first": func() error { return List(ctx, []string{"docs", "-server", "ws://localhost/ws"}, io.Discard) },
+	}
+	for name, run := range tests {
+		require.ErrorIsf(t, run(), errUsage, "%s", name)
+	}
+}
+
+func TestRemoteCommands(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		tmp      = t.TempDir()
+		uploaded = map[string]string{}
+		calls    []string
+		tree     = &shared.FSNode{Path: storage, IsDir: true, Childs: map[string]*shared.FSNode{
+			"docs": {Path: "storage/docs", IsDir: true, Childs: map[string]*shared.FSNode{
+				"a.txt": {Path: "storage/docs/a.txt", Revision: 3},
+			}},
+			"b.txt": {Path: "storage/b.txt", Revision: 1},
+		}}
+	)
+	t.Setenv("DEVICE_TOKEN", "device")
+	t.Setenv("ADMIN_TOKEN", "admin")
+	t.Setenv("E2E_PASSPHRASE", "")
+
+	mux := http.NewServeMux()
+	reply := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("GET /tree", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, tree)
+	})
+	mux.HandleFunc("GET /content", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("path") != "storage/docs/a.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("remote"))
+	})
+	mux.HandleFunc("PUT /content", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		uploaded[r.URL.Query().Get("path")] = string(data)
+		reply(w, shared.Result{Path: r.URL.Query().Get("path"), Revision: 4})
+	})
+	mux.HandleFunc("GET /versions", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, []shared.Version{{ID: 7, Path: r.URL.Query().Get("path"), Hash: sum("remote"), Author: "laptop"}})
+	})
+	mux.HandleFunc("GET /trash", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, []shared.TrashEntry{{ID: 2, Path: "storage/old", IsDir: true, DeletedBy: "phone"}})
+	})
+	mux.HandleFunc("GET /vault", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, map[string]string{"salt": hex.EncodeToString(testSalt)})
+	})
+	mux.HandleFunc("POST /devices", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusCreated)
+		reply(w, map[string]any{"device": shared.Device{ID: 5, Name: body["name"]}, "token": "secret"})
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := "device"
+		if strings.HasPrefix(r.URL.Path, "/devices") {
+			token = "admin"
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	serverURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	run := func(command func(context.Context, []string, io.Writer) error, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := command(ctx, append([]string{"-server", serverURL}, args...), &out)
+		return out.String(), err
+	}
+
+	out, err := run(List)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 2)
+	require.True(t, strings.HasPrefix(lines[0], "b.txt"))
+	require.True(t, strings.HasPrefix(lines[1], "docs/"))
+	_, err = run(List, "missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	out, err = run(Tree, "docs")
+	require.NoError(t, err)
+	require.Equal(t, "docs/\n  a.txt\n", out)
+
+	out, err = run(Get, "docs/a.txt", "-")
+	require.NoError(t, err)
+	require.Equal(t, "remote", out)
+	_, err = run(Get, "docs/a.txt", tmp)
+	require.NoError(t, err)
+	content, err := os.ReadFile(path.Join(tmp, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "remote", string(content))
+	_, err = run(Get, "missing.txt", tmp)
+	require.ErrorContains(t, err, "404")
+
+	local := path.Join(tmp, "local.txt")
+	require.NoError(t, os.WriteFile(local, []byte("local"), 0666))
+	out, err = run(Put, local, "docs/c.txt")
+	require.NoError(t, err)
+	require.Equal(t, "docs/c.txt at revision 4\n", out)
+	require.Equal(t, map[string]string{"storage/docs/c.txt": "local"}, uploaded)
+
+	out, err = run(History, "docs/a.txt")
+	require.NoError(t, err)
+	require.Contains(t, out, "laptop")
+	require.Contains(t, out, sum("remote")[:12])
+
+	out, err = run(Trash)
+	require.NoError(t, err)
+	require.Contains(t, out, "storage/old/")
+
+	out, err = run(Devices, "enroll", "phone")
+	require.NoError(t, err)
+	require.Contains(t, out, "DEVICE_TOKEN=secret")
+
+	require.Equal(t, []string{
+		"GET /tree", "GET /tree", "GET /tree",
+		"GET /content", "GET /content", "GET /content",
+		"PUT /content", "GET /versions", "GET /trash", "POST /devices",
+	}, calls)
+
+	// the keys are derived from the salt kept by the server
+	t.Setenv("E2E_PASSPHRASE", "correct horse battery staple")
+	calls, uploaded = nil, map[string]string{}
+	_, err = run(Put, local, "docs/c.txt")
+	require.NoError(t, err)
+	require.Equal(t, []string{"GET /vault", "PUT /content"}, calls)
+	v, err := newVault("correct horse battery staple", testSalt)
+	require.NoError(t, err)
+	require.Contains(t, uploaded, v.sealPath("storage/docs/c.txt"))
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+const defaultServerURL = "ws://localhost:8080/ws"
+
+var (
+	errTLSPair = errors.New("tls-cert and tls-key have to be set together")
+	errNoTLS   = errors.New("TLS options require a wss:// server URL")
+	// an empty selection would subscribe to the whole tree
+	errNoSelection = errors.New("sync paths outside of the sync roots")
+)
+
+// config is read from the environment, the .env file
+// included, flags taking precedence over it.
+type config struct {
+	serverURL string
+	// authorities trusted on top of the system ones
+	caFile string
+	// certificate presented to servers
+	// verifying the ones of their clients
+	certFile string
+	keyFile  string
+	// comma separated dir[=folder] directories
+	// synced with folders of the server
+	syncRoots string
+	// comma separated subtrees of the tree
+	// the device mirrors, all if empty
+	syncPaths string
+	// files are only downloaded on demand,
+	// placeholders stand for the others
+	onlineOnly bool
+	// the links of the server leading out
+	// of their root are created too
+	keepLinks bool
+	// arguments of the command, what follows the flags
+	args []string
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func loadConfig(args []string) (config, error) {
+	var c config
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.StringVar(&c.serverURL, "server", envOr("SERVER_URL", defaultServerURL), "websocket URL of the server (SERVER_URL)")
+	fs.StringVar(&c.caFile, "tls-ca", os.Getenv("TLS_CA"), "CA bundle verifying the server (TLS_CA)")
+	fs.StringVar(&c.certFile, "tls-cert", os.Getenv("TLS_CERT"), "client certificate file (TLS_CERT)")
+	fs.StringVar(&c.keyFile, "tls-key", os.Getenv("TLS_KEY"), "client key file (TLS_KEY)")
+	fs.StringVar(&c.syncRoots, "roots", os.Getenv("SYNC_ROOTS"), "comma separated dir[=folder] directories to sync, ./storage by default (SYNC_ROOTS)")
+	fs.StringVar(&c.syncPaths, "sync", os.Getenv("SYNC_PATHS"), "comma separated folders to mirror, all by default (SYNC_PATHS)")
+	onlineOnly, _ := strconv.ParseBool(os.Getenv("ONLINE_ONLY"))
+	fs.BoolVar(&c.onlineOnly, "online-only", onlineOnly, "download files on demand only (ONLINE_ONLY)")
+	keepLinks, _ := strconv.ParseBool(os.Getenv("KEEP_LINKS"))
+	fs.BoolVar(&c.keepLinks, "keep-links", keepLinks, "create the links leading out of their root (KEEP_LINKS)")
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	c.args = fs.Args()
+	u, err := url.Parse(c.serverURL)
+	if err != nil {
+		return c, err
+	}
+	switch u.Scheme {
+	case "ws":
+		if c.caFile != "" || c.certFile != "" {
+			return c, errNoTLS
+		}
+	case "wss":
+	default:
+		return c, fmt.Errorf("unsupported server URL scheme %q", u.Scheme)
+	}
+	if (c.certFile == "") != (c.keyFile == "") {
+		return c, errTLSPair
+	}
+	if _, err := c.roots(); err != nil {
+		return c, fmt.Errorf("invalid sync roots: %w", err)
+	}
+	if _, err := c.selection(); err != nil {
+		return c, fmt.Errorf("invalid sync paths: %w", err)
+	}
+	return c, nil
+}
+
+func (c config) roots() (roots, error) {
+	return parseRoots(c.syncRoots)
+}
+
+// selection returns the subtrees to mirror, the sync paths
+// are relative to the top of the tree and narrow the folders
+// of the roots.
+func (c config) selection() (shared.Selection, error) {
+	var paths []string
+	for _, p := range strings.Split(c.syncPaths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, path.Join(shared.Root, p))
+		}
+	}
+	selection, err := shared.NewSelection(paths)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := c.roots()
+	if err != nil {
+		return nil, err
+	}
+	folders, err := rs.selection()
+	if err != nil {
+		return nil, err
+	}
+	selection = selection.Intersect(folders)
+	if selection != nil && len(selection) == 0 {
+		return nil, errNoSelection
+	}
+	return selection, nil
+}
+
+// httpClient dials the server, nil
+// when the defaults are good enough.
+func (c config) httpClient() (*http.Client, error) {
+	if c.caFile == "" && c.certFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.caFile != "" {
+		pool, err := shared.SystemCertPool(c.caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if c.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return &http.Client{Transport: transport}, nil
+}
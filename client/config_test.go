@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/coder/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "tls", args: []string{"-server", "wss://example.com/ws", "-tls-ca", "ca.pem"}},
+		{name: "mtls", args: []string{"-server", "wss://example.com/ws", "-tls-cert", "c.pem", "-tls-key", "k.pem"}},
+		{name: "tls options over ws", args: []string{"-tls-ca", "ca.pem"}, wantErr: true},
+		{name: "certificate without key", args: []string{"-server", "wss://example.com/ws", "-tls-cert", "c.pem"}, wantErr: true},
+		{name: "unsupported scheme", args: []string{"-server", "ftp://example.com"}, wantErr: true},
+		{name: "selective sync", args: []string{"-sync", "docs, photos/2024"}},
+		{name: "sync path out of the storage", args: []string{"-sync", "docs,../etc"}, wantErr: true},
+		{name: "sync roots", args: []string{"-roots", "/home/me/Documents=docs, /home/me/Pictures=photos"}},
+		{name: "sync root of the whole tree", args: []string{"-roots", "/srv/harmony"}},
+		{name: "overlapping directories", args: []string{"-roots", "/home/me=docs,/home/me/Pictures=photos"}, wantErr: true},
+		{name: "overlapping folders", args: []string{"-roots", "/a=docs,/b=docs/work"}, wantErr: true},
+		{name: "sync root folder out of the tree", args: []string{"-roots", "/a=../etc"}, wantErr: true},
+		{name: "sync root in the working directory", args: []string{"-roots", ".=docs"}, wantErr: true},
+		{name: "sync paths inside the roots", args: []string{"-roots", "/a=docs", "-sync", "docs/work"}},
+		{name: "sync paths outside the roots", args: []string{"-roots", "/a=docs", "-sync", "photos"}, wantErr: true},
+		{name: "online-only", args: []string{"-online-only"}},
+		{name: "arguments", args: []string{"-online-only", "docs/a.txt", "b.txt"}},
+	}
+	for _, tc := range tests {
+		_, err := loadConfig(tc.args)
+		if tc.wantErr {
+			require.Errorf(t, err, "%s", tc.name)
+		} else {
+			require.NoErrorf(t, err, "%s", tc.name)
+		}
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer ts.Close()
+
+	caFile := path.Join(t.TempDir(), "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, pemData, 0600))
+
+	serverURL := "wss" + strings.TrimPrefix(ts.URL, "https")
+	ctx := context.Background()
+
+	// the certificate of the test server is unknown to the system
+	cfg, err := loadConfig([]string{"-server", serverURL})
+	require.NoError(t, err)
+	httpClient, err := cfg.httpClient()
+	require.NoError(t, err)
+	_, _, err = websocket.Dial(ctx, cfg.serverURL, &websocket.DialOptions{HTTPClient: httpClient})
+	require.Error(t, err)
+
+	cfg, err = loadConfig([]string{"-server", serverURL, "-tls-ca", caFile})
+	require.NoError(t, err)
+	httpClient, err = cfg.httpClient()
+	require.NoError(t, err)
+	conn, _, err := websocket.Dial(ctx, cfg.serverURL, &websocket.DialOptions{HTTPClient: httpClient})
+	require.NoError(t, err)
+	conn.CloseNow()
+
+	// the bundle is trusted on top of the system roots
+	want, err := x509.SystemCertPool()
+	require.NoError(t, err)
+	want.AddCert(ts.Certificate())
+	got := httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs
+	require.True(t, want.Equal(got))
+}
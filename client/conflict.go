@@ -0,0 +1,135 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+// conflictName returns the name of the n-th conflict
+// copy of the file at p made by client on day.
+func conflictName(p, client string, day time.Time, n int) string {
+	var (
+		name = path.Base(p)
+		ext  = path.Ext(name)
+		base = strings.TrimSuffix(name, ext)
+	)
+	if base == "" {
+		// dotfiles have no extension
+		base, ext = name, ""
+	}
+	suffix := fmt.Sprintf("conflicted copy from %s %s", client, day.Format(time.DateOnly))
+	if n > 1 {
+		suffix = fmt.Sprintf("%s %d", suffix, n)
+	}
+	return path.Join(path.Dir(p), fmt.Sprintf("%s (%s)%s", base, suffix, ext))
+}
+
+// conflictCopy keeps the local version of the file at p next to
+// it, the copy is sent to the server as a new file recorded as
+// a conflict of p and reaches the other clients like any other.
+func (r *registry) conflictCopy(ctx context.Context, p string) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return r.conflictLink(p, info)
+	}
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	var (
+		dest string
+		out  *os.File
+		now  = time.Now()
+	)
+	for n := 1; ; n++ {
+		dest = conflictName(p, r.name, now, n)
+		out, err = os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0777)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, src); err != nil {
+		return err
+	}
+	if err := out.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	stat, err := out.Stat()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if stat.Size() <= dedupThreshold {
+		if data, err = io.ReadAll(out); err != nil {
+			return err
+		}
+	}
+	hash, err := r.hashFile(dest)
+	if err != nil {
+		return err
+	}
+	event := &shared.FileEvent{
+		Path:       dest,
+		Op:         fsnotify.Create.String(),
+		ConflictOf: p,
+	}
+	event.SetMetadata(stat)
+	setContent(event, hash, stat.Size(), data)
+	// the copy is tracked before the watcher sees
+	// it, so it is only sent once
+	return r.broadcastEvent(event)
+}
+
+// conflictLink is conflictCopy for links,
+// the copy points to the same target.
+func (r *registry) conflictLink(p string, info fs.FileInfo) error {
+	target, err := r.readContent(p, info)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for n := 1; ; n++ {
+		dest := conflictName(p, r.name, now, n)
+		err := os.Symlink(string(target), dest)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		hash, err := r.hash(bytes.NewReader(target))
+		if err != nil {
+			return err
+		}
+		event := &shared.FileEvent{
+			Path:       dest,
+			Op:         fsnotify.Create.String(),
+			ConflictOf: p,
+			Link:       true,
+		}
+		setContent(event, hash, int64(len(target)), target)
+		return r.broadcastEvent(event)
+	}
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflictName(t *testing.T) {
+	day := time.Date(2025, 6, 30, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		p    string
+		n    int
+		want string
+	}{
+		{
+			name: "extension is kept",
+			p:    path.Join(storage, "dir", "report.final.pdf"),
+			n:    1,
+			want: path.Join(storage, "dir", "report.final (conflicted copy from laptop 2025-06-30).pdf"),
+		},
+		{
+			name: "no extension",
+			p:    path.Join(storage, "Makefile"),
+			n:    1,
+			want: path.Join(storage, "Makefile (conflicted copy from laptop 2025-06-30)"),
+		},
+		{
+			name: "dotfile",
+			p:    path.Join(storage, ".env"),
+			n:    1,
+			want: path.Join(storage, ".env (conflicted copy from laptop 2025-06-30)"),
+		},
+		{
+			name: "second copy of the day",
+			p:    path.Join(storage, "notes.txt"),
+			n:    2,
+			want: path.Join(storage, "notes (conflicted copy from laptop 2025-06-30 2).txt"),
+		},
+	}
+	for _, tc := range tests {
+		require.Equalf(t, tc.want, conflictName(tc.p, "laptop", day, tc.n), "%s", tc.name)
+	}
+}
@@ -1,23 +1,40 @@
-package main
+package client
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/hex"
 	"errors"
-	"io"
+	"io/fs"
 	"log"
 	"log/slog"
 	"os"
 	"path"
 	"path/filepath"
-	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/thesicktwist1/harmony/shared"
 )
 
+// files above dedupThreshold are first sent by hash only,
+// the server often has their content already (copies,
+// reverts) and asks for it otherwise.
+const dedupThreshold = 64 << 10
+
+// setContent fills the content of the event
+// depending on the size of the file.
+func setContent(f *shared.FileEvent, hash string, size int64, data []byte) {
+	f.Hash = hash
+	switch {
+	case size > shared.ChunkThreshold:
+		f.Chunked = true
+	case size > dedupThreshold:
+		f.Dedup = true
+	default:
+		f.Data = data
+	}
+}
+
 func (r *registry) Remove(ctx context.Context, e fsnotify.Event) error {
 	isDir := r.isDir(e.Name)
 	if isDir {
@@ -41,69 +58,98 @@ func (r *registry) Remove(ctx context.Context, e fsnotify.Event) error {
 	return nil
 }
 
+// Write sends the new content of the file, along with the
+// revision it is based on when the server already knows it.
+// Links are sent as such, their content is their target: the
+// absolute ones are made relative or, out of the root, left out.
 func (r *registry) Write(ctx context.Context, e fsnotify.Event) error {
-	var exists bool
-	fileinfo, err := r.DB.GetFile(ctx, e.Name)
-	if err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			return err
-		}
-	} else {
-		if e.Op.Has(fsnotify.Create) {
-			return r.broadcastEvent(&shared.FileEvent{
-				Path: e.Name,
-				Op:   shared.Update,
-			})
-		}
-		exists = true
-	}
-	file, err := os.Open(e.Name)
+	base, known, err := r.synced(ctx, e.Name)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	data, err := io.ReadAll(file)
+	stat, err := os.Lstat(e.Name)
 	if err != nil {
 		return err
 	}
-	newHash := sha256.Sum256(data)
-	hash := hex.EncodeToString(newHash[:])
-	stat, err := file.Stat()
+	if known && base.Placeholder && stat.Size() == 0 {
+		// placeholders stay empty until fetched
+		return nil
+	}
+	var (
+		data    []byte
+		hash    string
+		link    = stat.Mode()&fs.ModeSymlink != 0
+		chunked = !link && stat.Size() > shared.ChunkThreshold
+	)
+	if chunked {
+		// large files are hashed on the fly and
+		// streamed when the event is sent
+		hash, err = r.hashFile(e.Name)
+	} else {
+		data, err = r.readContent(e.Name, stat)
+		if errors.Is(err, errLocalLink) {
+			slog.Warn("link to a path of the device left out", "path", e.Name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hash, err = r.hash(bytes.NewReader(data))
+	}
 	if err != nil {
 		return err
 	}
-	timestamp := stat.ModTime()
 	f := &shared.FileEvent{
 		Path: e.Name,
 		Op:   e.Op.String(),
 	}
-	if exists {
-		updatedAt, err := time.Parse(shared.TimeLayout, fileinfo.Updatedat)
-		if err != nil {
-			return err
+	f.SetMetadata(stat)
+	if known {
+		// the rows recorded before modes were
+		// synced have none, as if it didn't change
+		sameMode := base.Mode == 0 || uint32(base.Mode) == f.Mode
+		if base.Hash == hash && base.Link == f.Link && sameMode {
+			// already on the server, events
+			// of synced files end up here
+			return nil
 		}
-		if fileinfo.Hash != hash {
-			if timestamp.After(updatedAt) {
-				f.Data = data
-				f.Hash = hash
-			} else {
-				f.Op = shared.Update
-			}
-			if err := r.broadcastEvent(f); err != nil {
+		if base.Placeholder {
+			// written to before being fetched, the local
+			// content is kept aside and the server's fetched
+			if err := r.conflictCopy(ctx, e.Name); err != nil {
 				return err
 			}
+			return r.broadcastEvent(&shared.FileEvent{
+				Path: e.Name,
+				Op:   shared.Update,
+			})
 		}
-	} else {
-		f.Data = data
-		if err := r.broadcastEvent(f); err != nil {
-			return err
-		}
+		f.Op = fsnotify.Write.String()
+		f.Revision = base.Revision
 	}
-	return nil
+	size := stat.Size()
+	if link {
+		size = int64(len(data))
+	}
+	setContent(f, hash, size, data)
+	return r.broadcastEvent(f)
+}
+
+// Chmod sends the new mode of a synced file, along with
+// its content: the server only keeps what changed.
+func (r *registry) Chmod(ctx context.Context, e fsnotify.Event) error {
+	if r.isDir(e.Name) {
+		return nil
+	}
+	if _, known, err := r.synced(ctx, e.Name); err != nil || !known {
+		// new files are sent by their creation
+		return err
+	}
+	return r.Write(ctx, fsnotify.Event{Name: e.Name, Op: fsnotify.Write})
 }
 
 func (r *registry) Create(ctx context.Context, event fsnotify.Event) error {
-	stat, err := os.Stat(event.Name)
+	stat, err := os.Lstat(event.Name)
 	if err != nil {
 		return err
 	}
@@ -126,7 +172,7 @@ func (r *registry) Rename(ctx context.Context, e fsnotify.Event) error {
 	if _, err := r.DB.GetFile(ctx, e.RenamedFrom); err != nil {
 		return err
 	}
-	stat, err := os.Stat(e.Name)
+	stat, err := os.Lstat(e.Name)
 	if err != nil {
 		return err
 	}
@@ -147,7 +193,8 @@ func (r *registry) Rename(ctx context.Context, e fsnotify.Event) error {
 }
 
 func (r *registry) handleDir(ctx context.Context, e fsnotify.Event) error {
-	if _, err := r.DB.GetFile(ctx, e.Name); err != nil {
+	// the top of the tree itself is never sent
+	if _, err := r.DB.GetFile(ctx, e.Name); err != nil && !r.roots.isTop(e.Name) {
 		if !errors.Is(err, sql.ErrNoRows) {
 			return err
 		} else {
@@ -167,6 +214,9 @@ func (r *registry) handleDir(ctx context.Context, e fsnotify.Event) error {
 	}
 	for _, child := range childs {
 		childPath := path.Join(e.Name, child.Name())
+		if r.roots.internal(childPath) || r.skipped(childPath, child.IsDir()) {
+			continue
+		}
 		if !child.IsDir() {
 			if err := r.Write(ctx, fsnotify.Event{
 				Name: childPath,
@@ -195,6 +245,9 @@ func (r *registry) appendDir(path string) error {
 	for _, child := range childs {
 		if child.IsDir() {
 			newPath := filepath.Join(path, child.Name())
+			if r.roots.internal(newPath) || r.skipped(newPath, true) {
+				continue
+			}
 			if err := r.appendDir(newPath); err != nil {
 				return err
 			}
@@ -205,6 +258,11 @@ func (r *registry) appendDir(path string) error {
 	r.Lock()
 	r.watchedDir[path] = dir
 	r.Unlock()
+	if r.watcher == nil {
+		// mounted, the changes are reported
+		// by the filesystem itself
+		return nil
+	}
 	if err := r.watcher.Add(path); err != nil {
 		return err
 	}
@@ -0,0 +1,336 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// node is a file or a directory of the mount. Operations are
+// applied to the directory of the root, the local cache of the
+// server tree, and turned into events as they happen: no
+// watcher, and no debounce, stands in between.
+type node struct {
+	*fs.LoopbackNode
+	client *client
+	// outlives the requests the events are sent from
+	ctx context.Context
+
+	mu sync.Mutex
+	// the content changed since the last flush
+	dirty bool
+	// the file was created since the last flush
+	created bool
+}
+
+var (
+	_ fs.NodeWrapChilder    = (*node)(nil)
+	_ fs.NodeLookuper       = (*node)(nil)
+	_ fs.NodeOpendirHandler = (*node)(nil)
+	_ fs.NodeOpener         = (*node)(nil)
+	_ fs.NodeCreater        = (*node)(nil)
+	_ fs.NodeWriter         = (*node)(nil)
+	_ fs.NodeCopyFileRanger = (*node)(nil)
+	_ fs.NodeSetattrer      = (*node)(nil)
+	_ fs.NodeFlusher        = (*node)(nil)
+	_ fs.NodeMkdirer        = (*node)(nil)
+	_ fs.NodeUnlinker       = (*node)(nil)
+	_ fs.NodeRmdirer        = (*node)(nil)
+	_ fs.NodeRenamer        = (*node)(nil)
+	_ fs.NodeSymlinker      = (*node)(nil)
+	_ fs.NodeLinker         = (*node)(nil)
+	_ fs.NodeMknoder        = (*node)(nil)
+)
+
+// file is an open file of the mount. Its descriptor is kept from
+// the kernel, with passthrough writes would bypass the mount.
+type file struct {
+	*fs.LoopbackFile
+}
+
+func (f *file) PassthroughFd() (int, bool) {
+	return 0, false
+}
+
+func wrapFile(fh fs.FileHandle) fs.FileHandle {
+	if lf, ok := fh.(*fs.LoopbackFile); ok {
+		return &file{lf}
+	}
+	return fh
+}
+
+// mount serves the directory of the only root at dir until
+// it is unmounted, the client has to run without a watcher.
+func (c *client) mount(ctx context.Context, dir string) (*fuse.Server, error) {
+	var (
+		// changes made on the server show up
+		// without waiting for the kernel cache
+		timeout = time.Duration(0)
+		root    = &node{
+			LoopbackNode: &fs.LoopbackNode{RootData: &fs.LoopbackRoot{Path: c.registry.roots[0].local}},
+			client:       c,
+			ctx:          ctx,
+		}
+	)
+	server, err := fs.Mount(dir, root, &fs.Options{
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+		MountOptions: fuse.MountOptions{
+			FsName:      "harmony",
+			Name:        "harmony",
+			DirectMount: true,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+func (n *node) WrapChild(ctx context.Context, ops fs.InodeEmbedder) fs.InodeEmbedder {
+	return &node{
+		LoopbackNode: ops.(*fs.LoopbackNode),
+		client:       n.client,
+		ctx:          n.ctx,
+	}
+}
+
+// local returns the path of the child name in the directory
+// of the root, the path of the node itself when name is empty.
+func (n *node) local(name string) string {
+	return path.Join(n.RootData.Path, n.Path(nil), name)
+}
+
+// internal reports whether the child name is
+// among the partial files of the client.
+func (n *node) internal(name string) bool {
+	return n.client.registry.roots.internal(n.local(name))
+}
+
+// send hands the event to the registry like the watcher would,
+// the change is already made locally whatever happens to it.
+func (n *node) send(e fsnotify.Event) {
+	if err := n.client.registry.Receive(n.ctx, e); err != nil {
+		slog.Error("registry receive error", "err", err)
+	}
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if n.internal(name) {
+		return nil, syscall.ENOENT
+	}
+	return n.LoopbackNode.Lookup(ctx, name, out)
+}
+
+// OpendirHandle lists the directory, the internal
+// files of the client are left out.
+func (n *node) OpendirHandle(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	dir := n.local("")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, fs.ToErrno(err)
+	}
+	list := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		if n.internal(e.Name()) {
+			continue
+		}
+		mode := uint32(syscall.S_IFREG)
+		switch {
+		case e.IsDir():
+			mode = syscall.S_IFDIR
+		case e.Type()&os.ModeSymlink != 0:
+			mode = syscall.S_IFLNK
+		}
+		list = append(list, fuse.DirEntry{Name: e.Name(), Mode: mode})
+	}
+	return fs.NewListDirStream(list), 0, 0
+}
+
+// Open downloads the content of placeholders first,
+// reads are then served from the local copy.
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	p := n.local("")
+	base, known, err := n.client.registry.synced(ctx, p)
+	if err != nil {
+		return nil, 0, syscall.EIO
+	}
+	if known && base.Placeholder {
+		if err := n.client.fetch(ctx, p); err != nil && !errors.Is(err, ErrNotPlaceholder) {
+			slog.Error("error fetching placeholder", "path", p, "err", err)
+			return nil, 0, syscall.EIO
+		}
+	}
+	fh, fuseFlags, errno := n.LoopbackNode.Open(ctx, flags)
+	if errno == 0 && flags&syscall.O_TRUNC != 0 {
+		n.touch(false)
+	}
+	return wrapFile(fh), fuseFlags, errno
+}
+
+// touch records a change of the content,
+// it is sent when the file is flushed.
+func (n *node) touch(created bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dirty = true
+	n.created = n.created || created
+}
+
+func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	if n.internal(name) {
+		return nil, nil, 0, syscall.EPERM
+	}
+	inode, fh, fuseFlags, errno := n.LoopbackNode.Create(ctx, name, flags, mode, out)
+	if errno == 0 {
+		inode.Operations().(*node).touch(true)
+	}
+	return inode, wrapFile(fh), fuseFlags, errno
+}
+
+func (n *node) Write(ctx context.Context, f fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	w, ok := f.(fs.FileWriter)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	written, errno := w.Write(ctx, data, off)
+	if written > 0 {
+		n.touch(false)
+	}
+	return written, errno
+}
+
+func (n *node) CopyFileRange(ctx context.Context, fhIn fs.FileHandle, offIn uint64, out *fs.Inode, fhOut fs.FileHandle, offOut uint64, len uint64, flags uint64) (uint32, syscall.Errno) {
+	written, errno := n.LoopbackNode.CopyFileRange(ctx, fhIn, offIn, out, fhOut, offOut, len, flags)
+	if written > 0 {
+		if dest, ok := out.Operations().(*node); ok {
+			dest.touch(false)
+		}
+	}
+	return written, errno
+}
+
+// Setattr sends truncations made without opening the file
+// right away, the others wait for the flush. So are the
+// changes of mode.
+func (n *node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	errno := n.LoopbackNode.Setattr(ctx, f, in, out)
+	if errno != 0 {
+		return errno
+	}
+	if _, ok := in.GetMode(); ok {
+		n.send(fsnotify.Event{Name: n.local(""), Op: fsnotify.Chmod})
+	}
+	if _, ok := in.GetSize(); !ok {
+		return errno
+	}
+	if f != nil {
+		n.touch(false)
+	} else {
+		n.send(fsnotify.Event{Name: n.local(""), Op: fsnotify.Write})
+	}
+	return errno
+}
+
+// Flush sends the changes made to the file, it is
+// called on every close of one of its descriptors.
+func (n *node) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	var errno syscall.Errno
+	if flusher, ok := f.(fs.FileFlusher); ok {
+		errno = flusher.Flush(ctx)
+	}
+	n.mu.Lock()
+	dirty, created := n.dirty, n.created
+	n.dirty, n.created = false, false
+	n.mu.Unlock()
+	if !dirty {
+		return errno
+	}
+	op := fsnotify.Write
+	if created {
+		op = fsnotify.Create
+	}
+	n.send(fsnotify.Event{Name: n.local(""), Op: op})
+	return errno
+}
+
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if n.internal(name) {
+		return nil, syscall.EPERM
+	}
+	inode, errno := n.LoopbackNode.Mkdir(ctx, name, mode, out)
+	if errno == 0 {
+		n.send(fsnotify.Event{Name: n.local(name), Op: fsnotify.Create})
+	}
+	return inode, errno
+}
+
+func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
+	errno := n.LoopbackNode.Unlink(ctx, name)
+	if errno == 0 {
+		n.send(fsnotify.Event{Name: n.local(name), Op: fsnotify.Remove})
+	}
+	return errno
+}
+
+func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	errno := n.LoopbackNode.Rmdir(ctx, name)
+	if errno == 0 {
+		n.send(fsnotify.Event{Name: n.local(name), Op: fsnotify.Remove})
+	}
+	return errno
+}
+
+func (n *node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	dest, ok := newParent.(*node)
+	if !ok {
+		return syscall.EXDEV
+	}
+	if flags != 0 {
+		// exchanges and no-replace renames
+		// have no event to stand for them
+		return syscall.ENOTSUP
+	}
+	if dest.internal(newName) {
+		return syscall.EPERM
+	}
+	errno := n.LoopbackNode.Rename(ctx, name, dest.LoopbackNode, newName, flags)
+	if errno == 0 {
+		n.send(fsnotify.Event{
+			Name:        dest.local(newName),
+			Op:          fsnotify.Rename,
+			RenamedFrom: n.local(name),
+		})
+	}
+	return errno
+}
+
+func (n *node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if n.internal(name) {
+		return nil, syscall.EPERM
+	}
+	inode, errno := n.LoopbackNode.Symlink(ctx, target, name, out)
+	if errno == 0 {
+		n.send(fsnotify.Event{Name: n.local(name), Op: fsnotify.Create})
+	}
+	return inode, errno
+}
+
+// hard links and special files can't be synced
+
+func (n *node) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return nil, syscall.ENOTSUP
+}
+
+func (n *node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return nil, syscall.ENOTSUP
+}
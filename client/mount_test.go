@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+func TestMount(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		ctx  = context.Background()
+		tmp  = t.TempDir()
+		mnt  = path.Join(tmp, "mnt")
+		next = func(r *registry) shared.FileEvent {
+			select {
+			case msg := <-r.msgBuffer:
+				return decodeEvent(t, msg)
+			default:
+				t.Fatal("no event sent")
+			}
+			return shared.FileEvent{}
+		}
+	)
+	db, err := makeDB(path.Join(tmp, "test.db"), "sqlite")
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, os.Mkdir(storage, 0777))
+	require.NoError(t, os.Mkdir(mnt, 0777))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("remote"))
+	}))
+	defer ts.Close()
+
+	r := newRegistry(nil, db)
+	c := &client{
+		registry: r,
+		url:      "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws",
+		Hub:      shared.NewClientHub(),
+	}
+	require.NoError(t, r.appendDir(storage))
+	server, err := c.mount(ctx, mnt)
+	if err != nil {
+		t.Skip("FUSE is unavailable: ", err)
+	}
+	defer server.Unmount()
+
+	// changes are sent as soon as they are made
+	require.NoError(t, os.WriteFile(path.Join(mnt, "a.txt"), []byte("hello"), 0666))
+	event := next(r)
+	require.Equal(t, fsnotify.Create.String(), event.Op)
+	require.Equal(t, path.Join(storage, "a.txt"), event.Path)
+	require.Equal(t, []byte("hello"), event.Data)
+	content, err := os.ReadFile(path.Join(storage, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+	require.NoError(t, r.track(ctx, &event, 1))
+
+	require.NoError(t, os.Mkdir(path.Join(mnt, "docs"), 0777))
+	event = next(r)
+	require.Equal(t, fsnotify.Create.String(), event.Op)
+	require.True(t, event.IsDir)
+	require.NoError(t, r.track(ctx, &event, 1))
+
+	require.NoError(t, os.Rename(path.Join(mnt, "a.txt"), path.Join(mnt, "docs", "a.txt")))
+	event = next(r)
+	require.Equal(t, fsnotify.Rename.String(), event.Op)
+	require.Equal(t, path.Join(storage, "a.txt"), event.Path)
+	require.Equal(t, path.Join(storage, "docs", "a.txt"), event.NewPath)
+	require.NoError(t, r.track(ctx, &event, 1))
+
+	f, err := os.OpenFile(path.Join(mnt, "docs", "a.txt"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(" world")
+	require.NoError(t, err)
+	require.Empty(t, r.msgBuffer, "writes are sent on close")
+	require.NoError(t, f.Close())
+	event = next(r)
+	require.Equal(t, fsnotify.Write.String(), event.Op)
+	require.Equal(t, []byte("hello world"), event.Data)
+
+	require.NoError(t, r.track(ctx, &event, 2))
+
+	// so are the links and the modes
+	require.NoError(t, os.Chmod(path.Join(mnt, "docs", "a.txt"), 0700))
+	event = next(r)
+	require.Equal(t, fsnotify.Write.String(), event.Op)
+	require.Equal(t, uint32(0700), event.Mode)
+	require.NoError(t, os.Symlink("a.txt", path.Join(mnt, "docs", "link")))
+	event = next(r)
+	require.Equal(t, fsnotify.Create.String(), event.Op)
+	require.True(t, event.Link)
+	require.Equal(t, []byte("a.txt"), event.Data)
+
+	require.NoError(t, os.Remove(path.Join(mnt, "docs", "a.txt")))
+	event = next(r)
+	require.Equal(t, fsnotify.Remove.String(), event.Op)
+	require.Equal(t, path.Join(storage, "docs", "a.txt"), event.Path)
+
+	// placeholders are fetched when opened
+	b := path.Join(storage, "b.txt")
+	require.NoError(t, r.placeholder(ctx, &shared.FileEvent{Path: b, Hash: sum("remote")}, 1))
+	content, err = os.ReadFile(path.Join(mnt, "b.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "remote", string(content))
+	require.Empty(t, r.msgBuffer)
+
+	// the internal files of the client don't show
+	_, err = os.Stat(path.Join(storage, shared.TmpDir))
+	require.NoError(t, err)
+	entries, err := os.ReadDir(mnt)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.NotEqual(t, shared.TmpDir, e.Name())
+	}
+	_, err = os.Stat(path.Join(mnt, shared.TmpDir))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,376 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/thesicktwist1/harmony/shared"
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+// outbox keeps track of the persisted events
+// that are currently travelling through msgBuffer.
+type outbox struct {
+	// events handed to the connection
+	// and not yet acknowledged by the server
+	inflight map[int64]struct{}
+
+	// events replaced by a newer one while
+	// they were still waiting in msgBuffer
+	superseded map[int64]struct{}
+
+	// set when an event couldn't be pushed to
+	// msgBuffer, the outbox has to be replayed
+	overflow bool
+}
+
+func newOutbox() outbox {
+	return outbox{
+		inflight:   make(map[int64]struct{}),
+		superseded: make(map[int64]struct{}),
+	}
+}
+
+// coalescable reports whether pending events with
+// the given operation can be replaced by a newer one.
+func coalescable(op string) bool {
+	return op == fsnotify.Write.String() || op == shared.Update
+}
+
+// enqueue appends the event to the outbox before
+// handing it to msgBuffer. If msgBuffer is full the
+// event stays in the outbox and gets replayed later.
+func (r *registry) enqueue(event *shared.FileEvent) error {
+	ctx := context.Background()
+
+	r.Lock()
+	defer r.Unlock()
+
+	// the outbox and the files table change together, a crash
+	// in between would leave them out of step for the replay
+	var replaced int64
+	if err := r.DB.Tx(ctx, func(db *database.Queries) error {
+		if coalescable(event.Op) {
+			last, err := db.GetLastOutboxForPath(ctx, database.GetLastOutboxForPathParams{
+				Path:    event.Path,
+				Newpath: event.Path,
+			})
+			if err != nil {
+				if !errors.Is(err, sql.ErrNoRows) {
+					return err
+				}
+			} else if _, sent := r.outbox.inflight[last.ID]; last.Op == event.Op && !sent {
+				var previous shared.FileEvent
+				if err := json.Unmarshal(last.Payload, &previous); err != nil {
+					return err
+				}
+				if err := db.DeleteOutbox(ctx, last.ID); err != nil {
+					return err
+				}
+				replaced = last.ID
+				// the replaced write never reaches the server,
+				// the new one is based on the same revision
+				event.Revision = previous.Revision
+			}
+		}
+
+		event.ID = 0
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		id, err := db.AppendOutbox(ctx, database.AppendOutboxParams{
+			Path:      event.Path,
+			Newpath:   event.NewPath,
+			Op:        event.Op,
+			Payload:   data,
+			Createdat: time.Now().Format(shared.TimeLayout),
+		})
+		if err != nil {
+			return err
+		}
+		event.ID = id
+
+		// the files table holds the state the server will be in
+		// once it applies the event, the writes that follow are
+		// based on it without waiting for the acknowledgement
+		switch event.Op {
+		case fsnotify.Create.String():
+			return trackRows(ctx, db, event, 1)
+		case fsnotify.Write.String():
+			return trackRows(ctx, db, event, event.Revision+1)
+		case fsnotify.Rename.String(), fsnotify.Remove.String():
+			return trackRows(ctx, db, event, 0)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if replaced != 0 {
+		r.outbox.superseded[replaced] = struct{}{}
+	}
+
+	payload, err := shared.MarshalEnvl(event, shared.Event)
+	if err != nil {
+		return err
+	}
+	select {
+	case r.msgBuffer <- payload:
+	default:
+		r.outbox.overflow = true
+	}
+	return nil
+}
+
+// pending drains msgBuffer and returns every persisted
+// event that hasn't been handed to the connection yet,
+// in the order they were recorded.
+func (r *registry) pending(ctx context.Context) ([][]byte, error) {
+	if r.DB == nil {
+		return nil, nil
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	for drained := false; !drained; {
+		select {
+		case <-r.msgBuffer:
+		default:
+			drained = true
+		}
+	}
+	r.outbox.overflow = false
+	clear(r.outbox.superseded)
+
+	rows, err := r.DB.ListOutbox(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payloads := make([][]byte, 0, len(rows))
+	for _, row := range rows {
+		if _, sent := r.outbox.inflight[row.ID]; sent {
+			continue
+		}
+		var event shared.FileEvent
+		if err := json.Unmarshal(row.Payload, &event); err != nil {
+			return nil, fmt.Errorf("outbox entry %d: %w", row.ID, err)
+		}
+		event.ID = row.ID
+		payload, err := shared.MarshalEnvl(&event, shared.Event)
+		if err != nil {
+			return nil, err
+		}
+		r.outbox.inflight[row.ID] = struct{}{}
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+// take marks the event as handed to the connection,
+// it returns false if the event was superseded and
+// must not be sent.
+func (r *registry) take(id int64) bool {
+	if id == 0 {
+		return true
+	}
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.outbox.superseded[id]; ok {
+		delete(r.outbox.superseded, id)
+		return false
+	}
+	r.outbox.inflight[id] = struct{}{}
+	return true
+}
+
+// ack removes an event acknowledged
+// by the server from the outbox.
+func (r *registry) ack(ctx context.Context, id int64) error {
+	if id == 0 || r.DB == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	delete(r.outbox.inflight, id)
+	return r.DB.DeleteOutbox(ctx, id)
+}
+
+// acked handles an event acknowledged by the server, the
+// revision it resulted in is kept unless a later event on
+// the same path is waiting to be acknowledged.
+func (r *registry) acked(ctx context.Context, res shared.Result) error {
+	if res.ID == 0 || r.DB == nil || res.Revision == 0 {
+		return r.ack(ctx, res.ID)
+	}
+	last, err := r.DB.GetLastOutboxForPath(ctx, database.GetLastOutboxForPathParams{
+		Path:    res.Path,
+		Newpath: res.Path,
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil && last.ID == res.ID {
+		file, known, err := r.synced(ctx, res.Path)
+		if err != nil {
+			return err
+		}
+		if known && !file.Isdir && file.Revision != res.Revision {
+			if err := r.DB.UpdateFile(ctx, database.UpdateFileParams{
+				Hash:      file.Hash,
+				Updatedat: time.Now().Format(shared.TimeLayout),
+				Revision:  res.Revision,
+				Path:      res.Path,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return r.ack(ctx, res.ID)
+}
+
+// nack handles an event rejected by the server, the
+// event is either retried, backed up or dropped.
+func (r *registry) nack(ctx context.Context, res shared.Result) error {
+	if res.ID == 0 || r.DB == nil {
+		slog.Error("event rejected by server", "path", res.Path, "code", res.Code, "err", res.Message)
+		return nil
+	}
+	row, err := r.DB.GetOutbox(ctx, res.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	var event shared.FileEvent
+	if err := json.Unmarshal(row.Payload, &event); err != nil {
+		return err
+	}
+	switch res.Code {
+	case shared.CodeInternal:
+		// transient failure, the event stays in
+		// the outbox and is part of the next replay
+		r.Lock()
+		delete(r.outbox.inflight, res.ID)
+		r.outbox.overflow = true
+		r.Unlock()
+		return nil
+	case shared.CodeNotExist:
+		if event.Op == fsnotify.Write.String() {
+			// the server doesn't know the file, upload it again
+			if err := r.ack(ctx, res.ID); err != nil {
+				return err
+			}
+			event.Op = fsnotify.Create.String()
+			return r.broadcastEvent(&event)
+		}
+	case shared.CodeUnknownContent:
+		// the server doesn't have the content
+		// the event was sent without, send it along
+		if err := r.ack(ctx, res.ID); err != nil {
+			return err
+		}
+		stat, err := os.Stat(event.Path)
+		if err != nil {
+			slog.Error("error reading file", "path", event.Path, "err", err)
+			return nil
+		}
+		event.Dedup = false
+		if stat.Size() > shared.ChunkThreshold {
+			event.Chunked = true
+		} else {
+			data, err := os.ReadFile(event.Path)
+			if err != nil {
+				slog.Error("error reading file", "path", event.Path, "err", err)
+				return nil
+			}
+			if event.Hash, err = r.hash(bytes.NewReader(data)); err != nil {
+				return err
+			}
+			event.Data = data
+		}
+		return r.broadcastEvent(&event)
+	case shared.CodeConflict:
+		// the file changed on the server since the revision the
+		// event is based on, the server's revision wins and the
+		// local one is kept as a conflict copy
+		if err := r.ack(ctx, res.ID); err != nil {
+			return err
+		}
+		if _, err := os.Stat(event.Path); err == nil {
+			if err := r.conflictCopy(ctx, event.Path); err != nil {
+				slog.Error("error making conflict copy", "err", err)
+			}
+		}
+		slog.Error("conflicting revision, keeping the server's one", "path", event.Path, "revision", res.Revision)
+		return r.broadcastEvent(&shared.FileEvent{
+			Path: event.Path,
+			Op:   shared.Update,
+		})
+	case shared.CodeReadOnly:
+		// the folder is shared read-only with us, changed
+		// or removed files are put back as the server has them
+		changed := event.Op == fsnotify.Write.String() || event.Op == fsnotify.Remove.String()
+		if changed && !event.IsDir {
+			if err := r.ack(ctx, res.ID); err != nil {
+				return err
+			}
+			slog.Error("read-only folder, restoring the server's copy", "path", event.Path)
+			return r.broadcastEvent(&shared.FileEvent{
+				Path: event.Path,
+				Op:   shared.Update,
+			})
+		}
+	case shared.CodeExist, shared.CodeMalformedEvent:
+		// the local copy diverged from the server, it is moved
+		// aside and the next tree sync restores the server's one
+		p := event.Path
+		if event.Op == fsnotify.Rename.String() {
+			p = event.NewPath
+		}
+		if _, err := os.Stat(p); err == nil {
+			if err := r.MoveToBackUp(p, path.Base(p)); err != nil {
+				slog.Error("error moving file to backup", "err", err)
+			}
+		}
+	}
+	slog.Error("event rejected by server", "op", event.Op, "path", event.Path, "code", res.Code, "err", res.Message)
+	return r.ack(ctx, res.ID)
+}
+
+// resetOutbox forgets about unacknowledged events, called
+// when a connection is lost so that they get replayed.
+func (r *registry) resetOutbox() {
+	r.Lock()
+	defer r.Unlock()
+	clear(r.outbox.inflight)
+}
+
+func (r *registry) overflowed() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.outbox.overflow
+}
+
+// peekEvent decodes the event carried by an
+// envelope, nil if the envelope isn't an event.
+func peekEvent(payload []byte) *shared.FileEvent {
+	var env shared.Envelope
+	if err := json.Unmarshal(payload, &env); err != nil || env.Type != shared.Event {
+		return nil
+	}
+	var event shared.FileEvent
+	if err := json.Unmarshal(env.Message, &event); err != nil {
+		return nil
+	}
+	return &event
+}
@@ -0,0 +1,341 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+func decodeEvent(t *testing.T, payload []byte) shared.FileEvent {
+	var env shared.Envelope
+	require.NoError(t, json.Unmarshal(payload, &env))
+	require.Equal(t, shared.Event, env.Type)
+	var event shared.FileEvent
+	require.NoError(t, json.Unmarshal(env.Message, &event))
+	return event
+}
+
+func TestOutbox(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dbPath = path.Join(t.TempDir(), "test.db")
+		file   = path.Join(storage, "file.txt")
+		other  = path.Join(storage, "other.txt")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	r := newRegistry(nil, db)
+
+	events := []*shared.FileEvent{
+		{Path: file, Op: fsnotify.Write.String(), Data: []byte("1")},
+		{Path: other, Op: fsnotify.Create.String()},
+		{Path: file, Op: fsnotify.Write.String(), Data: []byte("2")},
+		{Path: file, Op: fsnotify.Write.String(), Data: []byte("3")},
+	}
+	for _, e := range events {
+		require.NoError(t, r.broadcastEvent(e))
+	}
+
+	// the first write is still the tail of file.txt
+	// (other.txt doesn't count) so it is coalesced too
+	rows, err := db.ListOutbox(ctx)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	require.Equal(t, other, rows[0].Path)
+	require.Equal(t, file, rows[1].Path)
+
+	// superseded events waiting in msgBuffer are skipped
+	var sent []shared.FileEvent
+	for range events {
+		msg := <-r.msgBuffer
+		if r.take(peekEvent(msg).ID) {
+			sent = append(sent, decodeEvent(t, msg))
+		}
+	}
+	require.Len(t, sent, 2)
+	require.Equal(t, other, sent[0].Path)
+	require.Equal(t, []byte("3"), sent[1].Data)
+
+	// in flight events are not coalesced
+	require.NoError(t, r.broadcastEvent(&shared.FileEvent{
+		Path: file,
+		Op:   fsnotify.Write.String(),
+		Data: []byte("4"),
+	}))
+	rows, err = db.ListOutbox(ctx)
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+
+	// a lost connection replays everything still
+	// in the outbox, in order, without duplicates
+	r.resetOutbox()
+	payloads, err := r.pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, payloads, 3)
+	require.Empty(t, r.msgBuffer)
+
+	var ids []int64
+	for _, p := range payloads {
+		ids = append(ids, decodeEvent(t, p).ID)
+	}
+	require.IsIncreasing(t, ids)
+	require.Equal(t, []byte("4"), decodeEvent(t, payloads[2]).Data)
+
+	for _, id := range ids {
+		require.NoError(t, r.ack(ctx, id))
+	}
+	rows, err = db.ListOutbox(ctx)
+	require.NoError(t, err)
+	require.Empty(t, rows)
+}
+
+func TestOutboxOverflow(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dbPath = path.Join(t.TempDir(), "test.db")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	r := newRegistry(nil, db)
+
+	for i := range bufferSize + 10 {
+		require.NoError(t, r.broadcastEvent(&shared.FileEvent{
+			Path: path.Join(storage, "dir", string(rune('a'+i%26)), "file"),
+			Op:   fsnotify.Create.String(),
+		}))
+	}
+	require.True(t, r.overflowed())
+
+	payloads, err := r.pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, payloads, bufferSize+10)
+	require.False(t, r.overflowed())
+
+	// nothing left to replay once everything is in flight
+	payloads, err = r.pending(ctx)
+	require.NoError(t, err)
+	require.Empty(t, payloads)
+}
+
+func TestOutboxNack(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		ctx    = context.Background()
+		tmp    = t.TempDir()
+		dbPath = path.Join(tmp, "test.db")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	require.NoError(t, initTMP(tmp))
+	require.NoError(t, os.MkdirAll(backup, 0777))
+
+	r := newRegistry(nil, db)
+	r.name = "laptop"
+
+	send := func(e *shared.FileEvent) int64 {
+		require.NoError(t, r.broadcastEvent(e))
+		msg := <-r.msgBuffer
+		require.True(t, r.take(peekEvent(msg).ID))
+		return e.ID
+	}
+
+	// transient errors keep the event for the next replay
+	id := send(&shared.FileEvent{Path: path.Join(storage, "dir-2"), Op: fsnotify.Create.String(), IsDir: true})
+	require.NoError(t, r.nack(ctx, shared.Result{ID: id, Code: shared.CodeInternal}))
+	require.True(t, r.overflowed())
+	payloads, err := r.pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, payloads, 1)
+	require.NoError(t, r.ack(ctx, id))
+
+	// writes to a file unknown to the server are sent as creates
+	id = send(&shared.FileEvent{Path: path.Join(storage, "test-2.txt"), Op: fsnotify.Write.String(), Data: []byte("data")})
+	require.NoError(t, r.nack(ctx, shared.Result{ID: id, Code: shared.CodeNotExist}))
+	retry := decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, fsnotify.Create.String(), retry.Op)
+	require.Equal(t, []byte("data"), retry.Data)
+	require.NoError(t, r.ack(ctx, retry.ID))
+
+	// content unknown to the server is sent along
+	id = send(&shared.FileEvent{Path: path.Join(storage, "test-2.txt"), Op: fsnotify.Write.String(), Hash: "hash", Dedup: true})
+	require.NoError(t, r.nack(ctx, shared.Result{ID: id, Code: shared.CodeUnknownContent}))
+	retry = decodeEvent(t, <-r.msgBuffer)
+	require.False(t, retry.Dedup)
+	data, err := os.ReadFile(path.Join(storage, "test-2.txt"))
+	require.NoError(t, err)
+	require.Equal(t, data, retry.Data)
+	require.NoError(t, r.ack(ctx, retry.ID))
+
+	// conflicting writes keep the local file as a
+	// conflict copy and ask for the server's revision
+	conflicted := path.Join(storage, "dir-1", "test-1.txt")
+	require.NoError(t, os.WriteFile(conflicted, []byte("mine"), 0777))
+	id = send(&shared.FileEvent{Path: conflicted, Op: fsnotify.Write.String(), Data: []byte("mine"), Revision: 1})
+	require.NoError(t, r.nack(ctx, shared.Result{ID: id, Code: shared.CodeConflict, Revision: 2}))
+	copied := decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, fsnotify.Create.String(), copied.Op)
+	require.Equal(t, conflictName(conflicted, r.name, time.Now(), 1), copied.Path)
+	require.Equal(t, conflicted, copied.ConflictOf)
+	require.Equal(t, []byte("mine"), copied.Data)
+	data, err = os.ReadFile(copied.Path)
+	require.NoError(t, err)
+	require.Equal(t, []byte("mine"), data)
+	update := decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, shared.Update, update.Op)
+	require.Equal(t, conflicted, update.Path)
+	require.NoError(t, r.ack(ctx, copied.ID))
+	require.NoError(t, r.ack(ctx, update.ID))
+
+	// local changes to read-only folders are undone
+	id = send(&shared.FileEvent{Path: conflicted, Op: fsnotify.Write.String(), Data: []byte("mine"), Revision: 2})
+	require.NoError(t, r.nack(ctx, shared.Result{ID: id, Code: shared.CodeReadOnly}))
+	update = decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, shared.Update, update.Op)
+	require.Equal(t, conflicted, update.Path)
+	require.NoError(t, r.ack(ctx, update.ID))
+
+	// diverging local copies are moved to the backup
+	id = send(&shared.FileEvent{Path: path.Join(storage, "test-2.txt"), Op: fsnotify.Create.String()})
+	require.NoError(t, r.nack(ctx, shared.Result{ID: id, Code: shared.CodeMalformedEvent}))
+	_, err = os.Stat(path.Join(storage, "test-2.txt"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	entries, err := os.ReadDir(backup)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	rows, err := db.ListOutbox(ctx)
+	require.NoError(t, err)
+	require.Empty(t, rows)
+}
+
+func TestOutboxRevisions(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dbPath = path.Join(t.TempDir(), "test.db")
+		file   = path.Join(storage, "file.txt")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	r := newRegistry(nil, db)
+
+	revision := func() int64 {
+		row, err := db.GetFile(ctx, file)
+		require.NoError(t, err)
+		return row.Revision
+	}
+	send := func(e *shared.FileEvent) int64 {
+		require.NoError(t, r.broadcastEvent(e))
+		msg := <-r.msgBuffer
+		require.True(t, r.take(peekEvent(msg).ID))
+		return e.ID
+	}
+
+	// the revisions the server will give are
+	// tracked as soon as the events are recorded
+	created := send(&shared.FileEvent{Path: file, Op: fsnotify.Create.String(), Hash: "1"})
+	require.Equal(t, int64(1), revision())
+	written := send(&shared.FileEvent{Path: file, Op: fsnotify.Write.String(), Hash: "2", Revision: 1})
+	require.Equal(t, int64(2), revision())
+
+	// a coalesced write keeps the base of the one it replaces
+	require.NoError(t, r.broadcastEvent(&shared.FileEvent{Path: file, Op: fsnotify.Write.String(), Hash: "3", Revision: 2}))
+	require.NoError(t, r.broadcastEvent(&shared.FileEvent{Path: file, Op: fsnotify.Write.String(), Hash: "4", Revision: 3}))
+	rows, err := db.ListOutbox(ctx)
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	var pending shared.FileEvent
+	require.NoError(t, json.Unmarshal(rows[2].Payload, &pending))
+	require.Equal(t, int64(2), pending.Revision)
+	require.Equal(t, int64(3), revision())
+
+	// acknowledgements don't override the
+	// revision expected by later events
+	require.NoError(t, r.acked(ctx, shared.Result{ID: created, Path: file, Revision: 1}))
+	require.NoError(t, r.acked(ctx, shared.Result{ID: written, Path: file, Revision: 2}))
+	require.Equal(t, int64(3), revision())
+	require.NoError(t, r.acked(ctx, shared.Result{ID: rows[2].ID, Path: file, Revision: 5}))
+	require.Equal(t, int64(5), revision())
+
+	// removes forget about the file
+	require.NoError(t, r.broadcastEvent(&shared.FileEvent{Path: file, Op: fsnotify.Remove.String()}))
+	_, err = db.GetFile(ctx, file)
+	require.Error(t, err)
+}
+
+func TestUploadNack(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		tmp   = t.TempDir()
+		src   = path.Join(tmp, "big.bin")
+		begun = make(chan shared.TransferBegin, 1)
+	)
+	require.NoError(t, os.WriteFile(src, []byte(strings.Repeat("data", 1024)), 0777))
+
+	// reads the Begin and never answers it
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		_, msg, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+		var (
+			env   shared.Envelope
+			begin shared.TransferBegin
+		)
+		if json.Unmarshal(msg, &env) != nil || json.Unmarshal(env.Message, &begin) != nil {
+			return
+		}
+		begun <- begin
+		conn.Read(ctx)
+	}))
+	defer ts.Close()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.CloseNow()
+
+	c := NewClient(nil, nil, "laptop")
+	c.setRoots(roots{{local: tmp, remote: shared.Root}})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.upload(ctx, conn, &shared.FileEvent{ID: 3, Path: src, Op: fsnotify.Create.String()})
+	}()
+	begin := <-begun
+	require.NotEmpty(t, begin.Manifest)
+	require.Equal(t, int64(3), begin.Event.ID)
+
+	// a Nack of the Begin ends the upload right away
+	c.abortUpload(begin.Event.ID)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload still waiting for the server")
+	}
+	require.Empty(t, c.wants)
+	require.Empty(t, c.uploads)
+	// and the ones already done are left alone
+	c.abortUpload(begin.Event.ID)
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+var (
+	ErrNotPlaceholder = errors.New("registry: not a placeholder")
+	ErrStaleContent   = errors.New("registry: content changed on the server")
+)
+
+// missing handles a file of the server that is missing locally,
+// its content is requested or, in online-only mode, left on the
+// server behind a placeholder.
+func (r *registry) missing(ctx context.Context, node *shared.FSNode) error {
+	if node.Link && !r.keepLinks {
+		base, known, err := r.synced(ctx, node.Path)
+		if err != nil {
+			return err
+		}
+		if known && base.Placeholder && base.Hash == node.Hash {
+			// left out by the link policy
+			return nil
+		}
+	} else if r.onlineOnly && !node.Link {
+		return r.placeholder(ctx, &shared.FileEvent{
+			Path:    node.Path,
+			Hash:    node.Hash,
+			Mode:    node.Mode,
+			ModTime: node.ModTime,
+		}, node.Revision)
+	}
+	return r.broadcastEvent(&shared.FileEvent{
+		Path: node.Path,
+		Op:   shared.Update,
+	})
+}
+
+// placeholder stands for the file of the event until it is
+// fetched: an empty file whose row holds the state of the
+// server. A file already there is left as it is.
+func (r *registry) placeholder(ctx context.Context, event *shared.FileEvent, revision int64) error {
+	// recorded first so that the watcher
+	// doesn't send the empty file
+	if err := r.record(ctx, event, revision, true); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(event.Path, os.O_WRONLY|os.O_CREATE, 0777)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// stubbed reports whether the content of an event received
+// from the server is left there, in online-only mode only the
+// files that were fetched are kept up to date.
+func (r *registry) stubbed(ctx context.Context, event *shared.FileEvent) (bool, error) {
+	if !r.onlineOnly || event.IsDir || event.Link {
+		// links have no content to leave behind
+		return false, nil
+	}
+	if event.Op != fsnotify.Create.String() && event.Op != fsnotify.Write.String() {
+		// Update is only sent back to the
+		// clients asking for the content
+		return false, nil
+	}
+	base, known, err := r.synced(ctx, event.Path)
+	if err != nil {
+		return false, err
+	}
+	return !known || base.Placeholder, nil
+}
+
+// leftOut reports whether the event makes a link leading out of
+// its root, they are only created when the device keeps them.
+func (r *registry) leftOut(event *shared.FileEvent) bool {
+	if !event.Link || r.keepLinks {
+		return false
+	}
+	switch event.Op {
+	case fsnotify.Create.String(), fsnotify.Write.String(), shared.Update:
+		return r.roots.escapes(event.Path, string(event.Data))
+	}
+	return false
+}
+
+// leaveOut records the link of the event without making it, like
+// placeholders. The file it replaces is moved to the backups.
+func (r *registry) leaveOut(ctx context.Context, event *shared.FileEvent) error {
+	slog.Warn("link leading out of its root left out", "path", event.Path)
+	if err := r.record(ctx, event, event.Revision, true); err != nil {
+		return err
+	}
+	if stat, err := os.Lstat(event.Path); err == nil && !stat.IsDir() {
+		return r.MoveToBackUp(event.Path, stat.Name())
+	}
+	return nil
+}
+
+// apply processes and tracks an event received from the
+// server, the files that weren't fetched only get their
+// row updated.
+func (c *client) apply(ctx context.Context, event *shared.FileEvent) error {
+	if c.registry.leftOut(event) {
+		return c.registry.leaveOut(ctx, event)
+	}
+	stubbed, err := c.registry.stubbed(ctx, event)
+	if err != nil {
+		return err
+	}
+	if stubbed {
+		return c.registry.placeholder(ctx, event, event.Revision)
+	}
+	if err := c.Process(ctx, event); err != nil {
+		return err
+	}
+	return c.registry.track(ctx, event, event.Revision)
+}
+
+// fetch downloads the content of the placeholder at p, the
+// placeholder is replaced once the content is checked against
+// the hash of its row.
+func (c *client) fetch(ctx context.Context, p string) error {
+	r := c.registry
+	base, known, err := r.synced(ctx, p)
+	if err != nil {
+		return err
+	}
+	if !known || !base.Placeholder || base.Link {
+		return fmt.Errorf("%w: %s", ErrNotPlaceholder, p)
+	}
+	wire, ok := r.roots.wire(p)
+	if !ok {
+		return fmt.Errorf("%w: %s", errNoRoot, p)
+	}
+	root, _ := r.roots.of(p)
+	remote := c.remote()
+	resp, err := remote.send(ctx, http.MethodGet, "content", url.Values{"path": {remote.seal(wire)}}, nil)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", p, err)
+	}
+	defer resp.Body.Close()
+
+	dir := root.tmpDir()
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "*.fetch")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// the row is updated by the events
+	// of the writes made since
+	if hex.EncodeToString(hasher.Sum(nil)) != base.Hash {
+		return fmt.Errorf("%w: %s", ErrStaleContent, p)
+	}
+	src := tmp.Name()
+	if r.vault != nil {
+		if src, err = r.vault.openFile(dir, src); err != nil {
+			return err
+		}
+		defer os.Remove(src)
+	}
+	// tracked first so that the watcher takes
+	// the new content for the synced one
+	event := &shared.FileEvent{Path: p, Hash: base.Hash, Mode: uint32(base.Mode), ModTime: base.Modtime}
+	if err := r.record(ctx, event, base.Revision, false); err != nil {
+		return err
+	}
+	if err := os.Rename(src, p); err != nil {
+		// the empty file must not be taken for the content
+		r.record(ctx, event, base.Revision, true)
+		return err
+	}
+	return shared.ApplyMetadata(event)
+}
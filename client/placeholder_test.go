@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+func sum(data string) string {
+	hash := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestPlaceholder(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		ctx   = context.Background()
+		tmp   = t.TempDir()
+		docs  = path.Join(storage, "docs")
+		a     = path.Join(docs, "a.txt")
+		b     = path.Join(docs, "b.txt")
+		c     = path.Join(docs, "c.txt")
+		token = "device-token"
+		// content of the server
+		remote = map[string]string{a: "second", b: "changed since"}
+	)
+	db, err := makeDB(path.Join(tmp, "test.db"), "sqlite")
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, os.Mkdir(storage, 0777))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/content" || r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		content, ok := remote[r.URL.Query().Get("path")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer ts.Close()
+
+	r := newRegistry(nil, db)
+	r.onlineOnly = true
+	client := &client{
+		registry: r,
+		url:      "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws",
+		token:    token,
+		Hub:      shared.NewClientHub(),
+	}
+	placeholder := func(p, hash string, revision int64) {
+		t.Helper()
+		stat, err := os.Stat(p)
+		require.NoError(t, err)
+		require.Zero(t, stat.Size())
+		f, err := db.GetFile(ctx, p)
+		require.NoError(t, err)
+		require.True(t, f.Placeholder)
+		require.Equal(t, hash, f.Hash)
+		require.Equal(t, revision, f.Revision)
+	}
+
+	// the files of the tree are left on the server
+	r.SyncTree(ctx, &shared.FSNode{Path: storage, IsDir: true, Childs: map[string]*shared.FSNode{
+		"docs": {Path: docs, IsDir: true, Childs: map[string]*shared.FSNode{
+			"a.txt": {Path: a, Hash: sum("first"), Revision: 1},
+		}},
+	}})
+	placeholder(a, sum("first"), 1)
+	require.Empty(t, r.msgBuffer)
+
+	// placeholders are not sent back
+	require.NoError(t, r.Write(ctx, fsnotify.Event{Name: a, Op: fsnotify.Create}))
+	require.Empty(t, r.msgBuffer)
+
+	// only the rows of the files that weren't fetched are updated
+	for _, event := range []shared.FileEvent{
+		{Path: a, Op: fsnotify.Write.String(), Hash: sum("second"), Data: []byte("second"), Revision: 2},
+		{Path: b, Op: fsnotify.Create.String(), Hash: sum("created"), Data: []byte("created"), Revision: 1},
+	} {
+		require.NoError(t, client.apply(ctx, &event))
+	}
+	placeholder(a, sum("second"), 2)
+	placeholder(b, sum("created"), 1)
+
+	// fetched on demand
+	require.NoError(t, client.fetch(ctx, a))
+	content, err := os.ReadFile(a)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(content))
+	f, err := db.GetFile(ctx, a)
+	require.NoError(t, err)
+	require.False(t, f.Placeholder)
+	require.NoError(t, r.Write(ctx, fsnotify.Event{Name: a, Op: fsnotify.Write}))
+	require.Empty(t, r.msgBuffer)
+	require.ErrorIs(t, client.fetch(ctx, a), ErrNotPlaceholder)
+
+	// the content has to match the row
+	require.ErrorIs(t, client.fetch(ctx, b), ErrStaleContent)
+	placeholder(b, sum("created"), 1)
+
+	// written to before being fetched, the local content is kept
+	// as a conflict copy and the server's is requested
+	require.NoError(t, os.WriteFile(b, []byte("local"), 0777))
+	require.NoError(t, r.Write(ctx, fsnotify.Event{Name: b, Op: fsnotify.Write}))
+	event := decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, fsnotify.Create.String(), event.Op)
+	require.Equal(t, b, event.ConflictOf)
+	event = decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, shared.Update, event.Op)
+	require.Equal(t, b, event.Path)
+
+	// out of online-only mode, placeholders are filled
+	require.NoError(t, r.placeholder(ctx, &shared.FileEvent{Path: c, Hash: sum("c")}, 1))
+	r.onlineOnly = false
+	r.SyncTree(ctx, &shared.FSNode{Path: c, Hash: sum("c"), Revision: 1})
+	event = decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, shared.Update, event.Op)
+	require.Equal(t, c, event.Path)
+}
+
+func TestEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"ws://localhost:8080/ws":       "http://localhost:8080/content?path=storage%2Fa+b.txt",
+		"wss://example.com/harmony/ws": "https://example.com/harmony/content?path=storage%2Fa+b.txt",
+	}
+	for serverURL, want := range tests {
+		got, err := endpoint(serverURL, "content", url.Values{"path": {"storage/a b.txt"}})
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
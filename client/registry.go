@@ -1,16 +1,21 @@
-package main
+package client
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"log/slog"
 	"math"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -23,10 +28,14 @@ import (
 
 var (
 	ErrNotExist = errors.New("registry: path doesn't exist")
+	// links to the paths of the device out of
+	// their root are never sent to the server
+	errLocalLink = errors.New("registry: link to a path of the device")
 )
 
 const (
-	storage      = "storage"
+	// the directory of the default root
+	storage      = shared.Root
 	backup       = "backup"
 	backupSep    = "_"
 	bufferSize   = 48
@@ -39,13 +48,14 @@ type directory struct {
 	childs childDirs
 }
 
-var once sync.Once
-
 type WatchedDir map[string]*directory
 
 type childDirs map[string]struct{}
 
 type registry struct {
+	// name of the client, it appears
+	// in the conflict copies it makes
+	name string
 	// Database queries
 	DB *database.Queries
 	// fsnotify watcher watches for
@@ -58,9 +68,35 @@ type registry struct {
 	// message channel used to write to the connection
 	msgBuffer chan []byte
 
+	// persisted events waiting to be delivered
+	outbox outbox
+
 	// list the possible events from fsnotify
 	handlers map[fsnotify.Op]FSEventHandler
 
+	// paths left out of the sync
+	ignore *shared.Ignore
+
+	// directories synced with the server
+	roots roots
+
+	// subtrees mirrored by the device,
+	// their paths are the server's
+	selection shared.Selection
+
+	// encrypts what is sent to the server,
+	// nil unless end-to-end mode is on
+	vault *vault
+
+	// files are left on the server until
+	// fetched, placeholders stand for them
+	onlineOnly bool
+
+	// the links leading out of their root
+	// are created too, they are left out
+	// otherwise
+	keepLinks bool
+
 	// mutex used to keep things safe
 	sync.Mutex
 }
@@ -72,6 +108,9 @@ func newRegistry(watcher *fsnotify.Watcher, db *database.Queries) *registry {
 		watcher:    watcher,
 		watchedDir: make(WatchedDir),
 		msgBuffer:  make(chan []byte, bufferSize),
+		outbox:     newOutbox(),
+		ignore:     shared.NewIgnore(shared.DefaultIgnores),
+		roots:      defaultRoots,
 		DB:         db,
 	}
 	r.setupFSEventHandler()
@@ -86,11 +125,18 @@ func newDirectory(name, path string) *directory {
 	}
 }
 
-func (r *registry) SyncTree(root *shared.FSNode) {
+// SyncTree reconciles a root with its folder of the tree of
+// the server, local files are compared to the revision
+// they were last synced at to tell who changed them.
+func (r *registry) SyncTree(ctx context.Context, root *shared.FSNode) {
 	if root == nil {
 		return
 	}
-	fileinfo, err := os.Stat(root.Path)
+	if !r.roots.isTop(root.Path) && r.skipped(root.Path, root.IsDir) {
+		// left as they are on both sides
+		return
+	}
+	fileinfo, err := os.Lstat(root.Path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			if root.IsDir {
@@ -99,12 +145,8 @@ func (r *registry) SyncTree(root *shared.FSNode) {
 					return
 				}
 			} else {
-				if err := r.broadcastEvent(&shared.FileEvent{
-					Path: root.Path,
-					Op:   shared.Update,
-				}); err != nil {
-					slog.Error("error broadcasting event : %v", "err", err)
-					return
+				if err := r.missing(ctx, root); err != nil {
+					slog.Error("error requesting file : %v", "err", err)
 				}
 				return
 			}
@@ -125,44 +167,109 @@ func (r *registry) SyncTree(root *shared.FSNode) {
 					return
 				}
 			} else {
-				if err := r.broadcastEvent(&shared.FileEvent{
-					Path: root.Path,
-					Op:   shared.Update,
-				}); err != nil {
-					slog.Error("error broadcasting event : %v", "err", err)
-					return
+				if err := r.missing(ctx, root); err != nil {
+					slog.Error("error requesting file : %v", "err", err)
 				}
 				return
 			}
 		}
 	}
 	if !root.IsDir {
-		nodeTimestamp, err := time.Parse(shared.TimeLayout, root.ModTime)
+		base, known, err := r.synced(ctx, root.Path)
 		if err != nil {
-			slog.Error("error parsing time : %v", "err", err)
+			slog.Error("error reading database : %v", "err", err)
+			return
+		}
+		if known && base.Placeholder && fileinfo.Size() == 0 {
+			// never fetched, the placeholder
+			// is refreshed or filled
+			if err := r.missing(ctx, root); err != nil {
+				slog.Error("error requesting file : %v", "err", err)
+			}
+			return
+		}
+		hash, err := r.hashPath(root.Path, fileinfo)
+		if errors.Is(err, errLocalLink) {
+			slog.Warn("link to a path of the device left out", "path", root.Path)
 			return
 		}
-		data, err := os.ReadFile(root.Path)
 		if err != nil {
 			slog.Error("error reading file : %v", "err", err)
 			return
 		}
-		sumBytes := sha256.Sum256(data)
-		hash := hex.EncodeToString(sumBytes[:])
-		if root.Hash != hash {
-			if fileinfo.ModTime().After(nodeTimestamp) {
-				if err := r.broadcastEvent(&shared.FileEvent{
-					Path: root.Path,
-					Op:   fsnotify.Write.String(),
-					Hash: hash,
-					Data: data,
-				}); err != nil {
-					slog.Error("error broadcasting event : %v", "err", err)
+		local := &shared.FileEvent{}
+		local.SetMetadata(fileinfo)
+		if root.Hash == hash && root.Link == local.Link {
+			if root.Mode != 0 && root.Mode != local.Mode {
+				if known && uint32(base.Mode) == root.Mode {
+					// only changed locally
+					err = r.Write(ctx, fsnotify.Event{Name: root.Path, Op: fsnotify.Write})
+				} else {
+					err = os.Chmod(root.Path, fs.FileMode(root.Mode))
+				}
+				if err != nil {
+					slog.Error("error syncing mode : %v", "err", err)
+				}
+			}
+			if err := r.track(ctx, &shared.FileEvent{
+				Path:    root.Path,
+				Op:      fsnotify.Write.String(),
+				Hash:    hash,
+				Mode:    root.Mode,
+				Link:    root.Link,
+				ModTime: root.ModTime,
+			}, root.Revision); err != nil {
+				slog.Error("error tracking file : %v", "err", err)
+			}
+			return
+		}
+		event := &shared.FileEvent{
+			Path: root.Path,
+			Op:   shared.Update,
+		}
+		switch {
+		case known && !base.Placeholder && base.Revision == root.Revision:
+			// only changed locally, sent
+			// along with the base revision
+			event.Op = fsnotify.Write.String()
+			event.Revision = base.Revision
+			event.SetMetadata(fileinfo)
+			var (
+				data []byte
+				size = fileinfo.Size()
+			)
+			if local.Link || size <= dedupThreshold {
+				if data, err = r.readContent(root.Path, fileinfo); err != nil {
+					slog.Error("error reading file : %v", "err", err)
 					return
 				}
+				size = int64(len(data))
+			}
+			setContent(event, hash, size, data)
+		case known && base.Hash == hash:
+			// only changed on the server
+		default:
+			// changed on both sides, the server's revision wins
+			// and the local one is kept as a conflict copy
+			if err := r.conflictCopy(ctx, root.Path); err != nil {
+				slog.Error("error making conflict copy : ", "err", err)
+				return
 			}
 		}
+		if err := r.broadcastEvent(event); err != nil {
+			slog.Error("error broadcasting event : %v", "err", err)
+			return
+		}
 	} else {
+		if !r.roots.isTop(root.Path) {
+			if err := r.track(ctx, &shared.FileEvent{
+				Path:  root.Path,
+				Op:    fsnotify.Create.String(),
+				IsDir: true,
+			}, root.Revision); err != nil {
+				slog.Error("error tracking directory : %v", "err", err)
+			}
+		}
 		entry, err := os.ReadDir(root.Path)
 		if err != nil {
 			slog.Error("error reading directory : ", "err", err)
@@ -172,13 +279,16 @@ func (r *registry) SyncTree(root *shared.FSNode) {
 			_, exists := root.Childs[child.Name()]
 			if !exists {
 				childPath := path.Join(root.Path, child.Name())
+				if r.roots.internal(childPath) || r.skipped(childPath, child.IsDir()) {
+					continue
+				}
 				if err := r.MoveToBackUp(childPath, child.Name()); err != nil {
 					slog.Error("error : ", "err", err)
 				}
 			}
 		}
 		for _, child := range root.Childs {
-			r.SyncTree(child)
+			r.SyncTree(ctx, child)
 		}
 	}
 }
@@ -207,7 +317,7 @@ func (r *registry) ListenForEvents(ctx context.Context) {
 				mu.Unlock()
 			}
 			if event.Has(fsnotify.Write) {
-				stat, err := os.Stat(event.Name)
+				stat, err := os.Lstat(event.Name)
 				if err != nil {
 					slog.Error("error getting fileinfo", "err", err)
 					return
@@ -263,6 +373,16 @@ func (r *registry) ListenForEvents(ctx context.Context) {
 // handles directory creation, renaming,
 // removal events and broadcasting.
 func (r *registry) Receive(ctx context.Context, event fsnotify.Event) error {
+	if r.roots.internal(event.Name) {
+		return nil
+	}
+	if shared.IsIgnoreFile(event.Name) {
+		defer r.reloadIgnore(ctx, path.Dir(event.Name))
+	}
+	event, ignored := r.filter(event)
+	if ignored {
+		return nil
+	}
 	handlers, exist := r.handlers[event.Op]
 	if !exist {
 		return shared.ErrUnsupportedEvent
@@ -274,6 +394,298 @@ func (r *registry) Receive(ctx context.Context, event fsnotify.Event) error {
 	return nil
 }
 
+// filter drops the events of ignored paths, the renames
+// crossing the ignore rules are turned into the removal
+// or the creation of the path that is not ignored.
+func (r *registry) filter(e fsnotify.Event) (fsnotify.Event, bool) {
+	ignored := r.ignored(e.Name)
+	if e.Op != fsnotify.Rename {
+		return e, ignored
+	}
+	switch from := r.ignored(e.RenamedFrom); {
+	case ignored && from:
+		return e, true
+	case ignored:
+		return fsnotify.Event{Name: e.RenamedFrom, Op: fsnotify.Remove}, false
+	case from:
+		return fsnotify.Event{Name: e.Name, Op: fsnotify.Create}, false
+	}
+	return e, false
+}
+
+func (r *registry) ignored(p string) bool {
+	isDir := r.isDir(p)
+	if stat, err := os.Lstat(p); err == nil {
+		isDir = stat.IsDir()
+	}
+	return r.skipped(p, isDir)
+}
+
+// skipped reports whether p is left out of the sync, either
+// out of the roots, without a canonical form on the wire,
+// ignored or out of the selection.
+func (r *registry) skipped(p string, isDir bool) bool {
+	root, _ := r.roots.of(p)
+	wire, ok := r.roots.wire(p)
+	if !ok {
+		return true
+	}
+	return r.ignore.IgnoredIn(root.local, root.rel(p), isDir) || !r.selection.Includes(wire)
+}
+
+// reloadIgnore applies the new rules of dir, the paths they
+// no longer ignore are watched and sent to the server. The
+// files they now ignore stay on the server as they are.
+func (r *registry) reloadIgnore(ctx context.Context, dir string) {
+	r.ignore.Reload(dir)
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		return
+	}
+	if err := r.appendDir(dir); err != nil {
+		slog.Error("error watching directory", "err", err)
+		return
+	}
+	if err := r.handleDir(ctx, fsnotify.Event{Name: dir, Op: fsnotify.Create}); err != nil {
+		slog.Error("error syncing directory", "err", err)
+	}
+}
+
+// dropUnselected removes locally, and only locally, the synced
+// paths that are no longer selected. The subtrees holding local
+// changes the server doesn't know of are moved to the backup
+// directory instead.
+func (r *registry) dropUnselected(ctx context.Context) error {
+	if r.DB == nil {
+		return nil
+	}
+	files, err := r.DB.ListFiles(ctx)
+	if err != nil {
+		return err
+	}
+	var (
+		tops   []string
+		synced = make(map[string]database.File)
+	)
+	// parents are sorted before their childs
+	for _, f := range files {
+		wire, ok := r.roots.wire(f.Path)
+		if !ok {
+			// left by a root that is no longer synced,
+			// the files stay where they are
+			if err := r.DB.DeleteFile(ctx, f.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		if r.selection.Includes(wire) {
+			continue
+		}
+		synced[f.Path] = f
+		if len(tops) == 0 || !within(f.Path, tops[len(tops)-1]) {
+			tops = append(tops, f.Path)
+		}
+	}
+	for _, top := range tops {
+		if r.changed(top, synced) {
+			if err := r.MoveToBackUp(top, path.Base(top)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		} else if err := os.RemoveAll(top); err != nil {
+			return err
+		}
+		log.Printf("%v dropped from the selection\n", top)
+	}
+	for p := range synced {
+		if err := r.DB.DeleteFile(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changed reports whether the subtree at top holds
+// files that differ from their synced version.
+func (r *registry) changed(top string, synced map[string]database.File) bool {
+	changed := false
+	filepath.WalkDir(top, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			changed = !errors.Is(err, fs.ErrNotExist)
+			return filepath.SkipAll
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if f, ok := synced[p]; ok && f.Placeholder {
+			if info, err := d.Info(); err == nil && info.Size() == 0 {
+				return nil
+			}
+		}
+		hash, err := r.hashFile(p)
+		if f, ok := synced[p]; !ok || err != nil || f.Hash != hash {
+			changed = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return changed
+}
+
+func within(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// hash returns the hash the server knows the content read
+// from rd by: its SHA-256 or, in end-to-end mode, the SHA-256
+// of its sealed version. It is computed on the fly.
+func (r *registry) hash(rd io.Reader) (string, error) {
+	if r.vault != nil {
+		return r.vault.hash(rd)
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, rd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashFile returns the hash of the file
+// without loading it in memory.
+func (r *registry) hashFile(p string) (string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return r.hash(file)
+}
+
+// hashPath returns the hash of the file at p, info
+// being its Lstat: links are hashed by their target.
+func (r *registry) hashPath(p string, info fs.FileInfo) (string, error) {
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return r.hashFile(p)
+	}
+	target, err := r.readContent(p, info)
+	if err != nil {
+		return "", err
+	}
+	return r.hash(bytes.NewReader(target))
+}
+
+// readContent is shared.ReadContent for the files sent to the
+// server, links are sent with the target relink gives them and
+// fail with errLocalLink when it has none.
+func (r *registry) readContent(p string, info fs.FileInfo) ([]byte, error) {
+	data, err := shared.ReadContent(p, info)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return data, err
+	}
+	target, ok := r.roots.relink(p, string(data))
+	if !ok {
+		return nil, errLocalLink
+	}
+	return []byte(target), nil
+}
+
+// synced returns the row of the file at p, the last
+// state of the file known to be on the server.
+func (r *registry) synced(ctx context.Context, p string) (database.File, bool, error) {
+	if r.DB == nil {
+		return database.File{}, false, nil
+	}
+	file, err := r.DB.GetFile(ctx, p)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return file, false, nil
+		}
+		return file, false, err
+	}
+	return file, true, nil
+}
+
+// track applies the event to the files table, which mirrors
+// the state of the server. revision is the revision the file
+// has on the server once the event is applied.
+func (r *registry) track(ctx context.Context, event *shared.FileEvent, revision int64) error {
+	if r.DB == nil {
+		return nil
+	}
+	return r.DB.Tx(ctx, func(db *database.Queries) error {
+		return trackRows(ctx, db, event, revision)
+	})
+}
+
+func trackRows(ctx context.Context, db *database.Queries, event *shared.FileEvent, revision int64) error {
+	now := time.Now().Format(shared.TimeLayout)
+	switch event.Op {
+	case fsnotify.Create.String(), fsnotify.Write.String(), shared.Update:
+		return recordRow(ctx, db, event, revision, false)
+	case fsnotify.Rename.String(), fsnotify.Remove.String():
+		// '0' follows '/', the range holds
+		// every path starting with path/
+		files, err := db.ListSubtree(ctx, database.ListSubtreeParams{
+			Path:   event.Path,
+			Path_2: event.Path + "/",
+			Path_3: event.Path + "0",
+		})
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if event.Op == fsnotify.Remove.String() {
+				err = db.DeleteFile(ctx, f.Path)
+			} else {
+				err = db.RenameFile(ctx, database.RenameFileParams{
+					Path:      event.NewPath + strings.TrimPrefix(f.Path, event.Path),
+					Updatedat: now,
+					Path_2:    f.Path,
+				})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// record stores the state of the file on the server, placeholder
+// tells that its content is still on the server only.
+func (r *registry) record(ctx context.Context, event *shared.FileEvent, revision int64, placeholder bool) error {
+	return r.DB.Tx(ctx, func(db *database.Queries) error {
+		return recordRow(ctx, db, event, revision, placeholder)
+	})
+}
+
+func recordRow(ctx context.Context, db *database.Queries, event *shared.FileEvent, revision int64, placeholder bool) error {
+	now := time.Now().Format(shared.TimeLayout)
+	if err := db.CreateFile(ctx, database.CreateFileParams{
+		Path:      event.Path,
+		Hash:      event.Hash,
+		Updatedat: now,
+		Createdat: now,
+		Isdir:     event.IsDir,
+		Revision:  revision,
+	}); err != nil {
+		return err
+	}
+	if err := db.UpdateFile(ctx, database.UpdateFileParams{
+		Hash:        event.Hash,
+		Updatedat:   now,
+		Revision:    revision,
+		Placeholder: placeholder,
+		Path:        event.Path,
+	}); err != nil {
+		return err
+	}
+	return db.SetMetadata(ctx, database.SetMetadataParams{
+		Mode:    int64(event.Mode),
+		Link:    event.Link,
+		Modtime: event.ModTime,
+		Path:    event.Path,
+	})
+}
+
 func (r *registry) isDir(path string) bool {
 	r.Lock()
 	defer r.Unlock()
@@ -282,6 +694,9 @@ func (r *registry) isDir(path string) bool {
 }
 
 func (r *registry) broadcastEvent(event *shared.FileEvent) error {
+	if r.DB != nil {
+		return r.enqueue(event)
+	}
 	payload, err := shared.MarshalEnvl(event, shared.Event)
 	if err != nil {
 		return err
@@ -295,21 +710,30 @@ func (r *registry) broadcastEvent(event *shared.FileEvent) error {
 }
 
 func (r *registry) MoveToBackUp(src, destName string) error {
+	dest, err := backupDest(destName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(src, dest)
+}
+
+// backupDest makes sure the backup directory
+// exists and returns a new path inside it.
+func backupDest(destName string) (string, error) {
 	fileinfo, err := os.Stat(backup)
 	if err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
-			return err
+			return "", err
 		}
 		if err := os.Mkdir(backup, 0777); err != nil {
-			return err
+			return "", err
 		}
-	}
-	if !fileinfo.IsDir() {
+	} else if !fileinfo.IsDir() {
 		if err := os.RemoveAll(backup); err != nil {
-			return err
+			return "", err
 		}
 		if err := os.Mkdir(backup, 0777); err != nil {
-			return err
+			return "", err
 		}
 	}
 	destName = strings.Join([]string{
@@ -318,9 +742,9 @@ func (r *registry) MoveToBackUp(src, destName string) error {
 	}, backupSep)
 	dest := path.Join(backup, destName)
 	if _, err := os.Stat(dest); err == nil {
-		return os.ErrExist
+		return "", os.ErrExist
 	}
-	return os.Rename(src, dest)
+	return dest, nil
 }
 
 func (r *registry) setupFSEventHandler() {
@@ -329,5 +753,6 @@ func (r *registry) setupFSEventHandler() {
 		fsnotify.Remove: r.Remove,
 		fsnotify.Write:  r.Write,
 		fsnotify.Rename: r.Rename,
+		fsnotify.Chmod:  r.Chmod,
 	}
 }
@@ -1,4 +1,4 @@
-package main
+package client
 
 import (
 	"context"
@@ -61,6 +61,7 @@ var files = []database.CreateFileParams{
 		Isdir:     false,
 		Updatedat: "2125-10-22 14:32:45.123456789 -0400 EDT",
 		Createdat: "2125-10-22 13:30:45.324291621 -0400 EDT",
+		Revision:  3,
 	},
 	{
 		Path:      path.Join(storage, "test-2.txt"),
@@ -218,6 +219,7 @@ func TestRegistry(t *testing.T) {
 			wantFileEvent: &shared.FileEvent{
 				Path: path.Join(storage, "file.txt"),
 				Op:   fsnotify.Create.String(),
+				Hash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
 				Data: []byte{},
 			},
 		},
@@ -243,14 +245,17 @@ func TestRegistry(t *testing.T) {
 			},
 		},
 		{
-			name: "writing to a futur version of a file (update request)",
+			name: "writing to a synced file sends its base revision",
 			event: func(s string, fm os.FileMode) error {
 				return os.WriteFile(s, []byte("hello world"), fm)
 			},
 			path: path.Join(storage, "dir-1", "test-1.txt"),
 			wantFileEvent: &shared.FileEvent{
-				Path: path.Join(storage, "dir-1", "test-1.txt"),
-				Op:   shared.Update,
+				Path:     path.Join(storage, "dir-1", "test-1.txt"),
+				Op:       fsnotify.Write.String(),
+				Hash:     "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+				Data:     []byte("hello world"),
+				Revision: 3,
 			},
 		},
 		{
@@ -274,6 +279,7 @@ func TestRegistry(t *testing.T) {
 			wantFileEvent: &shared.FileEvent{
 				Path: path.Join(storage, "unwatched_file.go"),
 				Op:   fsnotify.Create.String(),
+				Hash: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
 				Data: []byte("foo"),
 			},
 		},
@@ -359,6 +365,17 @@ func TestRegistry(t *testing.T) {
 
 			require.NoError(t, json.Unmarshal(envelope.Message, &got))
 
+			// the event has been recorded in the outbox
+			require.NotZero(t, got.ID)
+			got.ID = 0
+			// along with the metadata of the file
+			if got.ModTime != "" {
+				stat, err := os.Lstat(got.Path)
+				require.NoError(t, err)
+				require.Equal(t, uint32(stat.Mode().Perm()), got.Mode)
+				got.Mode, got.ModTime = 0, ""
+			}
+
 			require.Equal(t, tc.wantFileEvent, &got)
 
 		case <-time.After(300 * time.Millisecond):
@@ -491,20 +508,34 @@ func TestSyncTreeCases(t *testing.T) {
 			},
 		},
 		{
-			name: "file changed on disk after node timestamp emits Write with data and hash",
+			name: "file never synced and changed on the server emits a conflict copy",
 			node: &shared.FSNode{
-				Path:    path.Join(storage, "test-2.txt"),
-				IsDir:   false,
-				ModTime: time.Now().Add(-2 * time.Hour).Format(shared.TimeLayout),
-				Hash:    "oldhash",
+				Path:     path.Join(storage, "test-2.txt"),
+				IsDir:    false,
+				ModTime:  time.Now().Add(-2 * time.Hour).Format(shared.TimeLayout),
+				Hash:     "oldhash",
+				Revision: 2,
 			},
 			expectEvent: true,
 			wantFileEvent: &shared.FileEvent{
-				Path: path.Join(storage, "test-2.txt"),
-				Op:   fsnotify.Write.String(),
+				Path: conflictName(path.Join(storage, "test-2.txt"), "laptop", time.Now(), 1),
+				Op:   fsnotify.Create.String(),
 				Hash: helloHash,
-				Data: []byte{},
 			},
+			wantExists: map[string]bool{
+				path.Join(storage, "test-2.txt"):                                        true,
+				conflictName(path.Join(storage, "test-2.txt"), "laptop", time.Now(), 1): true,
+			},
+		},
+		{
+			name: "file matching the server emits nothing",
+			node: &shared.FSNode{
+				Path:     path.Join(storage, "test-2.txt"),
+				IsDir:    false,
+				Hash:     helloHash,
+				Revision: 2,
+			},
+			expectEvent: false,
 			wantExists: map[string]bool{
 				path.Join(storage, "test-2.txt"): true,
 			},
@@ -547,8 +578,9 @@ func TestSyncTreeCases(t *testing.T) {
 			defer watcher.Close()
 
 			r := newRegistry(watcher, nil)
+			r.name = "laptop"
 
-			r.SyncTree(tc.node)
+			r.SyncTree(context.Background(), tc.node)
 
 			// Helper to receive and decode event from msgBuffer with timeout
 			var fe *shared.FileEvent
@@ -622,3 +654,295 @@ func TestSyncTreeCases(t *testing.T) {
 		})
 	}
 }
+
+func TestSyncTreeRevisions(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		ctx    = context.Background()
+		tmp    = t.TempDir()
+		dbPath = path.Join(tmp, "test.db")
+		local  = path.Join(storage, "dir-1", "test-1.txt")
+		remote = path.Join(storage, "test-2.txt")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+	require.NoError(t, initDB(db))
+	require.NoError(t, initTMP(tmp))
+
+	r := newRegistry(nil, db)
+
+	// test-1.txt was edited offline, the server is still at the
+	// synced revision. test-2.txt is untouched locally but the
+	// server moved on.
+	require.NoError(t, os.WriteFile(local, []byte("hello world"), 0777))
+	emptyHash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	require.NoError(t, db.UpdateFile(ctx, database.UpdateFileParams{
+		Hash:      emptyHash,
+		Updatedat: time.Now().Format(shared.TimeLayout),
+		Path:      remote,
+	}))
+
+	r.SyncTree(ctx, &shared.FSNode{Path: local, Hash: "56464", Revision: 3})
+	event := decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, fsnotify.Write.String(), event.Op)
+	require.Equal(t, int64(3), event.Revision)
+	require.Equal(t, []byte("hello world"), event.Data)
+
+	r.SyncTree(ctx, &shared.FSNode{Path: remote, Hash: "newhash", Revision: 1})
+	event = decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, shared.Update, event.Op)
+	require.Equal(t, remote, event.Path)
+	_, err = os.Stat(backup)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRegistryIgnore(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		ctx   = context.Background()
+		tmp   = t.TempDir()
+		rules = path.Join(storage, shared.IgnoreFile)
+		next  = func(r *registry) shared.FileEvent {
+			select {
+			case msg := <-r.msgBuffer:
+				return decodeEvent(t, msg)
+			default:
+				t.Fatal("no event sent")
+			}
+			return shared.FileEvent{}
+		}
+	)
+	db, err := makeDB(path.Join(tmp, "test.db"), "sqlite")
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, os.MkdirAll(path.Join(storage, "build"), 0777))
+	require.NoError(t, os.WriteFile(rules, []byte("*.log\nbuild/\n"), 0777))
+
+	watcher, err := fsnotify.NewWatcher()
+	require.NoError(t, err)
+	defer watcher.Close()
+	r := newRegistry(watcher, db)
+	require.NoError(t, r.appendDir(storage))
+	require.False(t, r.isDir(path.Join(storage, "build")), "ignored directories aren't watched")
+
+	// ignored paths are not sent
+	for _, p := range []string{path.Join(storage, "debug.log"), path.Join(storage, "build", "out.bin"), path.Join(storage, ".DS_Store")} {
+		require.NoError(t, os.WriteFile(p, []byte("x"), 0777))
+		require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: p, Op: fsnotify.Create}))
+	}
+	require.Empty(t, r.msgBuffer)
+
+	// renames crossing the rules
+	notes := path.Join(storage, "notes.txt")
+	require.NoError(t, os.Rename(path.Join(storage, "debug.log"), notes))
+	require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: notes, Op: fsnotify.Rename, RenamedFrom: path.Join(storage, "debug.log")}))
+	event := next(r)
+	require.Equal(t, fsnotify.Create.String(), event.Op)
+	require.Equal(t, notes, event.Path)
+
+	trace := path.Join(storage, "trace.log")
+	require.NoError(t, os.Rename(notes, trace))
+	require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: trace, Op: fsnotify.Rename, RenamedFrom: notes}))
+	event = next(r)
+	require.Equal(t, fsnotify.Remove.String(), event.Op)
+	require.Equal(t, notes, event.Path)
+
+	// ignored local files are left alone by the tree sync
+	hash, err := r.hashFile(rules)
+	require.NoError(t, err)
+	r.SyncTree(ctx, &shared.FSNode{Path: storage, IsDir: true, Childs: map[string]*shared.FSNode{
+		shared.IgnoreFile: {Path: rules, Hash: hash, Revision: 1},
+	}})
+	_, err = os.Stat(path.Join(storage, "build", "out.bin"))
+	require.NoError(t, err)
+	_, err = os.Stat(trace)
+	require.NoError(t, err)
+	require.Empty(t, r.msgBuffer)
+
+	// the paths the new rules no longer ignore are sent
+	require.NoError(t, os.WriteFile(rules, []byte("*.log\n!trace.log\n"), 0777))
+	require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: rules, Op: fsnotify.Write}))
+	sent := make(map[string]string)
+	for len(r.msgBuffer) > 0 {
+		event := next(r)
+		sent[event.Path] = event.Op
+	}
+	require.Equal(t, map[string]string{
+		rules:                                  fsnotify.Write.String(),
+		trace:                                  fsnotify.Create.String(),
+		path.Join(storage, "build"):            fsnotify.Create.String(),
+		path.Join(storage, "build", "out.bin"): fsnotify.Create.String(),
+	}, sent)
+	require.True(t, r.isDir(path.Join(storage, "build")))
+}
+
+func TestRegistrySelection(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		ctx = context.Background()
+		tmp = t.TempDir()
+	)
+	db, err := makeDB(path.Join(tmp, "test.db"), "sqlite")
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(tmp))
+
+	watcher, err := fsnotify.NewWatcher()
+	require.NoError(t, err)
+	defer watcher.Close()
+	r := newRegistry(watcher, db)
+
+	// synced before the selection was narrowed down
+	for _, p := range []string{"docs/a.txt", "music/b.txt", "videos/c.txt"} {
+		p = path.Join(storage, p)
+		require.NoError(t, os.MkdirAll(path.Dir(p), 0777))
+		require.NoError(t, os.WriteFile(p, []byte(p), 0777))
+		hash, err := r.hashFile(p)
+		require.NoError(t, err)
+		for _, f := range []string{path.Dir(p), p} {
+			require.NoError(t, r.track(ctx, &shared.FileEvent{Path: f, Op: fsnotify.Create.String(), IsDir: f != p, Hash: hash}, 1))
+		}
+	}
+	// changed since
+	require.NoError(t, os.WriteFile(path.Join(storage, "videos", "c.txt"), []byte("changed"), 0777))
+
+	r.selection, err = shared.NewSelection([]string{path.Join(storage, "docs")})
+	require.NoError(t, err)
+	require.NoError(t, r.dropUnselected(ctx))
+	require.NoError(t, r.appendDir(storage))
+
+	_, err = os.Stat(path.Join(storage, "docs", "a.txt"))
+	require.NoError(t, err)
+	_, err = os.Stat(path.Join(storage, "music"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(path.Join(storage, "videos"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	backups, err := os.ReadDir(backup)
+	require.NoError(t, err)
+	require.Len(t, backups, 1, "changed subtrees are backed up")
+
+	files, err := db.ListFiles(ctx)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	// nothing was sent to the server
+	require.Empty(t, r.msgBuffer)
+
+	// only the selected paths are sent
+	for _, p := range []string{"notes.txt", "docs/b.txt"} {
+		p = path.Join(storage, p)
+		require.NoError(t, os.WriteFile(p, nil, 0777))
+		require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: p, Op: fsnotify.Create}))
+	}
+	require.Len(t, r.msgBuffer, 1)
+	event := decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, path.Join(storage, "docs", "b.txt"), event.Path)
+}
+
+func TestRegistryMetadata(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		tmp     = t.TempDir()
+		secret  = path.Join(tmp, "secret.txt")
+		link    = path.Join(storage, "link")
+		script  = path.Join(storage, "run.sh")
+		modTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	)
+	db, err := makeDB(path.Join(tmp, "test.db"), "sqlite")
+	require.NoError(t, err)
+	t.Chdir(tmp)
+	require.NoError(t, os.Mkdir(storage, 0777))
+	require.NoError(t, os.WriteFile(secret, []byte("secret"), 0777))
+
+	r := newRegistry(nil, db)
+	c := &client{registry: r}
+	c.setRoots(defaultRoots)
+	receive := func(event shared.FileEvent) error {
+		t.Helper()
+		if err := c.open(&event); err != nil {
+			return err
+		}
+		return c.apply(ctx, &event)
+	}
+
+	// links are sent as such, their target isn't read
+	// and the paths of the device out of the root stay on it
+	require.NoError(t, os.Symlink(secret, link))
+	require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: link, Op: fsnotify.Create}))
+	require.Empty(t, r.msgBuffer)
+	require.NoError(t, os.Remove(link))
+	require.NoError(t, os.Symlink(path.Join(tmp, script), link))
+	require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: link, Op: fsnotify.Create}))
+	event := decodeEvent(t, <-r.msgBuffer)
+	require.True(t, event.Link)
+	require.Equal(t, []byte("run.sh"), event.Data, "made relative to the link")
+
+	// so are the modes, changing them alone sends the file again
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh"), 0777))
+	require.NoError(t, os.Chmod(script, 0644))
+	require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: script, Op: fsnotify.Create}))
+	event = decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, uint32(0644), event.Mode)
+	require.NotEmpty(t, event.ModTime)
+	require.NoError(t, os.Chmod(script, 0755))
+	require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: script, Op: fsnotify.Chmod}))
+	event = decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, fsnotify.Write.String(), event.Op)
+	require.Equal(t, uint32(0755), event.Mode)
+	require.Equal(t, int64(1), event.Revision)
+	require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: script, Op: fsnotify.Chmod}))
+	require.Empty(t, r.msgBuffer)
+
+	// the files of the server keep theirs
+	tool := path.Join(storage, "tool")
+	require.NoError(t, receive(shared.FileEvent{
+		Path:     tool,
+		Op:       fsnotify.Create.String(),
+		Data:     []byte("x"),
+		Hash:     sum("x"),
+		Mode:     0700,
+		ModTime:  modTime.Format(shared.TimeLayout),
+		Revision: 1,
+	}))
+	info, err := os.Stat(tool)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	require.True(t, modTime.Equal(info.ModTime()))
+	require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: tool, Op: fsnotify.Chmod}))
+	require.Empty(t, r.msgBuffer)
+
+	// links leading out of the root are left out
+	out := path.Join(storage, "out")
+	require.NoError(t, receive(shared.FileEvent{Path: out, Op: fsnotify.Create.String(), Data: []byte("../secret.txt"), Link: true, Hash: sum("../secret.txt"), Revision: 1}))
+	_, err = os.Lstat(out)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	r.SyncTree(ctx, &shared.FSNode{Path: out, Link: true, Hash: sum("../secret.txt"), Revision: 1})
+	require.Empty(t, r.msgBuffer, "and stay so")
+	require.NoError(t, receive(shared.FileEvent{Path: path.Join(storage, "in"), Op: fsnotify.Create.String(), Data: []byte("run.sh"), Link: true, Revision: 1}))
+	target, err := os.Readlink(path.Join(storage, "in"))
+	require.NoError(t, err)
+	require.Equal(t, "run.sh", target)
+	r.keepLinks = true
+	require.NoError(t, receive(shared.FileEvent{Path: out, Op: fsnotify.Write.String(), Data: []byte("../secret.txt"), Link: true, Revision: 2}))
+	target, err = os.Readlink(out)
+	require.NoError(t, err)
+	require.Equal(t, "../secret.txt", target)
+
+	// conflict copies of links are links
+	require.NoError(t, r.conflictCopy(ctx, link))
+	event = decodeEvent(t, <-r.msgBuffer)
+	require.True(t, event.Link)
+	require.Equal(t, link, event.ConflictOf)
+	target, err = os.Readlink(event.Path)
+	require.NoError(t, err)
+	require.Equal(t, "run.sh", target)
+	require.Equal(t, []byte("run.sh"), event.Data)
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+// remote is the HTTP API of the server, the one-shot
+// commands go through it instead of a connection.
+type remote struct {
+	// websocket URL of the server,
+	// the API is served next to it
+	url   string
+	token string
+	// carries the TLS settings, if any
+	httpClient *http.Client
+	// nil unless end-to-end encrypted
+	vault *vault
+}
+
+// newRemote authenticates as the device of the environment.
+func newRemote(ctx context.Context, cfg config) (remote, error) {
+	httpClient, err := cfg.httpClient()
+	if err != nil {
+		return remote{}, err
+	}
+	token := os.Getenv("DEVICE_TOKEN")
+	if token == "" {
+		return remote{}, errNoToken
+	}
+	r := remote{
+		url:        cfg.serverURL,
+		token:      token,
+		httpClient: httpClient,
+	}
+	if r.vault, err = newVaultFromEnv(ctx, r); err != nil {
+		return remote{}, err
+	}
+	return r, nil
+}
+
+func (c *client) remote() remote {
+	return remote{
+		url:        c.url,
+		token:      c.token,
+		httpClient: c.httpClient,
+		vault:      c.registry.vault,
+	}
+}
+
+// endpoint returns the URL of the endpoint name of the API
+// of the server whose websocket URL is serverURL.
+func endpoint(serverURL, name string, query url.Values) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = path.Join(path.Dir(u.Path), name)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// send sends a request to the endpoint name, answers other than
+// 2xx are turned into errors. The caller closes the body.
+func (r remote) send(ctx context.Context, method, name string, query url.Values, body io.Reader) (*http.Response, error) {
+	target, err := endpoint(r.url, name, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	httpClient := r.httpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s /%s: %s: %s", method, name, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// do sends a request to the endpoint name and decodes
+// the JSON answer into v, unless v is nil.
+func (r remote) do(ctx context.Context, method, name string, query url.Values, body io.Reader, v any) error {
+	resp, err := r.send(ctx, method, name, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// seal returns the path the server knows the file at p by.
+func (r remote) seal(p string) string {
+	if r.vault == nil {
+		return p
+	}
+	return r.vault.sealPath(p)
+}
+
+// open returns the plaintext of the path p of the
+// server, the sealed one if it can't be decrypted.
+func (r remote) open(p string) string {
+	if r.vault == nil {
+		return p
+	}
+	if opened, err := r.vault.openPath(p); err == nil {
+		return opened
+	}
+	return p
+}
+
+// copy writes the content of the server read from rd to w,
+// decrypted when end-to-end encrypted.
+func (r remote) copy(w io.Writer, rd io.Reader) error {
+	if r.vault == nil {
+		_, err := io.Copy(w, rd)
+		return err
+	}
+	return r.vault.open(w, rd)
+}
+
+// lookup returns the node of the tree of the server at p.
+func (r remote) lookup(ctx context.Context, p string) (*shared.FSNode, error) {
+	var tree shared.FSNode
+	if err := r.do(ctx, http.MethodGet, "tree", nil, nil, &tree); err != nil {
+		return nil, err
+	}
+	if r.vault != nil {
+		if err := r.vault.openTree(&tree); err != nil {
+			return nil, err
+		}
+	}
+	node := &tree
+	if p == shared.Root {
+		return node, nil
+	}
+	rel, ok := strings.CutPrefix(p, shared.Root+"/")
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", os.ErrNotExist, p)
+	}
+	for _, name := range strings.Split(rel, "/") {
+		if node = node.Childs[name]; node == nil {
+			return nil, fmt.Errorf("%w: %s", os.ErrNotExist, p)
+		}
+	}
+	return node, nil
+}
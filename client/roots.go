@@ -0,0 +1,284 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+var (
+	errRootsOverlap = errors.New("sync roots overlap")
+	errRootDir      = errors.New("sync root without a directory")
+	errRootFolder   = errors.New("sync root folder outside of the tree")
+)
+
+// root is a directory of the device synced with a folder of
+// the server. The events carry the paths of the server, where
+// the directory lives on the device never goes on the wire.
+type root struct {
+	// directory on the device, absolute or
+	// relative to the working directory
+	local string
+	// folder of the server it mirrors
+	remote string
+}
+
+// roots are the directories the device syncs, neither
+// their directories nor their folders overlap.
+type roots []root
+
+// defaultRoots sync the storage directory of the
+// working directory with the whole tree.
+var defaultRoots = roots{{local: storage, remote: shared.Root}}
+
+// parseRoots reads comma separated dir[=folder] entries, the
+// folder is relative to the top of the tree of the server and
+// the directory mirrors the whole tree without it.
+func parseRoots(s string) (roots, error) {
+	var rs roots
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		dir, folder, _ := strings.Cut(entry, "=")
+		r := root{
+			local:  path.Clean(strings.TrimSpace(dir)),
+			remote: path.Join(shared.Root, strings.TrimSpace(folder)),
+		}
+		if r.local == "." {
+			// the working directory holds the
+			// database and the backups
+			return nil, fmt.Errorf("%w: %s", errRootDir, entry)
+		}
+		if !within(r.remote, shared.Root) || shared.IsInternal(r.remote) {
+			return nil, fmt.Errorf("%w: %s", errRootFolder, folder)
+		}
+		for _, other := range rs {
+			if within(r.local, other.local) || within(other.local, r.local) ||
+				within(r.remote, other.remote) || within(other.remote, r.remote) {
+				return nil, fmt.Errorf("%w: %s and %s", errRootsOverlap, other.local, r.local)
+			}
+		}
+		rs = append(rs, r)
+	}
+	if len(rs) == 0 {
+		return defaultRoots, nil
+	}
+	return rs, nil
+}
+
+// rel returns the path of p relative to the directory.
+func (r root) rel(p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(p, r.local), "/")
+}
+
+// tmpDir holds the partial files of the root, it
+// is on the same filesystem as the directory.
+func (r root) tmpDir() string {
+	return path.Join(r.local, shared.TmpDir)
+}
+
+// of returns the root p is in.
+func (rs roots) of(p string) (root, bool) {
+	for _, r := range rs {
+		if within(p, r.local) {
+			return r, true
+		}
+	}
+	return root{}, false
+}
+
+// wire returns the path the server knows the local path p by,
+// ok is false when p is out of the roots or has no canonical
+// form: its names can't be synced.
+func (rs roots) wire(p string) (string, bool) {
+	r, ok := rs.of(p)
+	if !ok {
+		return p, false
+	}
+	wire, err := shared.CanonicalPath(path.Join(r.remote, r.rel(p)))
+	if err != nil {
+		return p, false
+	}
+	return wire, true
+}
+
+// local returns the path the path p of the server is synced
+// at, ok is false when p isn't canonical or no root mirrors it.
+func (rs roots) local(p string) (string, bool) {
+	if shared.ValidPath(p) != nil {
+		return p, false
+	}
+	for _, r := range rs {
+		if within(p, r.remote) {
+			return path.Join(r.local, strings.TrimPrefix(p, r.remote)), true
+		}
+	}
+	return p, false
+}
+
+// isTop reports whether p is the directory of a root mirroring
+// the whole tree, the top of the tree is never sent.
+func (rs roots) isTop(p string) bool {
+	for _, r := range rs {
+		if p == r.local && r.remote == shared.Root {
+			return true
+		}
+	}
+	return false
+}
+
+// internal reports whether p is among the partial
+// files of its root, they are never synced.
+func (rs roots) internal(p string) bool {
+	r, ok := rs.of(p)
+	return ok && within(p, r.tmpDir())
+}
+
+// check tells whether the events of the server may change the
+// local path p, they never leave the roots: the links found
+// on the way are not followed.
+func (rs roots) check(p string) error {
+	if p == "" {
+		return shared.ErrEmptyPath
+	}
+	r, ok := rs.of(p)
+	if !ok || rs.internal(p) {
+		return shared.ErrInvalidPath
+	}
+	return shared.CheckLinks(r.local, p)
+}
+
+// escapes reports whether the link at the local path p,
+// pointing to target, leads out of the root of p.
+func (rs roots) escapes(p, target string) bool {
+	r, ok := rs.of(p)
+	return !ok || shared.Escapes(r.local, p, target)
+}
+
+// relink returns the target the link at the local path p is sent
+// with, absolute targets are made relative to the link. ok is false
+// when they lead out of the root of p: the paths of the device never
+// go on the wire.
+func (rs roots) relink(p, target string) (string, bool) {
+	if !path.IsAbs(target) {
+		return target, true
+	}
+	r, ok := rs.of(p)
+	if !ok {
+		return "", false
+	}
+	local, err := filepath.Abs(r.local)
+	if err != nil {
+		return "", false
+	}
+	dir, err := filepath.Abs(path.Dir(p))
+	if err != nil {
+		return "", false
+	}
+	if target = path.Clean(target); !within(target, local) {
+		return "", false
+	}
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// mirrors reports whether the folder p of the server
+// is in one of the roots or leads to one of them.
+func (rs roots) mirrors(p string) bool {
+	for _, r := range rs {
+		if within(p, r.remote) || within(r.remote, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// selection returns the folders the roots mirror,
+// nil when one of them mirrors the whole tree.
+func (rs roots) selection() (shared.Selection, error) {
+	var folders []string
+	for _, r := range rs {
+		folders = append(folders, r.remote)
+	}
+	return shared.NewSelection(folders)
+}
+
+// send turns the local paths of an event into the
+// ones of the server, the event is about to be sent.
+func (rs roots) send(event *shared.FileEvent) {
+	event.Path, _ = rs.wire(event.Path)
+	if event.NewPath != "" {
+		event.NewPath, _ = rs.wire(event.NewPath)
+	}
+	if event.ConflictOf != "" {
+		event.ConflictOf, _ = rs.wire(event.ConflictOf)
+	}
+}
+
+// receive turns the paths of an event of the server into local
+// ones, ok is false when no root mirrors it. Like with selections
+// a rename out of the roots is a removal, one into them is left
+// to the tree sent on the next connection.
+func (rs roots) receive(event *shared.FileEvent) (ok bool) {
+	if event.Path, ok = rs.local(event.Path); !ok {
+		return false
+	}
+	if event.ConflictOf != "" {
+		if p, ok := rs.local(event.ConflictOf); ok {
+			event.ConflictOf = p
+		} else {
+			event.ConflictOf = ""
+		}
+	}
+	if event.NewPath != "" {
+		if p, ok := rs.local(event.NewPath); ok {
+			event.NewPath = p
+		} else if event.Op == fsnotify.Rename.String() {
+			event.Op = fsnotify.Remove.String()
+			event.NewPath = ""
+		}
+	}
+	return true
+}
+
+// subtree returns the folder of the root in the tree of the
+// server, its paths turned into local ones. It is nil when
+// the server doesn't have the folder.
+func (rs roots) subtree(tree *shared.FSNode, r root) *shared.FSNode {
+	node := tree
+	if rel, ok := strings.CutPrefix(r.remote, shared.Root+"/"); ok {
+		for _, name := range strings.Split(rel, "/") {
+			if node = node.Childs[name]; node == nil {
+				return nil
+			}
+		}
+	}
+	if !node.IsDir || !rs.localize(node) {
+		return nil
+	}
+	return node
+}
+
+// localize turns the paths of the node into local ones, the
+// nodes no root mirrors, or out of reach, are dropped. ok is
+// false if the node itself is.
+func (rs roots) localize(node *shared.FSNode) (ok bool) {
+	if node.Path, ok = rs.local(node.Path); !ok || rs.check(node.Path) != nil {
+		return false
+	}
+	for name, child := range node.Childs {
+		if child == nil || !rs.localize(child) {
+			delete(node.Childs, name)
+		}
+	}
+	return true
+}
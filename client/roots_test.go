@@ -0,0 +1,211 @@
+package client
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+func TestParseRoots(t *testing.T) {
+	rs, err := parseRoots("")
+	require.NoError(t, err)
+	require.Equal(t, defaultRoots, rs)
+
+	rs, err = parseRoots("/home/me/Documents/=docs, /mnt/photos=/photos/")
+	require.NoError(t, err)
+	require.Equal(t, roots{
+		{local: "/home/me/Documents", remote: "storage/docs"},
+		{local: "/mnt/photos", remote: "storage/photos"},
+	}, rs)
+
+	tests := []struct {
+		local string
+		wire  string
+	}{
+		{local: "/home/me/Documents", wire: "storage/docs"},
+		{local: "/home/me/Documents/work/a.txt", wire: "storage/docs/work/a.txt"},
+		{local: "/mnt/photos/2024/a.jpg", wire: "storage/photos/2024/a.jpg"},
+	}
+	for _, tc := range tests {
+		wire, ok := rs.wire(tc.local)
+		require.Truef(t, ok, "%s", tc.local)
+		require.Equal(t, tc.wire, wire)
+		local, ok := rs.local(tc.wire)
+		require.Truef(t, ok, "%s", tc.wire)
+		require.Equal(t, tc.local, local)
+	}
+	// nothing leads out of the roots
+	for _, p := range []string{"storage", "storage/music/a.mp3", "storage/docs/../music", "storage/docsx"} {
+		_, ok := rs.local(p)
+		require.Falsef(t, ok, "%s", p)
+	}
+	_, ok := rs.wire("/home/me/Music/a.mp3")
+	require.False(t, ok)
+
+	require.False(t, rs.isTop("/home/me/Documents"), "folders of the tree are sent")
+	require.True(t, defaultRoots.isTop(shared.Root))
+	require.True(t, rs.internal(path.Join("/mnt/photos", shared.TmpDir, "1.part")))
+	require.False(t, rs.internal(path.Join(shared.Root, shared.TmpDir)))
+	require.ErrorIs(t, rs.check(path.Join("/mnt/photos", shared.TmpDir)), shared.ErrInvalidPath)
+	require.ErrorIs(t, rs.check("/etc/passwd"), shared.ErrInvalidPath)
+	require.NoError(t, rs.check("/mnt/photos/a.jpg"))
+
+	selection, err := rs.selection()
+	require.NoError(t, err)
+	require.Equal(t, shared.Selection{"storage/docs", "storage/photos"}, selection)
+
+	for _, s := range []string{"/a=docs,/a/b=photos", "/a=docs,/b=docs/work", "/a=..", "/a=.harmony", "=docs"} {
+		_, err := parseRoots(s)
+		require.Errorf(t, err, "%s", s)
+	}
+}
+
+func TestRoots(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		tmp    = t.TempDir()
+		docs   = path.Join(tmp, "Documents")
+		photos = path.Join(tmp, "Pictures")
+		rs     = roots{
+			{local: docs, remote: "storage/docs"},
+			{local: photos, remote: "storage/photos"},
+		}
+	)
+	db, err := makeDB(path.Join(tmp, "test.db"), "sqlite")
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(docs, 0777))
+	require.NoError(t, os.Mkdir(photos, 0777))
+
+	r := newRegistry(nil, db)
+	c := &client{registry: r}
+	c.setRoots(rs)
+	receive := func(event shared.FileEvent) error {
+		t.Helper()
+		if err := c.open(&event); err != nil {
+			return err
+		}
+		return c.apply(ctx, &event)
+	}
+
+	// the events of the server land in the root of their folder
+	require.NoError(t, receive(shared.FileEvent{Path: "storage/docs/a.txt", Op: fsnotify.Create.String(), Data: []byte("a"), Hash: sum("a"), Revision: 1}))
+	require.NoError(t, receive(shared.FileEvent{Path: "storage/photos/2024", Op: fsnotify.Create.String(), IsDir: true, Revision: 1}))
+	content, err := os.ReadFile(path.Join(docs, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "a", string(content))
+	require.DirExists(t, path.Join(photos, "2024"))
+	f, err := db.GetFile(ctx, path.Join(docs, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), f.Revision)
+
+	require.ErrorIs(t, receive(shared.FileEvent{Path: "storage/music/a.mp3", Op: fsnotify.Create.String()}), errNoRoot)
+	require.ErrorIs(t, receive(shared.FileEvent{Path: "storage/docs/../../a.txt", Op: fsnotify.Create.String()}), errNoRoot)
+	require.Error(t, receive(shared.FileEvent{Path: "storage/docs/.harmony/a.txt", Op: fsnotify.Create.String()}))
+	require.NoFileExists(t, path.Join(docs, shared.TmpDir, "a.txt"))
+
+	// across roots, the content is moved along
+	require.NoError(t, receive(shared.FileEvent{Path: "storage/docs/a.txt", NewPath: "storage/photos/a.txt", Op: fsnotify.Rename.String(), Revision: 2}))
+	require.FileExists(t, path.Join(photos, "a.txt"))
+	// out of the roots, it is a removal
+	event := shared.FileEvent{Path: "storage/photos/a.txt", NewPath: "storage/music/a.txt", Op: fsnotify.Rename.String()}
+	require.NoError(t, c.open(&event))
+	require.Equal(t, fsnotify.Remove.String(), event.Op)
+	require.Empty(t, event.NewPath)
+
+	// local changes are sent with the paths of the server
+	require.NoError(t, os.WriteFile(path.Join(docs, "b.txt"), []byte("b"), 0777))
+	require.NoError(t, r.Receive(ctx, fsnotify.Event{Name: path.Join(docs, "b.txt"), Op: fsnotify.Create}))
+	event = decodeEvent(t, <-r.msgBuffer)
+	require.Equal(t, path.Join(docs, "b.txt"), event.Path, "the outbox holds local paths")
+	rs.send(&event)
+	require.Equal(t, "storage/docs/b.txt", event.Path)
+
+	// each root is reconciled with its folder, the
+	// folders the server doesn't have are sent
+	require.NoError(t, os.WriteFile(path.Join(photos, "p.jpg"), []byte("p"), 0777))
+	c.syncTree(ctx, &shared.FSNode{Path: shared.Root, IsDir: true, Childs: map[string]*shared.FSNode{
+		"docs": {Path: "storage/docs", IsDir: true, Childs: map[string]*shared.FSNode{
+			"a.txt": {Path: "storage/docs/a.txt", Hash: sum("a"), Revision: 3},
+			"b.txt": {Path: "storage/docs/b.txt", Hash: sum("b"), Revision: 1},
+		}},
+		"music": {Path: "storage/music", IsDir: true, Childs: map[string]*shared.FSNode{}},
+	}})
+	var sent []shared.FileEvent
+	for len(r.msgBuffer) > 0 {
+		event := decodeEvent(t, <-r.msgBuffer)
+		rs.send(&event)
+		sent = append(sent, event)
+	}
+	require.Len(t, sent, 3)
+	require.Equal(t, "storage/docs/a.txt", sent[0].Path)
+	require.Equal(t, shared.Update, sent[0].Op)
+	require.Equal(t, "storage/photos", sent[1].Path)
+	require.True(t, sent[1].IsDir)
+	require.Equal(t, "storage/photos/p.jpg", sent[2].Path)
+	f, err = db.GetFile(ctx, path.Join(docs, "b.txt"))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), f.Revision)
+}
+
+func TestRootsRelink(t *testing.T) {
+	rs := roots{{local: "/home/me/Documents", remote: "storage/docs"}}
+	for _, tc := range []struct {
+		p, target, want string
+		ok              bool
+	}{
+		{"/home/me/Documents/a/link", "../b.txt", "../b.txt", true},
+		{"/home/me/Documents/a/link", "../../../etc/passwd", "../../../etc/passwd", true},
+		{"/home/me/Documents/a/link", "/home/me/Documents/b.txt", "../b.txt", true},
+		{"/home/me/Documents/link", "/home/me/Documents/a/./b.txt", "a/b.txt", true},
+		{"/home/me/Documents/link", "/home/me/Documents", ".", true},
+		{"/home/me/Documents/link", "/etc/passwd", "", false},
+		{"/home/me/Documents/link", "/home/me/Documents2/b.txt", "", false},
+		{"/home/me/Documents/link", "/home/me/Documents/../.ssh/id_rsa", "", false},
+		{"/home/me/link", "/home/me/Documents/b.txt", "", false},
+	} {
+		target, ok := rs.relink(tc.p, tc.target)
+		require.Equal(t, tc.ok, ok, tc.target)
+		require.Equal(t, tc.want, target, tc.target)
+	}
+}
+
+// FuzzRootsReceive maps arbitrary events of the server, the
+// paths they end up with never leave the roots.
+func FuzzRootsReceive(f *testing.F) {
+	for _, seed := range [][2]string{
+		{"storage/docs/a.txt", "storage/photos/a.txt"},
+		{"storage/docs/../../etc/passwd", ""},
+		{"storage/docs/../photos", "storage/music"},
+		{"storage/docsx/a.txt", ""},
+		{"storage/docs/.harmony/a.part", ""},
+		{"storage/photos", "storage/docs/../../../tmp"},
+		{"storage", "/etc"},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+	rs := roots{
+		{local: "/home/me/Documents", remote: "storage/docs"},
+		{local: "/mnt/photos", remote: "storage/photos"},
+	}
+	f.Fuzz(func(t *testing.T, p, newPath string) {
+		event := shared.FileEvent{Path: p, NewPath: newPath, Op: fsnotify.Rename.String()}
+		if !rs.receive(&event) {
+			return
+		}
+		for _, local := range []string{event.Path, event.NewPath} {
+			if local == "" {
+				continue
+			}
+			r, ok := rs.of(local)
+			require.Truef(t, ok, "%q left the roots", local)
+			require.Equal(t, path.Clean(local), local)
+			require.NotContains(t, strings.Split(r.rel(local), "/"), "..", "%q left its root", local)
+		}
+	})
+}
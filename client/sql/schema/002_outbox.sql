@@ -0,0 +1,15 @@
+-- +goose Up
+CREATE TABLE outbox(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    path TEXT NOT NULL,
+    newPath TEXT NOT NULL,
+    op TEXT NOT NULL,
+    payload BLOB NOT NULL,
+    createdAt TEXT NOT NULL
+);
+
+CREATE INDEX outbox_path ON outbox(path);
+
+
+-- +goose Down
+DROP TABLE outbox;
@@ -0,0 +1,36 @@
+-- +goose Up
+CREATE TABLE blobs(
+    hash TEXT PRIMARY KEY,
+    size INTEGER NOT NULL,
+    refs INTEGER NOT NULL,
+    createdAt TEXT NOT NULL
+);
+
+-- chunks now point into blobs instead of files
+DROP TABLE chunks;
+CREATE TABLE chunks(
+    blob TEXT NOT NULL,
+    idx INTEGER NOT NULL,
+    hash TEXT NOT NULL,
+    start INTEGER NOT NULL,
+    size INTEGER NOT NULL,
+    PRIMARY KEY (blob, idx)
+);
+
+CREATE INDEX chunks_hash ON chunks(hash);
+
+
+-- +goose Down
+DROP TABLE chunks;
+CREATE TABLE chunks(
+    path TEXT NOT NULL,
+    idx INTEGER NOT NULL,
+    hash TEXT NOT NULL,
+    start INTEGER NOT NULL,
+    size INTEGER NOT NULL,
+    PRIMARY KEY (path, idx)
+);
+
+CREATE INDEX chunks_hash ON chunks(hash);
+
+DROP TABLE blobs;
@@ -0,0 +1,18 @@
+-- +goose Up
+-- the trash and the versions keep the metadata
+-- of the files so that restoring brings it back
+ALTER TABLE trash_files ADD COLUMN mode INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE trash_files ADD COLUMN link BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE trash_files ADD COLUMN modTime TEXT NOT NULL DEFAULT '';
+ALTER TABLE file_versions ADD COLUMN mode INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE file_versions ADD COLUMN link BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE file_versions ADD COLUMN modTime TEXT NOT NULL DEFAULT '';
+
+
+-- +goose Down
+ALTER TABLE file_versions DROP COLUMN modTime;
+ALTER TABLE file_versions DROP COLUMN link;
+ALTER TABLE file_versions DROP COLUMN mode;
+ALTER TABLE trash_files DROP COLUMN modTime;
+ALTER TABLE trash_files DROP COLUMN link;
+ALTER TABLE trash_files DROP COLUMN mode;
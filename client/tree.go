@@ -0,0 +1,239 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/coder/websocket"
+	"github.com/thesicktwist1/harmony/shared"
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+// pull is a tree exchange in progress. The client sends the hashes
+// it has for folders of the tree, the server answers with the childs
+// of those that differ and the client asks for the folders among them
+// that differ in turn. The subtrees both sides agree on are taken from
+// the database, which mirrors the state of the server.
+type pull struct {
+	// tree put together, with the paths of the server
+	tree *shared.FSNode
+	// the tree as last synced, by path
+	known map[string]*shared.FSNode
+	// folders of tree the server was asked for
+	waiting map[string]*shared.FSNode
+	// the server sent a folder it wasn't asked for,
+	// the exchange is started over once done
+	again bool
+}
+
+func (c *client) newPull(ctx context.Context) (*pull, error) {
+	known, err := c.registry.known(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pull{
+		tree:    &shared.FSNode{Path: shared.Root, IsDir: true},
+		known:   known,
+		waiting: make(map[string]*shared.FSNode),
+	}, nil
+}
+
+// pullTree starts a tree exchange with the server, the tree
+// it puts together is then reconciled with the roots.
+func (c *client) pullTree(ctx context.Context, conn *websocket.Conn) error {
+	p, err := c.newPull(ctx)
+	if err != nil {
+		return err
+	}
+	c.pull = p
+	return c.ask(ctx, conn, []*shared.FSNode{p.tree})
+}
+
+// ask sends the hashes the client has for the folders.
+func (c *client) ask(ctx context.Context, conn *websocket.Conn, folders []*shared.FSNode) error {
+	req := shared.TreeRequest{Hashes: make(map[string]string, len(folders))}
+	for _, folder := range folders {
+		c.pull.waiting[folder.Path] = folder
+		var hash string
+		if known := c.pull.known[folder.Path]; known != nil {
+			hash = known.Hash
+		}
+		p := folder.Path
+		if v := c.registry.vault; v != nil {
+			p = v.sealPath(p)
+		}
+		req.Hashes[p] = hash
+	}
+	payload, err := shared.MarshalEnvl(req, shared.Hashes)
+	if err != nil {
+		return err
+	}
+	return conn.Write(ctx, websocket.MessageBinary, payload)
+}
+
+// pulled takes the folders of the reply into the tree put together
+// and asks for those of their childs that differ, the tree is synced
+// once the server has answered for all of them. Without an exchange
+// in progress, the server starts one with the top of the tree: it
+// changed in ways the events can't tell.
+func (c *client) pulled(ctx context.Context, conn *websocket.Conn, reply shared.TreeReply) error {
+	if c.pull == nil {
+		p, err := c.newPull(ctx)
+		if err != nil {
+			return err
+		}
+		p.waiting[shared.Root] = p.tree
+		c.pull = p
+	}
+	var (
+		p    = c.pull
+		r    = c.registry
+		next []*shared.FSNode
+	)
+	for wire, folder := range reply.Folders {
+		if v := r.vault; v != nil {
+			var err error
+			if wire, err = v.openPath(wire); err != nil {
+				slog.Error("skipping undecryptable folder", "err", err)
+				continue
+			}
+			if folder != nil {
+				if err := v.openTree(folder); err != nil {
+					slog.Error("skipping undecryptable folder", "err", err)
+					continue
+				}
+			}
+		}
+		node, ok := p.waiting[wire]
+		if !ok {
+			p.again = true
+			continue
+		}
+		delete(p.waiting, wire)
+		switch {
+		case folder == nil:
+			// removed from the server since
+			p.drop(wire)
+		case folder.Childs == nil:
+			// same hash, the database has it all
+			if known := p.known[wire]; known != nil {
+				*node = *known
+			}
+		default:
+			*node = *folder
+			for _, child := range node.Childs {
+				if child == nil || !child.IsDir ||
+					!r.roots.mirrors(child.Path) || !r.selection.Includes(child.Path) {
+					continue
+				}
+				if known := p.known[child.Path]; known != nil && known.Hash == child.Hash {
+					child.Childs = known.Childs
+					continue
+				}
+				next = append(next, child)
+			}
+		}
+	}
+	if len(next) > 0 {
+		return c.ask(ctx, conn, next)
+	}
+	if len(p.waiting) > 0 {
+		return nil
+	}
+	c.pull = nil
+	c.syncTree(ctx, p.tree)
+	if p.again {
+		return c.pullTree(ctx, conn)
+	}
+	return nil
+}
+
+// drop removes the folder at the path wire from the tree.
+func (p *pull) drop(wire string) {
+	node := p.tree
+	if rel, ok := strings.CutPrefix(path.Dir(wire), shared.Root+"/"); ok {
+		for _, name := range strings.Split(rel, "/") {
+			if node = node.Childs[name]; node == nil {
+				return
+			}
+		}
+	}
+	delete(node.Childs, path.Base(wire))
+}
+
+// known returns the tree of the server as last synced, by path.
+// It is built from the database with the paths of the server, its
+// folders hold the hash the server has for them when unchanged.
+func (r *registry) known(ctx context.Context) (map[string]*shared.FSNode, error) {
+	nodes := make(map[string]*shared.FSNode)
+	if r.DB == nil {
+		return nodes, nil
+	}
+	for _, root := range r.roots {
+		top := &shared.FSNode{
+			Path:   root.remote,
+			IsDir:  true,
+			Childs: make(map[string]*shared.FSNode),
+		}
+		nodes[root.remote] = top
+		files, err := r.DB.ListSubtree(ctx, database.ListSubtreeParams{
+			Path:   root.local,
+			Path_2: root.local + "/",
+			Path_3: root.local + "0",
+		})
+		if err != nil {
+			return nil, err
+		}
+		// parents are sorted before their childs
+		for _, f := range files {
+			wire, ok := r.roots.wire(f.Path)
+			if !ok {
+				continue
+			}
+			if wire == root.remote {
+				top.Revision = f.Revision
+				continue
+			}
+			parent := nodes[path.Dir(wire)]
+			if parent == nil || !parent.IsDir {
+				continue
+			}
+			node := &shared.FSNode{
+				Path:     wire,
+				ModTime:  f.Modtime,
+				Hash:     f.Hash,
+				Revision: f.Revision,
+				IsDir:    f.Isdir,
+				Mode:     uint32(f.Mode),
+				Link:     f.Link,
+			}
+			if f.Isdir {
+				node.Childs = make(map[string]*shared.FSNode)
+			}
+			nodes[wire] = node
+			parent.Childs[path.Base(wire)] = node
+		}
+		r.hashTree(top)
+	}
+	return nodes, nil
+}
+
+// hashTree sets the hashes of the folders of node the way the
+// server computes them, from the names it knows: the sealed ones
+// in end-to-end mode.
+func (r *registry) hashTree(node *shared.FSNode) {
+	if !node.IsDir {
+		return
+	}
+	childs := make(map[string]*shared.FSNode, len(node.Childs))
+	for name, child := range node.Childs {
+		r.hashTree(child)
+		if r.vault != nil {
+			name = r.vault.sealName(name)
+		}
+		childs[name] = child
+	}
+	node.Hash = shared.DirHash(childs)
+}
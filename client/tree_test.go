@@ -0,0 +1,187 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coder/websocket"
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+func TestPullTree(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		tmp   = t.TempDir()
+		local = path.Join(tmp, "client")
+		mu    sync.Mutex
+		asked []string
+	)
+	db, err := makeDB(path.Join(tmp, "client.db"), "sqlite")
+	require.NoError(t, err)
+	serverDB, err := makeDB(path.Join(tmp, "server.db"), "sqlite")
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(path.Join(tmp, "server"), 0777))
+	require.NoError(t, os.Mkdir(local, 0777))
+	t.Chdir(path.Join(tmp, "server"))
+	require.NoError(t, shared.MakeStorage())
+
+	hub := shared.NewServerHub(serverDB)
+	process := func(event *shared.FileEvent) {
+		t.Helper()
+		require.NoError(t, hub.Process(ctx, event))
+	}
+	for _, event := range []*shared.FileEvent{
+		{Path: "storage/docs", IsDir: true},
+		{Path: "storage/docs/a.txt", Data: []byte("a")},
+		{Path: "storage/docs/sub", IsDir: true},
+		{Path: "storage/docs/sub/b.txt", Data: []byte("b")},
+		{Path: "storage/music", IsDir: true},
+		{Path: "storage/music/c.txt", Data: []byte("c")},
+	} {
+		event.Op = fsnotify.Create.String()
+		process(event)
+	}
+
+	// answers the hashes the way the server does
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			_, msg, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			var (
+				env shared.Envelope
+				req shared.TreeRequest
+			)
+			if json.Unmarshal(msg, &env) != nil || json.Unmarshal(env.Message, &req) != nil {
+				return
+			}
+			reply := shared.TreeReply{Folders: make(map[string]*shared.FSNode)}
+			for p, hash := range req.Hashes {
+				mu.Lock()
+				asked = append(asked, p)
+				mu.Unlock()
+				folder, err := hub.Folder(ctx, p)
+				if err != nil {
+					reply.Folders[p] = nil
+					continue
+				}
+				if folder.Hash == hash {
+					folder.Childs = nil
+				}
+				reply.Folders[p] = folder
+			}
+			payload, err := shared.MarshalEnvl(reply, shared.Folders)
+			if err != nil || conn.Write(ctx, websocket.MessageBinary, payload) != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.CloseNow()
+
+	r := newRegistry(nil, db)
+	c := &client{registry: r}
+	c.setRoots(roots{{local: local, remote: shared.Root}})
+	reset := func() {
+		mu.Lock()
+		asked = nil
+		mu.Unlock()
+	}
+	// pull runs an exchange to its end, it returns
+	// the folders asked for and the events sent
+	pull := func(start bool) ([]string, []shared.FileEvent) {
+		t.Helper()
+		if start {
+			reset()
+			require.NoError(t, c.pullTree(ctx, conn))
+		}
+		for c.pull != nil || start {
+			start = false
+			_, msg, err := conn.Read(ctx)
+			require.NoError(t, err)
+			var (
+				env   shared.Envelope
+				reply shared.TreeReply
+			)
+			require.NoError(t, json.Unmarshal(msg, &env))
+			require.Equal(t, shared.Folders, env.Type)
+			require.NoError(t, json.Unmarshal(env.Message, &reply))
+			require.NoError(t, c.pulled(ctx, conn, reply))
+		}
+		var events []shared.FileEvent
+		for len(r.msgBuffer) > 0 {
+			events = append(events, decodeEvent(t, <-r.msgBuffer))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		slices.Sort(asked)
+		return asked, events
+	}
+
+	// the same content is already there, nothing is known yet
+	require.NoError(t, os.MkdirAll(path.Join(local, "docs", "sub"), 0777))
+	require.NoError(t, os.MkdirAll(path.Join(local, "music"), 0777))
+	for p, data := range map[string]string{"docs/a.txt": "a", "docs/sub/b.txt": "b", "music/c.txt": "c"} {
+		require.NoError(t, os.WriteFile(path.Join(local, p), []byte(data), 0777))
+	}
+	got, events := pull(true)
+	require.Equal(t, []string{"storage", "storage/docs", "storage/docs/sub", "storage/music"}, got)
+	require.Empty(t, events)
+	f, err := db.GetFile(ctx, path.Join(local, "docs", "sub", "b.txt"))
+	require.NoError(t, err)
+	require.Equal(t, sum("b"), f.Hash)
+
+	// both sides agree, only the top is compared
+	got, events = pull(true)
+	require.Equal(t, []string{"storage"}, got)
+	require.Empty(t, events)
+
+	// only the folders holding the change are
+	process(&shared.FileEvent{Path: "storage/docs/sub/b.txt", Op: fsnotify.Write.String(), Data: []byte("b2"), Revision: 1})
+	got, events = pull(true)
+	require.Equal(t, []string{"storage", "storage/docs", "storage/docs/sub"}, got)
+	require.Len(t, events, 1)
+	require.Equal(t, shared.Update, events[0].Op)
+	require.Equal(t, path.Join(local, "docs", "sub", "b.txt"), events[0].Path)
+
+	// the local changes of the agreed subtrees are still sent
+	require.NoError(t, os.WriteFile(path.Join(local, "music", "c.txt"), []byte("c2"), 0777))
+	_, events = pull(true)
+	require.Len(t, events, 2)
+	require.ElementsMatch(t, []string{shared.Update, fsnotify.Write.String()}, []string{events[0].Op, events[1].Op})
+
+	// the server starts an exchange with the top of the tree
+	process(&shared.FileEvent{Path: "storage/music/c.txt", Op: fsnotify.Remove.String()})
+	folder, err := hub.Folder(ctx, shared.Root)
+	require.NoError(t, err)
+	payload, err := shared.MarshalEnvl(shared.TreeReply{Folders: map[string]*shared.FSNode{shared.Root: folder}}, shared.Folders)
+	require.NoError(t, err)
+	var env shared.Envelope
+	require.NoError(t, json.Unmarshal(payload, &env))
+	var reply shared.TreeReply
+	require.NoError(t, json.Unmarshal(env.Message, &reply))
+	reset()
+	require.NoError(t, c.pulled(ctx, conn, reply))
+	got, _ = pull(false)
+	require.Contains(t, got, "storage/music")
+	require.NotContains(t, got, "storage")
+	require.NoFileExists(t, path.Join(local, "music", "c.txt"), "moved to the backups")
+}
@@ -0,0 +1,359 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+const (
+	// blockSize is the size of the plaintext
+	// blocks file contents are sealed by
+	blockSize = 64 << 10
+	// the cost of the derivation is
+	// what slows guessing down
+	kdfIterations = 600_000
+	// the salt of the user is drawn by
+	// the server, which keeps it
+	minSaltSize = 16
+)
+
+var (
+	ErrNoPassphrase  = errors.New("vault: empty passphrase")
+	ErrShortSalt     = errors.New("vault: salt too short")
+	ErrUndecryptable = errors.New("vault: undecryptable content")
+)
+
+// the kinds of plaintext nonces are derived from
+const (
+	nameNonce byte = iota
+	blockNonce
+)
+
+// vault encrypts the names and contents of the files before
+// they are sent to the server, the server only ever sees
+// ciphertext. Encryption is deterministic, nonces are derived
+// from the plaintext, so that the server can still look files
+// up by path and deduplicate contents. Only the blocks left
+// untouched at the same offset are reused by delta transfers.
+// The price is that the server can tell equal names, and equal
+// blocks at the same offset, apart.
+type vault struct {
+	names   cipher.AEAD
+	content cipher.AEAD
+	// keys the derivation of the nonces
+	nonceKey []byte
+}
+
+// newVault derives the keys of the vault from the passphrase and
+// the salt, every device of the user has to use the same ones.
+func newVault(passphrase string, salt []byte) (*vault, error) {
+	if passphrase == "" {
+		return nil, ErrNoPassphrase
+	}
+	if len(salt) < minSaltSize {
+		return nil, ErrShortSalt
+	}
+	master, err := pbkdf2.Key(sha256.New, passphrase, salt, kdfIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	v := &vault{}
+	if v.names, err = newAEAD(master, "names"); err != nil {
+		return nil, err
+	}
+	if v.content, err = newAEAD(master, "content"); err != nil {
+		return nil, err
+	}
+	if v.nonceKey, err = hkdf.Key(sha256.New, master, nil, "nonces", 32); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func newAEAD(master []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, master, nil, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce derives the nonce sealing data
+// along with its additional data.
+func (v *vault) nonce(kind byte, ad, data []byte) []byte {
+	mac := hmac.New(sha256.New, v.nonceKey)
+	mac.Write([]byte{kind})
+	mac.Write(ad)
+	mac.Write(data)
+	return mac.Sum(nil)[:v.names.NonceSize()]
+}
+
+// sealName encrypts a single path component, the result
+// is URL safe base64 and holds no path separator.
+func (v *vault) sealName(name string) string {
+	nonce := v.nonce(nameNonce, nil, []byte(name))
+	sealed := v.names.Seal(nonce, nonce, []byte(name), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func (v *vault) openName(name string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(sealed) < v.names.NonceSize() {
+		return "", ErrUndecryptable
+	}
+	nonce, ciphertext := sealed[:v.names.NonceSize()], sealed[v.names.NonceSize():]
+	plain, err := v.names.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", ErrUndecryptable
+	}
+	return string(plain), nil
+}
+
+// sealPath encrypts every component of p but
+// the storage directory it is rooted at.
+func (v *vault) sealPath(p string) string {
+	if p == "" {
+		return p
+	}
+	parts := strings.Split(path.Clean(p), "/")
+	for i := 1; i < len(parts); i++ {
+		parts[i] = v.sealName(parts[i])
+	}
+	return path.Join(parts...)
+}
+
+func (v *vault) openPath(p string) (string, error) {
+	if p == "" {
+		return p, nil
+	}
+	parts := strings.Split(path.Clean(p), "/")
+	for i := 1; i < len(parts); i++ {
+		name, err := v.openName(parts[i])
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", err, p)
+		}
+		parts[i] = name
+	}
+	return path.Join(parts...), nil
+}
+
+// blockAD binds a block to its position, and
+// the last one to the end of the content, so
+// that blocks can't be reordered or dropped.
+func blockAD(index int64, final bool) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, uint64(index))
+	if final {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// seal encrypts the content read from r block by block,
+// empty contents are sealed as a single empty block.
+func (v *vault) seal(w io.Writer, r io.Reader) error {
+	var (
+		br    = bufio.NewReader(r)
+		block = make([]byte, blockSize)
+	)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(br, block)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		final := n < blockSize
+		if !final {
+			if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+				final = true
+			}
+		}
+		ad := blockAD(index, final)
+		nonce := v.nonce(blockNonce, ad, block[:n])
+		if _, err := w.Write(v.content.Seal(nonce, nonce, block[:n], ad)); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// open decrypts the content sealed by seal,
+// truncated or altered contents are rejected.
+func (v *vault) open(w io.Writer, r io.Reader) error {
+	var (
+		br     = bufio.NewReader(r)
+		size   = v.content.NonceSize()
+		sealed = make([]byte, blockSize+size+v.content.Overhead())
+	)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(br, sealed)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		final := n < len(sealed)
+		if !final {
+			if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+				final = true
+			}
+		}
+		if n < size {
+			return ErrUndecryptable
+		}
+		plain, err := v.content.Open(nil, sealed[:size], sealed[size:n], blockAD(index, final))
+		if err != nil {
+			return ErrUndecryptable
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+func (v *vault) sealData(data []byte) []byte {
+	var buf bytes.Buffer
+	// writing to a buffer doesn't fail
+	v.seal(&buf, bytes.NewReader(data))
+	return buf.Bytes()
+}
+
+func (v *vault) openData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := v.open(&buf, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// hash returns the SHA-256 of the sealed content, the hash the
+// server knows the content by. Without the key it tells nothing
+// about the plaintext.
+func (v *vault) hash(r io.Reader) (string, error) {
+	hasher := sha256.New()
+	if err := v.seal(hasher, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// convert writes the sealed or opened content of the file at
+// src to a temporary file of dir and returns its path.
+func convert(dir, src string, fn func(io.Writer, io.Reader) error) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	if stat, err := in.Stat(); err != nil {
+		return "", err
+	} else if stat.IsDir() {
+		return "", shared.ErrMalformedEvent
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	out, err := os.CreateTemp(dir, "*.vault")
+	if err != nil {
+		return "", err
+	}
+	if err := fn(out, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+func (v *vault) sealFile(dir, src string) (string, error) {
+	return convert(dir, src, v.seal)
+}
+
+func (v *vault) openFile(dir, src string) (string, error) {
+	return convert(dir, src, v.open)
+}
+
+// sealEvent encrypts the paths and the content of an event
+// about to be sent, its hash is already the sealed one.
+func (v *vault) sealEvent(event *shared.FileEvent) {
+	event.Path = v.sealPath(event.Path)
+	event.NewPath = v.sealPath(event.NewPath)
+	event.ConflictOf = v.sealPath(event.ConflictOf)
+	if event.Data != nil {
+		event.Data = v.sealData(event.Data)
+	}
+}
+
+// openEvent decrypts an event received from the server.
+func (v *vault) openEvent(event *shared.FileEvent) error {
+	var err error
+	if event.Path, err = v.openPath(event.Path); err != nil {
+		return err
+	}
+	if event.NewPath, err = v.openPath(event.NewPath); err != nil {
+		return err
+	}
+	if event.ConflictOf, err = v.openPath(event.ConflictOf); err != nil {
+		return err
+	}
+	if len(event.Data) > 0 {
+		if event.Data, err = v.openData(event.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openTree decrypts the paths of the tree, the nodes that
+// can't be decrypted (left by clients without the key or
+// with another one) are left out.
+func (v *vault) openTree(node *shared.FSNode) error {
+	p, err := v.openPath(node.Path)
+	if err != nil {
+		return err
+	}
+	node.Path = p
+	if node.Childs == nil {
+		return nil
+	}
+	childs := make(map[string]*shared.FSNode, len(node.Childs))
+	for _, child := range node.Childs {
+		if child == nil {
+			continue
+		}
+		if err := v.openTree(child); err != nil {
+			slog.Error("skipping undecryptable node", "err", err)
+			continue
+		}
+		childs[path.Base(child.Path)] = child
+	}
+	node.Childs = childs
+	return nil
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+// testSalt is the salt of the vaults of the tests.
+var testSalt = []byte("0123456789abcdef")
+
+func TestVault(t *testing.T) {
+	v, err := newVault("correct horse battery staple", testSalt)
+	require.NoError(t, err)
+	other, err := newVault("another passphrase", testSalt)
+	require.NoError(t, err)
+	_, err = newVault("", testSalt)
+	require.ErrorIs(t, err, ErrNoPassphrase)
+	_, err = newVault("correct horse battery staple", testSalt[:8])
+	require.ErrorIs(t, err, ErrShortSalt)
+	// the same passphrase under another salt gives other keys
+	resalted, err := newVault("correct horse battery staple", []byte("fedcba9876543210"))
+	require.NoError(t, err)
+	require.NotEqual(t, v.sealPath("storage/notes.txt"), resalted.sealPath("storage/notes.txt"))
+
+	// paths
+	p := path.Join(storage, "dir-1", "notes.txt")
+	sealedPath := v.sealPath(p)
+	require.True(t, strings.HasPrefix(sealedPath, storage+"/"))
+	require.NotContains(t, sealedPath, "notes")
+	require.Len(t, strings.Split(sealedPath, "/"), 3)
+	require.Equal(t, sealedPath, v.sealPath(p), "names are sealed deterministically")
+	require.Equal(t, path.Dir(sealedPath), v.sealPath(path.Dir(p)), "parents keep their sealed name")
+	opened, err := v.openPath(sealedPath)
+	require.NoError(t, err)
+	require.Equal(t, p, opened)
+	_, err = other.openPath(sealedPath)
+	require.ErrorIs(t, err, ErrUndecryptable)
+	_, err = v.openPath(p)
+	require.ErrorIs(t, err, ErrUndecryptable)
+
+	// contents
+	random := make([]byte, 3*blockSize+10)
+	rand.Read(random)
+	for _, size := range []int{0, 1, blockSize - 1, blockSize, blockSize + 1, len(random)} {
+		data := random[:size]
+		sealed := v.sealData(data)
+		if size >= 32 {
+			require.NotContains(t, string(sealed), string(data[:32]))
+		}
+		require.Equal(t, sealed, v.sealData(data), "size %d", size)
+
+		opened, err := v.openData(sealed)
+		require.NoError(t, err, "size %d", size)
+		require.True(t, bytes.Equal(data, opened), "size %d", size)
+
+		sum := sha256.Sum256(sealed)
+		hash, err := v.hash(bytes.NewReader(data))
+		require.NoError(t, err)
+		require.Equal(t, hex.EncodeToString(sum[:]), hash, "size %d", size)
+
+		_, err = other.openData(sealed)
+		require.ErrorIs(t, err, ErrUndecryptable, "size %d", size)
+	}
+
+	// blocks that didn't change are sealed the same
+	edited := bytes.Clone(random)
+	edited[len(edited)-1]++
+	require.Equal(t, v.sealData(random)[:blockSize], v.sealData(edited)[:blockSize])
+
+	// tampering, truncation and reordering are detected
+	content := v.sealData(random)
+	tampered := bytes.Clone(content)
+	tampered[100]++
+	_, err = v.openData(tampered)
+	require.ErrorIs(t, err, ErrUndecryptable)
+	block := len(content) / 4
+	_, err = v.openData(content[:block])
+	require.ErrorIs(t, err, ErrUndecryptable)
+	swapped := append(bytes.Clone(content[block:2*block]), content[:block]...)
+	_, err = v.openData(append(swapped, content[2*block:]...))
+	require.ErrorIs(t, err, ErrUndecryptable)
+	_, err = v.openData(nil)
+	require.ErrorIs(t, err, ErrUndecryptable)
+
+	// events and trees
+	event := &shared.FileEvent{
+		Path:       p,
+		NewPath:    path.Join(storage, "dir-2", "notes.txt"),
+		ConflictOf: path.Join(storage, "notes.txt"),
+		Op:         fsnotify.Rename.String(),
+		Data:       []byte("hello"),
+	}
+	wire := *event
+	v.sealEvent(&wire)
+	require.NotEqual(t, event.NewPath, wire.NewPath)
+	require.NotEqual(t, event.Data, wire.Data)
+	require.NoError(t, v.openEvent(&wire))
+	require.Equal(t, *event, wire)
+
+	tree := &shared.FSNode{
+		Path:  storage,
+		IsDir: true,
+		Childs: map[string]*shared.FSNode{
+			path.Base(sealedPath): {Path: sealedPath},
+			"plain.txt":           {Path: path.Join(storage, "plain.txt")},
+		},
+	}
+	require.NoError(t, v.openTree(tree))
+	require.Len(t, tree.Childs, 1, "undecryptable nodes are left out")
+	require.Equal(t, p, tree.Childs["notes.txt"].Path)
+}
+
+func TestVaultWrite(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	require.NoError(t, os.Mkdir(storage, 0777))
+
+	v, err := newVault("correct horse battery staple", testSalt)
+	require.NoError(t, err)
+	r := newRegistry(nil, nil)
+	r.vault = v
+
+	var (
+		p    = path.Join(storage, "doc.txt")
+		data = []byte("secret content")
+	)
+	require.NoError(t, os.WriteFile(p, data, 0777))
+	require.NoError(t, r.Write(context.Background(), fsnotify.Event{Name: p, Op: fsnotify.Create}))
+
+	// the event is kept in plaintext and carries
+	// the hash the server knows the content by
+	event := peekEvent(<-r.msgBuffer)
+	require.NotNil(t, event)
+	require.Equal(t, p, event.Path)
+	require.Equal(t, data, event.Data)
+	sum := sha256.Sum256(v.sealData(data))
+	require.Equal(t, hex.EncodeToString(sum[:]), event.Hash)
+
+	hash, err := r.hashFile(p)
+	require.NoError(t, err)
+	require.Equal(t, event.Hash, hash)
+
+	// the sealed copy of a file opens back to it
+	sealed, err := v.sealFile(path.Join(storage, shared.TmpDir), p)
+	require.NoError(t, err)
+	opened, err := v.openFile(path.Join(storage, shared.TmpDir), sealed)
+	require.NoError(t, err)
+	got, err := os.ReadFile(opened)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
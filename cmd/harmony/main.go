@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/joho/godotenv"
+	"github.com/thesicktwist1/harmony/client"
+	"github.com/thesicktwist1/harmony/server"
+)
+
+// command runs with the arguments following its name,
+// its flags come before the other arguments.
+type command struct {
+	name string
+	args string
+	help string
+	run  func(ctx context.Context, args []string, out io.Writer) error
+}
+
+// quiet adapts the commands that only log.
+func quiet(run func(context.Context, []string) error) func(context.Context, []string, io.Writer) error {
+	return func(ctx context.Context, args []string, _ io.Writer) error {
+		return run(ctx, args)
+	}
+}
+
+var commands = []command{
+	{"server", "", "serve the trees of the enrolled devices", quiet(server.Run)},
+	{"client", "", "sync the roots with the server", quiet(client.Run)},
+	{"mount", "<dir>", "sync a single root and serve it at dir", quiet(client.Mount)},
+	{"fetch", "<path>...", "download the content of placeholders", quiet(client.Fetch)},
+	{"status", "", "show pending events, the last sync and connected peers", client.Status},
+	{"ls", "[path]", "list a folder of the server", client.List},
+	{"tree", "[path]", "print the tree of the server", client.Tree},
+	{"get", "<path> [dest]", "download a file of the server, - for stdout", client.Get},
+	{"put", "<file> <path>", "upload a file to the server", client.Put},
+	{"history", "<path>", "list the versions of a file", client.History},
+	{"restore", "<version>", "restore a version of a file", client.Restore},
+	{"trash", "[restore|purge <id>]", "list or manage the trash", client.Trash},
+	{"devices", "[enroll|revoke ...]", "list or manage the enrolled devices", client.Devices},
+}
+
+var errNoCommand = errors.New("no command given")
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: harmony <command> [flags] [args]")
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.help)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run harmony <command> -h for the flags of a command.")
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return errNoCommand
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage(out)
+		return nil
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(ctx, args[1:], out)
+		}
+	}
+	usage(os.Stderr)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func main() {
+	// the environment is enough without a .env file
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal(".env unreadable: ", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatal(err)
+	}
+}
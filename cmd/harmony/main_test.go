@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	require.NoError(t, run(ctx, []string{"help"}, &out))
+	for _, c := range commands {
+		require.Contains(t, out.String(), "  "+c.name+" ")
+	}
+
+	require.ErrorIs(t, run(ctx, nil, &out), errNoCommand)
+	require.ErrorContains(t, run(ctx, []string{"pull"}, &out), `unknown command "pull"`)
+	// the arguments following the name go to the command
+	require.ErrorContains(t, run(ctx, []string{"put", "a.txt"}, &out), "usage: harmony put")
+}
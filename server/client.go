@@ -1,10 +1,12 @@
-package main
+package server
 
 import (
 	"context"
 	"log"
+	"path"
 
 	"github.com/coder/websocket"
+	"github.com/thesicktwist1/harmony/shared"
 )
 
 const (
@@ -12,10 +14,21 @@ const (
 )
 
 type Client struct {
-	name      string
+	// name of the device the
+	// client authenticated as
+	name   string
+	device int64
+	// user whose tree the client syncs
+	user string
+	// subtrees the client mirrors, guarded by the server lock
+	selection shared.Selection
 	msgBuffer chan []byte
 	conn      *websocket.Conn
 	server    *server
+	// uploads in progress
+	transfers *shared.Transfers
+	// closed once the client is removed
+	done chan struct{}
 }
 
 func newClient(conn *websocket.Conn, server *server) *Client {
@@ -23,6 +36,8 @@ func newClient(conn *websocket.Conn, server *server) *Client {
 		msgBuffer: make(chan []byte, bufferSize),
 		conn:      conn,
 		server:    server,
+		transfers: shared.NewTransfers(path.Join(shared.Root, shared.TmpDir), server.store),
+		done:      make(chan struct{}),
 	}
 }
 
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+var (
+	errTLSPair     = errors.New("tls-cert and tls-key have to be set together")
+	errClientNoTLS = errors.New("client-ca requires tls-cert and tls-key")
+)
+
+// config is read from the environment, the .env file
+// included, flags taking precedence over it.
+type config struct {
+	addr     string
+	certFile string
+	keyFile  string
+	// clients have to present a certificate signed
+	// by one of the authorities of the bundle
+	clientCA string
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func loadConfig(args []string) (config, error) {
+	var c config
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.StringVar(&c.addr, "addr", envOr("LISTEN_ADDR", defaultAddr), "address to listen on (LISTEN_ADDR)")
+	fs.StringVar(&c.certFile, "tls-cert", os.Getenv("TLS_CERT"), "TLS certificate file (TLS_CERT)")
+	fs.StringVar(&c.keyFile, "tls-key", os.Getenv("TLS_KEY"), "TLS key file (TLS_KEY)")
+	fs.StringVar(&c.clientCA, "client-ca", os.Getenv("TLS_CLIENT_CA"), "CA bundle verifying client certificates (TLS_CLIENT_CA)")
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if (c.certFile == "") != (c.keyFile == "") {
+		return c, errTLSPair
+	}
+	if c.clientCA != "" && c.certFile == "" {
+		return c, errClientNoTLS
+	}
+	return c, nil
+}
+
+// tlsConfig is nil when the server is served over plain HTTP.
+func (c config) tlsConfig() (*tls.Config, error) {
+	if c.certFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.clientCA != "" {
+		pool, err := shared.CertPool(c.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// listConflicts answers GET /conflicts.
+func (s *server) listConflicts(w http.ResponseWriter, r *http.Request) {
+	conflicts, err := s.Conflicts(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(conflicts); err != nil {
+		slog.Error("unable to write conflicts", "err", err)
+	}
+}
+
+// resolveConflict answers POST /conflicts/{id}/resolve?keep=copy|original,
+// the conflict copy is removed and, when kept, replaces the original.
+func (s *server) resolveConflict(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var keepCopy bool
+	switch keep := r.URL.Query().Get("keep"); keep {
+	case "copy":
+		keepCopy = true
+	case "original":
+	default:
+		http.Error(w, fmt.Sprintf("invalid keep %q", keep), http.StatusBadRequest)
+		return
+	}
+	events, err := s.ResolveConflict(r.Context(), id, keepCopy)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	for _, event := range events {
+		if event.Dedup {
+			if err := s.relay(s.detach(r), event, nil); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			continue
+		}
+		if err := s.publish(s.detach(r), *event, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
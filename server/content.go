@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+// getContent answers GET /content?path=storage/... with the
+// current content of the file, clients in online-only mode
+// fetch the files they only have a placeholder of.
+func (s *server) getContent(w http.ResponseWriter, r *http.Request) {
+	blob, err := s.Content(r.Context(), r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	file, err := os.Open(blob)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", stat.ModTime(), file)
+}
+
+// putContent answers PUT /content?path=storage/... with the
+// content as body. The file is created or overwritten whatever
+// its revision, clients get the content like any other write.
+func (s *server) putContent(w http.ResponseWriter, r *http.Request) {
+	dir := path.Join(shared.Root, shared.TmpDir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmp, err := os.CreateTemp(dir, "*.upload")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// moved to the blob store unless
+	// the content is already there
+	defer os.Remove(tmp.Name())
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), r.Body); err != nil {
+		tmp.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the content is moved to the blob store by the create, which
+	// is rolled back when the file exists: the write needs a copy
+	retry := tmp.Name() + ".retry"
+	if err := os.Link(tmp.Name(), retry); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(retry)
+	ctx := s.detach(r)
+	event := &shared.FileEvent{
+		Path:   r.URL.Query().Get("path"),
+		Op:     fsnotify.Create.String(),
+		Hash:   hex.EncodeToString(hasher.Sum(nil)),
+		Source: tmp.Name(),
+	}
+	err = s.Process(ctx, event)
+	if errors.Is(err, shared.ErrConflict) {
+		// the file exists, its current
+		// revision is in the event
+		event.Op = fsnotify.Write.String()
+		event.Source = retry
+		err = s.Process(ctx, event)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	if err := s.relay(ctx, event, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(shared.NewResult(event, nil)); err != nil {
+		slog.Error("unable to write result", "err", err)
+	}
+}
+
+// getTree answers GET /tree with the tree of the user,
+// the one sent to clients as they connect.
+func (s *server) getTree(w http.ResponseWriter, r *http.Request) {
+	tree, err := s.Tree(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tree); err != nil {
+		slog.Error("unable to write tree", "err", err)
+	}
+}
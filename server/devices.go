@@ -0,0 +1,184 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+type deviceKey struct{}
+
+func deviceOf(ctx context.Context) shared.Device {
+	device, _ := ctx.Value(deviceKey{}).(shared.Device)
+	return device
+}
+
+// detach returns the context of the work outliving the request,
+// it keeps the user of the request but not its cancellation.
+func (s *server) detach(r *http.Request) context.Context {
+	return shared.WithNamespace(s.ctx, shared.NamespaceOf(r.Context()))
+}
+
+// bearer returns the token of the Authorization header.
+func bearer(r *http.Request) string {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authenticate lets through the requests carrying the token of
+// an enrolled device, the device is the author of what follows.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		device, err := s.Authenticate(r.Context(), bearer(r))
+		if err != nil {
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+		ctx := context.WithValue(r.Context(), deviceKey{}, device)
+		ctx = shared.WithAuthor(ctx, device.Name)
+		ctx = shared.WithNamespace(ctx, device.User)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// admin lets through the requests carrying the admin token.
+func (s *server) admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.Error(w, "device enrollment is disabled", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(bearer(r)), []byte(s.adminToken)) != 1 {
+			http.Error(w, shared.ErrUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// enrollment is the answer to POST /devices, the token
+// is only ever shown here.
+type enrollment struct {
+	Device shared.Device `json:"device"`
+	Token  string        `json:"token"`
+}
+
+// enrollDevice answers POST /devices with a body of
+// {"name": "laptop", "user": "alice"}, the device syncs
+// the tree of the default user when user is left out.
+func (s *server) enrollDevice(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+		User string `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	device, token, err := s.EnrollDevice(r.Context(), body.Name, body.User)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(enrollment{Device: device, Token: token}); err != nil {
+		slog.Error("unable to write enrollment", "err", err)
+	}
+}
+
+// listDevices answers GET /devices.
+func (s *server) listDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := s.Devices(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(devices); err != nil {
+		slog.Error("unable to write devices", "err", err)
+	}
+}
+
+// revokeDevice answers DELETE /devices/{id}, the
+// device is disconnected right away.
+func (s *server) revokeDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.RevokeDevice(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	s.disconnect(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listPeers answers GET /peers with the devices of
+// the user currently connected to the server.
+func (s *server) listPeers(w http.ResponseWriter, r *http.Request) {
+	user := deviceOf(r.Context()).User
+	peers := []shared.Peer{}
+	s.RLock()
+	for client := range s.clients {
+		if client.user == user {
+			peers = append(peers, shared.Peer{Device: client.device, Name: client.name})
+		}
+	}
+	s.RUnlock()
+	slices.SortFunc(peers, func(a, b shared.Peer) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(peers); err != nil {
+		slog.Error("unable to write peers", "err", err)
+	}
+}
+
+// vaultInfo is the answer to GET /vault.
+type vaultInfo struct {
+	Salt string `json:"salt"`
+}
+
+// getVault answers GET /vault with the salt the devices of the
+// user derive their end-to-end encryption keys with.
+func (s *server) getVault(w http.ResponseWriter, r *http.Request) {
+	salt, err := s.VaultSalt(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(vaultInfo{Salt: salt}); err != nil {
+		slog.Error("unable to write vault", "err", err)
+	}
+}
+
+// disconnect closes the connections of the device.
+func (s *server) disconnect(device int64) {
+	s.RLock()
+	var clients []*Client
+	for client := range s.clients {
+		if client.device == device {
+			clients = append(clients, client)
+		}
+	}
+	s.RUnlock()
+	for _, client := range clients {
+		s.removeClient(client)
+	}
+}
@@ -1,23 +1,50 @@
-package main
+package server
 
 import (
+	"crypto/tls"
+	"time"
+
 	"github.com/coder/websocket"
+	"github.com/thesicktwist1/harmony/shared"
 )
 
 type optsFunc func(*opts)
 
 func defaultOpts() *opts {
 	return &opts{
-		maxConn:    defaultMaxConn,
-		readLimit:  defaultReadLimit,
-		acceptOpts: nil,
+		addr:        defaultAddr,
+		maxConn:     defaultMaxConn,
+		readLimit:   defaultReadLimit,
+		acceptOpts:  nil,
+		retention:   shared.DefaultRetention,
+		trashExpiry: shared.DefaultTrashExpiry,
 	}
 }
 
 type opts struct {
-	maxConn    int
-	readLimit  int64
-	acceptOpts *websocket.AcceptOptions
+	addr        string
+	maxConn     int
+	readLimit   int64
+	acceptOpts  *websocket.AcceptOptions
+	retention   shared.Retention
+	trashExpiry time.Duration
+	// token guarding the enrollment of devices,
+	// enrollment is disabled when empty
+	adminToken string
+	// served over plain HTTP when nil
+	tlsConfig *tls.Config
+}
+
+func withAddr(addr string) optsFunc {
+	return func(o *opts) {
+		o.addr = addr
+	}
+}
+
+func withTLS(cfg *tls.Config) optsFunc {
+	return func(o *opts) {
+		o.tlsConfig = cfg
+	}
 }
 
 func withMaxConn(n int) optsFunc {
@@ -37,3 +64,21 @@ func withAcceptOpts(aOpts *websocket.AcceptOptions) optsFunc {
 		o.acceptOpts = aOpts
 	}
 }
+
+func withRetention(r shared.Retention) optsFunc {
+	return func(o *opts) {
+		o.retention = r
+	}
+}
+
+func withTrashExpiry(d time.Duration) optsFunc {
+	return func(o *opts) {
+		o.trashExpiry = d
+	}
+}
+
+func withAdminToken(token string) optsFunc {
+	return func(o *opts) {
+		o.adminToken = token
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/thesicktwist1/harmony/shared"
+	_ "github.com/tursodatabase/libsql-client-go/libsql"
+)
+
+// how long the requests in progress are
+// waited for once the server is stopped
+const shutdownTimeout = 10 * time.Second
+
+var errNoDatabase = errors.New("DATABASE_URL environment variable is not set")
+
+// Run serves the trees of the users until ctx is done,
+// args are the flags of the server.
+func Run(ctx context.Context, args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return err
+	}
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		return errNoDatabase
+	}
+	db, err := shared.OpenWithGoose(dbURL, "libsql")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	server := NewServer(ctx, db,
+		withAdminToken(os.Getenv("ADMIN_TOKEN")),
+		withAddr(cfg.addr),
+		withTLS(tlsConfig),
+	)
+
+	if err := shared.MakeStorage(); err != nil {
+		return err
+	}
+	if err := server.Import(ctx); err != nil {
+		return err
+	}
+
+	go server.collectGarbage(ctx)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		log.Print("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	if err := server.serve(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-shutdown
+}
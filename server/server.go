@@ -1,13 +1,16 @@
-package main
+package server
 
 import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/coder/websocket"
 	"github.com/fsnotify/fsnotify"
@@ -18,13 +21,15 @@ import (
 
 var (
 	ErrServerFull = fmt.Errorf("connection not allowed: server full")
+	errClientGone = fmt.Errorf("client disconnected")
 )
 
 const (
 	defaultMaxConn   = 4
 	defaultReadLimit = -1
-	port             = ":8080"
-	storage          = "storage"
+	defaultAddr      = ":8080"
+	// how often unreferenced blobs are removed
+	gcInterval = time.Hour
 )
 
 type message struct {
@@ -34,6 +39,36 @@ type message struct {
 
 type clientList map[*Client]struct{}
 
+// store is the server side hub, the tree is kept in the
+// database and the content of the files in the blob store.
+type store interface {
+	shared.Hub
+	shared.ChunkSource
+	Tree(context.Context) (*shared.FSNode, error)
+	Folder(context.Context, string) (*shared.FSNode, error)
+	Content(context.Context, string) (string, error)
+	CollectGarbage(context.Context) error
+	Import(context.Context) error
+	Versions(context.Context, string) ([]shared.Version, error)
+	Restore(context.Context, int64) (*shared.FileEvent, error)
+	PruneVersions(context.Context) error
+	Trash(context.Context) ([]shared.TrashEntry, error)
+	RestoreTrash(context.Context, int64) ([]*shared.FileEvent, error)
+	PurgeTrash(context.Context, int64) error
+	ExpireTrash(context.Context, time.Duration) error
+	Conflicts(context.Context) ([]shared.Conflict, error)
+	ResolveConflict(context.Context, int64, bool) ([]*shared.FileEvent, error)
+	ShareFolder(context.Context, string, string, bool) (shared.Share, error)
+	Shares(context.Context) ([]shared.Share, error)
+	Unshare(context.Context, int64) (shared.Share, error)
+	Route(context.Context, shared.FileEvent) (map[string]shared.FileEvent, error)
+	EnrollDevice(context.Context, string, string) (shared.Device, string, error)
+	Authenticate(context.Context, string) (shared.Device, error)
+	Devices(context.Context) ([]shared.Device, error)
+	RevokeDevice(context.Context, int64) (shared.Device, error)
+	VaultSalt(context.Context) (string, error)
+}
+
 type server struct {
 	clients clientList
 
@@ -43,7 +78,7 @@ type server struct {
 
 	sync.RWMutex
 
-	shared.Hub
+	store
 
 	http.Server
 }
@@ -55,18 +90,47 @@ func NewServer(ctx context.Context, db *sql.DB, optsfunc ...optsFunc) *server {
 	}
 	mux := chi.NewMux()
 
+	hub := shared.NewServerHub(database.New(db))
+	hub.Retention = o.retention
 	s := &server{
 		clients: make(clientList),
 		opts:    o,
-		Hub:     shared.NewServerHub(database.New(db)),
+		store:   hub,
 		ctx:     ctx,
 		Server: http.Server{
-			Addr:    port,
-			Handler: mux,
+			Addr:      o.addr,
+			Handler:   mux,
+			TLSConfig: o.tlsConfig,
 		},
 	}
 
-	mux.HandleFunc("/ws", s.serveWS)
+	// everything but the enrollment
+	// is reserved to enrolled devices
+	mux.Group(func(r chi.Router) {
+		r.Use(s.authenticate)
+		r.HandleFunc("/ws", s.serveWS)
+		r.Get("/content", s.getContent)
+		r.Put("/content", s.putContent)
+		r.Get("/tree", s.getTree)
+		r.Get("/peers", s.listPeers)
+		r.Get("/vault", s.getVault)
+		r.Get("/versions", s.listVersions)
+		r.Post("/versions/{id}/restore", s.restoreVersion)
+		r.Get("/trash", s.listTrash)
+		r.Post("/trash/{id}/restore", s.restoreTrash)
+		r.Delete("/trash/{id}", s.purgeTrash)
+		r.Get("/conflicts", s.listConflicts)
+		r.Post("/conflicts/{id}/resolve", s.resolveConflict)
+		r.Get("/shares", s.listShares)
+		r.Post("/shares", s.shareFolder)
+		r.Delete("/shares/{id}", s.unshare)
+	})
+	mux.Group(func(r chi.Router) {
+		r.Use(s.admin)
+		r.Post("/devices", s.enrollDevice)
+		r.Get("/devices", s.listDevices)
+		r.Delete("/devices/{id}", s.revokeDevice)
+	})
 
 	return s
 }
@@ -86,17 +150,28 @@ func (s *server) serveWS(w http.ResponseWriter, r *http.Request) {
 
 	conn.SetReadLimit(s.readLimit)
 
+	device := deviceOf(r.Context())
 	c := newClient(conn, s)
-	c.name = r.RemoteAddr
+	c.name = device.Name
+	c.device = device.ID
+	c.user = device.User
 
 	s.addClient(c)
 
-	s.SendFSTree(c)
-
 	go c.readMessages(s.ctx)
 	go c.writeMessages(s.ctx)
 }
 
+// serve listens on the configured address,
+// over TLS when the server has a TLS config.
+func (s *server) serve() error {
+	if s.TLSConfig != nil {
+		// the certificates are part of the config
+		return s.ListenAndServeTLS("", "")
+	}
+	return s.ListenAndServe()
+}
+
 func (s *server) addClient(c *Client) {
 	s.Lock()
 	defer s.Unlock()
@@ -110,12 +185,23 @@ func (s *server) removeClient(c *Client) {
 	_, exists := s.clients[c]
 	if exists {
 		delete(s.clients, c)
+		close(c.done)
+		c.transfers.Close()
 		c.conn.CloseNow()
 	}
 }
 
-func (s *server) SendFSTree(client *Client) error {
-	tree := shared.BuildTree(storage)
+// SendFSTree sends the whole tree of the user of ctx,
+// pruned to the selection of the client. Clients get
+// it through the Hashes exchange instead, see sendFolders.
+func (s *server) SendFSTree(ctx context.Context, client *Client) error {
+	tree, err := s.Tree(ctx)
+	if err != nil {
+		return err
+	}
+	s.RLock()
+	tree = client.selection.Prune(tree)
+	s.RUnlock()
 	payload, err := shared.MarshalEnvl(tree, shared.FSTree)
 	if err != nil {
 		return err
@@ -124,6 +210,70 @@ func (s *server) SendFSTree(client *Client) error {
 	return nil
 }
 
+// sendFolders answers the TreeRequest of the client with the folders
+// of the tree it asks for, their childs pruned to its selection. The
+// client asks for the childs whose hash differs from its own in turn,
+// down to the folders both sides agree on.
+func (s *server) sendFolders(ctx context.Context, req shared.TreeRequest, client *Client) error {
+	s.RLock()
+	selection := client.selection
+	s.RUnlock()
+	reply := shared.TreeReply{Folders: make(map[string]*shared.FSNode, len(req.Hashes))}
+	for p, hash := range req.Hashes {
+		folder, err := s.Folder(ctx, p)
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, shared.ErrInvalidDest) ||
+			errors.Is(err, shared.ErrInvalidPath) || errors.Is(err, shared.ErrEmptyPath) {
+			// not a folder of the tree
+			reply.Folders[p] = nil
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if folder.Hash == hash {
+			folder.Childs = nil
+		}
+		for name, child := range folder.Childs {
+			if !selection.Includes(child.Path) {
+				delete(folder.Childs, name)
+			}
+		}
+		reply.Folders[p] = folder
+	}
+	return s.reply(shared.Folders, reply, client)
+}
+
+// resync makes the client reconcile its tree with the one of the user
+// of ctx, the top folder is sent as if the client had asked for it.
+func (s *server) resync(ctx context.Context, client *Client) error {
+	return s.sendFolders(ctx, shared.TreeRequest{
+		Hashes: map[string]string{shared.Root: ""},
+	}, client)
+}
+
+// collectGarbage periodically expires old versions and trash
+// entries, then removes the blobs no file points at anymore.
+func (s *server) collectGarbage(ctx context.Context) {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.PruneVersions(ctx); err != nil {
+				slog.Error("version pruning error", "err", err)
+			}
+			if err := s.ExpireTrash(ctx, s.trashExpiry); err != nil {
+				slog.Error("trash expiry error", "err", err)
+			}
+			if err := s.CollectGarbage(ctx); err != nil {
+				slog.Error("garbage collection error", "err", err)
+			}
+		}
+	}
+}
+
 func (s *server) AtMaxCapacity() bool {
 	s.RLock()
 	defer s.RUnlock()
@@ -133,23 +283,125 @@ func (s *server) AtMaxCapacity() bool {
 	return len(s.clients) >= s.maxConn
 }
 
-func (s *server) broadcast(msg []byte, sender *Client) {
+// broadcast sends the event to the clients of the user
+// of ctx but the sender, as seen through their selection.
+func (s *server) broadcast(ctx context.Context, event shared.FileEvent, sender *Client) error {
+	user := shared.NamespaceOf(ctx)
 	s.RLock()
-	clients := make(map[*Client]struct{})
+	clients := make(map[*Client]shared.Selection)
 	for client := range s.clients {
-		if client == sender {
+		if client == sender || client.user != user {
 			continue
 		}
-		clients[client] = struct{}{}
+		clients[client] = client.selection
 	}
 	s.RUnlock()
-	for client := range clients {
+	for client, selection := range clients {
+		view, ok := selection.View(event)
+		if !ok {
+			if event.Op == fsnotify.Rename.String() && selection.Includes(event.NewPath) {
+				// moved into the selection, the client
+				// gets the content through the tree
+				if err := s.resync(ctx, client); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		payload, err := shared.MarshalEnvl(view, shared.Event)
+		if err != nil {
+			return err
+		}
 		select {
-		case client.msgBuffer <- msg:
+		case client.msgBuffer <- payload:
 		default:
 			slog.Error("unable to send message to ", "err", client.name)
 		}
 	}
+	return nil
+}
+
+// publish sends the event to the clients of every user it
+// concerns but the sender, with the paths each of them sees.
+func (s *server) publish(ctx context.Context, event shared.FileEvent, sender *Client) error {
+	views, err := s.Route(ctx, event)
+	if err != nil {
+		return err
+	}
+	for user, view := range views {
+		if err := s.broadcast(shared.WithNamespace(ctx, user), view, sender); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relay sends the stored content of the event to every client
+// but the sender, embedded in the event when it is small enough
+// and as a chunked transfer otherwise.
+func (s *server) relay(ctx context.Context, event *shared.FileEvent, sender *Client) error {
+	blob, err := s.Content(ctx, event.Path)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(blob)
+	if err != nil {
+		return err
+	}
+	if stat.Size() <= shared.ChunkThreshold {
+		data, err := os.ReadFile(blob)
+		if err != nil {
+			return err
+		}
+		relayed := *event
+		relayed.ID = 0
+		relayed.Dedup = false
+		relayed.New(data)
+		return s.publish(ctx, relayed, sender)
+	}
+	views, err := s.Route(ctx, *event)
+	if err != nil {
+		return err
+	}
+	s.RLock()
+	clients := make([]*Client, 0, len(s.clients))
+	for client := range s.clients {
+		view, concerned := views[client.user]
+		if concerned && client != sender && client.selection.Includes(view.Path) {
+			clients = append(clients, client)
+		}
+	}
+	s.RUnlock()
+	for _, client := range clients {
+		if err := s.streamBlob(ctx, blob, views[client.user], client); err != nil {
+			slog.Error("unable to stream file to", "client", client.name, "err", err)
+		}
+	}
+	return nil
+}
+
+// stream sends the stored content of the event to the client
+// as a chunked transfer. Unlike respond it waits for room in
+// the client buffer so that no chunk is dropped.
+func (s *server) stream(ctx context.Context, event *shared.FileEvent, client *Client) error {
+	blob, err := s.Content(ctx, event.Path)
+	if err != nil {
+		return err
+	}
+	return s.streamBlob(ctx, blob, *event, client)
+}
+
+func (s *server) streamBlob(ctx context.Context, blob string, event shared.FileEvent, client *Client) error {
+	return shared.Stream(ctx, blob, event, func(payload []byte) error {
+		select {
+		case client.msgBuffer <- payload:
+			return nil
+		case <-client.done:
+			return errClientGone
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
 }
 
 func (s *server) respond(msg []byte, client *Client) {
@@ -171,30 +423,148 @@ func (s *server) respond(msg []byte, client *Client) {
 	}
 }
 
+// reply sends the result of an event to its sender.
+func (s *server) reply(Type shared.EnvelopeType, res any, client *Client) error {
+	payload, err := shared.MarshalEnvl(res, Type)
+	if err != nil {
+		return err
+	}
+	s.respond(payload, client)
+	return nil
+}
+
 func (s *server) Receive(ctx context.Context, msg message) error {
 	var env shared.Envelope
 	if err := json.Unmarshal(msg.payload, &env); err != nil {
 		return err
 	}
+	ctx = shared.WithAuthor(ctx, msg.sender.name)
+	ctx = shared.WithNamespace(ctx, msg.sender.user)
 	switch env.Type {
 	case shared.Event:
 		var event shared.FileEvent
 		if err := json.Unmarshal(env.Message, &event); err != nil {
-			return err
+			return s.reply(shared.Nack, shared.Result{
+				Code:    shared.CodeMalformedEvent,
+				Message: err.Error(),
+			}, msg.sender)
 		}
 		if err := s.Process(ctx, &event); err != nil {
-			return err
+			// the sender is told why the event failed
+			// instead of losing the whole connection
+			slog.Error("process error", "err", err, "client", msg.sender.name)
+			return s.reply(shared.Nack, shared.NewResult(&event, err), msg.sender)
 		}
 		if event.Op == shared.Update {
-			event.Op = fsnotify.Create.String()
+			// the reply keeps the Update op so
+			// that the sender overwrites its copy
+			if event.Chunked {
+				if err := s.stream(ctx, &event, msg.sender); err != nil {
+					return err
+				}
+				return s.reply(shared.Ack, shared.NewResult(&event, nil), msg.sender)
+			}
 			newPayload, err := shared.MarshalEnvl(event, shared.Event)
 			if err != nil {
 				return err
 			}
 			s.respond(newPayload, msg.sender)
+		} else if event.Dedup {
+			// the other clients don't
+			// have the content yet
+			if err := s.relay(ctx, &event, msg.sender); err != nil {
+				return err
+			}
 		} else {
-			s.broadcast(msg.payload, msg.sender)
+			// the other clients get the
+			// revision the event resulted in
+			relayed := event
+			relayed.ID = 0
+			if err := s.publish(ctx, relayed, msg.sender); err != nil {
+				return err
+			}
+		}
+		return s.reply(shared.Ack, shared.NewResult(&event, nil), msg.sender)
+	case shared.Begin:
+		var begin shared.TransferBegin
+		if err := json.Unmarshal(env.Message, &begin); err != nil {
+			return err
+		}
+		wanted, err := msg.sender.transfers.Begin(ctx, begin)
+		if err != nil {
+			return s.reply(shared.Nack, shared.NewResult(&begin.Event, err), msg.sender)
+		}
+		if wanted != nil {
+			// delta transfer, only the chunks
+			// we don't have are uploaded
+			return s.reply(shared.Want, shared.TransferWant{
+				ID:      begin.ID,
+				Indices: wanted,
+			}, msg.sender)
+		}
+	case shared.Chunk:
+		var chunk shared.TransferChunk
+		if err := json.Unmarshal(env.Message, &chunk); err != nil {
+			return err
+		}
+		event, exists := msg.sender.transfers.Pending(chunk.ID)
+		if !exists {
+			// the transfer was already aborted
+			// and its sender notified
+			return nil
+		}
+		if err := msg.sender.transfers.Write(chunk); err != nil {
+			return s.reply(shared.Nack, shared.NewResult(&event, err), msg.sender)
+		}
+	case shared.Commit:
+		var commit shared.TransferCommit
+		if err := json.Unmarshal(env.Message, &commit); err != nil {
+			return err
+		}
+		pending, exists := msg.sender.transfers.Pending(commit.ID)
+		if !exists {
+			return nil
+		}
+		event, err := msg.sender.transfers.Commit(commit)
+		if err != nil {
+			return s.reply(shared.Nack, shared.NewResult(&pending, err), msg.sender)
+		}
+		defer os.Remove(event.Source)
+		if err := s.Process(ctx, event); err != nil {
+			slog.Error("process error", "err", err, "client", msg.sender.name)
+			return s.reply(shared.Nack, shared.NewResult(event, err), msg.sender)
+		}
+		if err := s.relay(ctx, event, msg.sender); err != nil {
+			return err
+		}
+		return s.reply(shared.Ack, shared.NewResult(event, nil), msg.sender)
+	case shared.Subscribe:
+		var sub shared.Subscription
+		if err := json.Unmarshal(env.Message, &sub); err != nil {
+			return err
+		}
+		selection, err := shared.NewSelection(sub.Paths)
+		if err != nil {
+			return s.reply(shared.Nack, shared.Result{
+				Code:    shared.CodeOf(err),
+				Message: err.Error(),
+			}, msg.sender)
+		}
+		s.Lock()
+		msg.sender.selection = selection
+		s.Unlock()
+	case shared.FSTree:
+		// the whole tree, for the clients
+		// that don't exchange hashes
+		return s.SendFSTree(ctx, msg.sender)
+	case shared.Hashes:
+		// clients compare their tree with the
+		// one of the server on every (re)connection
+		var req shared.TreeRequest
+		if err := json.Unmarshal(env.Message, &req); err != nil {
+			return err
 		}
+		return s.sendFolders(ctx, req, msg.sender)
 	}
 	return nil
 }
@@ -1,15 +1,44 @@
-package main
+package server
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/coder/websocket"
 	"github.com/fsnotify/fsnotify"
 	"github.com/stretchr/testify/require"
 	"github.com/thesicktwist1/harmony/shared"
+	_ "modernc.org/sqlite"
 )
 
+func makeDB(t *testing.T) *sql.DB {
+	db, err := shared.OpenWithGoose(path.Join(t.TempDir(), "test.db"), "sqlite")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
 func testclients(server *server) map[string]*Client {
 	return map[string]*Client{
 		"test_client_1": newClient(nil, server),
@@ -18,6 +47,20 @@ func testclients(server *server) map[string]*Client {
 	}
 }
 
+// enroll returns the token of a new device.
+func enroll(t *testing.T, server *server, name string) string {
+	_, token, err := server.EnrollDevice(context.Background(), name, "")
+	require.NoError(t, err)
+	return token
+}
+
+// request is an authenticated request.
+func request(method, target, token string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
 func makeMsg(eventType shared.EnvelopeType, event shared.FileEvent) ([]byte, error) {
 	msg, err := json.Marshal(event)
 	if err != nil {
@@ -46,8 +89,16 @@ func TestServerResponses(t *testing.T) {
 		sender       string
 	}{
 		{
-			name:       "server broadcast (message from test_client_3)",
-			serverFunc: server.broadcast,
+			name: "server broadcast (message from test_client_3)",
+			serverFunc: func(msg []byte, sender *Client) {
+				var (
+					env   shared.Envelope
+					event shared.FileEvent
+				)
+				require.NoError(t, json.Unmarshal(msg, &env))
+				require.NoError(t, json.Unmarshal(env.Message, &event))
+				require.NoError(t, server.broadcast(ctx, event, sender))
+			},
 			message: func() []byte {
 				msg, err := makeMsg(
 					shared.Event,
@@ -107,3 +158,1000 @@ func TestServerResponses(t *testing.T) {
 		require.Equal(t, len(tc.wantReceived), len(clientmsgs))
 	}
 }
+
+func TestServerReceiveResults(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		server = NewServer(ctx, makeDB(t))
+	)
+	tests := []struct {
+		name     string
+		event    shared.FileEvent
+		wantType shared.EnvelopeType
+		wantCode shared.ErrorCode
+	}{
+		{
+			name: "processed event is acknowledged",
+			event: shared.FileEvent{
+				ID:   1,
+				Path: "storage/not-exists.txt",
+				Op:   fsnotify.Remove.String(),
+			},
+			wantType: shared.Ack,
+		},
+		{
+			name: "invalid path is rejected",
+			event: shared.FileEvent{
+				ID:   2,
+				Path: "other/file.txt",
+				Op:   fsnotify.Remove.String(),
+			},
+			wantType: shared.Nack,
+			wantCode: shared.CodeInvalidPath,
+		},
+		{
+			name: "unsupported event is rejected",
+			event: shared.FileEvent{
+				ID:   3,
+				Path: "storage/file.txt",
+				Op:   "unsupported",
+			},
+			wantType: shared.Nack,
+			wantCode: shared.CodeUnsupportedEvent,
+		},
+		{
+			name: "created file is acknowledged",
+			event: shared.FileEvent{
+				ID:   4,
+				Path: "storage/notes.txt",
+				Op:   fsnotify.Create.String(),
+				Data: []byte("notes"),
+			},
+			wantType: shared.Ack,
+		},
+		{
+			name: "name differing only by case is rejected",
+			event: shared.FileEvent{
+				ID:   5,
+				Path: "storage/Notes.txt",
+				Op:   fsnotify.Create.String(),
+				Data: []byte("other notes"),
+			},
+			wantType: shared.Nack,
+			wantCode: shared.CodeExist,
+		},
+	}
+	for _, tc := range tests {
+		sender := newClient(nil, server)
+		sender.name = tc.name
+		server.addClient(sender)
+
+		msg, err := makeMsg(shared.Event, tc.event)
+		require.NoError(t, err)
+
+		err = server.Receive(ctx, message{payload: msg, sender: sender})
+		require.NoErrorf(t, err, "%s", tc.name)
+
+		var env shared.Envelope
+		require.NoError(t, json.Unmarshal(<-sender.msgBuffer, &env))
+		require.Equalf(t, tc.wantType, env.Type, "%s", tc.name)
+
+		var res shared.Result
+		require.NoError(t, json.Unmarshal(env.Message, &res))
+		require.Equal(t, tc.event.ID, res.ID)
+		require.Equal(t, tc.wantCode, res.Code)
+	}
+}
+
+func TestServerDedup(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	db := makeDB(t)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	require.NoError(t, shared.MakeStorage())
+
+	var (
+		ctx     = context.Background()
+		server  = NewServer(ctx, db)
+		clients = testclients(server)
+		sender  = clients["test_client_1"]
+		data    = []byte("known content")
+		sum     = sha256.Sum256(data)
+		hash    = hex.EncodeToString(sum[:])
+	)
+	for name, c := range clients {
+		c.name = name
+		server.addClient(c)
+	}
+	receive := func(c *Client) (shared.Envelope, []byte) {
+		var env shared.Envelope
+		require.NoError(t, json.Unmarshal(<-c.msgBuffer, &env))
+		return env, env.Message
+	}
+	send := func(event shared.FileEvent) {
+		msg, err := makeMsg(shared.Event, event)
+		require.NoError(t, err)
+		require.NoError(t, server.Receive(ctx, message{payload: msg, sender: sender}))
+	}
+
+	// unknown content has to be uploaded
+	dedup := shared.FileEvent{ID: 1, Path: "storage/copy.txt", Op: fsnotify.Create.String(), Hash: hash, Dedup: true}
+	send(dedup)
+	env, msg := receive(sender)
+	require.Equal(t, shared.Nack, env.Type)
+	var res shared.Result
+	require.NoError(t, json.Unmarshal(msg, &res))
+	require.Equal(t, shared.CodeUnknownContent, res.Code)
+
+	send(shared.FileEvent{ID: 2, Path: "storage/file.txt", Op: fsnotify.Create.String(), Data: data})
+	env, _ = receive(sender)
+	require.Equal(t, shared.Ack, env.Type)
+	for _, name := range []string{"test_client_2", "test_client_3"} {
+		receive(clients[name])
+	}
+
+	// known content is not uploaded but relayed
+	// to the other clients along with the event
+	send(dedup)
+	env, _ = receive(sender)
+	require.Equal(t, shared.Ack, env.Type)
+	for _, name := range []string{"test_client_2", "test_client_3"} {
+		env, msg := receive(clients[name])
+		require.Equal(t, shared.Event, env.Type)
+		var event shared.FileEvent
+		require.NoError(t, json.Unmarshal(msg, &event))
+		require.Equal(t, dedup.Path, event.Path)
+		require.False(t, event.Dedup)
+		require.Equal(t, data, event.Data)
+	}
+
+	// the content of other users can't be
+	// claimed by its hash, it has to be sent
+	other := newClient(nil, server)
+	other.user = "mallory"
+	server.addClient(other)
+	msg, err = makeMsg(shared.Event, shared.FileEvent{ID: 3, Path: "storage/stolen.txt", Op: fsnotify.Create.String(), Hash: hash, Dedup: true})
+	require.NoError(t, err)
+	require.NoError(t, server.Receive(ctx, message{payload: msg, sender: other}))
+	env, msg = receive(other)
+	require.Equal(t, shared.Nack, env.Type)
+	require.NoError(t, json.Unmarshal(msg, &res))
+	require.Equal(t, int64(3), res.ID)
+	require.Equal(t, shared.CodeUnknownContent, res.Code)
+}
+
+func TestServerManifest(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	db := makeDB(t)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	require.NoError(t, shared.MakeStorage())
+
+	var (
+		ctx    = context.Background()
+		server = NewServer(ctx, db)
+		sender = newClient(nil, server)
+		sum    = sha256.Sum256([]byte("chunk"))
+	)
+	server.addClient(sender)
+	// chunk sizes no sender cuts are rejected
+	// before anything is read or allocated
+	for i, size := range []int64{-1, 0, 1 << 40} {
+		payload, err := shared.MarshalEnvl(shared.TransferBegin{
+			ID:       "transfer",
+			Event:    shared.FileEvent{ID: int64(i + 1), Path: "storage/big.bin", Op: fsnotify.Create.String()},
+			Size:     size,
+			Manifest: []shared.ChunkRef{{Hash: hex.EncodeToString(sum[:]), Size: size}},
+		}, shared.Begin)
+		require.NoError(t, err)
+		require.NoError(t, server.Receive(ctx, message{payload: payload, sender: sender}))
+
+		var (
+			env shared.Envelope
+			res shared.Result
+		)
+		require.NoError(t, json.Unmarshal(<-sender.msgBuffer, &env))
+		require.Equal(t, shared.Nack, env.Type)
+		require.NoError(t, json.Unmarshal(env.Message, &res))
+		require.Equal(t, int64(i+1), res.ID)
+		require.Equal(t, shared.CodeMalformedEvent, res.Code)
+	}
+}
+
+func TestServerConflict(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	db := makeDB(t)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	require.NoError(t, shared.MakeStorage())
+
+	var (
+		ctx     = context.Background()
+		server  = NewServer(ctx, db)
+		clients = testclients(server)
+		file    = "storage/doc.txt"
+	)
+	for name, c := range clients {
+		c.name = name
+		server.addClient(c)
+	}
+	receive := func(c *Client) (shared.EnvelopeType, []byte) {
+		var env shared.Envelope
+		require.NoError(t, json.Unmarshal(<-c.msgBuffer, &env))
+		return env.Type, env.Message
+	}
+	send := func(sender *Client, event shared.FileEvent) shared.Result {
+		msg, err := makeMsg(shared.Event, event)
+		require.NoError(t, err)
+		require.NoError(t, server.Receive(ctx, message{payload: msg, sender: sender}))
+		_, body := receive(sender)
+		var res shared.Result
+		require.NoError(t, json.Unmarshal(body, &res))
+		return res
+	}
+
+	res := send(clients["test_client_1"], shared.FileEvent{ID: 1, Path: file, Op: fsnotify.Create.String(), Data: []byte("first")})
+	require.Equal(t, int64(1), res.Revision)
+	receive(clients["test_client_2"])
+	receive(clients["test_client_3"])
+
+	// both clients edit revision 1, the first write wins
+	res = send(clients["test_client_2"], shared.FileEvent{ID: 1, Path: file, Op: fsnotify.Write.String(), Data: []byte("second"), Revision: 1})
+	require.Empty(t, res.Code)
+	require.Equal(t, int64(2), res.Revision)
+	for _, name := range []string{"test_client_1", "test_client_3"} {
+		Type, body := receive(clients[name])
+		require.Equal(t, shared.Event, Type)
+		var event shared.FileEvent
+		require.NoError(t, json.Unmarshal(body, &event))
+		require.Equal(t, int64(2), event.Revision)
+		require.Zero(t, event.ID)
+	}
+
+	res = send(clients["test_client_3"], shared.FileEvent{ID: 1, Path: file, Op: fsnotify.Write.String(), Data: []byte("third"), Revision: 1})
+	require.Equal(t, shared.CodeConflict, res.Code)
+	require.Equal(t, int64(2), res.Revision)
+	for _, c := range clients {
+		require.Empty(t, c.msgBuffer)
+	}
+}
+
+func TestServerVersions(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	db := makeDB(t)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	require.NoError(t, shared.MakeStorage())
+
+	var (
+		ctx     = context.Background()
+		server  = NewServer(ctx, db)
+		clients = testclients(server)
+		sender  = clients["test_client_1"]
+		token   = enroll(t, server, "laptop")
+		file    = "storage/doc.txt"
+	)
+	for name, c := range clients {
+		c.name = name
+		server.addClient(c)
+	}
+	drain := func() {
+		for _, c := range clients {
+			for len(c.msgBuffer) > 0 {
+				<-c.msgBuffer
+			}
+		}
+	}
+	for i, data := range []string{"first", "second"} {
+		op := fsnotify.Write.String()
+		if i == 0 {
+			op = fsnotify.Create.String()
+		}
+		msg, err := makeMsg(shared.Event, shared.FileEvent{Path: file, Op: op, Data: []byte(data), Revision: int64(i)})
+		require.NoError(t, err)
+		require.NoError(t, server.Receive(ctx, message{payload: msg, sender: sender}))
+	}
+	drain()
+
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodGet, "/versions?path="+file, token))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var versions []shared.Version
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&versions))
+	require.Len(t, versions, 2)
+	require.Equal(t, "test_client_1", versions[0].Author)
+
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodGet, "/versions?path=other/doc.txt", token))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// the restore reaches every client
+	rec = httptest.NewRecorder()
+	target := fmt.Sprintf("/versions/%d/restore", versions[1].ID)
+	server.Handler.ServeHTTP(rec, request(http.MethodPost, target, token))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	for _, c := range clients {
+		var env shared.Envelope
+		require.NoError(t, json.Unmarshal(<-c.msgBuffer, &env))
+		var event shared.FileEvent
+		require.NoError(t, json.Unmarshal(env.Message, &event))
+		require.Equal(t, fsnotify.Write.String(), event.Op)
+		require.Equal(t, []byte("first"), event.Data)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodPost, "/versions/1000/restore", token))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestServerTrash(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	db := makeDB(t)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	require.NoError(t, shared.MakeStorage())
+
+	var (
+		ctx     = context.Background()
+		server  = NewServer(ctx, db)
+		clients = testclients(server)
+		sender  = clients["test_client_1"]
+		token   = enroll(t, server, "laptop")
+	)
+	for name, c := range clients {
+		c.name = name
+		server.addClient(c)
+	}
+	for _, event := range []shared.FileEvent{
+		{Path: "storage/dir", Op: fsnotify.Create.String(), IsDir: true},
+		{Path: "storage/dir/file.txt", Op: fsnotify.Create.String(), Data: []byte("data")},
+		{Path: "storage/dir", Op: fsnotify.Remove.String(), IsDir: true},
+	} {
+		msg, err := makeMsg(shared.Event, event)
+		require.NoError(t, err)
+		require.NoError(t, server.Receive(ctx, message{payload: msg, sender: sender}))
+	}
+	for _, c := range clients {
+		for len(c.msgBuffer) > 0 {
+			<-c.msgBuffer
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodGet, "/trash", token))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var entries []shared.TrashEntry
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&entries))
+	require.Len(t, entries, 1)
+	require.Equal(t, "storage/dir", entries[0].Path)
+	require.Equal(t, "test_client_1", entries[0].DeletedBy)
+
+	// every client gets the directory back, parents first
+	rec = httptest.NewRecorder()
+	target := fmt.Sprintf("/trash/%d/restore", entries[0].ID)
+	server.Handler.ServeHTTP(rec, request(http.MethodPost, target, token))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	for _, c := range clients {
+		var got []shared.FileEvent
+		for len(c.msgBuffer) > 0 {
+			var env shared.Envelope
+			require.NoError(t, json.Unmarshal(<-c.msgBuffer, &env))
+			var event shared.FileEvent
+			require.NoError(t, json.Unmarshal(env.Message, &event))
+			got = append(got, event)
+		}
+		require.Len(t, got, 2)
+		require.Equal(t, "storage/dir", got[0].Path)
+		require.Equal(t, []byte("data"), got[1].Data)
+	}
+
+	// restored entries leave the trash
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodDelete, fmt.Sprintf("/trash/%d", entries[0].ID), token))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestServerConflicts(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	db := makeDB(t)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	require.NoError(t, shared.MakeStorage())
+
+	var (
+		ctx        = context.Background()
+		server     = NewServer(ctx, db)
+		clients    = testclients(server)
+		sender     = clients["test_client_1"]
+		token      = enroll(t, server, "laptop")
+		original   = "storage/doc.txt"
+		conflicted = "storage/doc (conflicted copy from laptop 2025-06-30).txt"
+	)
+	for name, c := range clients {
+		c.name = name
+		server.addClient(c)
+	}
+	for _, event := range []shared.FileEvent{
+		{Path: original, Op: fsnotify.Create.String(), Data: []byte("theirs")},
+		{Path: conflicted, Op: fsnotify.Create.String(), Data: []byte("mine"), ConflictOf: original},
+	} {
+		msg, err := makeMsg(shared.Event, event)
+		require.NoError(t, err)
+		require.NoError(t, server.Receive(ctx, message{payload: msg, sender: sender}))
+	}
+	for _, c := range clients {
+		for len(c.msgBuffer) > 0 {
+			<-c.msgBuffer
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodGet, "/conflicts", token))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var conflicts []shared.Conflict
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&conflicts))
+	require.Len(t, conflicts, 1)
+	require.Equal(t, conflicted, conflicts[0].Path)
+	require.Equal(t, original, conflicts[0].Original)
+	require.Equal(t, "test_client_1", conflicts[0].Author)
+
+	target := fmt.Sprintf("/conflicts/%d/resolve", conflicts[0].ID)
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodPost, target+"?keep=both", token))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// every client gets the copy as the new
+	// content of the original, and loses the copy
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodPost, target+"?keep=copy", token))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	for _, c := range clients {
+		var got []shared.FileEvent
+		for len(c.msgBuffer) > 0 {
+			var env shared.Envelope
+			require.NoError(t, json.Unmarshal(<-c.msgBuffer, &env))
+			var event shared.FileEvent
+			require.NoError(t, json.Unmarshal(env.Message, &event))
+			got = append(got, event)
+		}
+		require.Len(t, got, 2)
+		require.Equal(t, original, got[0].Path)
+		require.Equal(t, []byte("mine"), got[0].Data)
+		require.Equal(t, int64(2), got[0].Revision)
+		require.Equal(t, fsnotify.Remove.String(), got[1].Op)
+		require.Equal(t, conflicted, got[1].Path)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodPost, target+"?keep=original", token))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestServerDevices(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		server = NewServer(ctx, makeDB(t), withAdminToken("admin"))
+		ts     = httptest.NewServer(server.Handler)
+		wsURL  = "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	)
+	defer ts.Close()
+
+	dial := func(token string) (*websocket.Conn, *http.Response, error) {
+		return websocket.Dial(ctx, wsURL, &websocket.DialOptions{
+			HTTPHeader: http.Header{"Authorization": {"Bearer " + token}},
+		})
+	}
+	_, resp, err := dial("")
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// only the admin enrolls devices
+	enrollReq := func(token, body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/devices", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, enrollReq("laptop", `{"name":"laptop"}`))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, enrollReq("admin", `{"name":"laptop"}`))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var enrolled enrollment
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&enrolled))
+	require.Equal(t, "laptop", enrolled.Device.Name)
+
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, enrollReq("admin", `{"name":"laptop"}`))
+	require.Equal(t, http.StatusConflict, rec.Code)
+
+	conn, _, err := dial(enrolled.Token)
+	require.NoError(t, err)
+	defer conn.CloseNow()
+	require.Eventually(t, func() bool {
+		server.RLock()
+		defer server.RUnlock()
+		for c := range server.clients {
+			return c.name == "laptop" && c.device == enrolled.Device.ID
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	// devices see which of their peers are connected
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodGet, "/peers", enrolled.Token))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var peers []shared.Peer
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&peers))
+	require.Equal(t, []shared.Peer{{Device: enrolled.Device.ID, Name: "laptop"}}, peers)
+
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodGet, "/devices", "admin"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var devices []shared.Device
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&devices))
+	require.Len(t, devices, 1)
+	require.NotEmpty(t, devices[0].LastSeenAt)
+
+	// revoking disconnects the device and locks it out
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodDelete, fmt.Sprintf("/devices/%d", enrolled.Device.ID), "admin"))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Empty(t, server.clients)
+	_, _, err = conn.Read(ctx)
+	require.Error(t, err)
+
+	_, resp, err = dial(enrolled.Token)
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodDelete, "/devices/1000", "admin"))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	// the devices of a user share the salt of their vault
+	salt := func(token string) string {
+		rec := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rec, request(http.MethodGet, "/vault", token))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var info vaultInfo
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&info))
+		require.Len(t, info.Salt, 32)
+		return info.Salt
+	}
+	_, tablet, err := server.EnrollDevice(ctx, "tablet", "bob")
+	require.NoError(t, err)
+	phone := salt(enroll(t, server, "phone"))
+	require.Equal(t, phone, salt(enroll(t, server, "desktop")))
+	require.NotEqual(t, phone, salt(tablet))
+	require.Equal(t, salt(tablet), salt(tablet))
+}
+
+func TestServerNamespaces(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	db := makeDB(t)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	require.NoError(t, shared.MakeStorage())
+
+	var (
+		ctx     = context.Background()
+		server  = NewServer(ctx, db, withAdminToken("admin"))
+		clients = testclients(server)
+		file    = "storage/doc.txt"
+	)
+	users := map[string]string{
+		"test_client_1": "alice",
+		"test_client_2": "alice",
+		"test_client_3": "bob",
+	}
+	for name, c := range clients {
+		c.name = name
+		c.user = users[name]
+		server.addClient(c)
+	}
+	for _, sender := range []string{"test_client_1", "test_client_3"} {
+		msg, err := makeMsg(shared.Event, shared.FileEvent{Path: file, Op: fsnotify.Create.String(), Data: []byte(sender)})
+		require.NoError(t, err)
+		require.NoError(t, server.Receive(ctx, message{payload: msg, sender: clients[sender]}))
+
+		// both creations are acknowledged, the
+		// users don't share their trees
+		var env shared.Envelope
+		require.NoError(t, json.Unmarshal(<-clients[sender].msgBuffer, &env))
+		require.Equal(t, shared.Ack, env.Type)
+	}
+	// only the other device of alice got her file
+	require.Len(t, clients["test_client_2"].msgBuffer, 1)
+	var env shared.Envelope
+	require.NoError(t, json.Unmarshal(<-clients["test_client_2"].msgBuffer, &env))
+	var event shared.FileEvent
+	require.NoError(t, json.Unmarshal(env.Message, &event))
+	require.Equal(t, []byte("test_client_1"), event.Data)
+	require.Empty(t, clients["test_client_1"].msgBuffer)
+	require.Empty(t, clients["test_client_3"].msgBuffer)
+
+	req := httptest.NewRequest(http.MethodPost, "/devices", strings.NewReader(`{"name":"phone","user":"bob"}`))
+	req.Header.Set("Authorization", "Bearer admin")
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var enrolled enrollment
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&enrolled))
+	require.Equal(t, "bob", enrolled.Device.User)
+
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodGet, "/versions?path="+file, enrolled.Token))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var versions []shared.Version
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&versions))
+	require.Len(t, versions, 1)
+	require.Equal(t, "test_client_3", versions[0].Author)
+}
+
+func TestServerShares(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	db := makeDB(t)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	require.NoError(t, shared.MakeStorage())
+
+	var (
+		ctx     = context.Background()
+		server  = NewServer(ctx, db)
+		clients = testclients(server)
+		alice   = clients["test_client_1"]
+		bob     = clients["test_client_2"]
+		carol   = clients["test_client_3"]
+	)
+	alice.user, bob.user, carol.user = "alice", "bob", "carol"
+	for name, c := range clients {
+		c.name = name
+		server.addClient(c)
+	}
+	receive := func(sender *Client, event shared.FileEvent) shared.Envelope {
+		msg, err := makeMsg(shared.Event, event)
+		require.NoError(t, err)
+		require.NoError(t, server.Receive(ctx, message{payload: msg, sender: sender}))
+		var env shared.Envelope
+		require.NoError(t, json.Unmarshal(<-sender.msgBuffer, &env))
+		return env
+	}
+	for _, event := range []shared.FileEvent{
+		{Path: "storage/acme", Op: fsnotify.Create.String(), IsDir: true},
+		{Path: "storage/acme/plan.txt", Op: fsnotify.Create.String(), Data: []byte("plan")},
+	} {
+		require.Equal(t, shared.Ack, receive(bob, event).Type)
+	}
+	require.Empty(t, alice.msgBuffer)
+
+	_, token, err := server.EnrollDevice(ctx, "laptop", "bob")
+	require.NoError(t, err)
+	req := request(http.MethodPost, "/shares", token)
+	req.Body = io.NopCloser(strings.NewReader(`{"path":"storage/acme","member":"alice"}`))
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	// alice is made to pull the tree with the shared folder
+	var (
+		env   shared.Envelope
+		reply shared.TreeReply
+	)
+	require.NoError(t, json.Unmarshal(<-alice.msgBuffer, &env))
+	require.Equal(t, shared.Folders, env.Type)
+	require.NoError(t, json.Unmarshal(env.Message, &reply))
+	top := reply.Folders[shared.Root]
+	require.Contains(t, top.Childs, "acme")
+	payload, err := shared.MarshalEnvl(shared.TreeRequest{Hashes: map[string]string{
+		"storage/acme": "", "storage": top.Hash, "storage/missing": "",
+	}}, shared.Hashes)
+	require.NoError(t, err)
+	require.NoError(t, server.Receive(ctx, message{payload: payload, sender: alice}))
+	require.NoError(t, json.Unmarshal(<-alice.msgBuffer, &env))
+	require.NoError(t, json.Unmarshal(env.Message, &reply))
+	require.Equal(t, "storage/acme/plan.txt", reply.Folders["storage/acme"].Childs["plan.txt"].Path)
+	require.Nil(t, reply.Folders[shared.Root].Childs, "the same hash on both sides")
+	require.Contains(t, reply.Folders, "storage/missing")
+	require.Nil(t, reply.Folders["storage/missing"])
+
+	require.Equal(t, shared.Ack, receive(bob, shared.FileEvent{Path: "storage/acme/plan.txt", Op: fsnotify.Write.String(), Data: []byte("v2"), Revision: 1}).Type)
+	require.NoError(t, json.Unmarshal(<-alice.msgBuffer, &env))
+	var event shared.FileEvent
+	require.NoError(t, json.Unmarshal(env.Message, &event))
+	require.Equal(t, "storage/acme/plan.txt", event.Path)
+	require.Empty(t, carol.msgBuffer)
+
+	env = receive(alice, shared.FileEvent{Path: "storage/acme/plan.txt", Op: fsnotify.Write.String(), Data: []byte("mine"), Revision: 2})
+	require.Equal(t, shared.Nack, env.Type)
+	var res shared.Result
+	require.NoError(t, json.Unmarshal(env.Message, &res))
+	require.Equal(t, shared.CodeReadOnly, res.Code)
+	require.Empty(t, bob.msgBuffer)
+}
+
+func TestServerSelection(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	db := makeDB(t)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	require.NoError(t, shared.MakeStorage())
+
+	var (
+		ctx     = context.Background()
+		server  = NewServer(ctx, db)
+		clients = testclients(server)
+		desktop = clients["test_client_1"]
+		laptop  = clients["test_client_2"]
+	)
+	for name, c := range clients {
+		c.name = name
+		server.addClient(c)
+	}
+	send := func(sender *Client, Type shared.EnvelopeType, msg any) {
+		payload, err := shared.MarshalEnvl(msg, Type)
+		require.NoError(t, err)
+		require.NoError(t, server.Receive(ctx, message{payload: payload, sender: sender}))
+	}
+	next := func(c *Client) (shared.Envelope, shared.FileEvent) {
+		var (
+			env   shared.Envelope
+			event shared.FileEvent
+		)
+		select {
+		case msg := <-c.msgBuffer:
+			require.NoError(t, json.Unmarshal(msg, &env))
+		default:
+			t.Fatal("no message for", c.name)
+		}
+		if env.Type == shared.Event {
+			require.NoError(t, json.Unmarshal(env.Message, &event))
+		}
+		return env, event
+	}
+
+	send(laptop, shared.Subscribe, shared.Subscription{Paths: []string{"storage/docs/"}})
+	require.Empty(t, laptop.msgBuffer)
+
+	for _, event := range []shared.FileEvent{
+		{Path: "storage/docs", Op: fsnotify.Create.String(), IsDir: true},
+		{Path: "storage/docs/a.txt", Op: fsnotify.Create.String(), Data: []byte("a")},
+		{Path: "storage/music", Op: fsnotify.Create.String(), IsDir: true},
+		{Path: "storage/music/b.txt", Op: fsnotify.Create.String(), Data: []byte("b")},
+	} {
+		send(desktop, shared.Event, event)
+		env, _ := next(desktop)
+		require.Equal(t, shared.Ack, env.Type)
+	}
+	var got []string
+	for len(laptop.msgBuffer) > 0 {
+		_, event := next(laptop)
+		got = append(got, event.Path)
+	}
+	require.Equal(t, []string{"storage/docs", "storage/docs/a.txt"}, got)
+	require.Len(t, clients["test_client_3"].msgBuffer, 4)
+
+	// the tree is pruned to the selection
+	send(laptop, shared.FSTree, nil)
+	env, _ := next(laptop)
+	require.Equal(t, shared.FSTree, env.Type)
+	var tree shared.FSNode
+	require.NoError(t, json.Unmarshal(env.Message, &tree))
+	require.Len(t, tree.Childs, 1)
+	require.Contains(t, tree.Childs["docs"].Childs, "a.txt")
+
+	// and so are the folders of the exchange
+	var reply shared.TreeReply
+	send(laptop, shared.Hashes, shared.TreeRequest{Hashes: map[string]string{shared.Root: ""}})
+	env, _ = next(laptop)
+	require.Equal(t, shared.Folders, env.Type)
+	require.NoError(t, json.Unmarshal(env.Message, &reply))
+	require.Len(t, reply.Folders[shared.Root].Childs, 1)
+	require.Contains(t, reply.Folders[shared.Root].Childs, "docs")
+
+	// moved into the selection, the client is made to pull the tree
+	send(desktop, shared.Event, shared.FileEvent{Path: "storage/music", NewPath: "storage/docs/music", Op: fsnotify.Rename.String(), IsDir: true})
+	next(desktop)
+	env, _ = next(laptop)
+	require.Equal(t, shared.Folders, env.Type)
+	require.NoError(t, json.Unmarshal(env.Message, &reply))
+	require.Contains(t, reply.Folders, shared.Root)
+	send(laptop, shared.Hashes, shared.TreeRequest{Hashes: map[string]string{"storage/docs/music": ""}})
+	env, _ = next(laptop)
+	require.NoError(t, json.Unmarshal(env.Message, &reply))
+	require.Contains(t, reply.Folders["storage/docs/music"].Childs, "b.txt")
+
+	// moved out of it, the file is removed
+	send(desktop, shared.Event, shared.FileEvent{Path: "storage/docs/a.txt", NewPath: "storage/a.txt", Op: fsnotify.Rename.String()})
+	next(desktop)
+	_, event := next(laptop)
+	require.Equal(t, fsnotify.Remove.String(), event.Op)
+	require.Equal(t, "storage/docs/a.txt", event.Path)
+	require.Empty(t, event.NewPath)
+
+	send(laptop, shared.Subscribe, shared.Subscription{Paths: []string{"elsewhere"}})
+	env, _ = next(laptop)
+	require.Equal(t, shared.Nack, env.Type)
+}
+
+func TestServerContent(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	db := makeDB(t)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	require.NoError(t, shared.MakeStorage())
+
+	var (
+		ctx    = context.Background()
+		server = NewServer(ctx, db)
+		sender = newClient(nil, server)
+		token  = enroll(t, server, "laptop")
+	)
+	server.addClient(sender)
+	for _, event := range []shared.FileEvent{
+		{Path: "storage/docs", Op: fsnotify.Create.String(), IsDir: true},
+		{Path: "storage/docs/a.txt", Op: fsnotify.Create.String(), Data: []byte("content")},
+	} {
+		msg, err := makeMsg(shared.Event, event)
+		require.NoError(t, err)
+		require.NoError(t, server.Receive(ctx, message{payload: msg, sender: sender}))
+	}
+
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodGet, "/content?path=storage/docs/a.txt", token))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "content", rec.Body.String())
+
+	for target, code := range map[string]int{
+		"/content?path=storage/docs":    http.StatusBadRequest,
+		"/content?path=storage/missing": http.StatusNotFound,
+		"/content?path=../etc/passwd":   http.StatusBadRequest,
+	} {
+		rec = httptest.NewRecorder()
+		server.Handler.ServeHTTP(rec, request(http.MethodGet, target, token))
+		require.Equal(t, code, rec.Code, target)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodGet, "/content?path=storage/docs/a.txt", "unknown"))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// uploads create or overwrite the file
+	// and reach the connected clients
+	peer := newClient(nil, server)
+	server.addClient(peer)
+	put := func(target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+	for i, body := range []string{"uploaded", "overwritten"} {
+		rec = put("/content?path=storage/docs/b.txt", body)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var res shared.Result
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		require.Equal(t, int64(i+1), res.Revision)
+		var (
+			env   shared.Envelope
+			event shared.FileEvent
+		)
+		require.NoError(t, json.Unmarshal(<-peer.msgBuffer, &env))
+		require.NoError(t, json.Unmarshal(env.Message, &event))
+		require.Equal(t, "storage/docs/b.txt", event.Path)
+		require.Equal(t, []byte(body), event.Data)
+	}
+	rec = put("/content?path=storage/docs/a.txt", "content")
+	require.Equal(t, http.StatusOK, rec.Code)
+	for target, code := range map[string]int{
+		"/content?path=storage/docs":          http.StatusConflict,
+		"/content?path=storage/missing/c.txt": http.StatusNotFound,
+	} {
+		require.Equal(t, code, put(target, "content").Code, target)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, request(http.MethodGet, "/tree", token))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var tree shared.FSNode
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&tree))
+	docs := tree.Childs["docs"]
+	require.NotNil(t, docs)
+	hash := sha256.Sum256([]byte("overwritten"))
+	require.Equal(t, hex.EncodeToString(hash[:]), docs.Childs["b.txt"].Hash)
+	require.Equal(t, int64(2), docs.Childs["b.txt"].Revision)
+}
+
+// writeCert writes a certificate signed by parent, self-signed when
+// parent is nil, along with its key as PEM files in dir.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(path.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return cert, key
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+	file := func(name string) string { return path.Join(dir, name) }
+
+	for _, args := range [][]string{
+		{"-tls-cert", file("server.pem")},
+		{"-client-ca", file("ca.pem")},
+	} {
+		_, err := loadConfig(args)
+		require.Error(t, err)
+	}
+	cfg, err := loadConfig([]string{
+		"-addr", "127.0.0.1:0",
+		"-tls-cert", file("server.pem"),
+		"-tls-key", file("server.key"),
+		"-client-ca", file("ca.pem"),
+	})
+	require.NoError(t, err)
+	tlsConfig, err := cfg.tlsConfig()
+	require.NoError(t, err)
+
+	server := NewServer(context.Background(), makeDB(t), withAddr(cfg.addr), withTLS(tlsConfig))
+	ts := httptest.NewUnstartedServer(server.Handler)
+	ts.TLS = server.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool, err := shared.CertPool(file("ca.pem"))
+	require.NoError(t, err)
+	get := func(certs ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: certs,
+		}}}
+		return client.Get(ts.URL + "/devices")
+	}
+	// clients without a certificate of the CA are turned away
+	_, err = get()
+	require.Error(t, err)
+
+	cert, err := tls.LoadX509KeyPair(file("client.pem"), file("client.key"))
+	require.NoError(t, err)
+	resp, err := get(cert)
+	require.NoError(t, err)
+	resp.Body.Close()
+	// enrollment is disabled without an admin token
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
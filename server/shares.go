@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+// listShares answers GET /shares with the folders the
+// user shares and the ones shared with the user.
+func (s *server) listShares(w http.ResponseWriter, r *http.Request) {
+	shares, err := s.Shares(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(shares); err != nil {
+		slog.Error("unable to write shares", "err", err)
+	}
+}
+
+// shareFolder answers POST /shares with a body of
+// {"path": "storage/projects/acme", "member": "bob", "writable": true}.
+func (s *server) shareFolder(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Path     string `json:"path"`
+		Member   string `json:"member"`
+		Writable bool   `json:"writable"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	share, err := s.ShareFolder(r.Context(), body.Path, body.Member, body.Writable)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	s.refresh(s.detach(r), share.Member)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(share); err != nil {
+		slog.Error("unable to write share", "err", err)
+	}
+}
+
+// unshare answers DELETE /shares/{id}, the owner stops
+// sharing the folder or the member leaves it.
+func (s *server) unshare(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	share, err := s.Unshare(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	s.refresh(s.detach(r), share.Member)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refresh makes the clients of the user reconcile their tree,
+// called when the folders shared with the user change.
+func (s *server) refresh(ctx context.Context, user string) {
+	ctx = shared.WithNamespace(ctx, user)
+	s.RLock()
+	var clients []*Client
+	for client := range s.clients {
+		if client.user == user {
+			clients = append(clients, client)
+		}
+	}
+	s.RUnlock()
+	for _, client := range clients {
+		if err := s.resync(ctx, client); err != nil {
+			slog.Error("unable to send tree to", "client", client.name, "err", err)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+-- +goose Up
+CREATE TABLE trash(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    path TEXT NOT NULL,
+    isDir BOOLEAN NOT NULL,
+    deletedBy TEXT NOT NULL,
+    deletedAt TEXT NOT NULL
+);
+
+-- the rows of the files removed with a trash entry
+CREATE TABLE trash_files(
+    trashId INTEGER NOT NULL,
+    path TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    isDir BOOLEAN NOT NULL,
+    createdAt TEXT NOT NULL,
+    PRIMARY KEY (trashId, path)
+);
+
+
+-- +goose Down
+DROP TABLE trash_files;
+DROP TABLE trash;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- conflict copies waiting to be resolved, path is the
+-- copy and original the file it conflicted with
+CREATE TABLE conflicts(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    path TEXT NOT NULL UNIQUE,
+    original TEXT NOT NULL,
+    author TEXT NOT NULL,
+    createdAt TEXT NOT NULL
+);
+
+
+-- +goose Down
+DROP TABLE conflicts;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- enrolled devices, only the hash of their token is kept
+CREATE TABLE devices(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    tokenHash TEXT NOT NULL UNIQUE,
+    createdAt TEXT NOT NULL,
+    lastSeenAt TEXT NOT NULL DEFAULT '',
+    revokedAt TEXT NOT NULL DEFAULT ''
+);
+
+
+-- +goose Down
+DROP TABLE devices;
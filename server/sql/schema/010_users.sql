@@ -0,0 +1,8 @@
+-- +goose Up
+-- the user a device belongs to, each user has a tree of its
+-- own and the devices enrolled before belong to the default one
+ALTER TABLE devices ADD COLUMN user TEXT NOT NULL DEFAULT '';
+
+
+-- +goose Down
+ALTER TABLE devices DROP COLUMN user;
@@ -0,0 +1,18 @@
+-- +goose Up
+-- folders shared with other users, path is the row of the folder
+-- and mount where it shows in the tree of the member
+CREATE TABLE shares(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner TEXT NOT NULL,
+    path TEXT NOT NULL,
+    member TEXT NOT NULL,
+    mount TEXT NOT NULL,
+    writable BOOLEAN NOT NULL,
+    createdAt TEXT NOT NULL,
+    UNIQUE (path, member),
+    UNIQUE (member, mount)
+);
+
+
+-- +goose Down
+DROP TABLE shares;
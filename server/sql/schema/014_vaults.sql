@@ -0,0 +1,11 @@
+-- +goose Up
+-- the salt the end-to-end encryption keys of a user
+-- are derived with, the same on every device
+CREATE TABLE vaults(
+    user TEXT PRIMARY KEY,
+    salt TEXT NOT NULL
+);
+
+
+-- +goose Down
+DROP TABLE vaults;
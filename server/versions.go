@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thesicktwist1/harmony/shared"
+)
+
+// httpStatus maps an error returned by the store to a status code.
+func httpStatus(err error) int {
+	switch shared.CodeOf(err) {
+	case shared.CodeNotExist:
+		return http.StatusNotFound
+	case shared.CodeExist, shared.CodeConflict:
+		return http.StatusConflict
+	case shared.CodeUnauthorized:
+		return http.StatusUnauthorized
+	case shared.CodeReadOnly:
+		return http.StatusForbidden
+	case shared.CodeInternal:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// listVersions answers GET /versions?path=storage/...
+func (s *server) listVersions(w http.ResponseWriter, r *http.Request) {
+	versions, err := s.Versions(r.Context(), r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(versions); err != nil {
+		slog.Error("unable to write versions", "err", err)
+	}
+}
+
+// restoreVersion answers POST /versions/{id}/restore, the
+// restored content reaches every client as a normal write.
+func (s *server) restoreVersion(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	event, err := s.Restore(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	if err := s.relay(s.detach(r), event, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
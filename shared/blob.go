@@ -0,0 +1,252 @@
+package shared
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+// BlobDir holds the content of the files known to the server,
+// one file per SHA-256 shared by every path with that content.
+const BlobDir = "blobs"
+
+var ErrUnknownContent = errors.New("shared: unknown content")
+
+type blobStore struct {
+	dir string
+}
+
+func newBlobStore() blobStore {
+	return blobStore{dir: path.Join(Root, TmpDir, BlobDir)}
+}
+
+// path fans the blobs out over 256 directories.
+func (b blobStore) path(hash string) string {
+	return path.Join(b.dir, hash[:2], hash)
+}
+
+func isHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// putBlob stores the content of the event and returns its hash,
+// nothing is written when the content is already known. It is
+// up to the caller to reference the blob.
+func (s serverHub) putBlob(ctx context.Context, event *FileEvent) (string, error) {
+	if event.Dedup {
+		if !isHash(event.Hash) {
+			return "", ErrMalformedEvent
+		}
+		if _, err := s.DB.GetBlob(ctx, event.Hash); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return "", ErrUnknownContent
+			}
+			return "", err
+		}
+		ns, err := s.namespace(ctx)
+		if err != nil {
+			return "", err
+		}
+		// knowing the hash of the content of
+		// others isn't enough to get a copy
+		owned, err := s.owns(ctx, ns, event.Hash)
+		if err != nil {
+			return "", err
+		}
+		if !owned {
+			return "", ErrUnknownContent
+		}
+		return event.Hash, nil
+	}
+	var (
+		hash string
+		size int64
+	)
+	if event.Source != "" {
+		// committed transfers are checked
+		// against their hash on commit
+		stat, err := os.Stat(event.Source)
+		if err != nil {
+			return "", err
+		}
+		hash, size = event.Hash, stat.Size()
+	} else {
+		sum := sha256.Sum256(event.Data)
+		hash, size = hex.EncodeToString(sum[:]), int64(len(event.Data))
+	}
+	if _, err := s.DB.GetBlob(ctx, hash); err == nil {
+		return hash, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	p := s.blobs.path(hash)
+	if err := os.MkdirAll(path.Dir(p), perm); err != nil {
+		return "", err
+	}
+	var err error
+	if event.Source != "" {
+		err = os.Rename(event.Source, p)
+	} else {
+		err = os.WriteFile(p, event.Data, perm)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := s.DB.CreateBlob(ctx, database.CreateBlobParams{
+		Hash:      hash,
+		Size:      size,
+		Createdat: time.Now().Format(TimeLayout),
+	}); err != nil {
+		return "", err
+	}
+	if size > ChunkThreshold {
+		return hash, s.indexChunks(ctx, hash)
+	}
+	return hash, nil
+}
+
+// CollectGarbage removes the blobs no file points at anymore.
+func (s serverHub) CollectGarbage(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blobs, err := s.DB.ListUnreferencedBlobs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if err := os.Remove(s.blobs.path(blob.Hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := s.DB.DeleteChunks(ctx, blob.Hash); err != nil {
+			return err
+		}
+		if err := s.DB.DeleteBlob(ctx, blob.Hash); err != nil {
+			return err
+		}
+	}
+	// the rows of the blobs stored by events that
+	// failed were rolled back, their files are left
+	return filepath.WalkDir(s.blobs.dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() || !isHash(d.Name()) {
+			return err
+		}
+		if _, err := s.DB.GetBlob(ctx, d.Name()); !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		return os.Remove(p)
+	})
+}
+
+// Content returns the blob holding the content of the file at p.
+func (s serverHub) Content(ctx context.Context, p string) (string, error) {
+	if err := ValidPath(p); err != nil {
+		return "", err
+	}
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return "", err
+	}
+	row, _ := ns.scope(p)
+	return s.content(ctx, row)
+}
+
+func (s serverHub) content(ctx context.Context, p string) (string, error) {
+	file, err := s.DB.GetFile(ctx, p)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", os.ErrNotExist
+		}
+		return "", err
+	}
+	if file.Isdir {
+		return "", ErrInvalidPath
+	}
+	if !isHash(file.Hash) {
+		return "", os.ErrNotExist
+	}
+	return s.blobs.path(file.Hash), nil
+}
+
+// indexChunks records the content defined chunks of
+// large blobs so that delta transfers can reuse them.
+func (s serverHub) indexChunks(ctx context.Context, hash string) error {
+	if err := s.DB.DeleteChunks(ctx, hash); err != nil {
+		return err
+	}
+	manifest, _, err := NewManifest(s.blobs.path(hash))
+	if err != nil {
+		return err
+	}
+	var start int64
+	for i, ref := range manifest {
+		if err := s.DB.CreateChunk(ctx, database.CreateChunkParams{
+			Blob:  hash,
+			Idx:   int64(i),
+			Hash:  ref.Hash,
+			Start: start,
+			Size:  ref.Size,
+		}); err != nil {
+			return err
+		}
+		start += ref.Size
+	}
+	return nil
+}
+
+// owns reports whether a file or a version of the namespace
+// references the blob, the user has the content then.
+func (s serverHub) owns(ctx context.Context, ns namespace, hash string) (bool, error) {
+	files, err := s.DB.ListPathsWithHash(ctx, hash)
+	if err != nil {
+		return false, err
+	}
+	versions, err := s.DB.ListVersionPathsWithHash(ctx, hash)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range append(files, versions...) {
+		if _, _, visible := ns.unscope(p); visible {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LocateChunk implements ChunkSource, only the chunks of
+// blobs the user of ctx owns are reused.
+func (s serverHub) LocateChunk(ctx context.Context, hash string) (string, int64, int64, error) {
+	chunks, err := s.DB.ListChunks(ctx, hash)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	for _, chunk := range chunks {
+		owned, err := s.owns(ctx, ns, chunk.Blob)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		if owned {
+			return s.blobs.path(chunk.Blob), chunk.Start, chunk.Size, nil
+		}
+	}
+	return "", 0, 0, ErrUnknownContent
+}
@@ -0,0 +1,224 @@
+package shared
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobStore(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		tmp    = t.TempDir()
+		dbPath = path.Join(tmp, "test.db")
+		ctx    = context.Background()
+		data   = []byte("same content")
+		sum    = sha256.Sum256(data)
+		hash   = hex.EncodeToString(sum[:])
+		first  = path.Join(storage, "dir-1", "copy-1.txt")
+		second = path.Join(storage, "dir-2", "copy-2.txt")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	hub := NewServerHub(db)
+
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(db))
+
+	// identical files share a single blob, referenced
+	// by each file and each version of the files
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: first, Op: fsnotify.Create.String(), Data: data}))
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: second, Op: fsnotify.Create.String(), Data: data}))
+	blob, err := db.GetBlob(ctx, hash)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), blob.Refs)
+
+	// known content is not uploaded again
+	dedup := path.Join(storage, "dir-3", "copy-3.txt")
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: dedup, Op: fsnotify.Create.String(), Hash: hash, Dedup: true}))
+	require.Equal(t, data, content(t, hub, dedup))
+
+	err = hub.Process(ctx, &FileEvent{
+		Path:  path.Join(storage, "dir-3", "unknown.txt"),
+		Op:    fsnotify.Create.String(),
+		Hash:  hex.EncodeToString(make([]byte, sha256.Size)),
+		Dedup: true,
+	})
+	require.ErrorIs(t, err, ErrUnknownContent)
+	require.Equal(t, CodeUnknownContent, CodeOf(err))
+
+	// renames don't touch the blobs
+	renamed := path.Join(storage, "dir-1", "subdir-1", "renamed")
+	require.NoError(t, hub.Process(ctx, &FileEvent{
+		Path:    path.Join(storage, "dir-2"),
+		NewPath: renamed,
+		Op:      fsnotify.Rename.String(),
+		IsDir:   true,
+	}))
+	require.Equal(t, data, content(t, hub, path.Join(renamed, "copy-2.txt")))
+	blob, err = db.GetBlob(ctx, hash)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), blob.Refs)
+
+	// the blob is collected once nothing points at it
+	for _, p := range []string{first, dedup} {
+		require.NoError(t, hub.Process(ctx, &FileEvent{Path: p, Op: fsnotify.Remove.String()}))
+	}
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: path.Join(storage, "dir-1"), Op: fsnotify.Remove.String(), IsDir: true}))
+	// the history and the trash still point at it
+	p := hub.blobs.path(hash)
+	require.NoError(t, hub.CollectGarbage(ctx))
+	_, err = os.Stat(p)
+	require.NoError(t, err)
+
+	hub.Retention = Retention{}
+	require.NoError(t, hub.PruneVersions(ctx))
+	require.NoError(t, hub.CollectGarbage(ctx))
+	_, err = os.Stat(p)
+	require.NoError(t, err)
+
+	// and so does the trash
+	require.NoError(t, hub.ExpireTrash(ctx, 0))
+	require.NoError(t, hub.CollectGarbage(ctx))
+	_, err = os.Stat(p)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = db.GetBlob(ctx, hash)
+	require.Error(t, err)
+
+	// still referenced blobs are kept
+	_, err = os.ReadFile(hub.blobs.path(hashOf(path.Join(storage, "dir-3", "subdir-3", "file-3.txt"))))
+	require.NoError(t, err)
+
+	// the rows written by a rejected event are rolled
+	// back, the file of its blob is collected
+	err = hub.Process(ctx, &FileEvent{
+		Path:     path.Join(storage, "dir-3", "subdir-3", "file-3.txt"),
+		Op:       fsnotify.Write.String(),
+		Data:     []byte("stale"),
+		Revision: 7,
+	})
+	require.ErrorIs(t, err, ErrConflict)
+	_, err = db.GetBlob(ctx, hashOf("stale"))
+	require.Error(t, err)
+	require.FileExists(t, hub.blobs.path(hashOf("stale")))
+	require.NoError(t, hub.CollectGarbage(ctx))
+	require.NoFileExists(t, hub.blobs.path(hashOf("stale")))
+}
+
+func TestBlobNamespaces(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		tmp    = t.TempDir()
+		alice  = WithNamespace(context.Background(), "alice")
+		bob    = WithNamespace(context.Background(), "bob")
+		secret = path.Join(storage, "secret.txt")
+		large  = path.Join(storage, "large.bin")
+		data   = make([]byte, ChunkThreshold+1)
+	)
+	db, err := makeDB(path.Join(tmp, "test.db"), "sqlite")
+	require.NoError(t, err)
+	hub := NewServerHub(db)
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(db))
+
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, hub.Process(alice, &FileEvent{Path: secret, Op: fsnotify.Create.String(), Data: []byte("alice secret")}))
+	require.NoError(t, hub.Process(alice, &FileEvent{Path: large, Op: fsnotify.Create.String(), Data: data}))
+
+	// knowing the hash of the content of
+	// another user doesn't give access to it
+	stolen := &FileEvent{Path: path.Join(storage, "stolen.txt"), Op: fsnotify.Create.String(), Hash: hashOf("alice secret"), Dedup: true}
+	err = hub.Process(bob, stolen)
+	require.ErrorIs(t, err, ErrUnknownContent)
+	require.Equal(t, CodeUnknownContent, CodeOf(err))
+	_, err = hub.Content(bob, stolen.Path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// and neither do the hashes of its chunks
+	blob, err := hub.Content(alice, large)
+	require.NoError(t, err)
+	manifest, _, err := NewManifest(blob)
+	require.NoError(t, err)
+	for _, ref := range manifest {
+		_, _, _, err := hub.LocateChunk(bob, ref.Hash)
+		require.ErrorIs(t, err, ErrUnknownContent)
+		_, _, _, err = hub.LocateChunk(alice, ref.Hash)
+		require.NoError(t, err)
+	}
+
+	// the owner still copies it, from the history
+	// once the file is gone, and so do the members
+	// of the folders holding it
+	require.NoError(t, hub.Process(alice, &FileEvent{Path: secret, Op: fsnotify.Remove.String()}))
+	require.NoError(t, hub.Process(alice, &FileEvent{Path: path.Join(storage, "copy.txt"), Op: fsnotify.Create.String(), Hash: hashOf("alice secret"), Dedup: true}))
+	require.NoError(t, hub.Process(alice, &FileEvent{Path: path.Join(storage, "shared"), Op: fsnotify.Create.String(), IsDir: true}))
+	require.NoError(t, hub.Process(alice, &FileEvent{Path: path.Join(storage, "shared", "plan.txt"), Op: fsnotify.Create.String(), Data: []byte("plan")}))
+	_, err = hub.ShareFolder(alice, path.Join(storage, "shared"), "bob", false)
+	require.NoError(t, err)
+	require.NoError(t, hub.Process(bob, &FileEvent{Path: path.Join(storage, "plan.txt"), Op: fsnotify.Create.String(), Hash: hashOf("plan"), Dedup: true}))
+	blob, err = hub.Content(bob, path.Join(storage, "plan.txt"))
+	require.NoError(t, err)
+	require.Equal(t, hub.blobs.path(hashOf("plan")), blob)
+}
+
+func TestImport(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		tmp    = t.TempDir()
+		dbPath = path.Join(tmp, "test.db")
+		ctx    = context.Background()
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	hub := NewServerHub(db)
+
+	// the tree left on disk by a previous version
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(nil))
+	require.NoError(t, hub.Import(ctx))
+
+	entries, err := os.ReadDir(storage)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, TmpDir, entries[0].Name())
+
+	tree, err := hub.Tree(ctx)
+	require.NoError(t, err)
+	for p, isDir := range paths {
+		node := tree
+		for _, name := range strings.Split(p, sep)[1:] {
+			node = node.Childs[name]
+			require.NotNilf(t, node, "%s", p)
+		}
+		require.Equal(t, isDir, node.IsDir)
+		if !isDir {
+			require.Equal(t, hashOf(p), node.Hash)
+			require.Equal(t, []byte(p), content(t, hub, p))
+		}
+	}
+}
+
+func hashOf(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return hex.EncodeToString(sum[:])
+}
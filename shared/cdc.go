@@ -0,0 +1,132 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+// FastCDC parameters, chunk boundaries only depend on the
+// surrounding bytes so an edit only changes the chunks
+// around it and the rest of the file is deduplicated.
+const (
+	minChunk = 64 << 10
+	avgChunk = 256 << 10
+	maxChunk = 1 << 20
+
+	// normalized chunking, harder to cut before
+	// avgChunk and easier after it
+	maskS uint64 = (1<<20 - 1) << 44
+	maskL uint64 = (1<<16 - 1) << 48
+)
+
+var gear = gearTable()
+
+// gearTable fills the rolling hash table from a fixed
+// seed (splitmix64), both peers must use the same one.
+func gearTable() [256]uint64 {
+	var (
+		table [256]uint64
+		seed  uint64 = 0x6861726d6f6e79
+	)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// ChunkRef identifies a chunk of a file by its content.
+type ChunkRef struct {
+	// SHA-256 of the chunk
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// cut returns the length of the first chunk of data.
+func cut(data []byte) int {
+	n := len(data)
+	if n <= minChunk {
+		return n
+	}
+	if n > maxChunk {
+		n = maxChunk
+	}
+	normal := min(avgChunk, n)
+	var fp uint64
+	i := minChunk
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskS == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskL == 0 {
+			return i
+		}
+	}
+	return n
+}
+
+// SplitChunks reads r until EOF and calls fn with every
+// content defined chunk. data is only valid during the call.
+func SplitChunks(r io.Reader, fn func(data []byte) error) error {
+	var (
+		buf = make([]byte, 2*maxChunk)
+		n   int
+		eof bool
+	)
+	for {
+		if !eof && n < maxChunk {
+			read, err := io.ReadFull(r, buf[n:])
+			n += read
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		size := cut(buf[:n])
+		if err := fn(buf[:size]); err != nil {
+			return err
+		}
+		n = copy(buf, buf[size:n])
+	}
+}
+
+// NewManifest splits the file at p and returns its chunks
+// along with the SHA-256 of the whole content.
+func NewManifest(p string) ([]ChunkRef, string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	var (
+		manifest []ChunkRef
+		hasher   = sha256.New()
+	)
+	err = SplitChunks(file, func(data []byte) error {
+		hasher.Write(data)
+		sum := sha256.Sum256(data)
+		manifest = append(manifest, ChunkRef{
+			Hash: hex.EncodeToString(sum[:]),
+			Size: int64(len(data)),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return manifest, hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,149 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+)
+
+func randomData(n int) []byte {
+	rng := rand.New(rand.NewPCG(1, 2))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	return data
+}
+
+func TestSplitChunks(t *testing.T) {
+	data := randomData(8 << 20)
+
+	var sizes []int
+	var total int
+	err := SplitChunks(bytes.NewReader(data), func(chunk []byte) error {
+		require.True(t, bytes.Equal(data[total:total+len(chunk)], chunk))
+		sizes = append(sizes, len(chunk))
+		total += len(chunk)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(data), total)
+	for _, size := range sizes[:len(sizes)-1] {
+		require.GreaterOrEqual(t, size, minChunk)
+		require.LessOrEqual(t, size, maxChunk)
+	}
+
+	// an edit in the middle of the file only
+	// changes the chunks around it
+	var (
+		dir    = t.TempDir()
+		before = path.Join(dir, "before")
+		after  = path.Join(dir, "after")
+		edited = bytes.Clone(data)
+	)
+	edited[len(edited)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(before, data, 0777))
+	require.NoError(t, os.WriteFile(after, edited, 0777))
+
+	old, _, err := NewManifest(before)
+	require.NoError(t, err)
+	manifest, _, err := NewManifest(after)
+	require.NoError(t, err)
+
+	known := make(map[string]struct{})
+	for _, ref := range old {
+		known[ref.Hash] = struct{}{}
+	}
+	var changed int
+	for _, ref := range manifest {
+		if _, ok := known[ref.Hash]; !ok {
+			changed++
+		}
+	}
+	require.LessOrEqual(t, changed, 2)
+}
+
+func TestStreamDelta(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		tmp    = t.TempDir()
+		dbPath = path.Join(tmp, "test.db")
+		ctx    = context.Background()
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	hub := NewServerHub(db)
+
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(db))
+
+	var (
+		dest   = path.Join(storage, "dir-1", "big.bin")
+		src    = path.Join(tmp, "big.bin")
+		data   = randomData(ChunkThreshold + 3<<20)
+		edited = append(bytes.Clone(data[:1<<20]), data[1<<20+10:]...)
+	)
+	require.NoError(t, hub.Process(ctx, &FileEvent{
+		Path: dest,
+		Op:   fsnotify.Create.String(),
+		Data: data,
+	}))
+	require.NoError(t, os.WriteFile(src, edited, 0777))
+
+	var (
+		transfers = NewTransfers(path.Join(storage, TmpDir), hub)
+		wanted    = make(chan []int64, 1)
+		sent      int
+		committed *FileEvent
+		receive   = receiver(t, transfers, &committed)
+	)
+	send := func(payload []byte) error {
+		var env Envelope
+		require.NoError(t, json.Unmarshal(payload, &env))
+		switch env.Type {
+		case Begin:
+			var begin TransferBegin
+			require.NoError(t, json.Unmarshal(env.Message, &begin))
+			want, err := transfers.Begin(ctx, begin)
+			require.NoError(t, err)
+			require.Less(t, len(want), len(begin.Manifest))
+			wanted <- want
+			return nil
+		case Chunk:
+			sent++
+		}
+		return receive(payload)
+	}
+	err = StreamDelta(ctx, NewTransferID(), src, FileEvent{
+		Path:     dest,
+		Op:       fsnotify.Write.String(),
+		Revision: 1,
+	}, send, wanted)
+	require.NoError(t, err)
+	require.NotNil(t, committed)
+	require.LessOrEqual(t, sent, 2)
+
+	require.NoError(t, hub.Process(ctx, committed))
+	require.True(t, bytes.Equal(edited, content(t, hub, dest)))
+
+	// the new blob is indexed as well
+	blob, err := hub.Content(ctx, dest)
+	require.NoError(t, err)
+	manifest, _, err := NewManifest(blob)
+	require.NoError(t, err)
+	for _, ref := range manifest {
+		_, _, _, err := hub.LocateChunk(ctx, ref.Hash)
+		require.NoError(t, err)
+	}
+}
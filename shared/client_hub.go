@@ -9,20 +9,42 @@ import (
 
 type clientHub struct {
 	handlers map[string]EventHandler
+	// tells whether an event may change the path
+	check func(string) error
 }
 
+// NewClientHub applies the events to the storage directory.
 func NewClientHub() clientHub {
+	return NewClientHubIn(func(p string) error {
+		if err := ValidPath(p); err != nil {
+			return err
+		}
+		return CheckLinks(Root, p)
+	})
+}
+
+// NewClientHubIn applies the events to the paths check
+// accepts, the clients syncing other directories than
+// the storage one map the paths of the events first.
+// check has to keep the events inside the directories.
+func NewClientHubIn(check func(string) error) clientHub {
 	return clientHub{
 		handlers: setupClientEventHandler(),
+		check:    check,
 	}
 }
 
 type EventHandler func(context.Context, *FileEvent) error
 
 func (c clientHub) Process(ctx context.Context, event *FileEvent) error {
-	if err := isValidPath(event.Path); err != nil {
+	if err := c.check(event.Path); err != nil {
 		return EventError{err: err, data: event}
 	}
+	if event.NewPath != "" {
+		if err := c.check(event.NewPath); err != nil {
+			return EventError{err: err, path: event.NewPath, data: event}
+		}
+	}
 	handler, exist := c.handlers[event.Op]
 	if !exist {
 		return EventError{err: ErrUnsupportedEvent, data: event.Op}
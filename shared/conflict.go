@@ -0,0 +1,108 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Conflict is a conflict copy, the losing side of two
+// concurrent edits kept next to the file it conflicted with.
+type Conflict struct {
+	ID        int64  `json:"id"`
+	Path      string `json:"path"`
+	Original  string `json:"original"`
+	Author    string `json:"author"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// Conflicts lists the conflict copies left to resolve, newest first.
+func (s serverHub) Conflicts(ctx context.Context) ([]Conflict, error) {
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.ListConflicts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conflicts := make([]Conflict, 0, len(rows))
+	for _, row := range rows {
+		p, _, visible := ns.unscope(row.Path)
+		if !visible {
+			continue
+		}
+		original, _, _ := ns.unscope(row.Original)
+		conflicts = append(conflicts, Conflict{
+			ID:        row.ID,
+			Path:      p,
+			Original:  original,
+			Author:    row.Author,
+			CreatedAt: row.Createdat,
+		})
+	}
+	return conflicts, nil
+}
+
+// ResolveConflict settles a conflict, the copy replaces the
+// original when keepCopy is set and is removed either way.
+// The returned events have to be sent to the clients.
+func (s serverHub) ResolveConflict(ctx context.Context, id int64, keepCopy bool) ([]*FileEvent, error) {
+	conflict, err := s.DB.GetConflict(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	copyPath, _, visible := ns.unscope(conflict.Path)
+	originalPath, _, seen := ns.unscope(conflict.Original)
+	if !visible || !seen {
+		return nil, os.ErrNotExist
+	}
+	file, err := s.getFile(ctx, conflict.Path)
+	if err != nil {
+		return nil, err
+	}
+	var events []*FileEvent
+	if keepCopy {
+		event := &FileEvent{
+			Path:  originalPath,
+			Op:    fsnotify.Write.String(),
+			Hash:  file.Hash,
+			Dedup: true,
+		}
+		original, err := s.getFile(ctx, conflict.Original)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			// the original was removed since
+			event.Op = fsnotify.Create.String()
+		case err != nil:
+			return nil, err
+		case original.Isdir:
+			return nil, ErrInvalidDest
+		default:
+			event.Revision = original.Revision
+		}
+		if err := s.Process(ctx, event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	// removing the copy drops the conflict
+	remove := &FileEvent{
+		Path: copyPath,
+		Op:   fsnotify.Remove.String(),
+	}
+	if err := s.Process(ctx, remove); err != nil {
+		return nil, err
+	}
+	return append(events, remove), nil
+}
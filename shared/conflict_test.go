@@ -0,0 +1,80 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflicts(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		tmp        = t.TempDir()
+		dbPath     = path.Join(tmp, "test.db")
+		ctx        = WithAuthor(context.Background(), "laptop")
+		original   = path.Join(storage, "dir-1", "file-1.txt")
+		conflicted = path.Join(storage, "dir-1", "file-1 (conflicted copy from laptop 2025-06-30).txt")
+		renamed    = path.Join(storage, "dir-2", "file-1 (conflicted copy from laptop 2025-06-30).txt")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	hub := NewServerHub(db)
+
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(db))
+
+	require.NoError(t, hub.Process(ctx, &FileEvent{
+		Path:       conflicted,
+		Op:         fsnotify.Create.String(),
+		Data:       []byte("mine"),
+		ConflictOf: original,
+	}))
+	conflicts, err := hub.Conflicts(ctx)
+	require.NoError(t, err)
+	require.Len(t, conflicts, 1)
+	require.Equal(t, conflicted, conflicts[0].Path)
+	require.Equal(t, original, conflicts[0].Original)
+	require.Equal(t, "laptop", conflicts[0].Author)
+
+	// the conflict follows the copy
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: conflicted, NewPath: renamed, Op: fsnotify.Rename.String()}))
+	conflicts, err = hub.Conflicts(ctx)
+	require.NoError(t, err)
+	require.Equal(t, renamed, conflicts[0].Path)
+
+	// keeping the copy replaces the original
+	events, err := hub.ResolveConflict(ctx, conflicts[0].ID, true)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, fsnotify.Write.String(), events[0].Op)
+	require.Equal(t, fsnotify.Remove.String(), events[1].Op)
+	require.Equal(t, []byte("mine"), content(t, hub, original))
+	_, err = db.GetFile(ctx, renamed)
+	require.Error(t, err)
+	conflicts, err = hub.Conflicts(ctx)
+	require.NoError(t, err)
+	require.Empty(t, conflicts)
+
+	// removing a copy resolves its conflict
+	require.NoError(t, hub.Process(ctx, &FileEvent{
+		Path:       conflicted,
+		Op:         fsnotify.Create.String(),
+		Data:       []byte("mine again"),
+		ConflictOf: original,
+	}))
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: conflicted, Op: fsnotify.Remove.String()}))
+	conflicts, err = hub.Conflicts(ctx)
+	require.NoError(t, err)
+	require.Empty(t, conflicts)
+
+	_, err = hub.ResolveConflict(ctx, 1000, false)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
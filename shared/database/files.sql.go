@@ -10,12 +10,13 @@ import (
 )
 
 const createFile = `-- name: CreateFile :exec
-INSERT INTO files (path , hash , updatedAt , createdAt, isDir)
+INSERT INTO files (path , hash , updatedAt , createdAt, isDir, revision)
 VALUES (
     ?,
     ?,
     ?,
     ?,
+    ?,
     ?
 )ON CONFLICT DO NOTHING
 `
@@ -26,6 +27,7 @@ type CreateFileParams struct {
 	Updatedat string
 	Createdat string
 	Isdir     bool
+	Revision  int64
 }
 
 func (q *Queries) CreateFile(ctx context.Context, arg CreateFileParams) error {
@@ -35,6 +37,7 @@ func (q *Queries) CreateFile(ctx context.Context, arg CreateFileParams) error {
 		arg.Updatedat,
 		arg.Createdat,
 		arg.Isdir,
+		arg.Revision,
 	)
 	return err
 }
@@ -50,7 +53,7 @@ func (q *Queries) DeleteFile(ctx context.Context, path string) error {
 }
 
 const getFile = `-- name: GetFile :one
-SELECT path, hash, updatedat, createdat, isdir FROM files
+SELECT path, hash, updatedat, createdat, isdir, revision, placeholder, mode, link, modtime FROM files
 WHERE path = ?
 LIMIT 1
 `
@@ -64,24 +67,258 @@ func (q *Queries) GetFile(ctx context.Context, path string) (File, error) {
 		&i.Updatedat,
 		&i.Createdat,
 		&i.Isdir,
+		&i.Revision,
+		&i.Placeholder,
+		&i.Mode,
+		&i.Link,
+		&i.Modtime,
 	)
 	return i, err
 }
 
+const listChildren = `-- name: ListChildren :many
+SELECT path, hash, updatedat, createdat, isdir, revision, placeholder, mode, link, modtime FROM files
+WHERE path > ? AND path < ?
+AND instr(substr(path, CAST(? AS INTEGER)), '/') = 0
+ORDER BY path
+`
+
+type ListChildrenParams struct {
+	Path    string
+	Path_2  string
+	Column3 int64
+}
+
+func (q *Queries) ListChildren(ctx context.Context, arg ListChildrenParams) ([]File, error) {
+	rows, err := q.db.QueryContext(ctx, listChildren, arg.Path, arg.Path_2, arg.Column3)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []File
+	for rows.Next() {
+		var i File
+		if err := rows.Scan(
+			&i.Path,
+			&i.Hash,
+			&i.Updatedat,
+			&i.Createdat,
+			&i.Isdir,
+			&i.Revision,
+			&i.Placeholder,
+			&i.Mode,
+			&i.Link,
+			&i.Modtime,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listFiles = `-- name: ListFiles :many
+SELECT path, hash, updatedat, createdat, isdir, revision, placeholder, mode, link, modtime FROM files
+ORDER BY path
+`
+
+func (q *Queries) ListFiles(ctx context.Context) ([]File, error) {
+	rows, err := q.db.QueryContext(ctx, listFiles)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []File
+	for rows.Next() {
+		var i File
+		if err := rows.Scan(
+			&i.Path,
+			&i.Hash,
+			&i.Updatedat,
+			&i.Createdat,
+			&i.Isdir,
+			&i.Revision,
+			&i.Placeholder,
+			&i.Mode,
+			&i.Link,
+			&i.Modtime,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listPathsWithHash = `-- name: ListPathsWithHash :many
+SELECT path FROM files
+WHERE hash = ?
+`
+
+func (q *Queries) ListPathsWithHash(ctx context.Context, hash string) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, listPathsWithHash, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		items = append(items, path)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listSubtree = `-- name: ListSubtree :many
+SELECT path, hash, updatedat, createdat, isdir, revision, placeholder, mode, link, modtime FROM files
+WHERE path = ? OR (path > ? AND path < ?)
+ORDER BY path
+`
+
+type ListSubtreeParams struct {
+	Path   string
+	Path_2 string
+	Path_3 string
+}
+
+func (q *Queries) ListSubtree(ctx context.Context, arg ListSubtreeParams) ([]File, error) {
+	rows, err := q.db.QueryContext(ctx, listSubtree, arg.Path, arg.Path_2, arg.Path_3)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []File
+	for rows.Next() {
+		var i File
+		if err := rows.Scan(
+			&i.Path,
+			&i.Hash,
+			&i.Updatedat,
+			&i.Createdat,
+			&i.Isdir,
+			&i.Revision,
+			&i.Placeholder,
+			&i.Mode,
+			&i.Link,
+			&i.Modtime,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const renameFile = `-- name: RenameFile :exec
+UPDATE files
+SET path = ?,
+updatedAt = ?
+WHERE path = ?
+`
+
+type RenameFileParams struct {
+	Path      string
+	Updatedat string
+	Path_2    string
+}
+
+func (q *Queries) RenameFile(ctx context.Context, arg RenameFileParams) error {
+	_, err := q.db.ExecContext(ctx, renameFile, arg.Path, arg.Updatedat, arg.Path_2)
+	return err
+}
+
+const setHash = `-- name: SetHash :exec
+UPDATE files
+SET hash = ?
+WHERE path = ?
+`
+
+type SetHashParams struct {
+	Hash string
+	Path string
+}
+
+func (q *Queries) SetHash(ctx context.Context, arg SetHashParams) error {
+	_, err := q.db.ExecContext(ctx, setHash, arg.Hash, arg.Path)
+	return err
+}
+
+const setMetadata = `-- name: SetMetadata :exec
+UPDATE files
+SET mode = ?,
+link = ?,
+modTime = ?
+WHERE path = ?
+`
+
+type SetMetadataParams struct {
+	Mode    int64
+	Link    bool
+	Modtime string
+	Path    string
+}
+
+func (q *Queries) SetMetadata(ctx context.Context, arg SetMetadataParams) error {
+	_, err := q.db.ExecContext(ctx, setMetadata,
+		arg.Mode,
+		arg.Link,
+		arg.Modtime,
+		arg.Path,
+	)
+	return err
+}
+
 const updateFile = `-- name: UpdateFile :exec
 UPDATE files 
 SET hash = ?,
-updatedAt = ?
+updatedAt = ?,
+revision = ?,
+placeholder = ?
 WHERE path = ?
 `
 
 type UpdateFileParams struct {
-	Hash      string
-	Updatedat string
-	Path      string
+	Hash        string
+	Updatedat   string
+	Revision    int64
+	Placeholder bool
+	Path        string
 }
 
 func (q *Queries) UpdateFile(ctx context.Context, arg UpdateFileParams) error {
-	_, err := q.db.ExecContext(ctx, updateFile, arg.Hash, arg.Updatedat, arg.Path)
+	_, err := q.db.ExecContext(ctx, updateFile,
+		arg.Hash,
+		arg.Updatedat,
+		arg.Revision,
+		arg.Placeholder,
+		arg.Path,
+	)
 	return err
 }
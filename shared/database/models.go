@@ -4,10 +4,103 @@
 
 package database
 
+type Blob struct {
+	Hash      string
+	Size      int64
+	Refs      int64
+	Createdat string
+}
+
+type Chunk struct {
+	Blob  string
+	Idx   int64
+	Hash  string
+	Start int64
+	Size  int64
+}
+
+type Conflict struct {
+	ID        int64
+	Path      string
+	Original  string
+	Author    string
+	Createdat string
+}
+
+type Device struct {
+	ID         int64
+	Name       string
+	Tokenhash  string
+	Createdat  string
+	Lastseenat string
+	Revokedat  string
+	User       string
+}
+
 type File struct {
+	Path        string
+	Hash        string
+	Updatedat   string
+	Createdat   string
+	Isdir       bool
+	Revision    int64
+	Placeholder bool
+	Mode        int64
+	Link        bool
+	Modtime     string
+}
+
+type FileVersion struct {
+	ID        int64
 	Path      string
 	Hash      string
-	Updatedat string
+	Size      int64
+	Author    string
 	Createdat string
+	Mode      int64
+	Link      bool
+	Modtime   string
+}
+
+type Outbox struct {
+	ID        int64
+	Path      string
+	Newpath   string
+	Op        string
+	Payload   []byte
+	Createdat string
+}
+
+type Share struct {
+	ID        int64
+	Owner     string
+	Path      string
+	Member    string
+	Mount     string
+	Writable  bool
+	Createdat string
+}
+
+type Trash struct {
+	ID        int64
+	Path      string
 	Isdir     bool
+	Deletedby string
+	Deletedat string
+}
+
+type TrashFile struct {
+	Trashid   int64
+	Path      string
+	Hash      string
+	Isdir     bool
+	Createdat string
+	Mode      int64
+	Link      bool
+	Modtime   string
+}
+
+type Vault struct {
+	User string
+	Salt string
 }
@@ -0,0 +1,25 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Tx runs fn with queries bound to a single transaction, which is
+// committed when fn succeeds and rolled back otherwise. Queries that
+// are already bound to a transaction run fn within it.
+func (q *Queries) Tx(ctx context.Context, fn func(*Queries) error) error {
+	db, ok := q.db.(*sql.DB)
+	if !ok {
+		return fn(q)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(q.WithTx(tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,178 @@
+package shared
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+var (
+	ErrUnauthorized = errors.New("shared: unauthorized")
+	ErrInvalidName  = errors.New("shared: invalid device name")
+	ErrInvalidUser  = errors.New("shared: invalid user name")
+)
+
+// tokenSize is the number of random bytes of a device token.
+const tokenSize = 32
+
+// Device is an enrolled client, it identifies
+// itself with the token issued on enrollment.
+type Device struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// User owns the tree the device syncs,
+	// empty for the default user
+	User       string `json:"user,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+	LastSeenAt string `json:"lastSeenAt,omitempty"`
+	RevokedAt  string `json:"revokedAt,omitempty"`
+}
+
+// Peer is a device connected to the server.
+type Peer struct {
+	Device int64  `json:"device"`
+	Name   string `json:"name"`
+}
+
+func newDevice(row database.Device) Device {
+	return Device{
+		ID:         row.ID,
+		Name:       row.Name,
+		User:       row.User,
+		CreatedAt:  row.Createdat,
+		LastSeenAt: row.Lastseenat,
+		RevokedAt:  row.Revokedat,
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// EnrollDevice registers a new device of the user and returns its token,
+// only the hash of the token is stored so it can't be shown again.
+func (s serverHub) EnrollDevice(ctx context.Context, name, user string) (Device, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Device{}, "", ErrInvalidName
+	}
+	if !isValidUser(user) {
+		return Device{}, "", ErrInvalidUser
+	}
+	if _, err := s.DB.GetDeviceByName(ctx, name); err == nil {
+		return Device{}, "", os.ErrExist
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return Device{}, "", err
+	}
+	b := make([]byte, tokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return Device{}, "", err
+	}
+	token := hex.EncodeToString(b)
+	row, err := s.DB.CreateDevice(ctx, database.CreateDeviceParams{
+		Name:      name,
+		User:      user,
+		Tokenhash: hashToken(token),
+		Createdat: time.Now().Format(TimeLayout),
+	})
+	if err != nil {
+		return Device{}, "", err
+	}
+	return newDevice(row), token, nil
+}
+
+// Authenticate returns the device the token was issued to,
+// ErrUnauthorized if there is none or it was revoked.
+func (s serverHub) Authenticate(ctx context.Context, token string) (Device, error) {
+	if token == "" {
+		return Device{}, ErrUnauthorized
+	}
+	row, err := s.DB.GetDeviceByToken(ctx, hashToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Device{}, ErrUnauthorized
+		}
+		return Device{}, err
+	}
+	if row.Revokedat != "" {
+		return Device{}, ErrUnauthorized
+	}
+	row.Lastseenat = time.Now().Format(TimeLayout)
+	if err := s.DB.TouchDevice(ctx, database.TouchDeviceParams{
+		Lastseenat: row.Lastseenat,
+		ID:         row.ID,
+	}); err != nil {
+		return Device{}, err
+	}
+	return newDevice(row), nil
+}
+
+func (s serverHub) Devices(ctx context.Context) ([]Device, error) {
+	rows, err := s.DB.ListDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(rows))
+	for _, row := range rows {
+		devices = append(devices, newDevice(row))
+	}
+	return devices, nil
+}
+
+// RevokeDevice stops the token of the device from being accepted,
+// the device has to be enrolled again under another name.
+func (s serverHub) RevokeDevice(ctx context.Context, id int64) (Device, error) {
+	row, err := s.DB.GetDevice(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Device{}, os.ErrNotExist
+		}
+		return Device{}, err
+	}
+	if row.Revokedat != "" {
+		return newDevice(row), nil
+	}
+	row.Revokedat = time.Now().Format(TimeLayout)
+	if err := s.DB.RevokeDevice(ctx, database.RevokeDeviceParams{
+		Revokedat: row.Revokedat,
+		ID:        row.ID,
+	}); err != nil {
+		return Device{}, err
+	}
+	return newDevice(row), nil
+}
+
+// saltSize is the number of random bytes of a vault salt.
+const saltSize = 16
+
+// VaultSalt returns the hex encoded salt the end-to-end encryption keys
+// of the user of ctx are derived with, drawn the first time it is asked
+// for so that every device of the user gets the same one.
+func (s serverHub) VaultSalt(ctx context.Context) (string, error) {
+	b := make([]byte, saltSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	user := NamespaceOf(ctx)
+	// a salt drawn concurrently or earlier is kept
+	if err := s.DB.CreateVault(ctx, database.CreateVaultParams{
+		User: user,
+		Salt: hex.EncodeToString(b),
+	}); err != nil {
+		return "", err
+	}
+	row, err := s.DB.GetVault(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	return row.Salt, nil
+}
@@ -0,0 +1,69 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDevices(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dbPath = path.Join(t.TempDir(), "test.db")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	hub := NewServerHub(db)
+
+	laptop, token, err := hub.EnrollDevice(ctx, " laptop ", "")
+	require.NoError(t, err)
+	require.Equal(t, "laptop", laptop.Name)
+	require.Len(t, token, 2*tokenSize)
+
+	// the token itself is never stored
+	row, err := db.GetDevice(ctx, laptop.ID)
+	require.NoError(t, err)
+	require.NotEqual(t, token, row.Tokenhash)
+
+	_, _, err = hub.EnrollDevice(ctx, "laptop", "alice")
+	require.ErrorIs(t, err, os.ErrExist)
+	_, _, err = hub.EnrollDevice(ctx, "  ", "")
+	require.ErrorIs(t, err, ErrInvalidName)
+	for _, user := range []string{"..", "a/b", " alice"} {
+		_, _, err = hub.EnrollDevice(ctx, "tablet", user)
+		require.ErrorIs(t, err, ErrInvalidUser)
+	}
+
+	device, err := hub.Authenticate(ctx, token)
+	require.NoError(t, err)
+	require.Equal(t, laptop.ID, device.ID)
+	require.NotEmpty(t, device.LastSeenAt)
+
+	for _, token := range []string{"", "unknown", token + "0"} {
+		_, err = hub.Authenticate(ctx, token)
+		require.ErrorIs(t, err, ErrUnauthorized)
+	}
+
+	_, phoneToken, err := hub.EnrollDevice(ctx, "phone", "alice")
+	require.NoError(t, err)
+	revoked, err := hub.RevokeDevice(ctx, laptop.ID)
+	require.NoError(t, err)
+	require.NotEmpty(t, revoked.RevokedAt)
+	_, err = hub.Authenticate(ctx, token)
+	require.ErrorIs(t, err, ErrUnauthorized)
+	phone, err := hub.Authenticate(ctx, phoneToken)
+	require.NoError(t, err)
+	require.Equal(t, "alice", phone.User)
+
+	devices, err := hub.Devices(ctx)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	require.Equal(t, revoked.RevokedAt, devices[0].RevokedAt)
+
+	_, err = hub.RevokeDevice(ctx, 1000)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
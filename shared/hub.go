@@ -3,10 +3,14 @@ package shared
 import (
 	"context"
 	"errors"
+	"io"
+	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const backup = "backup"
@@ -16,7 +20,7 @@ type Hub interface {
 }
 
 func write(event *FileEvent) error {
-	stat, err := os.Stat(event.Path)
+	stat, err := os.Lstat(event.Path)
 	if err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
 			return err
@@ -25,19 +29,87 @@ func write(event *FileEvent) error {
 		if stat.IsDir() {
 			return ErrMalformedEvent
 		}
+		if event.Link || stat.Mode()&os.ModeSymlink != 0 {
+			// links are replaced, never written through
+			if err := os.Remove(event.Path); err != nil {
+				return err
+			}
+		} else if stat.Mode().Perm()&0200 == 0 {
+			// read-only files get the mode of the event after
+			if err := os.Chmod(event.Path, stat.Mode().Perm()|0200); err != nil {
+				return err
+			}
+		}
 	}
-	return os.WriteFile(event.Path, event.Data, 0777)
+	if err := put(event); err != nil {
+		return err
+	}
+	return ApplyMetadata(event)
 }
 
-func isValidPath(p string) error {
-	if p == "" {
-		return ErrEmptyPath
+// put makes the file of the event, a link
+// pointing to its content or a regular file.
+func put(event *FileEvent) error {
+	switch {
+	case event.Link && event.Source != "":
+		// targets are always embedded
+		return ErrMalformedEvent
+	case event.Link:
+		return os.Symlink(string(event.Data), event.Path)
+	case event.Source != "":
+		return move(event.Source, event.Path)
 	}
-	cleanPath := path.Clean(p)
-	if strings.Split(cleanPath, sep)[0] != storage {
-		return ErrInvalidPath
+	return os.WriteFile(event.Path, event.Data, perm)
+}
+
+// ApplyMetadata gives the file of the event its mode and its
+// modification time. Links have none of their own, directories
+// get a new time with each change of their childs.
+func ApplyMetadata(event *FileEvent) error {
+	if event.Link {
+		return nil
 	}
-	return nil
+	if event.Mode != 0 {
+		if err := os.Chmod(event.Path, fs.FileMode(event.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+	if event.ModTime == "" || event.IsDir {
+		return nil
+	}
+	modTime, err := time.Parse(TimeLayout, event.ModTime)
+	if err != nil {
+		return ErrMalformedEvent
+	}
+	// the zero time leaves the access time as it is
+	return os.Chtimes(event.Path, time.Time{}, modTime)
+}
+
+// move renames src to dst, the content is copied when
+// they are on different devices: synced directories
+// don't have to share the filesystem of the transfers.
+func move(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
 }
 
 func rename(event *FileEvent) error {
@@ -48,7 +120,7 @@ func rename(event *FileEvent) error {
 	if err == nil && !strings.HasPrefix(rel, "..") && rel != "." {
 		return ErrInvalidDest
 	}
-	stat, err := os.Stat(event.Path)
+	stat, err := os.Lstat(event.Path)
 	if err != nil {
 		return err
 	} else {
@@ -63,7 +135,7 @@ func rename(event *FileEvent) error {
 	if !stat.IsDir() {
 		return ErrInvalidDest
 	}
-	_, err = os.Stat(event.NewPath)
+	_, err = os.Lstat(event.NewPath)
 	if err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
 			return err
@@ -82,33 +154,36 @@ func create(event *FileEvent) error {
 	} else {
 		return err
 	}
-	if _, err := os.Stat(event.Path); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			if event.IsDir {
-				return os.Mkdir(event.Path, perm)
-			} else {
-				return os.WriteFile(event.Path, event.Data, perm)
-			}
+	if _, err := os.Lstat(event.Path); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if event.IsDir {
+			err = os.Mkdir(event.Path, perm)
 		} else {
+			err = put(event)
+		}
+		if err != nil {
 			return err
 		}
+		return ApplyMetadata(event)
 	}
 	return nil
 }
 
 func MakeStorage() error {
-	info, err := os.Stat(storage)
+	info, err := os.Stat(Root)
 	if err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
 			return err
 		}
-		return os.Mkdir(storage, 0777)
+		return os.Mkdir(Root, 0777)
 	} else {
 		if !info.IsDir() {
-			if err := os.Remove(storage); err != nil {
+			if err := os.Remove(Root); err != nil {
 				return err
 			}
-			return os.Mkdir(storage, 0777)
+			return os.Mkdir(Root, 0777)
 		}
 	}
 	return nil
@@ -4,9 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"maps"
 	"os"
 	"path"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/pressly/goose/v3"
@@ -44,8 +47,12 @@ func makeDB(dbPath, driverName string) (*database.Queries, error) {
 	return database.New(db), nil
 }
 
+// initTMP creates the test tree, on disk for a client
+// and in the database and blob store for a server.
 func initTMP(db *database.Queries) error {
-	ctx := context.Background()
+	if db != nil {
+		return initServer(db)
+	}
 	for p, isDir := range paths {
 		if err := os.MkdirAll(path.Dir(p), 0777); err != nil {
 			return err
@@ -64,19 +71,44 @@ func initTMP(db *database.Queries) error {
 				return err
 			}
 		}
-		if db != nil {
-			if err := db.CreateFile(ctx, database.CreateFileParams{
-				Path:  p,
-				Hash:  p,
-				Isdir: isDir,
-			}); err != nil {
-				return err
-			}
+	}
+	return nil
+}
+
+func initServer(db *database.Queries) error {
+	if err := os.MkdirAll(storage, 0777); err != nil {
+		return err
+	}
+	var (
+		ctx    = context.Background()
+		hub    = NewServerHub(db)
+		sorted = slices.Sorted(maps.Keys(paths))
+	)
+	for _, p := range sorted {
+		event := &FileEvent{
+			Path:  p,
+			Op:    fsnotify.Create.String(),
+			IsDir: paths[p],
+		}
+		if !event.IsDir {
+			event.Data = []byte(p)
+		}
+		if err := hub.Create(ctx, event); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// content returns the stored content of the file at p.
+func content(t *testing.T, hub serverHub, p string) []byte {
+	blob, err := hub.Content(context.Background(), p)
+	require.NoError(t, err)
+	data, err := os.ReadFile(blob)
+	require.NoError(t, err)
+	return data
+}
+
 func TestServerHubCreateEvent(t *testing.T) {
 	wd, err := os.Getwd()
 	require.NoError(t, err)
@@ -140,8 +172,41 @@ func TestServerHubCreateEvent(t *testing.T) {
 			event: &FileEvent{
 				Path:  path.Join(storage, "dir-1", "file-1.txt"),
 				Op:    fsnotify.Create.String(),
+				Data:  []byte(path.Join(storage, "dir-1", "file-1.txt")),
+				IsDir: false,
+			},
+		},
+		{
+			name: "creating preexisting file with another content",
+			event: &FileEvent{
+				Path:  path.Join(storage, "dir-1", "file-1.txt"),
+				Op:    fsnotify.Create.String(),
+				Data:  []byte("other"),
+				IsDir: false,
+			},
+			wantErr: true,
+			errType: ErrConflict,
+		},
+		{
+			name: "name differing from a sibling only by case",
+			event: &FileEvent{
+				Path:  path.Join(storage, "dir-1", "File-1.txt"),
+				Op:    fsnotify.Create.String(),
+				Data:  []byte("other"),
 				IsDir: false,
 			},
+			wantErr: true,
+			errType: os.ErrExist,
+		},
+		{
+			name: "directory differing from a sibling only by case",
+			event: &FileEvent{
+				Path:  path.Join(storage, "DIR-1"),
+				Op:    fsnotify.Create.String(),
+				IsDir: true,
+			},
+			wantErr: true,
+			errType: os.ErrExist,
 		}, {
 			name: "invalid (top directory doesn't match)",
 			event: &FileEvent{
@@ -182,18 +247,10 @@ func TestServerHubCreateEvent(t *testing.T) {
 			require.NoErrorf(t, err, "%s", err)
 
 			for _, p := range tc.wantNotExists {
-				_, err := os.Stat(p)
-				require.ErrorIsf(t, err, os.ErrNotExist, "%s should not exists", p)
-
 				_, err = db.GetFile(ctx, p)
 				require.ErrorIsf(t, err, sql.ErrNoRows, "%s should not exists (database)", p)
 			}
 			for path, isDir := range tc.wantExists {
-				got, err := os.Stat(path)
-				require.NoErrorf(t, err, "%s doesn't exists", path)
-
-				require.Equalf(t, got.IsDir(), isDir, "%s", path)
-
 				gotDB, err := db.GetFile(ctx, path)
 				require.NoErrorf(t, err, "%s doesn't exists (database)", path)
 
@@ -286,6 +343,30 @@ func TestServerHubRenameEvent(t *testing.T) {
 			wantErr: true,
 			errType: os.ErrExist,
 		},
+		{
+			name: "moving a file next to one differing only by case",
+			event: &FileEvent{
+				Path:    path.Join(storage, "dir-3", "subdir-3", "file-3.txt"),
+				NewPath: path.Join(storage, "dir-1", "subdir-1", "FILE-3.txt"),
+				Op:      fsnotify.Rename.String(),
+			},
+			wantErr: true,
+			errType: os.ErrExist,
+		},
+		{
+			name: "changing the case of a name",
+			event: &FileEvent{
+				Path:    path.Join(storage, "dir-3", "subdir-3", "file-3.txt"),
+				NewPath: path.Join(storage, "dir-3", "subdir-3", "File-3.txt"),
+				Op:      fsnotify.Rename.String(),
+			},
+			wantExists: map[string]bool{
+				path.Join(storage, "dir-3", "subdir-3", "File-3.txt"): false,
+			},
+			wantNotExists: []string{
+				path.Join(storage, "dir-3", "subdir-3", "file-3.txt"),
+			},
+		},
 
 		{
 			name: "renaming file",
@@ -384,18 +465,10 @@ func TestServerHubRenameEvent(t *testing.T) {
 			_, exists := paths[tc.event.Path]
 			require.True(t, exists)
 			for _, p := range tc.wantNotExists {
-				_, err := os.Stat(p)
-				require.ErrorIsf(t, err, os.ErrNotExist, "%s should not exists", p)
-
 				_, err = db.GetFile(ctx, p)
 				require.ErrorIsf(t, err, sql.ErrNoRows, "%s should not exists (database)", p)
 			}
 			for path, isDir := range tc.wantExists {
-				got, err := os.Stat(path)
-				require.NoErrorf(t, err, "%s doesn't exists", path)
-
-				require.Equalf(t, got.IsDir(), isDir, "%s", path)
-
 				gotDB, err := db.GetFile(ctx, path)
 				require.NoErrorf(t, err, "%s doesn't exists (database)", path)
 
@@ -493,9 +566,6 @@ func TestServerHubRemoveEvent(t *testing.T) {
 			require.NoErrorf(t, err, "%s", err)
 
 			for _, p := range tc.wantNotExists {
-				_, err := os.Stat(p)
-				require.ErrorIsf(t, err, os.ErrNotExist, "%s should not exists", p)
-
 				_, err = db.GetFile(ctx, p)
 				require.ErrorIsf(t, err, sql.ErrNoRows, "%s should not exists (database)", p)
 			}
@@ -510,23 +580,50 @@ func TestServerHubWriteEvent(t *testing.T) {
 
 	defer os.Chdir(wd)
 	tests := []struct {
-		name     string
-		event    *FileEvent
-		wantErr  bool
-		wantData []byte
-		wantHash string
-		errType  error
+		name         string
+		event        *FileEvent
+		wantErr      bool
+		wantData     []byte
+		wantHash     string
+		wantRevision int64
+		errType      error
 	}{
 		{
 			name: "write",
 			event: &FileEvent{
-				Path: path.Join(storage, "dir-1", "file-1.txt"),
-				Op:   fsnotify.Write.String(),
-				Data: []byte("new data"),
-				Hash: "hash",
+				Path:     path.Join(storage, "dir-1", "file-1.txt"),
+				Op:       fsnotify.Write.String(),
+				Data:     []byte("new data"),
+				Hash:     "hash",
+				Revision: 1,
 			},
-			wantData: []byte("new data"),
-			wantHash: "hash",
+			// the hash is computed by the server
+			wantData:     []byte("new data"),
+			wantHash:     "d5b7f828235a92d3d280fa08f3ddb9e5b6947123b44091c92db7594aa1408614",
+			wantRevision: 2,
+		},
+		{
+			name: "write based on a stale revision",
+			event: &FileEvent{
+				Path:     path.Join(storage, "dir-1", "file-1.txt"),
+				Op:       fsnotify.Write.String(),
+				Data:     []byte("new data"),
+				Revision: 0,
+			},
+			wantErr: true,
+			errType: ErrConflict,
+		},
+		{
+			name: "replaying a write",
+			event: &FileEvent{
+				Path:     path.Join(storage, "dir-1", "file-1.txt"),
+				Op:       fsnotify.Write.String(),
+				Data:     []byte(path.Join(storage, "dir-1", "file-1.txt")),
+				Revision: 0,
+			},
+			wantData:     []byte(path.Join(storage, "dir-1", "file-1.txt")),
+			wantHash:     hashOf(path.Join(storage, "dir-1", "file-1.txt")),
+			wantRevision: 1,
 		},
 		{
 			name: "writing to a directory",
@@ -587,15 +684,14 @@ func TestServerHubWriteEvent(t *testing.T) {
 			_, exists := paths[tc.event.Path]
 			require.True(t, exists)
 
-			got, err := os.ReadFile(tc.event.Path)
-			require.NoError(t, err)
-
-			require.Equal(t, tc.wantData, got)
+			require.Equal(t, tc.wantData, content(t, server, tc.event.Path))
 
 			gotDB, err := server.DB.GetFile(ctx, tc.event.Path)
 			require.NoError(t, err)
 
 			require.Equal(t, tc.wantHash, gotDB.Hash)
+			require.Equal(t, tc.wantRevision, gotDB.Revision)
+			require.Equal(t, tc.wantRevision, tc.event.Revision)
 			require.False(t, gotDB.Isdir)
 		}
 
@@ -766,6 +862,110 @@ func TestClientHubUpdate(t *testing.T) {
 	}
 }
 
+func TestClientHubMetadata(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		client  = NewClientHub()
+		modTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		script  = path.Join(storage, "dir-1", "run.sh")
+		link    = path.Join(storage, "dir-1", "latest")
+	)
+	t.Chdir(t.TempDir())
+	require.NoError(t, initTMP(nil))
+
+	// the mode and the time of the file are kept
+	require.NoError(t, client.Process(ctx, &FileEvent{
+		Path:    script,
+		Op:      fsnotify.Create.String(),
+		Data:    []byte("#!/bin/sh"),
+		Mode:    0755,
+		ModTime: modTime.Format(TimeLayout),
+	}))
+	info, err := os.Stat(script)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	require.True(t, modTime.Equal(info.ModTime()))
+
+	// read-only files are written to all the same
+	require.NoError(t, client.Process(ctx, &FileEvent{Path: script, Op: fsnotify.Write.String(), Data: []byte("a"), Mode: 0444}))
+	require.NoError(t, client.Process(ctx, &FileEvent{Path: script, Op: fsnotify.Write.String(), Data: []byte("b"), Mode: 0555}))
+	data, err := os.ReadFile(script)
+	require.NoError(t, err)
+	require.Equal(t, "b", string(data))
+
+	// links are made from their target, and replaced
+	// rather than written through afterwards
+	require.NoError(t, client.Process(ctx, &FileEvent{
+		Path: link,
+		Op:   fsnotify.Create.String(),
+		Data: []byte("file-1.txt"),
+		Link: true,
+	}))
+	target, err := os.Readlink(link)
+	require.NoError(t, err)
+	require.Equal(t, "file-1.txt", target)
+	require.NoError(t, client.Process(ctx, &FileEvent{Path: link, Op: fsnotify.Write.String(), Data: []byte("c")}))
+	info, err = os.Lstat(link)
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsRegular())
+	data, err = os.ReadFile(path.Join(storage, "dir-1", "file-1.txt"))
+	require.NoError(t, err)
+	require.Equal(t, path.Join(storage, "dir-1", "file-1.txt"), string(data))
+
+	require.NoError(t, client.Process(ctx, &FileEvent{Path: link, Op: Update, Data: []byte("subdir-1"), Link: true}))
+	require.NoError(t, client.Process(ctx, &FileEvent{Path: link, NewPath: link + "-2", Op: fsnotify.Rename.String()}))
+	require.NoError(t, client.Process(ctx, &FileEvent{Path: link + "-2", Op: fsnotify.Remove.String()}))
+	require.DirExists(t, path.Join(storage, "dir-1", "subdir-1"), "links are removed, not their target")
+
+	err = client.Process(ctx, &FileEvent{Path: link, Op: fsnotify.Create.String(), Link: true, Source: "blob"})
+	require.ErrorIs(t, err, ErrMalformedEvent)
+}
+
+func TestServerHubMetadata(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		tmp  = t.TempDir()
+		p    = path.Join(storage, "dir-1", "file-1.txt")
+		link = path.Join(storage, "dir-1", "latest")
+	)
+	db, err := makeDB(path.Join(tmp, "test.db"), "sqlite")
+	require.NoError(t, err)
+	server := NewServerHub(db)
+	t.Chdir(tmp)
+	require.NoError(t, initTMP(db))
+
+	require.NoError(t, server.Process(ctx, &FileEvent{
+		Path:    link,
+		Op:      fsnotify.Create.String(),
+		Data:    []byte("file-1.txt"),
+		Link:    true,
+		ModTime: "then",
+	}))
+	// changing the mode alone never conflicts
+	event := &FileEvent{Path: p, Op: fsnotify.Write.String(), Data: []byte(p), Mode: 0755, Revision: 0}
+	require.NoError(t, server.Process(ctx, event))
+	require.Equal(t, int64(2), event.Revision)
+	versions, err := server.DB.ListVersions(ctx, p)
+	require.NoError(t, err)
+	require.Len(t, versions, 1, "the content is the same")
+	event = &FileEvent{Path: p, Op: fsnotify.Write.String(), Data: []byte(p), Mode: 0755, Revision: 2}
+	require.NoError(t, server.Process(ctx, event))
+	require.Equal(t, int64(2), event.Revision)
+
+	tree, err := server.Tree(ctx)
+	require.NoError(t, err)
+	dir := tree.Childs["dir-1"]
+	require.True(t, dir.Childs["latest"].Link)
+	require.Equal(t, "then", dir.Childs["latest"].ModTime)
+	require.Equal(t, uint32(0755), dir.Childs["file-1.txt"].Mode)
+
+	// so do the Update replies
+	update := &FileEvent{Path: link, Op: Update}
+	require.NoError(t, server.Process(ctx, update))
+	require.True(t, update.Link)
+	require.Equal(t, "file-1.txt", string(update.Data))
+}
+
 func TestBuildTree(t *testing.T) {
 	wd, err := os.Getwd()
 	require.NoError(t, err)
@@ -839,3 +1039,39 @@ func TestBuildTree(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+func TestCodeOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorCode
+	}{
+		{
+			name: "event error",
+			err:  EventError{err: ErrInvalidDest, path: "storage"},
+			want: CodeInvalidDest,
+		},
+		{
+			name: "path error",
+			err:  &os.PathError{Op: "stat", Path: "storage", Err: os.ErrNotExist},
+			want: CodeNotExist,
+		},
+		{
+			name: "already exists",
+			err:  EventError{err: os.ErrExist},
+			want: CodeExist,
+		},
+		{
+			name: "unknown error",
+			err:  errors.New("database is locked"),
+			want: CodeInternal,
+		},
+	}
+	for _, tc := range tests {
+		got := CodeOf(tc.err)
+		require.Equalf(t, tc.want, got, "%s", tc.name)
+		if got != CodeInternal {
+			require.ErrorIsf(t, tc.err, got.Err(), "%s", tc.name)
+		}
+	}
+}
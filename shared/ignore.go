@@ -0,0 +1,225 @@
+package shared
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// IgnoreFile lists the paths of its directory, and of the
+// ones below, that are left out of the sync. It uses the
+// gitignore syntax and is synced like any other file.
+const IgnoreFile = ".harmonyignore"
+
+// DefaultIgnores apply to the whole tree,
+// before any IgnoreFile.
+var DefaultIgnores = []string{
+	".git/",
+	"node_modules/",
+	".DS_Store",
+	"Thumbs.db",
+	"desktop.ini",
+	"*.swp",
+	"*.swo",
+	"*~",
+	".#*",
+}
+
+type ignoreRule struct {
+	// the pattern split on '/'
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// patterns holding a '/' are relative to the
+	// directory of their file, the others match
+	// the name of a path at any depth
+	anchored bool
+}
+
+// Ignore tells whether paths are ignored, the
+// IgnoreFile of each directory is read once and
+// kept until Reload is called.
+type Ignore struct {
+	defaults []ignoreRule
+	// rules of the IgnoreFile of each directory,
+	// nil for directories without one
+	dirs map[string][]ignoreRule
+	sync.Mutex
+}
+
+func NewIgnore(defaults []string) *Ignore {
+	ig := &Ignore{dirs: make(map[string][]ignoreRule)}
+	for _, line := range defaults {
+		if rule, ok := parseRule(line); ok {
+			ig.defaults = append(ig.defaults, rule)
+		}
+	}
+	return ig
+}
+
+// IsIgnoreFile reports whether p holds ignore rules.
+func IsIgnoreFile(p string) bool {
+	return path.Base(p) == IgnoreFile
+}
+
+// parseRule parses a line of an IgnoreFile, ok
+// is false for blank lines and comments.
+func parseRule(line string) (rule ignoreRule, ok bool) {
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are dropped unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return rule, false
+	}
+	switch {
+	case line[0] == '!':
+		rule.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	rule.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return rule, false
+	}
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// match reports whether the rule matches rel, the
+// path relative to the directory of the rule.
+func (r ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	if !r.anchored {
+		return matchName(r.segments[0], parts[len(parts)-1])
+	}
+	return matchSegments(r.segments, parts)
+}
+
+func matchName(pattern, name string) bool {
+	matched, err := path.Match(pattern, name)
+	return err == nil && matched
+}
+
+// matchSegments matches the path components against the
+// pattern ones, "**" standing for any number of them.
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				// a trailing "**" matches what is inside
+				return len(parts) > 0
+			}
+			for i := range parts {
+				if matchSegments(pattern, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 || !matchName(pattern[0], parts[0]) {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// evaluate returns the verdict of the last rule matching
+// rel, matched is false if none of them does.
+func evaluate(rules []ignoreRule, rel string, isDir bool) (ignored, matched bool) {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].match(rel, isDir) {
+			return !rules[i].negate, true
+		}
+	}
+	return false, false
+}
+
+// Ignored reports whether p, rooted at the storage
+// directory, is ignored. Like with git, the paths
+// inside an ignored directory are ignored as well.
+func (ig *Ignore) Ignored(p string, isDir bool) bool {
+	root, rel, _ := strings.Cut(path.Clean(p), sep)
+	return ig.IgnoredIn(root, rel, isDir)
+}
+
+// IgnoredIn reports whether rel, relative to the synced
+// directory root, is ignored. The root can be any
+// directory, its rules are read from there.
+func (ig *Ignore) IgnoredIn(root, rel string, isDir bool) bool {
+	if rel = path.Clean(rel); rel == "." {
+		return false
+	}
+	parts := append([]string{root}, strings.Split(rel, sep)...)
+	for i := 2; i <= len(parts); i++ {
+		if ig.match(parts[:i], i < len(parts) || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// match evaluates the rules that apply to the path made
+// of parts, those of the deepest IgnoreFile come first
+// and the defaults last.
+func (ig *Ignore) match(parts []string, isDir bool) bool {
+	for i := len(parts) - 1; i >= 1; i-- {
+		rules := ig.rules(path.Join(parts[:i]...))
+		if ignored, matched := evaluate(rules, path.Join(parts[i:]...), isDir); matched {
+			return ignored
+		}
+	}
+	ignored, _ := evaluate(ig.defaults, path.Join(parts[1:]...), isDir)
+	return ignored
+}
+
+func (ig *Ignore) rules(dir string) []ignoreRule {
+	ig.Lock()
+	defer ig.Unlock()
+	if rules, loaded := ig.dirs[dir]; loaded {
+		return rules
+	}
+	rules := loadRules(path.Join(dir, IgnoreFile))
+	ig.dirs[dir] = rules
+	return rules
+}
+
+// loadRules reads an IgnoreFile, a missing
+// or unreadable file holds no rule.
+func loadRules(p string) []ignoreRule {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Reload forgets the rules of dir, they are read
+// again the next time they are needed.
+func (ig *Ignore) Reload(dir string) {
+	ig.Lock()
+	defer ig.Unlock()
+	delete(ig.dirs, path.Clean(dir))
+}
@@ -0,0 +1,98 @@
+package shared
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnore(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+	require.NoError(t, os.Chdir(t.TempDir()))
+
+	ignoreFiles := map[string]string{
+		storage:                   "# build output\n*.log\n!keep.log\n/dist/\ndocs/**/draft.md\n\\#notes\ntrailing.txt   \n",
+		path.Join(storage, "app"): "!debug.log\nvendor\ntmp/**\n",
+	}
+	for dir, rules := range ignoreFiles {
+		require.NoError(t, os.MkdirAll(dir, perm))
+		require.NoError(t, os.WriteFile(path.Join(dir, IgnoreFile), []byte(rules), perm))
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{path: path.Join(storage, "a.txt")},
+		{path: path.Join(storage, "a.log"), want: true},
+		{path: path.Join(storage, "deep", "down", "a.log"), want: true},
+		{path: path.Join(storage, "keep.log")},
+		{path: path.Join(storage, "dist"), isDir: true, want: true},
+		{path: path.Join(storage, "dist", "bundle.js"), want: true},
+		{path: path.Join(storage, "dist"), isDir: false},
+		{path: path.Join(storage, "app", "dist"), isDir: true},
+		{path: path.Join(storage, "docs", "draft.md"), want: true},
+		{path: path.Join(storage, "docs", "a", "b", "draft.md"), want: true},
+		{path: path.Join(storage, "#notes"), want: true},
+		{path: path.Join(storage, "trailing.txt"), want: true},
+		// the rules of deeper files take precedence
+		{path: path.Join(storage, "app", "debug.log")},
+		{path: path.Join(storage, "app", "other.log"), want: true},
+		{path: path.Join(storage, "app", "vendor"), isDir: true, want: true},
+		{path: path.Join(storage, "app", "src", "vendor", "lib.go"), want: true},
+		{path: path.Join(storage, "app", "tmp"), isDir: true},
+		{path: path.Join(storage, "app", "tmp", "cache"), want: true},
+		{path: path.Join(storage, "vendor")},
+		// defaults
+		{path: path.Join(storage, ".git", "HEAD"), want: true},
+		{path: path.Join(storage, "app", "node_modules"), isDir: true, want: true},
+		{path: path.Join(storage, "app", ".main.go.swp"), want: true},
+		{path: path.Join(storage, ".DS_Store"), want: true},
+		{path: path.Join(storage, IgnoreFile)},
+	}
+	ignore := NewIgnore(DefaultIgnores)
+	for _, tc := range tests {
+		require.Equalf(t, tc.want, ignore.Ignored(tc.path, tc.isDir), "%s", tc.path)
+	}
+
+	// rules are cached until reloaded
+	require.NoError(t, os.WriteFile(path.Join(storage, IgnoreFile), nil, perm))
+	require.True(t, ignore.Ignored(path.Join(storage, "a.log"), false))
+	ignore.Reload(storage)
+	require.False(t, ignore.Ignored(path.Join(storage, "a.log"), false))
+
+	// the tree leaves ignored paths out
+	require.NoError(t, os.MkdirAll(path.Join(storage, "app", "vendor"), perm))
+	require.NoError(t, os.WriteFile(path.Join(storage, "app", ".DS_Store"), nil, perm))
+	require.NoError(t, os.WriteFile(path.Join(storage, "app", "main.go"), nil, perm))
+	tree := BuildTree(storage)
+	require.NotNil(t, tree)
+	app := tree.Childs["app"]
+	require.NotNil(t, app)
+	require.Contains(t, app.Childs, "main.go")
+	require.Contains(t, app.Childs, IgnoreFile)
+	require.NotContains(t, app.Childs, "vendor")
+	require.NotContains(t, app.Childs, ".DS_Store")
+}
+
+func TestIgnoredIn(t *testing.T) {
+	// a root outside the working directory, its
+	// rules are read from the root itself
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(root, "app"), perm))
+	require.NoError(t, os.WriteFile(path.Join(root, IgnoreFile), []byte("*.log\n"), perm))
+	require.NoError(t, os.WriteFile(path.Join(root, "app", IgnoreFile), []byte("!debug.log\n"), perm))
+
+	ignore := NewIgnore(DefaultIgnores)
+	require.False(t, ignore.IgnoredIn(root, "", true))
+	require.False(t, ignore.IgnoredIn(root, "a.txt", false))
+	require.True(t, ignore.IgnoredIn(root, "a.log", false))
+	require.True(t, ignore.IgnoredIn(root, "app/other.log", false))
+	require.False(t, ignore.IgnoredIn(root, "app/debug.log", false))
+	require.True(t, ignore.IgnoredIn(root, ".git", true))
+}
@@ -0,0 +1,213 @@
+package shared
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+// DirHash returns the Merkle hash of a directory: the SHA-256 of its
+// childs sorted by name, each written as its name and its hash. The
+// names of directories end with a slash, an empty directory and an
+// empty file differ. Equal subtrees have equal hashes wherever they
+// are in the tree, comparing two of them is one hash check.
+func DirHash(childs map[string]*FSNode) string {
+	hasher := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(childs)) {
+		child := childs[name]
+		if child == nil {
+			continue
+		}
+		if child.IsDir {
+			name += sep
+		}
+		// names hold no control character
+		fmt.Fprintf(hasher, "%s\x00%s\n", name, child.Hash)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// dirHash computes the hash of the directory at p
+// from the rows of its childs.
+func (s serverHub) dirHash(ctx context.Context, p string) (string, error) {
+	files, err := s.children(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	childs := make(map[string]*FSNode, len(files))
+	for _, f := range files {
+		childs[path.Base(f.Path)] = &FSNode{Hash: f.Hash, IsDir: f.Isdir}
+	}
+	return DirHash(childs), nil
+}
+
+// rehash updates the hashes of the directories holding p
+// after it changed, from its parent up to the top of the
+// tree which has no row.
+func (s serverHub) rehash(ctx context.Context, p string) error {
+	for dir := path.Dir(p); dir != "." && dir != sep; dir = path.Dir(dir) {
+		file, err := s.DB.GetFile(ctx, dir)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hash, err := s.dirHash(ctx, dir)
+		if err != nil {
+			return err
+		}
+		if hash == file.Hash {
+			// the ones above are up to date
+			return nil
+		}
+		if err := s.DB.SetHash(ctx, database.SetHashParams{
+			Hash: hash,
+			Path: dir,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rehashAll computes the hash of every directory, the rows
+// written before directories had one get theirs.
+func (s serverHub) rehashAll(ctx context.Context) error {
+	files, err := s.DB.ListFiles(ctx)
+	if err != nil {
+		return err
+	}
+	return s.rehashFiles(ctx, files)
+}
+
+// rehashFiles computes the hashes of the directories among
+// files, sorted by path, from the ones of their childs. The
+// childs of a directory have to be among files.
+func (s serverHub) rehashFiles(ctx context.Context, files []database.File) error {
+	nodes := make(map[string]*FSNode, len(files))
+	for _, f := range files {
+		node := &FSNode{Path: f.Path, Hash: f.Hash, IsDir: f.Isdir}
+		if f.Isdir {
+			node.Childs = make(map[string]*FSNode)
+		}
+		nodes[f.Path] = node
+		// parents are sorted before their childs
+		if parent := nodes[path.Dir(f.Path)]; parent != nil && parent.IsDir {
+			parent.Childs[path.Base(f.Path)] = node
+		}
+	}
+	// and childs are hashed before their parents
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		if !f.Isdir {
+			continue
+		}
+		node := nodes[f.Path]
+		node.Hash = DirHash(node.Childs)
+		if node.Hash == f.Hash {
+			continue
+		}
+		if err := s.DB.SetHash(ctx, database.SetHashParams{
+			Hash: node.Hash,
+			Path: f.Path,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TreeRequest carries the hashes a client has for folders of
+// the tree, by path. Empty ones are hashes it doesn't know.
+type TreeRequest struct {
+	Hashes map[string]string `json:"hashes"`
+}
+
+// TreeReply answers a TreeRequest with the folders it asks for,
+// by path. The ones whose hash differs hold their childs, which
+// hold none: the client asks for those that differ in turn. The
+// others hold no childs, and the folders the server doesn't have
+// are nil.
+type TreeReply struct {
+	Folders map[string]*FSNode `json:"folders"`
+}
+
+// Folder returns the folder at p of the tree of the user of ctx
+// along with its childs, without theirs. Its hash covers the
+// folders shared with the user mounted below it.
+func (s serverHub) Folder(ctx context.Context, p string) (*FSNode, error) {
+	if err := ValidPath(p); err != nil {
+		return nil, err
+	}
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.folder(ctx, ns, p)
+}
+
+func (s serverHub) folder(ctx context.Context, ns namespace, p string) (*FSNode, error) {
+	scoped, _ := ns.scope(p)
+	node := &FSNode{
+		Path:    p,
+		ModTime: time.Now().Format(TimeLayout),
+		IsDir:   true,
+	}
+	if p != Root {
+		// the top of the tree has no row
+		f, err := s.getFile(ctx, scoped)
+		if err != nil {
+			return nil, err
+		}
+		if !f.Isdir {
+			return nil, ErrInvalidDest
+		}
+		node = fileNode(p, f)
+	}
+	files, err := s.children(ctx, scoped)
+	if err != nil {
+		return nil, err
+	}
+	node.Childs = make(map[string]*FSNode, len(files))
+	for _, f := range files {
+		name := path.Base(f.Path)
+		node.Childs[name] = fileNode(path.Join(p, name), f)
+	}
+	for _, share := range ns.shares {
+		if path.Dir(share.Mount) != p {
+			continue
+		}
+		f, err := s.getFile(ctx, share.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		node.Childs[path.Base(share.Mount)] = fileNode(share.Mount, f)
+	}
+	for _, child := range node.Childs {
+		if !child.IsDir || !ns.holdsMount(child.Path) {
+			continue
+		}
+		// the stored hash leaves the mounts out
+		sub, err := s.folder(ctx, ns, child.Path)
+		if err != nil {
+			return nil, err
+		}
+		child.Hash = sub.Hash
+	}
+	node.Hash = DirHash(node.Childs)
+	return node, nil
+}
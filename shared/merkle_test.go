@@ -0,0 +1,144 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+func TestDirHash(t *testing.T) {
+	var (
+		empty = DirHash(nil)
+		file  = &FSNode{Hash: hashOf("")}
+		dir   = &FSNode{Hash: empty, IsDir: true}
+	)
+	require.Equal(t, empty, DirHash(map[string]*FSNode{}))
+	require.Equal(t, empty, DirHash(map[string]*FSNode{"a": nil}), "nil childs are left out")
+	require.NotEqual(t, DirHash(map[string]*FSNode{"a": file}), DirHash(map[string]*FSNode{"a": dir}))
+	require.NotEqual(t, DirHash(map[string]*FSNode{"a": file}), DirHash(map[string]*FSNode{"b": file}))
+	require.NotEqual(t, DirHash(map[string]*FSNode{"a": file, "b": dir}), DirHash(map[string]*FSNode{"a": dir, "b": file}))
+	// only the names and the hashes count
+	require.Equal(t,
+		DirHash(map[string]*FSNode{"a": file, "b": dir}),
+		DirHash(map[string]*FSNode{"b": {Path: "x", Hash: empty, IsDir: true}, "a": {Path: "y", Hash: hashOf(""), Revision: 3}}),
+	)
+}
+
+func TestServerHubMerkle(t *testing.T) {
+	var (
+		ctx = context.Background()
+		tmp = t.TempDir()
+	)
+	db, err := makeDB(path.Join(tmp, "test.db"), "sqlite")
+	require.NoError(t, err)
+	hub := NewServerHub(db)
+	t.Chdir(tmp)
+	require.NoError(t, initTMP(db))
+
+	stored := func(p string) string {
+		t.Helper()
+		f, err := db.GetFile(ctx, p)
+		require.NoError(t, err)
+		return f.Hash
+	}
+	// every directory holds the hash of its rows
+	check := func() {
+		t.Helper()
+		files, err := db.ListFiles(ctx)
+		require.NoError(t, err)
+		for _, f := range files {
+			if !f.Isdir {
+				continue
+			}
+			want, err := hub.dirHash(ctx, f.Path)
+			require.NoError(t, err)
+			require.Equalf(t, want, f.Hash, "%s", f.Path)
+		}
+	}
+	check()
+	// the hash of the content, whatever the sender claims
+	file := path.Join(Root, "dir-1", "file-1.txt")
+	require.Equal(t, hashOf(file), stored(file))
+	event := &FileEvent{Path: path.Join(Root, "dir-2", "new.txt"), Op: fsnotify.Create.String(), Data: []byte("new"), Hash: hashOf("other")}
+	require.NoError(t, hub.Process(ctx, event))
+	require.Equal(t, hashOf("new"), event.Hash)
+	require.Equal(t, hashOf("new"), stored(event.Path))
+	require.Equal(t, DirHash(nil), stored(path.Join(Root, "dir-2", "subdir-2")))
+	check()
+
+	// the same content gives the same hash wherever it is
+	copy := path.Join(Root, "dir-4", "subdir-3")
+	for _, event := range []*FileEvent{
+		{Path: path.Join(Root, "dir-4"), IsDir: true},
+		{Path: copy, IsDir: true},
+		{Path: path.Join(copy, "file-3.txt"), Data: []byte(path.Join(Root, "dir-3", "subdir-3", "file-3.txt"))},
+	} {
+		event.Op = fsnotify.Create.String()
+		require.NoError(t, hub.Process(ctx, event))
+	}
+	require.Equal(t, stored(path.Join(Root, "dir-3", "subdir-3")), stored(copy))
+	require.Equal(t, stored(path.Join(Root, "dir-3")), stored(path.Join(Root, "dir-4")))
+
+	// and a change shows in every directory above it
+	before := stored(path.Join(Root, "dir-4"))
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: path.Join(copy, "file-3.txt"), Op: fsnotify.Write.String(), Data: []byte("changed"), Revision: 1}))
+	require.NotEqual(t, before, stored(path.Join(Root, "dir-4")))
+	require.NotEqual(t, stored(path.Join(Root, "dir-3")), stored(path.Join(Root, "dir-4")))
+	check()
+
+	// moved directories keep their hash
+	moved := stored(copy)
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: copy, NewPath: path.Join(Root, "dir-2", "subdir-3"), Op: fsnotify.Rename.String(), IsDir: true}))
+	require.Equal(t, moved, stored(path.Join(Root, "dir-2", "subdir-3")))
+	require.Equal(t, DirHash(nil), stored(path.Join(Root, "dir-4")))
+	check()
+
+	before = stored(path.Join(Root, "dir-1"))
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: path.Join(Root, "dir-1", "subdir-1"), Op: fsnotify.Remove.String(), IsDir: true}))
+	require.NotEqual(t, before, stored(path.Join(Root, "dir-1")))
+	check()
+	entries, err := hub.Trash(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	_, err = hub.RestoreTrash(ctx, entries[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, before, stored(path.Join(Root, "dir-1")))
+	check()
+
+	// the tree carries the hashes, the one of
+	// the top covers the whole tree
+	tree, err := hub.Tree(ctx)
+	require.NoError(t, err)
+	require.Equal(t, stored(path.Join(Root, "dir-1")), tree.Childs["dir-1"].Hash)
+	require.Equal(t, DirHash(tree.Childs), tree.Hash)
+	// and so do the folders
+	folder, err := hub.Folder(ctx, Root)
+	require.NoError(t, err)
+	require.Equal(t, tree.Hash, folder.Hash)
+	require.Nil(t, folder.Childs["dir-1"].Childs)
+	folder, err = hub.Folder(ctx, path.Join(Root, "dir-1"))
+	require.NoError(t, err)
+	require.Equal(t, stored(path.Join(Root, "dir-1")), folder.Hash)
+	require.Equal(t, stored(file), folder.Childs["file-1.txt"].Hash)
+	_, err = hub.Folder(ctx, file)
+	require.ErrorIs(t, err, ErrInvalidDest)
+	_, err = hub.Folder(ctx, path.Join(Root, "missing"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// rows without a hash get theirs on import
+	files, err := db.ListFiles(ctx)
+	require.NoError(t, err)
+	for _, f := range files {
+		if f.Isdir {
+			require.NoError(t, db.SetHash(ctx, database.SetHashParams{Path: f.Path}))
+		}
+	}
+	require.NoError(t, hub.Import(ctx))
+	require.Equal(t, before, stored(path.Join(Root, "dir-1")))
+	check()
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 )
 
 type EnvelopeType int
@@ -13,6 +14,24 @@ type EnvelopeType int
 const (
 	Event EnvelopeType = iota
 	FSTree
+	// Ack and Nack carry a Result telling the
+	// sender what happened to one of its events
+	Ack
+	Nack
+	// Begin, Chunk and Commit carry the
+	// content of files streamed in chunks
+	Begin
+	Chunk
+	Commit
+	// Want answers the manifest of a delta transfer
+	Want
+	// Subscribe carries the Subscription of a client,
+	// it is sent before the tree is requested
+	Subscribe
+	// Hashes carries a TreeRequest, Folders the
+	// TreeReply of the server
+	Hashes
+	Folders
 )
 
 const (
@@ -25,6 +44,7 @@ var (
 	ErrEmptyPath        = errors.New("shared: empty path")
 	ErrInvalidPath      = errors.New("shared: invalid path")
 	ErrInvalidDest      = errors.New("shared: invalid destination ")
+	ErrConflict         = errors.New("shared: conflicting revision")
 )
 
 type EventError struct {
@@ -47,12 +67,40 @@ type Envelope struct {
 }
 
 type FileEvent struct {
+	// ID is the sequence number of the event in the
+	// sender's outbox, echoed back in the Ack / Nack.
+	ID      int64  `json:"id,omitempty"`
 	Path    string `json:"path"`
 	NewPath string `json:"newpath"`
 	Op      string `json:"op"`
 	Hash    string `json:"hash"`
 	Data    []byte `json:"data"`
 	IsDir   bool   `json:"isDir"`
+	// Revision is the revision of the file the change
+	// is based on when sent by a client, and the one
+	// it resulted in when sent by the server.
+	Revision int64 `json:"revision,omitempty"`
+	// Chunked is set when the content doesn't
+	// fit in Data and is streamed instead.
+	Chunked bool `json:"chunked,omitempty"`
+	// Dedup is set when Data is left out because the
+	// receiver is expected to know the content by Hash.
+	Dedup bool `json:"dedup,omitempty"`
+	// ConflictOf is set on the creation of a conflict
+	// copy, it is the path of the file it conflicted with.
+	ConflictOf string `json:"conflictOf,omitempty"`
+	// Mode holds the permission bits of the file,
+	// receivers keep their own when it is zero.
+	Mode uint32 `json:"mode,omitempty"`
+	// Link is set when the file is a symbolic link,
+	// its content is the target of the link.
+	Link bool `json:"link,omitempty"`
+	// ModTime is the time the file was last modified
+	// on the device that changed it, in TimeLayout.
+	ModTime string `json:"modTime,omitempty"`
+	// Source is the local file holding the
+	// content of a committed transfer.
+	Source string `json:"-"`
 }
 
 func MarshalEnvl(msg any, Type EnvelopeType) ([]byte, error) {
@@ -66,6 +114,18 @@ func MarshalEnvl(msg any, Type EnvelopeType) ([]byte, error) {
 	})
 }
 
+// SetMetadata fills the metadata of the event from
+// info, the Lstat of its file: links are not followed.
+func (f *FileEvent) SetMetadata(info fs.FileInfo) {
+	f.Link = info.Mode()&fs.ModeSymlink != 0
+	f.Mode = 0
+	if !f.Link {
+		// the bits of links are meaningless
+		f.Mode = uint32(info.Mode().Perm())
+	}
+	f.ModTime = info.ModTime().Format(TimeLayout)
+}
+
 func (f *FileEvent) New(data []byte) {
 	f.Data = data
 	newHash := sha256.Sum256(data)
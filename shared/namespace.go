@@ -0,0 +1,135 @@
+package shared
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+// usersDir holds the trees of the users in the database,
+// the tree of the default user is stored as is.
+const usersDir = "users"
+
+type namespaceKey struct{}
+
+// WithNamespace scopes the events processed with ctx
+// to the tree of user, "" being the default user.
+func WithNamespace(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, user)
+}
+
+// NamespaceOf returns the user ctx is scoped to.
+func NamespaceOf(ctx context.Context) string {
+	user, _ := ctx.Value(namespaceKey{}).(string)
+	return user
+}
+
+// isValidUser reports whether the user can name a namespace,
+// which has to fit in a single path element.
+func isValidUser(user string) bool {
+	if user == "" {
+		return true
+	}
+	return user != "." && user != ".." &&
+		!strings.ContainsAny(user, `/\`) &&
+		strings.TrimSpace(user) == user
+}
+
+// rootOf is where the storage of the user lives in the database.
+func rootOf(user string) string {
+	if user == "" {
+		return Root
+	}
+	return path.Join(usersDir, user, Root)
+}
+
+func root(ctx context.Context) string {
+	return rootOf(NamespaceOf(ctx))
+}
+
+// ownerOf returns the user the row at p belongs to.
+func ownerOf(p string) string {
+	parts := strings.SplitN(p, sep, 3)
+	if len(parts) == 3 && parts[0] == usersDir {
+		return parts[1]
+	}
+	return ""
+}
+
+// within reports whether p is dir or is under it.
+func within(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+sep)
+}
+
+// namespace is the tree of a user along
+// with the folders shared with the user.
+type namespace struct {
+	root   string
+	shares []database.Share
+}
+
+func newNamespace(user string, shares []database.Share) namespace {
+	n := namespace{root: rootOf(user)}
+	for _, share := range shares {
+		if share.Member == user {
+			n.shares = append(n.shares, share)
+		}
+	}
+	return n
+}
+
+func (s serverHub) namespace(ctx context.Context) (namespace, error) {
+	shares, err := s.DB.ListShares(ctx)
+	if err != nil {
+		return namespace{}, err
+	}
+	return newNamespace(NamespaceOf(ctx), shares), nil
+}
+
+// scope maps a path of the tree of the user to its row in the
+// database, share is set when p is in a folder shared with the user.
+func (n namespace) scope(p string) (string, *database.Share) {
+	if p == "" {
+		return p, nil
+	}
+	p = path.Clean(p)
+	for i, share := range n.shares {
+		if within(p, share.Mount) {
+			return share.Path + strings.TrimPrefix(p, share.Mount), &n.shares[i]
+		}
+	}
+	return n.root + strings.TrimPrefix(p, Root), nil
+}
+
+// unscope maps a row of the database back to the tree of the user,
+// visible is false when the row is in none of the folders of the user.
+func (n namespace) unscope(p string) (_ string, _ *database.Share, visible bool) {
+	if within(p, n.root) {
+		return Root + strings.TrimPrefix(p, n.root), nil, true
+	}
+	for i, share := range n.shares {
+		if within(p, share.Path) {
+			return share.Mount + strings.TrimPrefix(p, share.Path), &n.shares[i], true
+		}
+	}
+	return "", nil, false
+}
+
+// holdsMount reports whether a folder shared
+// with the user is mounted below p.
+func (n namespace) holdsMount(p string) bool {
+	for _, share := range n.shares {
+		if share.Mount != p && within(share.Mount, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// writable reports whether the user can change what is under the
+// share, which is nil for the own tree of the user.
+func writable(share *database.Share) bool {
+	return share == nil || share.Writable
+}
@@ -0,0 +1,92 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaces(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		tmp    = t.TempDir()
+		dbPath = path.Join(tmp, "test.db")
+		alice  = WithNamespace(context.Background(), "alice")
+		bob    = WithNamespace(context.Background(), "bob")
+		file   = path.Join(storage, "doc.txt")
+		dir    = path.Join(storage, "dir")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	hub := NewServerHub(db)
+
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(db))
+
+	// the same path lives in both trees
+	for ctx, data := range map[context.Context]string{alice: "alice", bob: "bob"} {
+		event := &FileEvent{Path: file, Op: fsnotify.Create.String(), Data: []byte(data)}
+		require.NoError(t, hub.Process(ctx, event))
+		require.Equal(t, file, event.Path)
+		require.Equal(t, int64(1), event.Revision)
+	}
+	require.NoError(t, hub.Process(alice, &FileEvent{Path: dir, Op: fsnotify.Create.String(), IsDir: true}))
+
+	blob, err := hub.Content(bob, file)
+	require.NoError(t, err)
+	data, err := os.ReadFile(blob)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bob"), data)
+
+	tree, err := hub.Tree(alice)
+	require.NoError(t, err)
+	require.Len(t, tree.Childs, 2)
+	require.Equal(t, file, tree.Childs["doc.txt"].Path)
+	require.Equal(t, dir, tree.Childs["dir"].Path)
+	tree, err = hub.Tree(bob)
+	require.NoError(t, err)
+	require.Len(t, tree.Childs, 1)
+
+	// the default tree doesn't see the users
+	tree, err = hub.Tree(context.Background())
+	require.NoError(t, err)
+	_, exists := tree.Childs[usersDir]
+	require.False(t, exists)
+	_, err = hub.Content(context.Background(), file)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// moving into the tree of another user is not possible
+	err = hub.Process(alice, &FileEvent{Path: file, NewPath: "users/bob/storage/doc.txt", Op: fsnotify.Rename.String()})
+	require.ErrorIs(t, err, ErrInvalidPath)
+
+	versions, err := hub.Versions(alice, file)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	require.Equal(t, file, versions[0].Path)
+	_, err = hub.Restore(bob, versions[0].ID)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, hub.Process(alice, &FileEvent{Path: file, Op: fsnotify.Remove.String()}))
+	entries, err := hub.Trash(bob)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	entries, err = hub.Trash(alice)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, file, entries[0].Path)
+
+	_, err = hub.RestoreTrash(bob, entries[0].ID)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.ErrorIs(t, hub.PurgeTrash(bob, entries[0].ID), os.ErrNotExist)
+	events, err := hub.RestoreTrash(alice, entries[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, file, events[0].Path)
+}
@@ -0,0 +1,120 @@
+package shared
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Paths travel between the devices and the server in a canonical
+// form: slash separated, relative, rooted at Root, NFC normalized
+// and made of plain names. Senders turn their paths into it with
+// CanonicalPath, receivers reject the others with ValidPath rather
+// than guess what they stand for.
+
+// reservedNames can't be created on Windows,
+// whatever the extension that follows them.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// CanonicalPath returns the canonical form of p, empty and "."
+// names are dropped. It fails when p has none: absolute, out of
+// the tree, or holding a name that can't be synced.
+func CanonicalPath(p string) (string, error) {
+	if p == "" {
+		return "", ErrEmptyPath
+	}
+	if !utf8.ValidString(p) || strings.HasPrefix(p, sep) {
+		return "", ErrInvalidPath
+	}
+	names := make([]string, 0, strings.Count(p, sep)+1)
+	for _, name := range strings.Split(norm.NFC.String(p), sep) {
+		if name == "" || name == "." {
+			continue
+		}
+		if !validName(name) {
+			return "", ErrInvalidPath
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 || names[0] != Root {
+		return "", ErrInvalidPath
+	}
+	return strings.Join(names, sep), nil
+}
+
+// validName reports whether name can be synced on every system.
+func validName(name string) bool {
+	if name == ".." || strings.ContainsRune(name, '\\') {
+		return false
+	}
+	for _, r := range name {
+		// NUL and the other control characters
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	base, _, _ := strings.Cut(name, ".")
+	return !reservedNames[strings.ToUpper(strings.TrimRight(base, " "))]
+}
+
+// ValidPath checks that p is a canonical path of the tree that
+// events may change, the internal directory is out of reach.
+func ValidPath(p string) error {
+	canonical, err := CanonicalPath(p)
+	if err != nil {
+		return err
+	}
+	if canonical != p || IsInternal(p) {
+		return ErrInvalidPath
+	}
+	return nil
+}
+
+// CheckLinks fails when one of the directories of p below root
+// is a symbolic link: the events would follow it out of the root.
+// p itself may be one, the events replace links rather than
+// follow them.
+func CheckLinks(root, p string) error {
+	rel, ok := strings.CutPrefix(p, root)
+	if !ok || rel != "" && !strings.HasPrefix(rel, sep) {
+		return ErrInvalidPath
+	}
+	dir := root
+	for _, name := range strings.Split(path.Dir(strings.TrimPrefix(rel, sep)), sep) {
+		if name == "." {
+			continue
+		}
+		dir = path.Join(dir, name)
+		info, err := os.Lstat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			// nothing below to follow
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return ErrInvalidPath
+		}
+	}
+	return nil
+}
+
+// Escapes reports whether the link at p, pointing to target,
+// leads out of root. Absolute targets always do.
+func Escapes(root, p, target string) bool {
+	if target == "" || path.IsAbs(target) {
+		return true
+	}
+	return !within(path.Join(path.Dir(p), target), root)
+}
@@ -0,0 +1,190 @@
+package shared
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		err  error
+	}{
+		{path: Root, want: Root},
+		{path: "storage/docs/a.txt", want: "storage/docs/a.txt"},
+		{path: "storage//docs/./a.txt/", want: "storage/docs/a.txt"},
+		// decomposed é
+		{path: "storage/cafe\u0301.txt", want: "storage/caf\u00e9.txt"},
+		{path: "", err: ErrEmptyPath},
+		{path: "/storage/a.txt", err: ErrInvalidPath},
+		{path: "docs/a.txt", err: ErrInvalidPath},
+		{path: "./storage", want: Root},
+		{path: "storage/docs/../a.txt", err: ErrInvalidPath},
+		{path: "storage/..", err: ErrInvalidPath},
+		{path: "storage/a\x00.txt", err: ErrInvalidPath},
+		{path: "storage/a\n.txt", err: ErrInvalidPath},
+		{path: `storage\..\a.txt`, err: ErrInvalidPath},
+		{path: "storage/\xff", err: ErrInvalidPath},
+		{path: "storage/CON", err: ErrInvalidPath},
+		{path: "storage/docs/nul.txt", err: ErrInvalidPath},
+		{path: "storage/Lpt1 .tar.gz", err: ErrInvalidPath},
+		{path: "storage/console.txt", want: "storage/console.txt"},
+		{path: "storage/COM10", want: "storage/COM10"},
+	}
+	for _, tc := range tests {
+		got, err := CanonicalPath(tc.path)
+		if tc.err != nil {
+			require.ErrorIsf(t, err, tc.err, "%q", tc.path)
+			continue
+		}
+		require.NoErrorf(t, err, "%q", tc.path)
+		require.Equal(t, tc.want, got)
+	}
+
+	// receivers only take the canonical form
+	require.NoError(t, ValidPath("storage/docs/a.txt"))
+	require.ErrorIs(t, ValidPath("storage/docs/"), ErrInvalidPath)
+	require.ErrorIs(t, ValidPath("storage/cafe\u0301.txt"), ErrInvalidPath)
+	require.ErrorIs(t, ValidPath(path.Join(Root, TmpDir, "a.part")), ErrInvalidPath)
+}
+
+func TestCheckLinks(t *testing.T) {
+	tmp := t.TempDir()
+	root := path.Join(tmp, Root)
+	require.NoError(t, os.MkdirAll(path.Join(root, "docs"), perm))
+	require.NoError(t, os.Symlink(tmp, path.Join(root, "link")))
+
+	require.NoError(t, CheckLinks(root, root))
+	require.NoError(t, CheckLinks(root, path.Join(root, "docs", "a.txt")))
+	require.NoError(t, CheckLinks(root, path.Join(root, "missing", "a.txt")))
+	// the link itself is replaced, not followed
+	require.NoError(t, CheckLinks(root, path.Join(root, "link")))
+	require.ErrorIs(t, CheckLinks(root, path.Join(root, "link", "a.txt")), ErrInvalidPath)
+	require.ErrorIs(t, CheckLinks(root, root+"x/a.txt"), ErrInvalidPath)
+
+	link := path.Join(root, "docs", "link")
+	require.False(t, Escapes(root, link, "a.txt"))
+	require.False(t, Escapes(root, link, "../notes/a.txt"))
+	require.True(t, Escapes(root, link, "../../a.txt"))
+	require.True(t, Escapes(root, link, "/etc/passwd"))
+	require.True(t, Escapes(root, link, ""))
+}
+
+func FuzzValidPath(f *testing.F) {
+	for _, seed := range []string{
+		"storage/a.txt", "storage/../etc/passwd", "/etc/passwd", "storage/a/../../b",
+		"storage/.harmony/blobs", "storage/a\x00b", `storage\a`, "storage/cafe\u0301",
+		"storage//a", "storage/AUX.c", "C:/storage", "storage/..\\..",
+	} {
+		f.Add(seed)
+	}
+	root := f.TempDir()
+	f.Fuzz(func(t *testing.T, p string) {
+		canonical, err := CanonicalPath(p)
+		if err != nil {
+			require.Error(t, ValidPath(p))
+			return
+		}
+		c, err := CanonicalPath(canonical)
+		require.NoError(t, err)
+		require.Equal(t, canonical, c, "canonical paths are their own canonical form")
+		if ValidPath(p) != nil {
+			return
+		}
+		require.Equal(t, canonical, p)
+		require.True(t, norm.NFC.IsNormalString(p))
+		require.NotContains(t, p, "\x00")
+		// whatever the directory it is joined
+		// to, the path stays inside of it
+		rel, err := filepath.Rel(root, filepath.Join(root, p))
+		require.NoError(t, err)
+		require.False(t, rel == ".." || strings.HasPrefix(rel, "../"), "%q leads out of the root", p)
+		require.True(t, within(p, Root))
+		require.False(t, IsInternal(p))
+	})
+}
+
+// FuzzClientHub applies arbitrary events next to a symlink
+// leading out of the storage directory, nothing outside of
+// it may change. The links the events make aren't followed.
+func FuzzClientHub(f *testing.F) {
+	ops := []string{
+		fsnotify.Create.String(), fsnotify.Write.String(),
+		fsnotify.Rename.String(), fsnotify.Remove.String(), Update,
+	}
+	f.Add(uint8(0), "storage/new.txt", "", false, []byte("new"), false)
+	f.Add(uint8(0), "storage/../outside.txt", "", false, []byte("x"), false)
+	f.Add(uint8(0), "storage/link/escaped.txt", "", false, []byte("x"), false)
+	f.Add(uint8(0), "storage/link/dir", "", true, []byte(nil), false)
+	f.Add(uint8(1), "storage/link/secret.txt", "", false, []byte("x"), false)
+	f.Add(uint8(1), "storage/docs/a.txt", "", false, []byte("a"), false)
+	f.Add(uint8(2), "storage/docs/a.txt", "storage/link/a.txt", false, []byte(nil), false)
+	f.Add(uint8(2), "storage/docs/a.txt", "outside.txt", false, []byte(nil), false)
+	f.Add(uint8(2), "storage/docs", "storage/../moved", true, []byte(nil), false)
+	f.Add(uint8(3), "storage/link/secret.txt", "", false, []byte(nil), false)
+	f.Add(uint8(3), "storage/../outside.txt", "", false, []byte(nil), false)
+	f.Add(uint8(3), "storage/link", "", false, []byte(nil), false)
+	f.Add(uint8(4), "/tmp/a.txt", "", false, []byte("x"), false)
+	f.Add(uint8(0), "storage/docs/up", "", false, []byte("../.."), true)
+	f.Add(uint8(1), "storage/link", "", false, []byte("/etc"), true)
+	f.Fuzz(func(t *testing.T, op uint8, p, newPath string, isDir bool, data []byte, link bool) {
+		tmp := t.TempDir()
+		target := path.Join(tmp, "target")
+		work := path.Join(tmp, "work")
+		require.NoError(t, os.MkdirAll(path.Join(work, Root, "docs"), perm))
+		require.NoError(t, os.MkdirAll(target, perm))
+		require.NoError(t, os.WriteFile(path.Join(target, "secret.txt"), []byte("secret"), perm))
+		require.NoError(t, os.WriteFile(path.Join(work, "outside.txt"), []byte("outside"), perm))
+		require.NoError(t, os.WriteFile(path.Join(work, Root, "docs", "a.txt"), []byte("a"), perm))
+		require.NoError(t, os.Symlink(target, path.Join(work, Root, "link")))
+		outside := snapshot(t, tmp, path.Join(work, Root))
+		t.Chdir(work)
+
+		NewClientHub().Process(context.Background(), &FileEvent{
+			Path:    p,
+			NewPath: newPath,
+			Op:      ops[int(op)%len(ops)],
+			IsDir:   isDir,
+			Data:    data,
+			Link:    link,
+		})
+		require.Equal(t, outside, snapshot(t, tmp, path.Join(work, Root)))
+	})
+}
+
+// snapshot returns the content of the files below dir,
+// the subtree at skip left aside. The target of links is
+// not listed.
+func snapshot(t *testing.T, dir, skip string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == skip {
+			return filepath.SkipDir
+		}
+		if d.Type().IsRegular() {
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			files[p] = string(data)
+		} else {
+			files[p] = d.Type().String()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return files
+}
@@ -0,0 +1,98 @@
+package shared
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrorCode identifies why an event was rejected,
+// it travels with Nack envelopes so that the sender
+// can decide what to do with the event.
+type ErrorCode string
+
+const (
+	CodeMalformedEvent   ErrorCode = "MALFORMED_EVENT"
+	CodeUnsupportedEvent ErrorCode = "UNSUPPORTED_EVENT"
+	CodeEmptyPath        ErrorCode = "EMPTY_PATH"
+	CodeInvalidPath      ErrorCode = "INVALID_PATH"
+	CodeInvalidDest      ErrorCode = "INVALID_DESTINATION"
+	CodeExist            ErrorCode = "EXIST"
+	CodeNotExist         ErrorCode = "NOT_EXIST"
+	CodeCorrupted        ErrorCode = "CORRUPTED"
+	CodeUnknownContent   ErrorCode = "UNKNOWN_CONTENT"
+	CodeConflict         ErrorCode = "CONFLICT"
+	CodeUnauthorized     ErrorCode = "UNAUTHORIZED"
+	CodeInvalidName      ErrorCode = "INVALID_NAME"
+	CodeReadOnly         ErrorCode = "READ_ONLY"
+	CodeInternal         ErrorCode = "INTERNAL"
+)
+
+var codes = []struct {
+	code ErrorCode
+	err  error
+}{
+	{CodeMalformedEvent, ErrMalformedEvent},
+	{CodeUnsupportedEvent, ErrUnsupportedEvent},
+	{CodeEmptyPath, ErrEmptyPath},
+	{CodeInvalidPath, ErrInvalidPath},
+	{CodeInvalidDest, ErrInvalidDest},
+	{CodeExist, os.ErrExist},
+	{CodeNotExist, os.ErrNotExist},
+	{CodeCorrupted, ErrCorruptedChunk},
+	{CodeCorrupted, ErrUnknownTransfer},
+	{CodeUnknownContent, ErrUnknownContent},
+	{CodeConflict, ErrConflict},
+	{CodeUnauthorized, ErrUnauthorized},
+	{CodeInvalidName, ErrInvalidName},
+	{CodeInvalidName, ErrInvalidUser},
+	{CodeReadOnly, ErrReadOnly},
+}
+
+// Result is the outcome of a single event.
+type Result struct {
+	ID   int64  `json:"id"`
+	Path string `json:"path"`
+	// Revision is the revision of the file once
+	// the event is applied, the current one when
+	// the event is rejected.
+	Revision int64     `json:"revision,omitempty"`
+	Code     ErrorCode `json:"code,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// CodeOf maps an error returned by a Hub
+// to the code sent back to the client.
+func CodeOf(err error) ErrorCode {
+	for _, c := range codes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return CodeInternal
+}
+
+// Err returns the error matching the code,
+// nil for an unknown code.
+func (c ErrorCode) Err() error {
+	for _, code := range codes {
+		if code.code == c {
+			return code.err
+		}
+	}
+	return nil
+}
+
+// NewResult builds the result of the event,
+// err being the error returned by Process.
+func NewResult(event *FileEvent, err error) Result {
+	res := Result{
+		ID:       event.ID,
+		Path:     event.Path,
+		Revision: event.Revision,
+	}
+	if err != nil {
+		res.Code = CodeOf(err)
+		res.Message = err.Error()
+	}
+	return res
+}
@@ -0,0 +1,131 @@
+package shared
+
+import (
+	"slices"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Subscription lists the subtrees a client syncs, an
+// empty list subscribes the client to the whole tree.
+type Subscription struct {
+	Paths []string `json:"paths"`
+}
+
+// Selection is the set of subtrees a device mirrors,
+// a nil Selection selects the whole tree.
+type Selection []string
+
+// NewSelection checks the paths and puts them in their
+// canonical form, selecting the top of the tree selects all.
+func NewSelection(paths []string) (Selection, error) {
+	var s Selection
+	for _, p := range paths {
+		p, err := CanonicalPath(p)
+		if err != nil {
+			return nil, err
+		}
+		if IsInternal(p) {
+			return nil, ErrInvalidPath
+		}
+		if p == Root {
+			return nil, nil
+		}
+		if !slices.Contains(s, p) {
+			s = append(s, p)
+		}
+	}
+	return s, nil
+}
+
+// Contains reports whether p is in a selected subtree.
+func (s Selection) Contains(p string) bool {
+	if s == nil {
+		return true
+	}
+	for _, dir := range s {
+		if within(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Includes reports whether p is mirrored, either
+// selected or a directory leading to a selected one.
+func (s Selection) Includes(p string) bool {
+	if s.Contains(p) {
+		return true
+	}
+	for _, dir := range s {
+		if within(dir, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Intersect returns the subtrees selected by both
+// selections, it is empty when they have none in common.
+func (s Selection) Intersect(o Selection) Selection {
+	if s == nil {
+		return o
+	}
+	if o == nil {
+		return s
+	}
+	both := Selection{}
+	for _, p := range s {
+		for _, q := range o {
+			dir := ""
+			switch {
+			case within(p, q):
+				dir = p
+			case within(q, p):
+				dir = q
+			}
+			if dir != "" && !slices.Contains(both, dir) {
+				both = append(both, dir)
+			}
+		}
+	}
+	return both
+}
+
+// Prune returns the part of the tree that is mirrored,
+// the tree itself is left untouched.
+func (s Selection) Prune(node *FSNode) *FSNode {
+	if s == nil || node == nil || s.Contains(node.Path) {
+		return node
+	}
+	if !s.Includes(node.Path) {
+		return nil
+	}
+	pruned := *node
+	pruned.Childs = make(map[string]*FSNode)
+	for name, child := range node.Childs {
+		if child := s.Prune(child); child != nil {
+			pruned.Childs[name] = child
+		}
+	}
+	return &pruned
+}
+
+// View returns the event as seen through the selection, ok is
+// false when it doesn't concern it. A rename out of the selection
+// is a removal, one into it isn't delivered as the content is
+// missing: the tree has to be sent again instead.
+func (s Selection) View(event FileEvent) (view FileEvent, ok bool) {
+	if !s.Includes(event.Path) {
+		return event, false
+	}
+	if event.ConflictOf != "" && !s.Includes(event.ConflictOf) {
+		event.ConflictOf = ""
+	}
+	if event.Op == fsnotify.Rename.String() && !s.Includes(event.NewPath) {
+		// moved out of the selection
+		event.Op = fsnotify.Remove.String()
+		event.NewPath = ""
+	}
+	return event, true
+}
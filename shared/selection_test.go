@@ -0,0 +1,80 @@
+package shared
+
+import (
+	"path"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelection(t *testing.T) {
+	all, err := NewSelection([]string{path.Join(storage, "docs"), storage})
+	require.NoError(t, err)
+	require.Nil(t, all)
+	require.True(t, all.Includes(path.Join(storage, "anything")))
+
+	_, err = NewSelection([]string{"docs"})
+	require.ErrorIs(t, err, ErrInvalidPath)
+
+	s, err := NewSelection([]string{"storage/docs/work/", "storage/photos", "storage/photos"})
+	require.NoError(t, err)
+	require.Len(t, s, 2)
+
+	tests := []struct {
+		path     string
+		contains bool
+		includes bool
+	}{
+		{path: storage, includes: true},
+		{path: "storage/docs", includes: true},
+		{path: "storage/docs/work", contains: true, includes: true},
+		{path: "storage/docs/work/a.txt", contains: true, includes: true},
+		{path: "storage/docs/personal.txt"},
+		{path: "storage/docs/workshop"},
+		{path: "storage/photos/2024/a.jpg", contains: true, includes: true},
+		{path: "storage/music"},
+	}
+	for _, tc := range tests {
+		require.Equalf(t, tc.contains, s.Contains(tc.path), "%s", tc.path)
+		require.Equalf(t, tc.includes, s.Includes(tc.path), "%s", tc.path)
+	}
+
+	tree := &FSNode{Path: storage, IsDir: true, Childs: map[string]*FSNode{
+		"docs": {Path: "storage/docs", IsDir: true, Childs: map[string]*FSNode{
+			"work":         {Path: "storage/docs/work", IsDir: true, Childs: map[string]*FSNode{}},
+			"personal.txt": {Path: "storage/docs/personal.txt"},
+		}},
+		"music": {Path: "storage/music", IsDir: true, Childs: map[string]*FSNode{}},
+	}}
+	pruned := s.Prune(tree)
+	require.Len(t, pruned.Childs, 1)
+	require.Len(t, pruned.Childs["docs"].Childs, 1)
+	require.Contains(t, pruned.Childs["docs"].Childs, "work")
+	require.Len(t, tree.Childs, 2, "the tree is left untouched")
+
+	_, ok := s.View(FileEvent{Path: "storage/music/a.mp3", Op: fsnotify.Create.String()})
+	require.False(t, ok)
+	view, ok := s.View(FileEvent{Path: "storage/docs/work/a (conflicted copy).txt", ConflictOf: "storage/docs/work/a.txt", Op: fsnotify.Create.String()})
+	require.True(t, ok)
+	require.Equal(t, "storage/docs/work/a.txt", view.ConflictOf)
+	view, ok = s.View(FileEvent{Path: "storage/docs/work/a.txt", NewPath: "storage/music/a.txt", Op: fsnotify.Rename.String()})
+	require.True(t, ok)
+	require.Equal(t, fsnotify.Remove.String(), view.Op)
+	require.Empty(t, view.NewPath)
+	_, ok = s.View(FileEvent{Path: "storage/music/a.txt", NewPath: "storage/docs/work/a.txt", Op: fsnotify.Rename.String()})
+	require.False(t, ok)
+}
+
+func TestSelectionIntersect(t *testing.T) {
+	s := Selection{"storage/docs", "storage/photos/2024"}
+	require.Equal(t, s, s.Intersect(nil))
+	require.Equal(t, s, Selection(nil).Intersect(s))
+
+	both := s.Intersect(Selection{"storage/docs/work", "storage/photos", "storage/music"})
+	require.Equal(t, Selection{"storage/docs/work", "storage/photos/2024"}, both)
+
+	none := s.Intersect(Selection{"storage/music"})
+	require.NotNil(t, none, "an empty selection selects nothing")
+	require.False(t, none.Includes("storage/docs"))
+}
@@ -7,8 +7,14 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -17,64 +23,191 @@ import (
 
 const (
 	TimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
-	perm       = 0777
-	storage    = "storage"
-	sep        = "/"
+	// Root is the first segment of every path on
+	// the wire, it stands for the top of the tree
+	Root = "storage"
+	// the directory holding the tree on the server
+	storage = Root
+	perm    = 0777
+	sep     = "/"
 )
 
+// serverHub keeps the tree in the database, the
+// content of the files lives in the blob store.
 type serverHub struct {
-	DB       *database.Queries
-	handlers map[string]EventHandler
+	DB        *database.Queries
+	Retention Retention
+	blobs     blobStore
+	mu        *sync.Mutex
+	handlers  map[string]EventHandler
 }
 
 func NewServerHub(db *database.Queries) serverHub {
 	s := serverHub{
-		DB: db,
+		DB:        db,
+		Retention: DefaultRetention,
+		blobs:     newBlobStore(),
+		mu:        &sync.Mutex{},
 	}
 	s.setupServerEventHandlers()
 	return s
 }
 
 func (s serverHub) Create(ctx context.Context, event *FileEvent) error {
-	if err := create(event); err != nil {
+	if err := s.checkParent(ctx, event.Path); err != nil {
 		return err
 	}
+	file, err := s.DB.GetFile(ctx, event.Path)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	exists := err == nil
+	if exists && file.Isdir != event.IsDir {
+		return os.ErrExist
+	}
+	if exists && event.IsDir {
+		event.Revision = file.Revision
+		return nil
+	}
+	if !exists {
+		if err := s.checkCase(ctx, event.Path, ""); err != nil {
+			return err
+		}
+	}
+	// the hash of a directory is the one of
+	// its content, it is empty at first
+	hash := DirHash(nil)
+	if !event.IsDir {
+		if hash, err = s.putBlob(ctx, event); err != nil {
+			return err
+		}
+		event.Hash = hash
+	}
+	if exists {
+		// created on both sides, only replays
+		// of the same content are accepted
+		event.Revision = file.Revision
+		if hash != file.Hash {
+			return ErrConflict
+		}
+		return nil
+	}
+	if !event.IsDir {
+		if err := s.DB.RefBlob(ctx, hash); err != nil {
+			return err
+		}
+	}
+	event.Revision = 1
 	if err := s.DB.CreateFile(ctx, database.CreateFileParams{
 		Path:      event.Path,
-		Hash:      event.Hash,
+		Hash:      hash,
 		Updatedat: time.Now().Format(TimeLayout),
 		Createdat: time.Now().Format(TimeLayout),
 		Isdir:     event.IsDir,
+		Revision:  event.Revision,
 	}); err != nil {
 		return err
 	}
-	return nil
+	if err := s.setMetadata(ctx, event); err != nil {
+		return err
+	}
+	if err := s.rehash(ctx, event.Path); err != nil {
+		return err
+	}
+	if event.IsDir {
+		return nil
+	}
+	if event.ConflictOf != "" {
+		if err := s.DB.CreateConflict(ctx, database.CreateConflictParams{
+			Path:      event.Path,
+			Original:  event.ConflictOf,
+			Author:    authorOf(ctx),
+			Createdat: time.Now().Format(TimeLayout),
+		}); err != nil {
+			return err
+		}
+	}
+	return s.addVersion(ctx, event.Path)
 }
 
 func (s serverHub) Process(ctx context.Context, event *FileEvent) error {
-	if err := isValidPath(event.Path); err != nil {
+	if err := ValidPath(event.Path); err != nil {
 		return EventError{err: err, path: event.Path, data: event.Op}
 	}
+	for _, p := range []string{event.NewPath, event.ConflictOf} {
+		if p == "" {
+			continue
+		}
+		if err := ValidPath(p); err != nil {
+			return EventError{err: err, path: p, data: event.Op}
+		}
+	}
 	fmt.Printf("Processing event: %s, path: %s\n", event.Op, event.Path)
-	handler, exist := s.handlers[event.Op]
-	if !exist {
+	if _, exist := s.handlers[event.Op]; !exist {
 		return EventError{err: ErrUnsupportedEvent, data: event.Op}
 	}
-	if err := handler(ctx, event); err != nil {
-		return EventError{err: err, path: event.Path, data: event}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return EventError{err: err, path: event.Path, data: event.Op}
+	}
+	// the handlers work on the rows of the database,
+	// the caller gets its own paths back
+	wire := *event
+	var share, newShare *database.Share
+	event.Path, share = ns.scope(event.Path)
+	event.NewPath, newShare = ns.scope(event.NewPath)
+	event.ConflictOf, _ = ns.scope(event.ConflictOf)
+	defer func() {
+		event.Path, event.NewPath, event.ConflictOf = wire.Path, wire.NewPath, wire.ConflictOf
+	}()
+	if err := allowed(&wire, share, newShare); err != nil {
+		return EventError{err: err, path: wire.Path, data: wire.Op}
+	}
+	if err := s.atomic(ctx, func(tx serverHub) error {
+		return tx.handlers[event.Op](ctx, event)
+	}); err != nil {
+		return EventError{err: err, path: wire.Path, data: &wire}
 	}
 	return nil
 }
 
+// atomic runs fn on a copy of s whose queries share a single
+// transaction, none of the rows it writes are kept when it fails.
+func (s serverHub) atomic(ctx context.Context, fn func(serverHub) error) error {
+	return s.DB.Tx(ctx, func(db *database.Queries) error {
+		s.DB = db
+		s.setupServerEventHandlers()
+		return fn(s)
+	})
+}
+
 func (s serverHub) Update(ctx context.Context, event *FileEvent) error {
-	stat, err := os.Stat(event.Path)
+	p, err := s.content(ctx, event.Path)
+	if err != nil {
+		return err
+	}
+	file, err := s.getFile(ctx, event.Path)
+	if err != nil {
+		return err
+	}
+	event.Revision = file.Revision
+	event.Mode = uint32(file.Mode)
+	event.Link = file.Link
+	event.ModTime = file.Modtime
+	stat, err := os.Stat(p)
 	if err != nil {
 		return err
 	}
-	if stat.IsDir() {
-		return ErrInvalidPath
+	if stat.Size() > ChunkThreshold {
+		// too big to be embedded, the
+		// content has to be streamed
+		event.Data = nil
+		event.Chunked = true
+		return nil
 	}
-	data, err := os.ReadFile(event.Path)
+	data, err := os.ReadFile(p)
 	if err != nil {
 		return err
 	}
@@ -82,172 +215,424 @@ func (s serverHub) Update(ctx context.Context, event *FileEvent) error {
 	return nil
 }
 
+// Rename only moves the database rows,
+// the blobs are left untouched.
 func (s serverHub) Rename(ctx context.Context, event *FileEvent) error {
-	if err := rename(event); err != nil {
+	if event.NewPath == "" {
+		return ErrEmptyPath
+	}
+	rel, err := filepath.Rel(event.Path, event.NewPath)
+	if err == nil && !strings.HasPrefix(rel, "..") && rel != "." {
+		return ErrInvalidDest
+	}
+	file, err := s.getFile(ctx, event.Path)
+	if err != nil {
 		return err
 	}
-	if event.IsDir {
-		if err := s.renameDir(ctx, event); err != nil {
+	if file.Isdir != event.IsDir {
+		return ErrMalformedEvent
+	}
+	if err := s.checkParent(ctx, event.NewPath); err != nil {
+		return err
+	}
+	if _, err := s.DB.GetFile(ctx, event.NewPath); err == nil {
+		return os.ErrExist
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	// changing the case of the name alone is fine
+	if err := s.checkCase(ctx, event.NewPath, event.Path); err != nil {
+		return err
+	}
+	files, err := s.subtree(ctx, event.Path)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		newPath := event.NewPath + strings.TrimPrefix(f.Path, event.Path)
+		if err := s.DB.RenameFile(ctx, database.RenameFileParams{
+			Path:      newPath,
+			Updatedat: time.Now().Format(TimeLayout),
+			Path_2:    f.Path,
+		}); err != nil {
+			return err
+		}
+		// the history follows the file
+		if err := s.DB.RenameVersions(ctx, database.RenameVersionsParams{
+			Path:   newPath,
+			Path_2: f.Path,
+		}); err != nil {
+			return err
+		}
+		// and so do the conflicts on either side
+		if err := s.DB.RenameConflicts(ctx, database.RenameConflictsParams{
+			Path:   newPath,
+			Path_2: f.Path,
+		}); err != nil {
 			return err
 		}
-	} else {
-		if err := s.renameFile(ctx, event); err != nil {
+		if err := s.DB.RetargetConflicts(ctx, database.RetargetConflictsParams{
+			Original:   newPath,
+			Original_2: f.Path,
+		}); err != nil {
+			return err
+		}
+		// shared folders stay shared
+		if err := s.DB.RenameShares(ctx, database.RenameSharesParams{
+			Path:   newPath,
+			Path_2: f.Path,
+		}); err != nil {
 			return err
 		}
 	}
-	return nil
+	// the hashes below are the same, only
+	// the folders on either side change
+	if err := s.rehash(ctx, event.Path); err != nil {
+		return err
+	}
+	return s.rehash(ctx, event.NewPath)
 }
 
+// Remove moves the file, or the whole directory,
+// to the trash where it can be restored from.
 func (s serverHub) Remove(ctx context.Context, event *FileEvent) error {
-	stat, err := os.Stat(event.Path)
+	file, err := s.getFile(ctx, event.Path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return nil
-		} else {
-			return err
 		}
+		return err
 	}
-	if stat.IsDir() != event.IsDir {
+	if file.Isdir != event.IsDir {
 		return ErrMalformedEvent
 	}
-	if stat.IsDir() {
-		if err := s.removeDirFromDB(ctx, event.Path); err != nil {
-			return err
+	files, err := s.subtree(ctx, event.Path)
+	if err != nil {
+		return err
+	}
+	if err := s.trash(ctx, file, files); err != nil {
+		return err
+	}
+	return s.rehash(ctx, event.Path)
+}
+
+func (s serverHub) Write(ctx context.Context, event *FileEvent) error {
+	file, err := s.getFile(ctx, event.Path)
+	if err != nil {
+		return err
+	}
+	if file.Isdir {
+		return ErrMalformedEvent
+	}
+	hash, err := s.putBlob(ctx, event)
+	if err != nil {
+		return err
+	}
+	event.Hash = hash
+	if hash == file.Hash {
+		event.Revision = file.Revision
+		if file.Link == event.Link && (event.Mode == 0 || uint32(file.Mode) == event.Mode) {
+			// nothing changed, replays of
+			// applied writes end up here too
+			return nil
 		}
-	} else {
-		if err := s.removeFileFromDB(ctx, event.Path); err != nil {
+		// only the metadata changed, with the same
+		// content there is nothing to conflict with
+		event.Revision = file.Revision + 1
+		if err := s.DB.UpdateFile(ctx, database.UpdateFileParams{
+			Hash:      hash,
+			Updatedat: time.Now().Format(TimeLayout),
+			Revision:  event.Revision,
+			Path:      event.Path,
+		}); err != nil {
 			return err
 		}
+		return s.setMetadata(ctx, event)
 	}
-	return os.RemoveAll(event.Path)
+	if event.Revision != file.Revision {
+		// the file changed since the sender last saw it, the
+		// blob is rolled back and its file garbage collected
+		event.Revision = file.Revision
+		return ErrConflict
+	}
+	if err := s.DB.RefBlob(ctx, hash); err != nil {
+		return err
+	}
+	if err := s.DB.UnrefBlob(ctx, file.Hash); err != nil {
+		return err
+	}
+	event.Revision = file.Revision + 1
+	if err := s.DB.UpdateFile(ctx, database.UpdateFileParams{
+		Hash:      hash,
+		Updatedat: time.Now().Format(TimeLayout),
+		Revision:  event.Revision,
+		Path:      event.Path,
+	}); err != nil {
+		return err
+	}
+	if err := s.setMetadata(ctx, event); err != nil {
+		return err
+	}
+	if err := s.rehash(ctx, event.Path); err != nil {
+		return err
+	}
+	return s.addVersion(ctx, event.Path)
+}
+
+// setMetadata stores the mode, the kind and
+// the modification time of the file of the event.
+func (s serverHub) setMetadata(ctx context.Context, event *FileEvent) error {
+	return s.DB.SetMetadata(ctx, database.SetMetadataParams{
+		Mode:    int64(event.Mode),
+		Link:    event.Link,
+		Modtime: event.ModTime,
+		Path:    event.Path,
+	})
 }
 
-func (s serverHub) removeDirFromDB(ctx context.Context, path string) error {
-	childs, err := os.ReadDir(path)
+// Tree builds the tree of the user of ctx from the database,
+// the folders shared with the user show under their mount.
+func (s serverHub) Tree(ctx context.Context) (*FSNode, error) {
+	ns, err := s.namespace(ctx)
 	if err != nil {
-		return err
-	}
-	for _, child := range childs {
-		childPath := filepath.Join(path, child.Name())
-		if child.IsDir() {
-			if err := s.removeDirFromDB(ctx, childPath); err != nil {
-				return err
+		return nil, err
+	}
+	tree := &FSNode{
+		Path:    Root,
+		ModTime: time.Now().Format(TimeLayout),
+		Childs:  make(map[string]*FSNode),
+		IsDir:   true,
+	}
+	tops := []string{ns.root}
+	for _, share := range ns.shares {
+		tops = append(tops, share.Path)
+	}
+	nodes := map[string]*FSNode{Root: tree}
+	for _, top := range tops {
+		files, err := s.subtree(ctx, top)
+		if err != nil {
+			return nil, err
+		}
+		// parents are sorted before their childs
+		for _, f := range files {
+			p, _, _ := ns.unscope(f.Path)
+			parent, exists := nodes[path.Dir(p)]
+			if !exists {
+				continue
 			}
-		} else {
-			if err := s.removeFileFromDB(ctx, childPath); err != nil {
-				return err
+			node := fileNode(p, f)
+			if f.Isdir {
+				node.Childs = make(map[string]*FSNode)
+				nodes[p] = node
 			}
+			parent.Childs[path.Base(p)] = node
 		}
 	}
-	if err := s.DB.DeleteFile(ctx, path); err != nil {
-		return err
+	// the folders holding a mount show more than their
+	// rows, their hashes are the ones of the tree of the
+	// user. The deeper ones are hashed first.
+	dirs := []string{Root}
+	for _, share := range ns.shares {
+		for dir := path.Dir(share.Mount); dir != Root && within(dir, Root); dir = path.Dir(dir) {
+			dirs = append(dirs, dir)
+		}
 	}
-	return nil
+	slices.SortFunc(dirs, func(a, b string) int {
+		return strings.Count(b, sep) - strings.Count(a, sep)
+	})
+	for _, dir := range dirs {
+		if node := nodes[dir]; node != nil {
+			node.Hash = DirHash(node.Childs)
+		}
+	}
+	return tree, nil
+}
+
+// fileNode returns the node of the row f at the path p
+// of the tree of the user, without childs.
+func fileNode(p string, f database.File) *FSNode {
+	node := &FSNode{
+		Path:     p,
+		ModTime:  f.Modtime,
+		Hash:     f.Hash,
+		Revision: f.Revision,
+		IsDir:    f.Isdir,
+		Mode:     uint32(f.Mode),
+		Link:     f.Link,
+	}
+	if node.ModTime == "" {
+		// synced before the devices sent it
+		node.ModTime = f.Updatedat
+	}
+	return node
 }
 
-func (s serverHub) removeFileFromDB(ctx context.Context, path string) error {
-	if err := s.DB.DeleteFile(ctx, path); err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
+// Import moves the files left on disk by earlier
+// versions, which didn't have a blob store, into it.
+func (s serverHub) Import(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		dirs   []string
+		ignore = NewIgnore(DefaultIgnores)
+	)
+	err := filepath.WalkDir(Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
 			return err
 		}
+		if p == Root {
+			return nil
+		}
+		if IsInternal(p) {
+			return filepath.SkipDir
+		}
+		if ignore.Ignored(p, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			dirs = append(dirs, p)
+			return s.DB.CreateFile(ctx, database.CreateFileParams{
+				Path:      p,
+				Updatedat: time.Now().Format(TimeLayout),
+				Createdat: time.Now().Format(TimeLayout),
+				Isdir:     true,
+				Revision:  1,
+			})
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return s.importFile(ctx, p)
+	})
+	if err != nil {
+		return err
 	}
-	return nil
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	// the imported directories, and the
+	// ones written before, get their hash
+	return s.rehashAll(ctx)
 }
 
-func (s serverHub) addDirToDB(ctx context.Context, path string) error {
-	childs, err := os.ReadDir(path)
+func (s serverHub) importFile(ctx context.Context, p string) error {
+	file, err := os.Open(p)
 	if err != nil {
 		return err
 	}
-	for _, child := range childs {
-		childPath := filepath.Join(path, child.Name())
-		if child.IsDir() {
-			if err := s.addDirToDB(ctx, childPath); err != nil {
-				return err
-			}
-		} else {
-			if err := s.addFileToDB(ctx, childPath); err != nil {
-				return err
-			}
-		}
-	}
-	if err := s.DB.CreateFile(ctx, database.CreateFileParams{
-		Path:      path,
-		Hash:      "",
-		Updatedat: time.Now().Format(TimeLayout),
-		Createdat: time.Now().Format(TimeLayout),
-		Isdir:     true,
-	}); err != nil {
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	file.Close()
+	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (s serverHub) addFileToDB(ctx context.Context, path string) error {
-	data, err := os.ReadFile(path)
+	hash, err := s.putBlob(ctx, &FileEvent{
+		Path:   p,
+		Hash:   hex.EncodeToString(hasher.Sum(nil)),
+		Source: p,
+	})
 	if err != nil {
 		return err
 	}
-	newHash := sha256.Sum256(data)
+	if err := s.DB.RefBlob(ctx, hash); err != nil {
+		return err
+	}
 	if err := s.DB.CreateFile(ctx, database.CreateFileParams{
-		Path:      path,
-		Hash:      hex.EncodeToString(newHash[:]),
+		Path:      p,
+		Hash:      hash,
 		Updatedat: time.Now().Format(TimeLayout),
 		Createdat: time.Now().Format(TimeLayout),
-		Isdir:     false,
+		Revision:  1,
 	}); err != nil {
 		return err
 	}
-	return nil
-}
-
-func (s serverHub) renameDir(ctx context.Context, event *FileEvent) error {
-	if err := s.removeDirFromDB(ctx, event.Path); err != nil {
+	// rows written before the blob store
+	// don't reference any blob
+	if err := s.DB.UpdateFile(ctx, database.UpdateFileParams{
+		Hash:      hash,
+		Updatedat: time.Now().Format(TimeLayout),
+		Revision:  1,
+		Path:      p,
+	}); err != nil {
 		return err
 	}
-	if err := os.Rename(event.Path, event.NewPath); err != nil {
+	if err := s.addVersion(ctx, p); err != nil {
 		return err
 	}
-	if err := s.addDirToDB(ctx, event.NewPath); err != nil {
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
 	return nil
 }
 
-func (s serverHub) Write(ctx context.Context, event *FileEvent) error {
-	stat, err := os.Stat(event.Path)
-	if err != nil {
-		return err
-	}
-	if stat.IsDir() {
-		return ErrMalformedEvent
+// getFile is GetFile returning os.ErrNotExist
+// for paths unknown to the database.
+func (s serverHub) getFile(ctx context.Context, p string) (database.File, error) {
+	file, err := s.DB.GetFile(ctx, p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return file, os.ErrNotExist
+	}
+	return file, err
+}
+
+// checkParent makes sure the parent of p is a known directory.
+func (s serverHub) checkParent(ctx context.Context, p string) error {
+	parent := path.Dir(p)
+	if parent == root(ctx) {
+		return nil
 	}
-	if err := os.WriteFile(event.Path, event.Data, 0777); err != nil {
+	file, err := s.getFile(ctx, parent)
+	if err != nil {
 		return err
 	}
-	if err := s.DB.UpdateFile(ctx, database.UpdateFileParams{
-		Hash:      event.Hash,
-		Updatedat: time.Now().Format(TimeLayout),
-		Path:      event.Path,
-	}); err != nil {
-		return err
+	if !file.Isdir {
+		return ErrInvalidDest
 	}
 	return nil
 }
 
-func (s serverHub) renameFile(ctx context.Context, event *FileEvent) error {
-	if err := s.removeFileFromDB(ctx, event.Path); err != nil {
-		return err
-	}
-	if err := os.Rename(event.Path, event.NewPath); err != nil {
+// checkCase fails with os.ErrExist when a sibling of p other than
+// self has the same name once case folded, the two can't live side
+// by side on the devices with case-insensitive file systems.
+func (s serverHub) checkCase(ctx context.Context, p, self string) error {
+	siblings, err := s.children(ctx, path.Dir(p))
+	if err != nil {
 		return err
 	}
-	if err := s.addFileToDB(ctx, event.NewPath); err != nil {
-		return err
+	name := path.Base(p)
+	for _, f := range siblings {
+		if f.Path != self && f.Path != p && strings.EqualFold(path.Base(f.Path), name) {
+			return os.ErrExist
+		}
 	}
 	return nil
 }
 
+// children returns the rows right under p.
+func (s serverHub) children(ctx context.Context, p string) ([]database.File, error) {
+	// '0' follows '/', the range holds every path starting
+	// with p/, and the childs have no slash after it
+	return s.DB.ListChildren(ctx, database.ListChildrenParams{
+		Path:    p + sep,
+		Path_2:  p + "0",
+		Column3: int64(len(p) + 2),
+	})
+}
+
+// subtree returns the row of p and the rows of everything under it.
+func (s serverHub) subtree(ctx context.Context, p string) ([]database.File, error) {
+	// '0' follows '/', the range holds
+	// every path starting with p/
+	return s.DB.ListSubtree(ctx, database.ListSubtreeParams{
+		Path:   p,
+		Path_2: p + sep,
+		Path_3: p + "0",
+	})
+}
+
 func (s *serverHub) setupServerEventHandlers() {
 	handlers := make(map[string]EventHandler)
 
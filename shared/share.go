@@ -0,0 +1,207 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+var ErrReadOnly = errors.New("shared: read-only")
+
+// Share is a folder of its owner shared with a member,
+// it shows at Mount in the tree of the member.
+type Share struct {
+	ID    int64  `json:"id"`
+	Owner string `json:"owner"`
+	// Path is the folder in the tree of the owner
+	Path      string `json:"path"`
+	Member    string `json:"member"`
+	Mount     string `json:"mount"`
+	Writable  bool   `json:"writable"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func newShare(row database.Share) Share {
+	return Share{
+		ID:        row.ID,
+		Owner:     row.Owner,
+		Path:      Root + strings.TrimPrefix(row.Path, rootOf(row.Owner)),
+		Member:    row.Member,
+		Mount:     row.Mount,
+		Writable:  row.Writable,
+		CreatedAt: row.Createdat,
+	}
+}
+
+// allowed checks that the event, share and newShare being the
+// shares its paths are in, can be applied by the member.
+func allowed(event *FileEvent, share, newShare *database.Share) error {
+	if event.Op == Update {
+		return nil
+	}
+	if !writable(share) || !writable(newShare) {
+		return ErrReadOnly
+	}
+	// the mount point is left to the owner
+	moved := event.Op == fsnotify.Rename.String() || event.Op == fsnotify.Remove.String()
+	if moved && share != nil && path.Clean(event.Path) == share.Mount {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// ShareFolder shares the folder at p of the user of ctx with member,
+// read-only unless writable is set. Only folders of the own tree of
+// the user can be shared, they show at the top of the member's one.
+func (s serverHub) ShareFolder(ctx context.Context, p, member string, writable bool) (Share, error) {
+	if err := ValidPath(p); err != nil {
+		return Share{}, err
+	}
+	owner := NamespaceOf(ctx)
+	if !isValidUser(member) || member == owner {
+		return Share{}, ErrInvalidUser
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shares, err := s.DB.ListShares(ctx)
+	if err != nil {
+		return Share{}, err
+	}
+	row, share := newNamespace(owner, shares).scope(p)
+	if share != nil {
+		return Share{}, ErrInvalidPath
+	}
+	file, err := s.getFile(ctx, row)
+	if err != nil {
+		return Share{}, err
+	}
+	if !file.Isdir {
+		return Share{}, ErrInvalidPath
+	}
+	mount := path.Join(Root, path.Base(row))
+	target, _ := newNamespace(member, shares).scope(mount)
+	if _, err := s.DB.GetFile(ctx, target); err == nil {
+		return Share{}, os.ErrExist
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return Share{}, err
+	}
+	for _, share := range shares {
+		if share.Path == row && share.Member == member {
+			return Share{}, os.ErrExist
+		}
+	}
+	created, err := s.DB.CreateShare(ctx, database.CreateShareParams{
+		Owner:     owner,
+		Path:      row,
+		Member:    member,
+		Mount:     mount,
+		Writable:  writable,
+		Createdat: time.Now().Format(TimeLayout),
+	})
+	if err != nil {
+		return Share{}, err
+	}
+	return newShare(created), nil
+}
+
+// Shares lists the folders the user of ctx shares
+// or that are shared with the user.
+func (s serverHub) Shares(ctx context.Context) ([]Share, error) {
+	rows, err := s.DB.ListShares(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user := NamespaceOf(ctx)
+	shares := make([]Share, 0, len(rows))
+	for _, row := range rows {
+		if row.Owner == user || row.Member == user {
+			shares = append(shares, newShare(row))
+		}
+	}
+	return shares, nil
+}
+
+// Unshare stops sharing a folder, either
+// its owner or its member can do it.
+func (s serverHub) Unshare(ctx context.Context, id int64) (Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	row, err := s.DB.GetShare(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Share{}, os.ErrNotExist
+		}
+		return Share{}, err
+	}
+	if user := NamespaceOf(ctx); row.Owner != user && row.Member != user {
+		return Share{}, os.ErrNotExist
+	}
+	return newShare(row), s.DB.DeleteShare(ctx, id)
+}
+
+// Route returns the event processed with ctx as seen by each
+// of the users it concerns, keyed by user.
+func (s serverHub) Route(ctx context.Context, event FileEvent) (map[string]FileEvent, error) {
+	shares, err := s.DB.ListShares(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sender := newNamespace(NamespaceOf(ctx), shares)
+	p, _ := sender.scope(event.Path)
+	newPath, _ := sender.scope(event.NewPath)
+	conflictOf, _ := sender.scope(event.ConflictOf)
+	users := map[string]struct{}{ownerOf(p): {}}
+	if newPath != "" {
+		users[ownerOf(newPath)] = struct{}{}
+	}
+	for _, share := range shares {
+		if within(p, share.Path) || newPath != "" && within(newPath, share.Path) {
+			users[share.Member] = struct{}{}
+		}
+	}
+	views := make(map[string]FileEvent, len(users))
+	for user := range users {
+		if view, ok := newNamespace(user, shares).view(event, p, newPath, conflictOf); ok {
+			views[user] = view
+		}
+	}
+	return views, nil
+}
+
+// view is the event on the rows p, newPath and conflictOf
+// as seen in the namespace, ok is false when it isn't seen.
+func (n namespace) view(event FileEvent, p, newPath, conflictOf string) (_ FileEvent, ok bool) {
+	from, _, seen := n.unscope(p)
+	if event.Op != fsnotify.Rename.String() {
+		if !seen {
+			return event, false
+		}
+		event.Path = from
+		if event.ConflictOf != "" {
+			// empty when the original isn't seen
+			event.ConflictOf, _, _ = n.unscope(conflictOf)
+		}
+		return event, true
+	}
+	to, _, seenTo := n.unscope(newPath)
+	switch {
+	case seen && seenTo:
+		event.Path, event.NewPath = from, to
+	case seen:
+		// moved out of sight
+		event.Op = fsnotify.Remove.String()
+		event.Path, event.NewPath = from, ""
+	default:
+		// moved in sight, it shows
+		// up on the next tree sync
+		return event, false
+	}
+	return event, true
+}
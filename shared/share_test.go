@@ -0,0 +1,131 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShares(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		tmp    = t.TempDir()
+		dbPath = path.Join(tmp, "test.db")
+		alice  = WithNamespace(context.Background(), "alice")
+		bob    = WithNamespace(context.Background(), "bob")
+		carol  = WithNamespace(context.Background(), "carol")
+		acme   = path.Join(storage, "projects", "acme")
+		plan   = path.Join(acme, "plan.txt")
+		// where alice and carol see bob's plan
+		mounted = path.Join(storage, "acme", "plan.txt")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	hub := NewServerHub(db)
+
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(db))
+
+	for _, event := range []*FileEvent{
+		{Path: path.Dir(acme), Op: fsnotify.Create.String(), IsDir: true},
+		{Path: acme, Op: fsnotify.Create.String(), IsDir: true},
+		{Path: plan, Op: fsnotify.Create.String(), Data: []byte("plan")},
+	} {
+		require.NoError(t, hub.Process(bob, event))
+	}
+	require.NoError(t, hub.Process(alice, &FileEvent{Path: path.Join(storage, "notes"), Op: fsnotify.Create.String(), IsDir: true}))
+
+	_, err = hub.ShareFolder(bob, plan, "alice", false)
+	require.ErrorIs(t, err, ErrInvalidPath)
+	_, err = hub.ShareFolder(bob, acme, "bob", false)
+	require.ErrorIs(t, err, ErrInvalidUser)
+
+	share, err := hub.ShareFolder(bob, acme, "alice", false)
+	require.NoError(t, err)
+	require.Equal(t, acme, share.Path)
+	require.Equal(t, path.Dir(mounted), share.Mount)
+	_, err = hub.ShareFolder(bob, acme, "alice", true)
+	require.ErrorIs(t, err, os.ErrExist)
+	_, err = hub.ShareFolder(alice, path.Dir(mounted), "carol", false)
+	require.ErrorIs(t, err, ErrInvalidPath)
+	_, err = hub.ShareFolder(alice, path.Join(storage, "notes"), "bob", false)
+	require.NoError(t, err)
+	_, err = hub.ShareFolder(carol, path.Join(storage, "notes"), "bob", false)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	tree, err := hub.Tree(alice)
+	require.NoError(t, err)
+	require.Equal(t, mounted, tree.Childs["acme"].Childs["plan.txt"].Path)
+	require.Contains(t, tree.Childs, "notes")
+	require.Equal(t, DirHash(tree.Childs), tree.Hash, "the hash covers the mounts")
+	folder, err := hub.Folder(alice, Root)
+	require.NoError(t, err)
+	require.Equal(t, tree.Hash, folder.Hash)
+	require.Equal(t, tree.Childs["acme"].Hash, folder.Childs["acme"].Hash)
+	require.Nil(t, folder.Childs["acme"].Childs)
+	blob, err := hub.Content(alice, mounted)
+	require.NoError(t, err)
+	data, err := os.ReadFile(blob)
+	require.NoError(t, err)
+	require.Equal(t, []byte("plan"), data)
+
+	// read-only members can't change anything
+	for _, event := range []*FileEvent{
+		{Path: mounted, Op: fsnotify.Write.String(), Data: []byte("mine"), Revision: 1},
+		{Path: path.Join(path.Dir(mounted), "new.txt"), Op: fsnotify.Create.String()},
+		{Path: mounted, Op: fsnotify.Remove.String()},
+		{Path: mounted, NewPath: path.Join(storage, "plan.txt"), Op: fsnotify.Rename.String()},
+	} {
+		require.ErrorIs(t, hub.Process(alice, event), ErrReadOnly)
+	}
+	require.NoError(t, hub.Process(alice, &FileEvent{Path: mounted, Op: Update}))
+
+	// events reach every user with their own paths
+	views, err := hub.Route(bob, FileEvent{Path: plan, Op: fsnotify.Write.String()})
+	require.NoError(t, err)
+	require.Len(t, views, 2)
+	require.Equal(t, plan, views["bob"].Path)
+	require.Equal(t, mounted, views["alice"].Path)
+
+	_, err = hub.ShareFolder(bob, acme, "carol", true)
+	require.NoError(t, err)
+	require.NoError(t, hub.Process(carol, &FileEvent{Path: mounted, Op: fsnotify.Write.String(), Data: []byte("carol's"), Revision: 1}))
+	require.ErrorIs(t, hub.Process(carol, &FileEvent{Path: path.Dir(mounted), Op: fsnotify.Remove.String(), IsDir: true}), ErrReadOnly)
+
+	// moving a file out of the share removes it for the others
+	moved := &FileEvent{Path: mounted, NewPath: path.Join(storage, "plan.txt"), Op: fsnotify.Rename.String()}
+	require.NoError(t, hub.Process(carol, moved))
+	views, err = hub.Route(carol, *moved)
+	require.NoError(t, err)
+	require.Len(t, views, 3)
+	require.Equal(t, fsnotify.Rename.String(), views["carol"].Op)
+	require.Equal(t, fsnotify.Remove.String(), views["alice"].Op)
+	require.Equal(t, mounted, views["alice"].Path)
+	require.Equal(t, plan, views["bob"].Path)
+
+	// the share follows the folder
+	require.NoError(t, hub.Process(bob, &FileEvent{Path: acme, NewPath: path.Join(storage, "acme-2"), Op: fsnotify.Rename.String(), IsDir: true}))
+	shares, err := hub.Shares(alice)
+	require.NoError(t, err)
+	require.Len(t, shares, 2)
+	require.Equal(t, path.Join(storage, "acme-2"), shares[0].Path)
+	tree, err = hub.Tree(alice)
+	require.NoError(t, err)
+	require.Contains(t, tree.Childs, "acme")
+
+	_, err = hub.Unshare(carol, share.ID)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = hub.Unshare(alice, share.ID)
+	require.NoError(t, err)
+	tree, err = hub.Tree(alice)
+	require.NoError(t, err)
+	require.NotContains(t, tree.Childs, "acme")
+}
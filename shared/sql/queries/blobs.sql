@@ -0,0 +1,32 @@
+-- name: CreateBlob :exec
+INSERT INTO blobs (hash, size, refs, createdAt)
+VALUES (
+    ?,
+    ?,
+    0,
+    ?
+)ON CONFLICT DO NOTHING;
+
+-- name: GetBlob :one
+SELECT * FROM blobs
+WHERE hash = ?
+LIMIT 1;
+
+-- name: RefBlob :exec
+UPDATE blobs
+SET refs = refs + 1
+WHERE hash = ?;
+
+-- name: UnrefBlob :exec
+UPDATE blobs
+SET refs = refs - 1
+WHERE hash = ?;
+
+-- name: ListUnreferencedBlobs :many
+SELECT * FROM blobs
+WHERE refs <= 0
+ORDER BY hash;
+
+-- name: DeleteBlob :exec
+DELETE FROM blobs
+WHERE hash = ?;
@@ -0,0 +1,18 @@
+-- name: CreateChunk :exec
+INSERT INTO chunks (blob, idx, hash, start, size)
+VALUES (
+    ?,
+    ?,
+    ?,
+    ?,
+    ?
+);
+
+-- name: ListChunks :many
+SELECT * FROM chunks
+WHERE hash = ?
+ORDER BY blob, idx;
+
+-- name: DeleteChunks :exec
+DELETE FROM chunks
+WHERE blob = ?;
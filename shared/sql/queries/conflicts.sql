@@ -0,0 +1,35 @@
+-- name: CreateConflict :exec
+INSERT INTO conflicts (path, original, author, createdAt)
+VALUES (
+    ?,
+    ?,
+    ?,
+    ?
+)ON CONFLICT DO NOTHING;
+
+-- name: GetConflict :one
+SELECT * FROM conflicts
+WHERE id = ?
+LIMIT 1;
+
+-- name: ListConflicts :many
+SELECT * FROM conflicts
+ORDER BY id DESC;
+
+-- name: DeleteConflict :exec
+DELETE FROM conflicts
+WHERE id = ?;
+
+-- name: DeleteConflictsForPath :exec
+DELETE FROM conflicts
+WHERE path = ?;
+
+-- name: RenameConflicts :exec
+UPDATE conflicts
+SET path = ?
+WHERE path = ?;
+
+-- name: RetargetConflicts :exec
+UPDATE conflicts
+SET original = ?
+WHERE original = ?;
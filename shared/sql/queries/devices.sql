@@ -0,0 +1,38 @@
+-- name: CreateDevice :one
+INSERT INTO devices (name, user, tokenHash, createdAt)
+VALUES (
+    ?,
+    ?,
+    ?,
+    ?
+)
+RETURNING *;
+
+-- name: GetDevice :one
+SELECT * FROM devices
+WHERE id = ?
+LIMIT 1;
+
+-- name: GetDeviceByName :one
+SELECT * FROM devices
+WHERE name = ?
+LIMIT 1;
+
+-- name: GetDeviceByToken :one
+SELECT * FROM devices
+WHERE tokenHash = ?
+LIMIT 1;
+
+-- name: ListDevices :many
+SELECT * FROM devices
+ORDER BY id;
+
+-- name: RevokeDevice :exec
+UPDATE devices
+SET revokedAt = ?
+WHERE id = ?;
+
+-- name: TouchDevice :exec
+UPDATE devices
+SET lastSeenAt = ?
+WHERE id = ?;
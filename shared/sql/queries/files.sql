@@ -4,22 +4,62 @@ WHERE path = ?
 LIMIT 1;
 
 -- name: CreateFile :exec
-INSERT INTO files (path , hash , updatedAt , createdAt, isDir)
+INSERT INTO files (path , hash , updatedAt , createdAt, isDir, revision)
 VALUES (
     ?,
     ?,
     ?,
     ?,
+    ?,
     ?
 )ON CONFLICT DO NOTHING;
 
 -- name: UpdateFile :exec 
 UPDATE files 
 SET hash = ?,
-updatedAt = ?
+updatedAt = ?,
+revision = ?,
+placeholder = ?
 WHERE path = ?;
 
 
 -- name: DeleteFile :exec
 DELETE FROM files 
-WHERE path = ?;
\ No newline at end of file
+WHERE path = ?;
+
+-- name: ListFiles :many
+SELECT * FROM files
+ORDER BY path;
+
+-- name: ListPathsWithHash :many
+SELECT path FROM files
+WHERE hash = ?;
+
+-- name: ListSubtree :many
+SELECT * FROM files
+WHERE path = ? OR (path > ? AND path < ?)
+ORDER BY path;
+
+-- name: RenameFile :exec
+UPDATE files
+SET path = ?,
+updatedAt = ?
+WHERE path = ?;
+
+-- name: SetMetadata :exec
+UPDATE files
+SET mode = ?,
+link = ?,
+modTime = ?
+WHERE path = ?;
+
+-- name: ListChildren :many
+SELECT * FROM files
+WHERE path > ? AND path < ?
+AND instr(substr(path, CAST(? AS INTEGER)), '/') = 0
+ORDER BY path;
+
+-- name: SetHash :exec
+UPDATE files
+SET hash = ?
+WHERE path = ?;
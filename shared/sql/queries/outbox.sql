@@ -0,0 +1,29 @@
+-- name: AppendOutbox :one
+INSERT INTO outbox (path, newPath, op, payload, createdAt)
+VALUES (
+    ?,
+    ?,
+    ?,
+    ?,
+    ?
+)
+RETURNING id;
+
+-- name: GetOutbox :one
+SELECT * FROM outbox
+WHERE id = ?
+LIMIT 1;
+
+-- name: ListOutbox :many
+SELECT * FROM outbox
+ORDER BY id;
+
+-- name: GetLastOutboxForPath :one
+SELECT * FROM outbox
+WHERE path = ? OR newPath = ?
+ORDER BY id DESC
+LIMIT 1;
+
+-- name: DeleteOutbox :exec
+DELETE FROM outbox
+WHERE id = ?;
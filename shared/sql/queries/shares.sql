@@ -0,0 +1,33 @@
+-- name: CreateShare :one
+INSERT INTO shares (owner, path, member, mount, writable, createdAt)
+VALUES (
+    ?,
+    ?,
+    ?,
+    ?,
+    ?,
+    ?
+)
+RETURNING *;
+
+-- name: GetShare :one
+SELECT * FROM shares
+WHERE id = ?
+LIMIT 1;
+
+-- name: ListShares :many
+SELECT * FROM shares
+ORDER BY id;
+
+-- name: DeleteShare :exec
+DELETE FROM shares
+WHERE id = ?;
+
+-- name: DeleteSharesForPath :exec
+DELETE FROM shares
+WHERE path = ?;
+
+-- name: RenameShares :exec
+UPDATE shares
+SET path = ?
+WHERE path = ?;
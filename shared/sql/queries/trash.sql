@@ -0,0 +1,44 @@
+-- name: CreateTrash :one
+INSERT INTO trash (path, isDir, deletedBy, deletedAt)
+VALUES (
+    ?,
+    ?,
+    ?,
+    ?
+)
+RETURNING id;
+
+-- name: CreateTrashFile :exec
+INSERT INTO trash_files (trashId, path, hash, isDir, createdAt, mode, link, modTime)
+VALUES (
+    ?,
+    ?,
+    ?,
+    ?,
+    ?,
+    ?,
+    ?,
+    ?
+);
+
+-- name: GetTrash :one
+SELECT * FROM trash
+WHERE id = ?
+LIMIT 1;
+
+-- name: ListTrash :many
+SELECT * FROM trash
+ORDER BY id DESC;
+
+-- name: ListTrashFiles :many
+SELECT * FROM trash_files
+WHERE trashId = ?
+ORDER BY path;
+
+-- name: DeleteTrash :exec
+DELETE FROM trash
+WHERE id = ?;
+
+-- name: DeleteTrashFiles :exec
+DELETE FROM trash_files
+WHERE trashId = ?;
@@ -0,0 +1,12 @@
+-- name: CreateVault :exec
+INSERT INTO vaults (user, salt)
+VALUES (
+    ?,
+    ?
+)
+ON CONFLICT (user) DO NOTHING;
+
+-- name: GetVault :one
+SELECT * FROM vaults
+WHERE user = ?
+LIMIT 1;
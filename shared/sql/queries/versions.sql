@@ -0,0 +1,39 @@
+-- name: CreateVersion :exec
+INSERT INTO file_versions (path, hash, size, author, createdAt, mode, link, modTime)
+VALUES (
+    ?,
+    ?,
+    ?,
+    ?,
+    ?,
+    ?,
+    ?,
+    ?
+);
+
+-- name: GetVersion :one
+SELECT * FROM file_versions
+WHERE id = ?
+LIMIT 1;
+
+-- name: ListVersions :many
+SELECT * FROM file_versions
+WHERE path = ?
+ORDER BY id DESC;
+
+-- name: ListVersionPathsWithHash :many
+SELECT DISTINCT path FROM file_versions
+WHERE hash = ?;
+
+-- name: ListVersionedPaths :many
+SELECT DISTINCT path FROM file_versions
+ORDER BY path;
+
+-- name: RenameVersions :exec
+UPDATE file_versions
+SET path = ?
+WHERE path = ?;
+
+-- name: DeleteVersion :exec
+DELETE FROM file_versions
+WHERE id = ?;
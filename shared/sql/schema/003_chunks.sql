@@ -0,0 +1,15 @@
+-- +goose Up
+CREATE TABLE chunks(
+    path TEXT NOT NULL,
+    idx INTEGER NOT NULL,
+    hash TEXT NOT NULL,
+    start INTEGER NOT NULL,
+    size INTEGER NOT NULL,
+    PRIMARY KEY (path, idx)
+);
+
+CREATE INDEX chunks_hash ON chunks(hash);
+
+
+-- +goose Down
+DROP TABLE chunks;
@@ -0,0 +1,15 @@
+-- +goose Up
+CREATE TABLE file_versions(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    path TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    author TEXT NOT NULL,
+    createdAt TEXT NOT NULL
+);
+
+CREATE INDEX file_versions_path ON file_versions(path);
+
+
+-- +goose Down
+DROP TABLE file_versions;
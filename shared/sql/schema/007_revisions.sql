@@ -0,0 +1,8 @@
+-- +goose Up
+-- the revision of a file is bumped by every write,
+-- clients send the one their change is based on
+ALTER TABLE files ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;
+
+
+-- +goose Down
+ALTER TABLE files DROP COLUMN revision;
@@ -0,0 +1,8 @@
+-- +goose Up
+-- set by clients on the files whose content
+-- wasn't downloaded, their row is all they have
+ALTER TABLE files ADD COLUMN placeholder BOOLEAN NOT NULL DEFAULT FALSE;
+
+
+-- +goose Down
+ALTER TABLE files DROP COLUMN placeholder;
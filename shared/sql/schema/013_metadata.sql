@@ -0,0 +1,13 @@
+-- +goose Up
+-- the permission bits of the file, whether it
+-- is a symbolic link and the time it was last
+-- modified on the device that changed it
+ALTER TABLE files ADD COLUMN mode INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN link BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE files ADD COLUMN modTime TEXT NOT NULL DEFAULT '';
+
+
+-- +goose Down
+ALTER TABLE files DROP COLUMN modTime;
+ALTER TABLE files DROP COLUMN link;
+ALTER TABLE files DROP COLUMN mode;
@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+var ErrNoCertificate = errors.New("shared: no certificate found")
+
+// CertPool reads a bundle of PEM encoded certificates,
+// used to verify the other end of TLS connections.
+func CertPool(file string) (*x509.CertPool, error) {
+	return appendCerts(x509.NewCertPool(), file)
+}
+
+// SystemCertPool is CertPool on top of the
+// authorities trusted by the system.
+func SystemCertPool(file string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		// the system has none to offer
+		pool = x509.NewCertPool()
+	}
+	return appendCerts(pool, file)
+}
+
+func appendCerts(pool *x509.CertPool, file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, ErrNoCertificate
+	}
+	return pool, nil
+}
@@ -0,0 +1,479 @@
+package shared
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TmpDir holds partial transfers, it lives inside
+	// storage so that committing is an atomic rename.
+	TmpDir = ".harmony"
+	// ChunkSize is the size of a transfer chunk.
+	ChunkSize = 256 << 10
+	// ChunkThreshold is the size above which file
+	// contents are streamed instead of being
+	// embedded in the FileEvent.
+	ChunkThreshold = 4 << 20
+	// how long the sender of a delta transfer
+	// waits for the receiver to answer
+	wantTimeout = time.Minute
+)
+
+var (
+	ErrUnknownTransfer = errors.New("shared: unknown transfer")
+	ErrCorruptedChunk  = errors.New("shared: corrupted chunk")
+	ErrTransferTimeout = errors.New("shared: transfer timed out")
+	ErrTransferAborted = errors.New("shared: transfer aborted")
+)
+
+// TransferBegin opens a chunked transfer of the
+// content of Event, it is followed by the chunks
+// and a TransferCommit.
+type TransferBegin struct {
+	ID    string    `json:"id"`
+	Event FileEvent `json:"event"`
+	Size  int64     `json:"size"`
+	// Manifest lists the content defined chunks of
+	// a delta transfer, the receiver answers with the
+	// chunks it is missing and only those are sent.
+	Manifest []ChunkRef `json:"manifest,omitempty"`
+}
+
+// TransferWant lists the indices of the manifest
+// chunks the receiver of a delta transfer needs.
+type TransferWant struct {
+	ID      string  `json:"id"`
+	Indices []int64 `json:"indices"`
+}
+
+type TransferChunk struct {
+	ID    string `json:"id"`
+	Index int64  `json:"index"`
+	// SHA-256 of Data
+	Hash string `json:"hash"`
+	Data []byte `json:"data"`
+}
+
+type TransferCommit struct {
+	ID     string `json:"id"`
+	Chunks int64  `json:"chunks"`
+	// SHA-256 of the whole content
+	Hash string `json:"hash"`
+}
+
+// ChunkSource locates chunks already stored
+// on the receiving side of a delta transfer.
+type ChunkSource interface {
+	LocateChunk(ctx context.Context, hash string) (path string, offset, size int64, err error)
+}
+
+type chunkLocation struct {
+	path   string
+	offset int64
+	size   int64
+}
+
+type transfer struct {
+	event FileEvent
+	file  *os.File
+	hash  hash.Hash
+	next  int64
+
+	// delta transfers only
+	manifest []ChunkRef
+	known    map[int64]chunkLocation
+}
+
+// Transfers keeps track of the incoming
+// transfers of a single connection.
+type Transfers struct {
+	dir    string
+	source ChunkSource
+	active map[string]*transfer
+	sync.Mutex
+}
+
+// NewTransfers stores partial transfers in dir, source
+// may be nil in which case delta transfers need every chunk.
+func NewTransfers(dir string, source ChunkSource) *Transfers {
+	return &Transfers{
+		dir:    dir,
+		source: source,
+		active: make(map[string]*transfer),
+	}
+}
+
+func NewTransferID() string {
+	return rand.Text()
+}
+
+// IsInternal reports whether p is inside the
+// directory used for partial transfers.
+func IsInternal(p string) bool {
+	parts := strings.Split(path.Clean(p), sep)
+	return len(parts) > 1 && parts[1] == TmpDir
+}
+
+// Begin creates the temporary file receiving the transfer,
+// for delta transfers it returns the indices of the chunks
+// that have to be sent, nil otherwise.
+func (t *Transfers) Begin(ctx context.Context, b TransferBegin) ([]int64, error) {
+	if err := ValidPath(b.Event.Path); err != nil {
+		return nil, err
+	}
+	for _, ref := range b.Manifest {
+		// no chunk is cut past maxChunk
+		if ref.Size <= 0 || ref.Size > maxChunk || !isHash(ref.Hash) {
+			return nil, ErrMalformedEvent
+		}
+	}
+	if err := os.MkdirAll(t.dir, perm); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(t.dir, "*.part")
+	if err != nil {
+		return nil, err
+	}
+	tr := &transfer{
+		event: b.Event,
+		file:  file,
+		hash:  sha256.New(),
+	}
+	var wanted []int64
+	if len(b.Manifest) > 0 {
+		wanted = []int64{}
+		tr.manifest = b.Manifest
+		tr.known = make(map[int64]chunkLocation)
+		for i, ref := range b.Manifest {
+			if loc, ok := t.locate(ctx, ref); ok {
+				tr.known[int64(i)] = loc
+			} else {
+				wanted = append(wanted, int64(i))
+			}
+		}
+	}
+	t.Lock()
+	defer t.Unlock()
+	if old, exists := t.active[b.ID]; exists {
+		old.abort()
+	}
+	t.active[b.ID] = tr
+	return wanted, nil
+}
+
+// locate finds a stored copy of the chunk
+// and checks that it is still up to date.
+func (t *Transfers) locate(ctx context.Context, ref ChunkRef) (chunkLocation, bool) {
+	if t.source == nil {
+		return chunkLocation{}, false
+	}
+	p, offset, size, err := t.source.LocateChunk(ctx, ref.Hash)
+	if err != nil {
+		return chunkLocation{}, false
+	}
+	loc := chunkLocation{path: p, offset: offset, size: size}
+	if _, err := loc.read(ref); err != nil {
+		return chunkLocation{}, false
+	}
+	return loc, true
+}
+
+// read returns the content of the chunk
+// if it still matches its reference.
+func (loc chunkLocation) read(ref ChunkRef) ([]byte, error) {
+	file, err := os.Open(loc.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// the size on the wire is only checked
+	// along with the hash, never trusted
+	data := make([]byte, loc.size)
+	if _, err := file.ReadAt(data, loc.offset); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != ref.Hash {
+		return nil, ErrCorruptedChunk
+	}
+	return data, nil
+}
+
+// Write appends a chunk to its transfer, chunks
+// must arrive in order and match their hash.
+func (t *Transfers) Write(c TransferChunk) error {
+	t.Lock()
+	tr, exists := t.active[c.ID]
+	t.Unlock()
+	if !exists {
+		return ErrUnknownTransfer
+	}
+	sum := sha256.Sum256(c.Data)
+	hash := hex.EncodeToString(sum[:])
+	if err := tr.accept(c, hash); err != nil {
+		t.Abort(c.ID)
+		return err
+	}
+	if _, err := tr.file.Write(c.Data); err != nil {
+		t.Abort(c.ID)
+		return err
+	}
+	tr.hash.Write(c.Data)
+	tr.next++
+	return nil
+}
+
+// accept checks that the chunk is the next one
+// expected, delta transfers copy the known chunks
+// preceding it first.
+func (tr *transfer) accept(c TransferChunk, hash string) error {
+	if hash != c.Hash {
+		return ErrCorruptedChunk
+	}
+	if tr.manifest == nil {
+		if c.Index != tr.next {
+			return ErrCorruptedChunk
+		}
+		return nil
+	}
+	if c.Index < tr.next || c.Index >= int64(len(tr.manifest)) {
+		return ErrCorruptedChunk
+	}
+	if _, known := tr.known[c.Index]; known || tr.manifest[c.Index].Hash != hash {
+		return ErrCorruptedChunk
+	}
+	return tr.fill(c.Index)
+}
+
+// fill copies the known chunks up to
+// (excluding) the chunk at index end.
+func (tr *transfer) fill(end int64) error {
+	for ; tr.next < end; tr.next++ {
+		loc, known := tr.known[tr.next]
+		if !known {
+			// a wanted chunk was skipped
+			return ErrCorruptedChunk
+		}
+		data, err := loc.read(tr.manifest[tr.next])
+		if err != nil {
+			return ErrCorruptedChunk
+		}
+		if _, err := tr.file.Write(data); err != nil {
+			return err
+		}
+		tr.hash.Write(data)
+	}
+	return nil
+}
+
+// Commit checks the transfer and returns its event,
+// Source points to the temporary file holding the
+// content. The caller is responsible for removing it.
+func (t *Transfers) Commit(c TransferCommit) (*FileEvent, error) {
+	t.Lock()
+	tr, exists := t.active[c.ID]
+	delete(t.active, c.ID)
+	t.Unlock()
+	if !exists {
+		return nil, ErrUnknownTransfer
+	}
+	if tr.manifest != nil {
+		if err := tr.fill(int64(len(tr.manifest))); err != nil {
+			tr.abort()
+			return nil, err
+		}
+	}
+	if err := tr.file.Close(); err != nil {
+		os.Remove(tr.file.Name())
+		return nil, err
+	}
+	if c.Chunks != tr.next || hex.EncodeToString(tr.hash.Sum(nil)) != c.Hash {
+		os.Remove(tr.file.Name())
+		return nil, ErrCorruptedChunk
+	}
+	event := tr.event
+	event.Data = nil
+	event.Chunked = false
+	event.Hash = c.Hash
+	event.Source = tr.file.Name()
+	return &event, nil
+}
+
+// Pending returns the event of an active transfer.
+func (t *Transfers) Pending(id string) (FileEvent, bool) {
+	t.Lock()
+	defer t.Unlock()
+	tr, exists := t.active[id]
+	if !exists {
+		return FileEvent{}, false
+	}
+	return tr.event, true
+}
+
+func (t *Transfers) Abort(id string) {
+	t.Lock()
+	defer t.Unlock()
+	if tr, exists := t.active[id]; exists {
+		tr.abort()
+		delete(t.active, id)
+	}
+}
+
+// Close aborts every active transfer,
+// called when the connection is lost.
+func (t *Transfers) Close() {
+	t.Lock()
+	defer t.Unlock()
+	for id, tr := range t.active {
+		tr.abort()
+		delete(t.active, id)
+	}
+}
+
+func (tr *transfer) abort() {
+	tr.file.Close()
+	os.Remove(tr.file.Name())
+}
+
+// Stream sends the content of the file at src as a
+// chunked transfer of event, send is called with
+// every envelope of the transfer in order.
+func Stream(ctx context.Context, src string, event FileEvent, send func([]byte) error) error {
+	return stream(ctx, NewTransferID(), src, event, nil, send, nil)
+}
+
+// StreamDelta sends the content of the file at src as a delta
+// transfer of event, once the manifest is sent it waits for the
+// indices of the chunks the receiver is missing on wanted.
+// Closing wanted aborts the transfer.
+func StreamDelta(ctx context.Context, id, src string, event FileEvent, send func([]byte) error, wanted <-chan []int64) error {
+	manifest, _, err := NewManifest(src)
+	if err != nil {
+		return err
+	}
+	if len(manifest) == 0 {
+		return stream(ctx, id, src, event, nil, send, nil)
+	}
+	return stream(ctx, id, src, event, manifest, send, wanted)
+}
+
+func stream(ctx context.Context, id, src string, event FileEvent, manifest []ChunkRef, send func([]byte) error, wanted <-chan []int64) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return ErrMalformedEvent
+	}
+	event.Data = nil
+	event.Chunked = false
+	payload, err := MarshalEnvl(TransferBegin{
+		ID:       id,
+		Event:    event,
+		Size:     stat.Size(),
+		Manifest: manifest,
+	}, Begin)
+	if err != nil {
+		return err
+	}
+	if err := send(payload); err != nil {
+		return err
+	}
+	var want map[int64]struct{}
+	if manifest != nil {
+		select {
+		case indices, ok := <-wanted:
+			if !ok {
+				return ErrTransferAborted
+			}
+			want = make(map[int64]struct{}, len(indices))
+			for _, i := range indices {
+				want[i] = struct{}{}
+			}
+		case <-time.After(wantTimeout):
+			return ErrTransferTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var (
+		hasher = sha256.New()
+		index  int64
+	)
+	sendChunk := func(data []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hasher.Write(data)
+		defer func() { index++ }()
+		if want != nil {
+			if _, ok := want[index]; !ok {
+				return nil
+			}
+		}
+		sum := sha256.Sum256(data)
+		payload, err := MarshalEnvl(TransferChunk{
+			ID:    id,
+			Index: index,
+			Hash:  hex.EncodeToString(sum[:]),
+			Data:  data,
+		}, Chunk)
+		if err != nil {
+			return err
+		}
+		return send(payload)
+	}
+	if manifest != nil {
+		// chunks are cut the same way as the manifest
+		err = SplitChunks(file, sendChunk)
+	} else {
+		err = splitFixed(file, sendChunk)
+	}
+	if err != nil {
+		return err
+	}
+	payload, err = MarshalEnvl(TransferCommit{
+		ID:     id,
+		Chunks: index,
+		Hash:   hex.EncodeToString(hasher.Sum(nil)),
+	}, Commit)
+	if err != nil {
+		return err
+	}
+	return send(payload)
+}
+
+// splitFixed calls fn with every ChunkSize bytes of r.
+func splitFixed(r io.Reader, fn func(data []byte) error) error {
+	buf := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := fn(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+)
+
+// receiver applies the envelopes produced by Stream to t.
+func receiver(t *testing.T, transfers *Transfers, committed **FileEvent) func([]byte) error {
+	return func(payload []byte) error {
+		var env Envelope
+		require.NoError(t, json.Unmarshal(payload, &env))
+		switch env.Type {
+		case Begin:
+			var begin TransferBegin
+			require.NoError(t, json.Unmarshal(env.Message, &begin))
+			_, err := transfers.Begin(context.Background(), begin)
+			return err
+		case Chunk:
+			var chunk TransferChunk
+			require.NoError(t, json.Unmarshal(env.Message, &chunk))
+			return transfers.Write(chunk)
+		case Commit:
+			var commit TransferCommit
+			require.NoError(t, json.Unmarshal(env.Message, &commit))
+			event, err := transfers.Commit(commit)
+			*committed = event
+			return err
+		}
+		t.Fatalf("unexpected envelope %v", env.Type)
+		return nil
+	}
+}
+
+func TestStreamTransfer(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	tmp := t.TempDir()
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(nil))
+
+	var (
+		ctx       = context.Background()
+		src       = path.Join(tmp, "big.bin")
+		dest      = path.Join(storage, "dir-1", "big.bin")
+		data      = make([]byte, 3*ChunkSize+123)
+		transfers = NewTransfers(path.Join(storage, TmpDir), nil)
+		committed *FileEvent
+	)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(src, data, 0777))
+
+	event := FileEvent{
+		ID:   7,
+		Path: dest,
+		Op:   fsnotify.Create.String(),
+	}
+	err = Stream(ctx, src, event, receiver(t, transfers, &committed))
+	require.NoError(t, err)
+	require.NotNil(t, committed)
+
+	sum := sha256.Sum256(data)
+	require.Equal(t, hex.EncodeToString(sum[:]), committed.Hash)
+	require.Equal(t, int64(7), committed.ID)
+
+	// the committed content is applied by the hub
+	require.NoError(t, NewClientHub().Process(ctx, committed))
+	got, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, got))
+
+	entries, err := os.ReadDir(path.Join(storage, TmpDir))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestTransferCorruption(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	require.NoError(t, os.Chdir(t.TempDir()))
+	require.NoError(t, initTMP(nil))
+
+	var (
+		ctx       = context.Background()
+		transfers = NewTransfers(path.Join(storage, TmpDir), nil)
+		event     = FileEvent{Path: path.Join(storage, "file.bin")}
+		chunk     = []byte("chunk")
+		sum       = sha256.Sum256(chunk)
+		hash      = hex.EncodeToString(sum[:])
+	)
+
+	// paths are checked before anything is written
+	_, err = transfers.Begin(ctx, TransferBegin{ID: "1", Event: FileEvent{Path: path.Join(storage, TmpDir, "x")}})
+	require.ErrorIs(t, err, ErrInvalidPath)
+
+	// so are the sizes of the manifest, no chunk is
+	// empty or longer than the chunker cuts them
+	for _, size := range []int64{-1, 0, maxChunk + 1, math.MaxInt64} {
+		_, err = transfers.Begin(ctx, TransferBegin{ID: "1", Event: event, Manifest: []ChunkRef{{Hash: hash, Size: size}}})
+		require.ErrorIs(t, err, ErrMalformedEvent)
+	}
+
+	// chunk not matching its hash
+	_, err = transfers.Begin(ctx, TransferBegin{ID: "2", Event: event})
+	require.NoError(t, err)
+	err = transfers.Write(TransferChunk{ID: "2", Data: chunk, Hash: "bad"})
+	require.ErrorIs(t, err, ErrCorruptedChunk)
+	_, exists := transfers.Pending("2")
+	require.False(t, exists)
+
+	// chunk out of order
+	_, err = transfers.Begin(ctx, TransferBegin{ID: "3", Event: event})
+	require.NoError(t, err)
+	err = transfers.Write(TransferChunk{ID: "3", Index: 1, Data: chunk, Hash: hash})
+	require.ErrorIs(t, err, ErrCorruptedChunk)
+
+	// missing chunk at commit
+	_, err = transfers.Begin(ctx, TransferBegin{ID: "4", Event: event})
+	require.NoError(t, err)
+	require.NoError(t, transfers.Write(TransferChunk{ID: "4", Data: chunk, Hash: hash}))
+	_, err = transfers.Commit(TransferCommit{ID: "4", Chunks: 2, Hash: hash})
+	require.ErrorIs(t, err, ErrCorruptedChunk)
+
+	_, err = transfers.Commit(TransferCommit{ID: "5"})
+	require.ErrorIs(t, err, ErrUnknownTransfer)
+
+	// aborted transfers leave nothing behind
+	_, err = transfers.Begin(ctx, TransferBegin{ID: "6", Event: event})
+	require.NoError(t, err)
+	transfers.Close()
+	entries, err := os.ReadDir(path.Join(storage, TmpDir))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
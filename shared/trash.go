@@ -0,0 +1,242 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+// DefaultTrashExpiry is how long removed files
+// stay in the trash before being purged.
+const DefaultTrashExpiry = 30 * 24 * time.Hour
+
+// TrashEntry is a removed file or directory,
+// along with everything that was under it.
+type TrashEntry struct {
+	ID        int64  `json:"id"`
+	Path      string `json:"path"`
+	IsDir     bool   `json:"isDir"`
+	DeletedBy string `json:"deletedBy"`
+	DeletedAt string `json:"deletedAt"`
+}
+
+// trash moves the rows of the subtree to a new trash entry,
+// the entry keeps the references to the blobs of the files.
+func (s serverHub) trash(ctx context.Context, file database.File, files []database.File) error {
+	id, err := s.DB.CreateTrash(ctx, database.CreateTrashParams{
+		Path:      file.Path,
+		Isdir:     file.Isdir,
+		Deletedby: authorOf(ctx),
+		Deletedat: time.Now().Format(TimeLayout),
+	})
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := s.DB.CreateTrashFile(ctx, database.CreateTrashFileParams{
+			Trashid:   id,
+			Path:      f.Path,
+			Hash:      f.Hash,
+			Isdir:     f.Isdir,
+			Createdat: f.Createdat,
+			Mode:      f.Mode,
+			Link:      f.Link,
+			Modtime:   f.Modtime,
+		}); err != nil {
+			return err
+		}
+		if err := s.DB.DeleteFile(ctx, f.Path); err != nil {
+			return err
+		}
+		// removing a conflict copy resolves the conflict
+		if err := s.DB.DeleteConflictsForPath(ctx, f.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s serverHub) Trash(ctx context.Context) ([]TrashEntry, error) {
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.ListTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]TrashEntry, 0, len(rows))
+	for _, row := range rows {
+		p, _, visible := ns.unscope(row.Path)
+		if !visible {
+			continue
+		}
+		entries = append(entries, TrashEntry{
+			ID:        row.ID,
+			Path:      p,
+			IsDir:     row.Isdir,
+			DeletedBy: row.Deletedby,
+			DeletedAt: row.Deletedat,
+		})
+	}
+	return entries, nil
+}
+
+// getTrash returns the entry if the user of ctx can change it.
+func (s serverHub) getTrash(ctx context.Context, id int64) (database.Trash, namespace, error) {
+	entry, err := s.DB.GetTrash(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return entry, namespace{}, os.ErrNotExist
+		}
+		return entry, namespace{}, err
+	}
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return entry, ns, err
+	}
+	_, share, visible := ns.unscope(entry.Path)
+	if !visible {
+		return entry, ns, os.ErrNotExist
+	}
+	if !writable(share) {
+		return entry, ns, ErrReadOnly
+	}
+	return entry, ns, nil
+}
+
+// RestoreTrash puts a trash entry back where it was removed from,
+// the returned events recreate it on the clients, parents first.
+func (s serverHub) RestoreTrash(ctx context.Context, id int64) ([]*FileEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ns, err := s.getTrash(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkParent(ctx, entry.Path); err != nil {
+		return nil, err
+	}
+	if _, err := s.DB.GetFile(ctx, entry.Path); err == nil {
+		return nil, os.ErrExist
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	files, err := s.DB.ListTrashFiles(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*FileEvent, 0, len(files))
+	for _, f := range files {
+		if err := s.DB.CreateFile(ctx, database.CreateFileParams{
+			Path:      f.Path,
+			Hash:      f.Hash,
+			Updatedat: time.Now().Format(TimeLayout),
+			Createdat: f.Createdat,
+			Isdir:     f.Isdir,
+			Revision:  1,
+		}); err != nil {
+			return nil, err
+		}
+		if err := s.DB.SetMetadata(ctx, database.SetMetadataParams{
+			Mode:    f.Mode,
+			Link:    f.Link,
+			Modtime: f.Modtime,
+			Path:    f.Path,
+		}); err != nil {
+			return nil, err
+		}
+		p, _, _ := ns.unscope(f.Path)
+		event := &FileEvent{
+			Path:     p,
+			Op:       fsnotify.Create.String(),
+			IsDir:    f.Isdir,
+			Revision: 1,
+		}
+		if !f.Isdir {
+			event.Hash = f.Hash
+			event.Dedup = true
+			event.Mode = uint32(f.Mode)
+			event.Link = f.Link
+			event.ModTime = f.Modtime
+		}
+		events = append(events, event)
+	}
+	// the hashes of the restored directories
+	// are computed again, then the ones above
+	restored, err := s.subtree(ctx, entry.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rehashFiles(ctx, restored); err != nil {
+		return nil, err
+	}
+	if err := s.rehash(ctx, entry.Path); err != nil {
+		return nil, err
+	}
+	if err := s.DB.DeleteTrashFiles(ctx, id); err != nil {
+		return nil, err
+	}
+	return events, s.DB.DeleteTrash(ctx, id)
+}
+
+// PurgeTrash removes a trash entry for good.
+func (s serverHub) PurgeTrash(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, err := s.getTrash(ctx, id); err != nil {
+		return err
+	}
+	return s.purge(ctx, id)
+}
+
+// ExpireTrash purges the entries removed more than maxAge ago.
+func (s serverHub) ExpireTrash(ctx context.Context, maxAge time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.DB.ListTrash(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		deletedAt, err := time.Parse(TimeLayout, entry.Deletedat)
+		if err != nil || time.Since(deletedAt) < maxAge {
+			continue
+		}
+		if err := s.purge(ctx, entry.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purge drops the blob references of the entry,
+// the blobs are then garbage collected.
+func (s serverHub) purge(ctx context.Context, id int64) error {
+	files, err := s.DB.ListTrashFiles(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Isdir {
+			// shares outlive the trash
+			// but not the purge
+			if err := s.DB.DeleteSharesForPath(ctx, f.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.DB.UnrefBlob(ctx, f.Hash); err != nil {
+			return err
+		}
+	}
+	if err := s.DB.DeleteTrashFiles(ctx, id); err != nil {
+		return err
+	}
+	return s.DB.DeleteTrash(ctx, id)
+}
@@ -0,0 +1,129 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+func TestTrash(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		tmp    = t.TempDir()
+		dbPath = path.Join(tmp, "test.db")
+		ctx    = WithAuthor(context.Background(), "laptop")
+		dir    = path.Join(storage, "dir-1")
+		file   = path.Join(storage, "dir-1", "subdir-1", "file-4.txt")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	hub := NewServerHub(db)
+
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(db))
+
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: dir, Op: fsnotify.Remove.String(), IsDir: true}))
+	_, err = db.GetFile(ctx, file)
+	require.Error(t, err)
+
+	entries, err := hub.Trash(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, dir, entries[0].Path)
+	require.Equal(t, "laptop", entries[0].DeletedBy)
+	require.True(t, entries[0].IsDir)
+
+	// trashed content survives garbage collection
+	require.NoError(t, hub.ExpireTrash(ctx, time.Hour))
+	require.NoError(t, hub.CollectGarbage(ctx))
+
+	events, err := hub.RestoreTrash(ctx, entries[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, dir, events[0].Path)
+	require.True(t, events[0].IsDir)
+	for _, event := range events {
+		_, known := paths[event.Path]
+		require.True(t, known)
+		require.Equal(t, paths[event.Path], event.IsDir)
+	}
+	require.Equal(t, []byte(file), content(t, hub, file))
+
+	entries, err = hub.Trash(ctx)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// restoring over an existing file
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: file, Op: fsnotify.Remove.String()}))
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: file, Op: fsnotify.Create.String(), Data: []byte("new")}))
+	entries, err = hub.Trash(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	_, err = hub.RestoreTrash(ctx, entries[0].ID)
+	require.ErrorIs(t, err, os.ErrExist)
+
+	require.NoError(t, hub.PurgeTrash(ctx, entries[0].ID))
+	_, err = hub.RestoreTrash(ctx, entries[0].ID)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.ErrorIs(t, hub.PurgeTrash(ctx, entries[0].ID), os.ErrNotExist)
+}
+
+func TestTrashMetadata(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		tmp     = t.TempDir()
+		ctx     = context.Background()
+		dir     = path.Join(storage, "dir-1")
+		script  = path.Join(dir, "run.sh")
+		link    = path.Join(dir, "link")
+		modTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC).Format(TimeLayout)
+	)
+	db, err := makeDB(path.Join(tmp, "test.db"), "sqlite")
+	require.NoError(t, err)
+
+	hub := NewServerHub(db)
+
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(db))
+
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: script, Op: fsnotify.Create.String(), Data: []byte("#!/bin/sh"), Mode: 0755, ModTime: modTime}))
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: link, Op: fsnotify.Create.String(), Data: []byte("run.sh"), Link: true, Mode: 0777}))
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: dir, Op: fsnotify.Remove.String(), IsDir: true}))
+
+	entries, err := hub.Trash(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	events, err := hub.RestoreTrash(ctx, entries[0].ID)
+	require.NoError(t, err)
+	restored := make(map[string]*FileEvent)
+	for _, event := range events {
+		restored[event.Path] = event
+	}
+	for p, want := range map[string]database.File{
+		script: {Mode: 0755, Modtime: modTime},
+		link:   {Mode: 0777, Link: true},
+	} {
+		event := restored[p]
+		require.NotNil(t, event, p)
+		require.Equal(t, uint32(want.Mode), event.Mode, p)
+		require.Equal(t, want.Link, event.Link, p)
+		require.Equal(t, want.Modtime, event.ModTime, p)
+		file, err := db.GetFile(ctx, p)
+		require.NoError(t, err)
+		require.Equal(t, want.Mode, file.Mode, p)
+		require.Equal(t, want.Link, file.Link, p)
+		require.Equal(t, want.Modtime, file.Modtime, p)
+	}
+}
@@ -3,6 +3,7 @@ package shared
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path"
@@ -12,11 +13,23 @@ type FSNode struct {
 	Path    string
 	ModTime string
 	Hash    string
-	IsDir   bool
-	Childs  map[string]*FSNode
+	// Revision is only set in the trees built by the server
+	Revision int64
+	IsDir    bool
+	// Mode and Link are the metadata of the
+	// file, as carried by the FileEvent
+	Mode   uint32
+	Link   bool
+	Childs map[string]*FSNode
 }
 
+// BuildTree walks the directory at p, the
+// ignored paths are left out of the tree.
 func BuildTree(p string) *FSNode {
+	return buildTree(p, NewIgnore(DefaultIgnores))
+}
+
+func buildTree(p string, ignore *Ignore) *FSNode {
 	info, err := os.Stat(p)
 	if err != nil || !info.IsDir() {
 		slog.Error("error fetching  directory : %v", "err", err)
@@ -35,27 +48,44 @@ func BuildTree(p string) *FSNode {
 	}
 	for _, child := range childs {
 		childPath := path.Join(p, child.Name())
+		if IsInternal(childPath) || ignore.Ignored(childPath, child.IsDir()) {
+			continue
+		}
 		if child.IsDir() {
-			currNode.Childs[child.Name()] = BuildTree(childPath)
+			currNode.Childs[child.Name()] = buildTree(childPath, ignore)
 		} else {
 			info, err := child.Info()
 			if err != nil {
 				slog.Error("error fetching file info : %v", "err", err)
-			} else {
-				data, err := os.ReadFile(childPath)
-				if err != nil {
-					slog.Error("error reading file : %v", "err", err)
-				} else {
-					hash := sha256.Sum256(data)
-					currNode.Childs[child.Name()] = &FSNode{
-						Path:    childPath,
-						Hash:    hex.EncodeToString(hash[:]),
-						ModTime: info.ModTime().Format(TimeLayout),
-						IsDir:   false,
-					}
-				}
+				continue
+			}
+			data, err := ReadContent(childPath, info)
+			if err != nil {
+				slog.Error("error reading file : %v", "err", err)
+				continue
+			}
+			hash := sha256.Sum256(data)
+			event := FileEvent{}
+			event.SetMetadata(info)
+			currNode.Childs[child.Name()] = &FSNode{
+				Path:    childPath,
+				Hash:    hex.EncodeToString(hash[:]),
+				ModTime: event.ModTime,
+				Mode:    event.Mode,
+				Link:    event.Link,
+				IsDir:   false,
 			}
 		}
 	}
 	return currNode
 }
+
+// ReadContent returns the content of the file at p, info
+// being its Lstat: the one of a link is its target.
+func ReadContent(p string, info fs.FileInfo) ([]byte, error) {
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return os.ReadFile(p)
+	}
+	target, err := os.Readlink(p)
+	return []byte(target), err
+}
@@ -0,0 +1,220 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+// Retention decides which past versions of a file are kept,
+// the blobs of the dropped ones are then garbage collected.
+type Retention struct {
+	// the Last versions are always kept
+	Last int
+	// the last version of each of the
+	// past Daily days is kept as well
+	Daily int
+}
+
+var DefaultRetention = Retention{Last: 10, Daily: 30}
+
+// Version is a content a file had at some point.
+type Version struct {
+	ID        int64  `json:"id"`
+	Path      string `json:"path"`
+	Hash      string `json:"hash"`
+	Size      int64  `json:"size"`
+	Author    string `json:"author"`
+	CreatedAt string `json:"createdAt"`
+}
+
+type authorKey struct{}
+
+// WithAuthor records who the events
+// processed with ctx come from.
+func WithAuthor(ctx context.Context, author string) context.Context {
+	return context.WithValue(ctx, authorKey{}, author)
+}
+
+func authorOf(ctx context.Context) string {
+	author, _ := ctx.Value(authorKey{}).(string)
+	return author
+}
+
+// keep reports which of the versions,
+// sorted newest first, are retained.
+func (r Retention) keep(versions []database.FileVersion, now time.Time) []bool {
+	var (
+		kept = make([]bool, len(versions))
+		days = make(map[string]struct{})
+	)
+	for i, v := range versions {
+		created, err := time.Parse(TimeLayout, v.Createdat)
+		if err != nil {
+			kept[i] = i < r.Last
+			continue
+		}
+		day := created.Format(time.DateOnly)
+		_, seen := days[day]
+		days[day] = struct{}{}
+		switch {
+		case i < r.Last:
+			kept[i] = true
+		case !seen && now.Sub(created) < time.Duration(r.Daily)*24*time.Hour:
+			kept[i] = true
+		}
+	}
+	return kept
+}
+
+// addVersion records the new content of the file at p along with
+// its metadata, the version holds a reference to the blob of its own.
+func (s serverHub) addVersion(ctx context.Context, p string) error {
+	file, err := s.DB.GetFile(ctx, p)
+	if err != nil {
+		return err
+	}
+	blob, err := s.DB.GetBlob(ctx, file.Hash)
+	if err != nil {
+		return err
+	}
+	if err := s.DB.CreateVersion(ctx, database.CreateVersionParams{
+		Path:      p,
+		Hash:      file.Hash,
+		Size:      blob.Size,
+		Author:    authorOf(ctx),
+		Createdat: time.Now().Format(TimeLayout),
+		Mode:      file.Mode,
+		Link:      file.Link,
+		Modtime:   file.Modtime,
+	}); err != nil {
+		return err
+	}
+	if err := s.DB.RefBlob(ctx, file.Hash); err != nil {
+		return err
+	}
+	return s.pruneVersions(ctx, p, time.Now())
+}
+
+func (s serverHub) pruneVersions(ctx context.Context, p string, now time.Time) error {
+	versions, err := s.DB.ListVersions(ctx, p)
+	if err != nil {
+		return err
+	}
+	retention := s.Retention
+	if _, err := s.DB.GetFile(ctx, p); err == nil {
+		// the current version of a file is always kept,
+		// the history of removed ones only until it expires
+		retention.Last = max(retention.Last, 1)
+	} else if errors.Is(err, sql.ErrNoRows) {
+		retention.Last = 0
+	} else {
+		return err
+	}
+	for i, kept := range retention.keep(versions, now) {
+		if kept {
+			continue
+		}
+		if err := s.DB.DeleteVersion(ctx, versions[i].ID); err != nil {
+			return err
+		}
+		if err := s.DB.UnrefBlob(ctx, versions[i].Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneVersions applies the retention policy to every file,
+// daily versions expire even when the file is left untouched.
+func (s serverHub) PruneVersions(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths, err := s.DB.ListVersionedPaths(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, p := range paths {
+		if err := s.pruneVersions(ctx, p, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Versions lists the versions of the file at p, newest first.
+// Versions of removed files are kept until they expire.
+func (s serverHub) Versions(ctx context.Context, p string) ([]Version, error) {
+	if err := ValidPath(p); err != nil {
+		return nil, err
+	}
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	row, _ := ns.scope(p)
+	rows, err := s.DB.ListVersions(ctx, row)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, 0, len(rows))
+	for _, row := range rows {
+		versions = append(versions, Version{
+			ID:        row.ID,
+			Path:      p,
+			Hash:      row.Hash,
+			Size:      row.Size,
+			Author:    row.Author,
+			CreatedAt: row.Createdat,
+		})
+	}
+	return versions, nil
+}
+
+// Restore makes the version the current content of its file,
+// the returned event has to be sent to the clients.
+func (s serverHub) Restore(ctx context.Context, id int64) (*FileEvent, error) {
+	version, err := s.DB.GetVersion(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	ns, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p, _, visible := ns.unscope(version.Path)
+	if !visible {
+		return nil, os.ErrNotExist
+	}
+	event := &FileEvent{
+		Path:    p,
+		Op:      fsnotify.Write.String(),
+		Hash:    version.Hash,
+		Dedup:   true,
+		Mode:    uint32(version.Mode),
+		Link:    version.Link,
+		ModTime: version.Modtime,
+	}
+	if file, err := s.DB.GetFile(ctx, version.Path); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		// the file was removed since
+		event.Op = fsnotify.Create.String()
+	} else {
+		event.Revision = file.Revision
+	}
+	if err := s.Process(ctx, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
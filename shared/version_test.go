@@ -0,0 +1,178 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+	"github.com/thesicktwist1/harmony/shared/database"
+)
+
+func TestRetention(t *testing.T) {
+	var (
+		now = time.Date(2025, 6, 30, 12, 0, 0, 0, time.UTC)
+		day = 24 * time.Hour
+	)
+	// newest first
+	ages := []time.Duration{
+		0,
+		time.Hour,
+		2 * time.Hour,
+		day,
+		day + time.Hour,
+		10 * day,
+		40 * day,
+	}
+	var versions []database.FileVersion
+	for i, age := range ages {
+		versions = append(versions, database.FileVersion{
+			ID:        int64(len(ages) - i),
+			Createdat: now.Add(-age).Format(TimeLayout),
+		})
+	}
+
+	tests := []struct {
+		name      string
+		retention Retention
+		want      []bool
+	}{
+		{
+			name:      "last versions",
+			retention: Retention{Last: 2},
+			want:      []bool{true, true, false, false, false, false, false},
+		},
+		{
+			name:      "one version per day",
+			retention: Retention{Daily: 30},
+			want:      []bool{true, false, false, true, false, true, false},
+		},
+		{
+			name:      "both",
+			retention: DefaultRetention,
+			want:      []bool{true, true, true, true, true, true, true},
+		},
+		{
+			name:      "daily versions already kept as last ones",
+			retention: Retention{Last: 4, Daily: 30},
+			want:      []bool{true, true, true, true, false, true, false},
+		},
+	}
+	for _, tc := range tests {
+		require.Equalf(t, tc.want, tc.retention.keep(versions, now), "%s", tc.name)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		tmp    = t.TempDir()
+		dbPath = path.Join(tmp, "test.db")
+		ctx    = WithAuthor(context.Background(), "laptop")
+		file   = path.Join(storage, "dir-1", "doc.txt")
+	)
+	db, err := makeDB(dbPath, "sqlite")
+	require.NoError(t, err)
+
+	hub := NewServerHub(db)
+
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(db))
+
+	for i, data := range []string{"draft", "final", "clobbered"} {
+		op := fsnotify.Write.String()
+		if i == 0 {
+			op = fsnotify.Create.String()
+		}
+		require.NoError(t, hub.Process(ctx, &FileEvent{Path: file, Op: op, Data: []byte(data), Revision: int64(i)}))
+	}
+	// writing the same content is not a new version
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: file, Op: fsnotify.Write.String(), Data: []byte("clobbered"), Revision: 3}))
+
+	versions, err := hub.Versions(ctx, file)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	require.Equal(t, "laptop", versions[0].Author)
+	require.Equal(t, int64(len("clobbered")), versions[0].Size)
+
+	// older contents survive garbage collection
+	require.NoError(t, hub.CollectGarbage(ctx))
+
+	event, err := hub.Restore(ctx, versions[1].ID)
+	require.NoError(t, err)
+	require.Equal(t, fsnotify.Write.String(), event.Op)
+	require.Equal(t, int64(4), event.Revision)
+	require.Equal(t, []byte("final"), content(t, hub, file))
+
+	versions, err = hub.Versions(ctx, file)
+	require.NoError(t, err)
+	require.Len(t, versions, 4)
+
+	// the history follows renames and outlives the file
+	renamed := path.Join(storage, "dir-2", "doc.txt")
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: file, NewPath: renamed, Op: fsnotify.Rename.String()}))
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: renamed, Op: fsnotify.Remove.String()}))
+	versions, err = hub.Versions(ctx, renamed)
+	require.NoError(t, err)
+	require.Len(t, versions, 4)
+
+	event, err = hub.Restore(ctx, versions[3].ID)
+	require.NoError(t, err)
+	require.Equal(t, fsnotify.Create.String(), event.Op)
+	require.Equal(t, []byte("draft"), content(t, hub, renamed))
+
+	_, err = hub.Restore(ctx, 1000)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestVersionsMetadata(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+
+	var (
+		tmp     = t.TempDir()
+		ctx     = context.Background()
+		script  = path.Join(storage, "dir-1", "run.sh")
+		link    = path.Join(storage, "dir-1", "link")
+		modTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC).Format(TimeLayout)
+	)
+	db, err := makeDB(path.Join(tmp, "test.db"), "sqlite")
+	require.NoError(t, err)
+
+	hub := NewServerHub(db)
+
+	require.NoError(t, os.Chdir(tmp))
+	require.NoError(t, initTMP(db))
+
+	// an executable that lost its bit, a link made a plain file
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: script, Op: fsnotify.Create.String(), Data: []byte("#!/bin/sh"), Mode: 0755, ModTime: modTime}))
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: script, Op: fsnotify.Write.String(), Data: []byte("#!/bin/bash"), Mode: 0644, Revision: 1}))
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: link, Op: fsnotify.Create.String(), Data: []byte("run.sh"), Link: true, Mode: 0777}))
+	require.NoError(t, hub.Process(ctx, &FileEvent{Path: link, Op: fsnotify.Write.String(), Data: []byte("plain"), Mode: 0644, Revision: 1}))
+
+	for p, want := range map[string]database.File{
+		script: {Mode: 0755, Modtime: modTime},
+		link:   {Mode: 0777, Link: true},
+	} {
+		versions, err := hub.Versions(ctx, p)
+		require.NoError(t, err)
+		require.Len(t, versions, 2)
+		event, err := hub.Restore(ctx, versions[1].ID)
+		require.NoError(t, err)
+		require.Equal(t, uint32(want.Mode), event.Mode, p)
+		require.Equal(t, want.Link, event.Link, p)
+		require.Equal(t, want.Modtime, event.ModTime, p)
+		file, err := db.GetFile(ctx, p)
+		require.NoError(t, err)
+		require.Equal(t, want.Mode, file.Mode, p)
+		require.Equal(t, want.Link, file.Link, p)
+	}
+	require.Equal(t, []byte("run.sh"), content(t, hub, link))
+}